@@ -0,0 +1,467 @@
+// Chaos connects to a running pg_logplexcollector and misbehaves, as
+// a broken or malicious client might: sending truncated frames, wrong
+// message types, oversized messages and impossible lengths, and
+// disconnecting mid-stream.  Between its attacks it probes that the
+// socket is still served, and afterwards that every connection it made
+// has been cleaned up, exiting with status 1 should either not be so.
+//
+// For example, with the collector serving "test identity" on
+// log.sock and its admin interface on admin.sock:
+//
+//	$ chaos -socket log.sock -identity 'test identity' \
+//	    -admin unix:admin.sock -duration 10m
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const version = "PG-9.4.0/logfebe-1"
+
+// The size of log record beyond which the collector disconnects.
+const maxRecord = 1 << 20
+
+// A way of misbehaving, given a connection to the collector.
+type fault struct {
+	name string
+	run  func(c net.Conn, rng *rand.Rand, ident string) error
+}
+
+var faults = []fault{
+	{"valid", valid},
+	{"truncated_frame", truncatedFrame},
+	{"wrong_type", wrongType},
+	{"oversized", oversized},
+	{"bad_length", badLength},
+	{"mid_stream_disconnect", midStreamDisconnect},
+	{"stall", stall},
+	{"garbage", garbage},
+}
+
+// Frame payload as a message of type typ.
+func frame(typ byte, payload []byte) []byte {
+	b := make([]byte, 5, 5+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], uint32(len(payload)+4))
+	return append(b, payload...)
+}
+
+func handshake(ident string) []byte {
+	b := frame('V', []byte(version+"\x00"))
+	return append(b, frame('I', []byte(ident+"\x00"))...)
+}
+
+// Encode a well-formed log record of message text.
+func record(text string, seq uint64) []byte {
+	var b bytes.Buffer
+	cs := func(s string) {
+		b.WriteString(s)
+		b.WriteByte(0)
+	}
+	null := func() { b.WriteString("N\x00") }
+	ns := func(s string) {
+		b.WriteByte('P')
+		cs(s)
+	}
+	i32 := func(n int32) { binary.Write(&b, binary.BigEndian, n) }
+	u64 := func(n uint64) { binary.Write(&b, binary.BigEndian, n) }
+
+	now := time.Now().UTC().Format("2006-01-02 15:04:05.000 MST")
+	cs(now)                 // LogTime
+	ns("chaos")             // UserName
+	ns("chaos")             // DatabaseName
+	i32(int32(os.Getpid())) // Pid
+	null()                  // ClientAddr
+	cs("chaos.session")     // SessionId
+	u64(seq)                // SeqNum
+	null()                  // PsDisplay
+	cs(now)                 // SessionStart
+	null()                  // Vxid
+	u64(0)                  // Txid
+	i32(15)                 // ELevel: LOG
+	ns("00000")             // SQLState
+	ns(text)                // ErrMessage
+	null()                  // ErrDetail
+	null()                  // ErrHint
+	null()                  // InternalQuery
+	i32(0)                  // InternalQueryPos
+	null()                  // ErrContext
+	null()                  // UserQuery
+	i32(0)                  // UserQueryPos
+	null()                  // FileErrPos
+	ns("chaos")             // ApplicationName
+	return b.Bytes()
+}
+
+func records(n int) []byte {
+	var b []byte
+	for i := 0; i < n; i++ {
+		b = append(b, frame('L', record(fmt.Sprintf(
+			"chaos record %d of %d", i+1, n), uint64(i)))...)
+	}
+
+	return b
+}
+
+func valid(c net.Conn, rng *rand.Rand, ident string) error {
+	_, err := c.Write(append(handshake(ident),
+		records(1+rng.Intn(20))...))
+	return err
+}
+
+// Send a prefix of a well-formed stream, ending mid-frame.
+func truncatedFrame(c net.Conn, rng *rand.Rand, ident string) error {
+	b := append(handshake(ident), records(1+rng.Intn(3))...)
+	_, err := c.Write(b[:1+rng.Intn(len(b)-1)])
+	return err
+}
+
+func wrongType(c net.Conn, rng *rand.Rand, ident string) error {
+	msgs := [][]byte{
+		frame('V', []byte(version+"\x00")),
+		frame('I', []byte(ident+"\x00")),
+		frame('L', record("wrong type", 0)),
+	}
+
+	// Replace the type of one message with another.
+	i := rng.Intn(len(msgs))
+	types := []byte("VILQXZ\x00\xff")
+	for {
+		t := types[rng.Intn(len(types))]
+		if t != msgs[i][0] {
+			msgs[i][0] = t
+			break
+		}
+	}
+
+	_, err := c.Write(bytes.Join(msgs, nil))
+	return err
+}
+
+// Announce a message larger than the collector accepts, in the
+// handshake or as a log record, then send as much of it as will be
+// read.
+func oversized(c net.Conn, rng *rand.Rand, ident string) error {
+	var b []byte
+	switch rng.Intn(3) {
+	case 0:
+		b = []byte{'V'}
+	case 1:
+		b = frame('V', []byte(version+"\x00"))
+		b = append(b, 'I')
+	default:
+		b = append(handshake(ident), 'L')
+	}
+
+	size := uint32(maxRecord + 1 + rng.Intn(maxRecord))
+	b = binary.BigEndian.AppendUint32(b, size)
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 64*1024)
+	rng.Read(chunk)
+	for sent := uint32(0); sent < size; sent += uint32(len(chunk)) {
+		if _, err := c.Write(chunk); err != nil {
+			// Being disconnected is the expected outcome.
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Send a length header too small to count itself.
+func badLength(c net.Conn, rng *rand.Rand, ident string) error {
+	var b []byte
+	if rng.Intn(2) == 0 {
+		b = handshake(ident)
+	}
+
+	b = append(b, 'L')
+	b = binary.BigEndian.AppendUint32(b, uint32(rng.Intn(4)))
+	_, err := c.Write(b)
+	return err
+}
+
+// Send some records, then disconnect mid-record without warning.
+func midStreamDisconnect(c net.Conn, rng *rand.Rand, ident string) error {
+	b := append(handshake(ident), records(rng.Intn(10))...)
+	rec := frame('L', record("interrupted", 99))
+	b = append(b, rec[:rng.Intn(len(rec))]...)
+	_, err := c.Write(b)
+	return err
+}
+
+// Fall silent mid-record for a while before disconnecting.
+func stall(c net.Conn, rng *rand.Rand, ident string) error {
+	rec := frame('L', record("stalled", 0))
+	b := append(handshake(ident), rec[:rng.Intn(len(rec))]...)
+	if _, err := c.Write(b); err != nil {
+		return err
+	}
+
+	time.Sleep(time.Duration(rng.Int63n(int64(2 * time.Second))))
+	return nil
+}
+
+func garbage(c net.Conn, rng *rand.Rand, ident string) error {
+	b := make([]byte, rng.Intn(4096))
+	rng.Read(b)
+	_, err := c.Write(b)
+	return err
+}
+
+// Check that the socket at path is still served: a connection
+// presenting an unsupported version must be disconnected within
+// timeout, as only a worker of the collector would do.
+func probe(path string, timeout time.Duration) error {
+	c, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return fmt.Errorf("cannot connect: %v", err)
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(frame('V', []byte("PG-0.0/chaos-probe\x00"))); err != nil {
+		return fmt.Errorf("cannot send probe: %v", err)
+	}
+
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return fmt.Errorf("not disconnected within %v: the "+
+				"socket is not being served", timeout)
+		}
+	}
+
+	return nil
+}
+
+// Counts of faults attempted, and of problems found.
+type tally struct {
+	mu       sync.Mutex
+	attempts map[string]int
+	errors   map[string]int
+	wedged   int
+}
+
+func (t *tally) add(name string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts[name] += 1
+	if err != nil {
+		t.errors[name] += 1
+	}
+}
+
+func (t *tally) print(w io.Writer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(t.attempts))
+	for name := range t.attempts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%-24s %8d attempts %8d send errors\n", name,
+			t.attempts[name], t.errors[name])
+	}
+	fmt.Fprintf(w, "%-24s %8d\n", "wedged probes", t.wedged)
+}
+
+// Attack the socket at path until stop is closed, probing it after
+// every probeEvery faults.
+func attack(path, ident string, rng *rand.Rand, probeEvery int,
+	timeout time.Duration, t *tally, stop <-chan struct{}) {
+	for n := 1; ; n++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		f := faults[rng.Intn(len(faults))]
+		c, err := net.DialTimeout("unix", path, timeout)
+		if err == nil {
+			c.SetDeadline(time.Now().Add(timeout))
+			err = f.run(c, rng, ident)
+			c.Close()
+		}
+		t.add(f.name, err)
+
+		if n%probeEvery == 0 {
+			if err := probe(path, timeout); err != nil {
+				log.Printf("probe failed: %v", err)
+				t.mu.Lock()
+				t.wedged += 1
+				t.mu.Unlock()
+			}
+		}
+	}
+}
+
+// The admin interface's description of a live connection.
+type connection struct {
+	Ident string `json:"identity"`
+	Path  string `json:"socket"`
+}
+
+// Fetch the live connections from the admin interface at addr, which
+// is either a TCP address or a unix socket path prefixed with "unix:".
+func connections(addr string) ([]connection, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	base := "http://" + addr
+	if strings.HasPrefix(addr, "unix:") {
+		p := strings.TrimPrefix(addr, "unix:")
+		client.Transport = &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial("unix", p)
+			},
+		}
+		base = "http://admin"
+	}
+
+	resp, err := client.Get(base + "/connections")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin interface responds %s",
+			resp.Status)
+	}
+
+	var conns []connection
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		return nil, err
+	}
+
+	return conns, nil
+}
+
+// Wait up to settle for every connection of ident to have been
+// cleaned up, returning those that remain.
+func awaitCleanup(admin, ident string, settle time.Duration) ([]connection,
+	error) {
+	deadline := time.Now().Add(settle)
+	for {
+		conns, err := connections(admin)
+		if err != nil {
+			return nil, err
+		}
+
+		// Connections yet to identify themselves can't be
+		// told apart from those of other sockets.
+		var left []connection
+		for _, c := range conns {
+			if c.Ident == ident {
+				left = append(left, c)
+			}
+		}
+
+		if len(left) == 0 || time.Now().After(deadline) {
+			return left, nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func main() {
+	path := flag.String("socket", "", "the collector's socket to attack")
+	ident := flag.String("identity", "", "the identity it serves")
+	admin := flag.String("admin", "",
+		"the collector's admin address, such as unix:admin.sock, "+
+			"to check connections are cleaned up")
+	duration := flag.Duration("duration", time.Minute,
+		"how long to attack for")
+	concurrency := flag.Int("concurrency", 8,
+		"the number of connections to attack with at once")
+	probeEvery := flag.Int("probe-every", 10,
+		"the number of faults each attacker commits between probes")
+	timeout := flag.Duration("timeout", 10*time.Second,
+		"how long a connection or probe may take")
+	settle := flag.Duration("settle", 30*time.Second,
+		"how long connections may take to be cleaned up afterwards")
+	seed := flag.Int64("seed", 0,
+		"the random seed, or 0 for one chosen by the time")
+	flag.Parse()
+
+	if *path == "" || *ident == "" {
+		log.Fatal("-socket and -identity must be given")
+	} else if *concurrency < 1 || *probeEvery < 1 {
+		log.Fatal("-concurrency and -probe-every must be positive")
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("attacking %q for %v with seed %d", *path, *duration,
+		*seed)
+
+	t := &tally{attempts: make(map[string]int),
+		errors: make(map[string]int)}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		rng := rand.New(rand.NewSource(*seed + int64(i)))
+		go func() {
+			defer wg.Done()
+			attack(*path, *ident, rng, *probeEvery, *timeout, t,
+				stop)
+		}()
+	}
+
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+
+	failed := false
+	if err := probe(*path, *timeout); err != nil {
+		log.Printf("final probe failed: %v", err)
+		t.wedged += 1
+	}
+
+	if t.wedged > 0 {
+		failed = true
+	}
+
+	if *admin != "" {
+		left, err := awaitCleanup(*admin, *ident, *settle)
+		if err != nil {
+			log.Printf("cannot check connections: %v", err)
+			failed = true
+		}
+
+		for _, c := range left {
+			log.Printf("connection on %q not cleaned up after %v",
+				c.Path, *settle)
+			failed = true
+		}
+	}
+
+	t.print(os.Stdout)
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Unaccepted connections wait in the backlog, unanswered.
+	if err := probe(path, 100*time.Millisecond); err == nil {
+		t.Fatal("Expected a socket not being served to fail " +
+			"the probe")
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			// Refuse the version, as would the collector.
+			c.Read(make([]byte, 5))
+			c.Close()
+		}
+	}()
+
+	if err := probe(path, 5*time.Second); err != nil {
+		t.Fatalf("Expected the probe to succeed: %v", err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, f := range faults {
+		if f.name == "stall" {
+			continue
+		}
+
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			// Read some, then disconnect, as the collector
+			// does on finding a fault.
+			io.CopyN(ioutil.Discard, server, 1<<20)
+			server.Close()
+		}()
+
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := f.run(client, rng, "chaos"); err != nil &&
+			err != io.ErrClosedPipe {
+			t.Errorf("%s: %v", f.name, err)
+		}
+
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// What an end-to-end test expects logplexd to receive, read from a
+// JSON file such as:
+//
+//	{
+//	    "token": "t.9d19ac58-0597-4ea0-94b0-45778803597c",
+//	    "count": 2,
+//	    "match": ["statement: SELECT 1", "^LOG: "],
+//	    "timeout": "30s"
+//	}
+//
+// Every request must authenticate with token, and every message must
+// be addressed to it.  Exactly count messages must arrive, should
+// count be non-zero, and each of the regular expressions in match
+// must match the text of at least one of them.  Should this not come
+// to pass within timeout, the expectations are not met.
+type expectations struct {
+	Token   string   `json:"token"`
+	Count   int      `json:"count"`
+	Match   []string `json:"match"`
+	Timeout string   `json:"timeout"`
+
+	match   []*regexp.Regexp
+	timeout time.Duration
+}
+
+func loadExpectations(path string) (*expectations, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var e expectations
+	if err := json.Unmarshal(contents, &e); err != nil {
+		return nil, fmt.Errorf("cannot parse %q: %v", path, err)
+	}
+
+	for _, m := range e.Match {
+		re, err := regexp.Compile(m)
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression "+
+				"%q: %v", m, err)
+		}
+
+		e.match = append(e.match, re)
+	}
+
+	e.timeout = 30 * time.Second
+	if e.Timeout != "" {
+		d, err := time.ParseDuration(e.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("bad timeout %q", e.Timeout)
+		}
+
+		e.timeout = d
+	}
+
+	return &e, nil
+}
+
+// Checks the messages received against expectations.
+type checker struct {
+	e *expectations
+
+	mu       sync.Mutex
+	received int
+	matched  []bool
+	failures []string
+
+	// Receives a value, without blocking, whenever messages
+	// arrive.
+	changed chan struct{}
+}
+
+func newChecker(e *expectations) *checker {
+	return &checker{
+		e:       e,
+		matched: make([]bool, len(e.match)),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Record a request authenticated with password, carrying msgs.  A
+// nil *checker ignores it.
+func (c *checker) receive(password string, msgs []message) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.e.Token != "" && password != c.e.Token {
+		c.failures = append(c.failures, fmt.Sprintf(
+			"request authenticated with %q, want %q",
+			password, c.e.Token))
+	}
+
+	for _, m := range msgs {
+		c.received += 1
+		if c.e.Token != "" && m.Token != c.e.Token {
+			c.failures = append(c.failures, fmt.Sprintf(
+				"message addressed to %q, want %q",
+				m.Token, c.e.Token))
+		}
+
+		for i, re := range c.e.match {
+			if re.MatchString(m.Text) {
+				c.matched[i] = true
+			}
+		}
+	}
+
+	if c.e.Count > 0 && c.received > c.e.Count {
+		c.failures = append(c.failures, fmt.Sprintf(
+			"received %d messages, want %d", c.received, c.e.Count))
+	}
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Record a request that could not be decoded.  A nil *checker
+// ignores it.
+func (c *checker) fail(format string, args ...interface{}) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.failures = append(c.failures, fmt.Sprintf(format, args...))
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Report whether something has gone irrecoverably wrong.
+func (c *checker) failed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.failures) > 0
+}
+
+// Describe every way in which the expectations are not met, if any.
+func (c *checker) unmet() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	unmet := append([]string(nil), c.failures...)
+	if c.e.Count > 0 && c.received < c.e.Count {
+		unmet = append(unmet, fmt.Sprintf(
+			"received %d messages, want %d", c.received, c.e.Count))
+	}
+
+	for i, ok := range c.matched {
+		if !ok {
+			unmet = append(unmet, fmt.Sprintf(
+				"no message matched %q", c.e.Match[i]))
+		}
+	}
+
+	return unmet
+}
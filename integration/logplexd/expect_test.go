@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeExpectations(t *testing.T, contents string) *expectations {
+	dir, err := ioutil.TempDir("", "logplexd_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "expect.json")
+	ioutil.WriteFile(path, []byte(contents), 0600)
+
+	e, err := loadExpectations(path)
+	if err != nil {
+		t.Fatalf("Could not load expectations: %v", err)
+	}
+
+	return e
+}
+
+func TestChecker(t *testing.T) {
+	e := writeExpectations(t, `{"token": "t.abc", "count": 2, `+
+		`"match": ["^LOG: ", "SELECT \\d"], "timeout": "5s"}`)
+	if e.timeout != 5*time.Second {
+		t.Fatalf("Got timeout %v, want 5s", e.timeout)
+	}
+
+	c := newChecker(e)
+	if len(c.unmet()) != 3 {
+		t.Fatalf("Expected count and both matches unmet: %v",
+			c.unmet())
+	}
+
+	c.receive("t.abc", []message{{Token: "t.abc", Text: "LOG: hello"}})
+	if unmet := c.unmet(); len(unmet) != 2 || c.failed() {
+		t.Fatalf("Expected count and one match unmet: %v", unmet)
+	}
+
+	c.receive("t.abc", []message{{Token: "t.abc", Text: "SELECT 1"}})
+	if unmet := c.unmet(); len(unmet) != 0 {
+		t.Fatalf("Expected expectations met: %v", unmet)
+	}
+
+	// Too many messages, under the wrong token.
+	c.receive("t.xyz", []message{{Token: "t.xyz", Text: "LOG: again"}})
+	if !c.failed() || len(c.unmet()) != 3 {
+		t.Fatalf("Expected token and count failures: %v", c.unmet())
+	}
+}
+
+func TestAwait(t *testing.T) {
+	e := writeExpectations(t, `{"count": 1}`)
+
+	c := newChecker(e)
+	sigch := make(chan os.Signal)
+	if code := await(c, 50*time.Millisecond, sigch); code != 1 {
+		t.Fatalf("Expected timing out to fail, got status %d", code)
+	}
+
+	c = newChecker(e)
+	c.receive("", []message{{Text: "hello"}})
+	if code := await(c, 5*time.Second, sigch); code != 0 {
+		t.Fatalf("Expected met expectations to succeed, "+
+			"got status %d", code)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// A message as framed by logplexc: an RFC 5424 syslog message
+// prefixed by its length, as in
+//
+//	83 <134>1 2014-01-01T00:00:00Z host token procid - - text
+//
+// MsgId and StructuredData are empty should they be the nil value,
+// "-".
+type message struct {
+	Priority       int    `json:"priority"`
+	Time           string `json:"time"`
+	Host           string `json:"host"`
+	Token          string `json:"token"`
+	ProcId         string `json:"procid"`
+	MsgId          string `json:"msgid,omitempty"`
+	StructuredData string `json:"structured_data,omitempty"`
+	Text           string `json:"text"`
+}
+
+// Decode every message in a logplex-1 request body.
+func parseFrames(body []byte) ([]message, error) {
+	var msgs []message
+	for len(body) > 0 {
+		sp := bytes.IndexByte(body, ' ')
+		if sp < 0 {
+			return msgs, fmt.Errorf("frame %d: no length", len(msgs))
+		}
+
+		n, err := strconv.Atoi(string(body[:sp]))
+		if err != nil || n < 0 || n > len(body)-sp-1 {
+			return msgs, fmt.Errorf("frame %d: bad length %q",
+				len(msgs), body[:sp])
+		}
+
+		m, err := parseSyslog(body[sp+1 : sp+1+n])
+		if err != nil {
+			return msgs, fmt.Errorf("frame %d: %v", len(msgs), err)
+		}
+
+		msgs = append(msgs, m)
+		body = body[sp+1+n:]
+	}
+
+	return msgs, nil
+}
+
+// Decode a single syslog message, less its length prefix.
+func parseSyslog(b []byte) (message, error) {
+	var m message
+
+	if len(b) == 0 || b[0] != '<' {
+		return m, fmt.Errorf("no priority")
+	}
+
+	end := bytes.IndexByte(b, '>')
+	if end < 0 {
+		return m, fmt.Errorf("unterminated priority")
+	}
+
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil {
+		return m, fmt.Errorf("bad priority %q", b[1:end])
+	}
+	m.Priority = pri
+
+	// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	// STRUCTURED-DATA MSG, where STRUCTURED-DATA may itself
+	// contain spaces.
+	fields := bytes.SplitN(b[end+1:], []byte{' '}, 7)
+	if len(fields) < 7 {
+		return m, fmt.Errorf("too few header fields")
+	}
+
+	if string(fields[0]) != "1" {
+		return m, fmt.Errorf("unsupported version %q", fields[0])
+	}
+
+	m.Time = string(fields[1])
+	m.Host = string(fields[2])
+	m.Token = string(fields[3])
+	m.ProcId = string(fields[4])
+	if string(fields[5]) != "-" {
+		m.MsgId = string(fields[5])
+	}
+
+	sd, rest, err := splitStructuredData(fields[6])
+	if err != nil {
+		return m, err
+	}
+
+	if string(sd) != "-" {
+		m.StructuredData = string(sd)
+	}
+
+	if len(rest) > 0 {
+		m.Text = string(rest[1:])
+	}
+
+	return m, nil
+}
+
+// Split the STRUCTURED-DATA from the start of b, which is either the
+// nil value or a sequence of SD-ELEMENTs, such as
+//
+//	[id@32473 key="a \"quoted\" value"][other]
+//
+// returning it and what follows it.
+func splitStructuredData(b []byte) ([]byte, []byte, error) {
+	if len(b) > 0 && b[0] == '-' {
+		return splitAfterStructuredData(b, 1)
+	}
+
+	i := 0
+	for i < len(b) && b[i] == '[' {
+		quoted := false
+		for i++; ; i++ {
+			if i >= len(b) {
+				return nil, nil, fmt.Errorf(
+					"unterminated structured data")
+			}
+
+			c := b[i]
+			if quoted && c == '\\' {
+				i++
+			} else if c == '"' {
+				quoted = !quoted
+			} else if c == ']' && !quoted {
+				i++
+				break
+			}
+		}
+	}
+
+	if i == 0 {
+		return nil, nil, fmt.Errorf("bad structured data")
+	}
+
+	return splitAfterStructuredData(b, i)
+}
+
+// Split b after the STRUCTURED-DATA ending at i, which must be
+// followed by a space or nothing at all.
+func splitAfterStructuredData(b []byte, i int) ([]byte, []byte, error) {
+	rest := b[i:]
+	if len(rest) > 0 && rest[0] != ' ' {
+		return nil, nil, fmt.Errorf("bad structured data")
+	}
+
+	return b[:i], rest, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func frame(s string) string {
+	return fmt.Sprintf("%d %s", len(s), s)
+}
+
+func TestParseFrames(t *testing.T) {
+	body := frame("<134>1 2014-01-01T00:00:00Z postgres t.abc 123 - - "+
+		"LOG: hello") + frame("<134>1 2014-01-01T00:00:01Z postgres "+
+		"t.abc 124 - - with spaces  and\nnewlines")
+
+	msgs, err := parseFrames([]byte(body))
+	if err != nil {
+		t.Fatalf("Could not parse frames: %v", err)
+	}
+
+	want := []message{
+		{Priority: 134, Time: "2014-01-01T00:00:00Z", Host: "postgres",
+			Token: "t.abc", ProcId: "123", Text: "LOG: hello"},
+		{Priority: 134, Time: "2014-01-01T00:00:01Z", Host: "postgres",
+			Token: "t.abc", ProcId: "124",
+			Text: "with spaces  and\nnewlines"},
+	}
+
+	if !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("Got %+v, want %+v", msgs, want)
+	}
+}
+
+func TestParseFramesBad(t *testing.T) {
+	for _, body := range []string{
+		"12",
+		"x <134>1 a b c d - - e",
+		"100 <134>1 a b c d - - e",
+		frame("134>1 a b c d - - e"),
+		frame("<134>2 a b c d - - e"),
+		frame("<134>1 a b"),
+	} {
+		if _, err := parseFrames([]byte(body)); err == nil {
+			t.Errorf("Expected %q not to parse", body)
+		}
+	}
+}
+
+func TestParseFramesStructuredData(t *testing.T) {
+	sd := `[pg@32473 sqlstate="42P01" context="a \"b\" [c\]"][x]`
+	body := frame("<134>1 2014-01-01T00:00:00Z postgres t.abc 123 "+
+		"msg "+sd+" LOG: hello") + frame("<134>1 "+
+		"2014-01-01T00:00:01Z postgres t.abc 124 - "+sd)
+
+	msgs, err := parseFrames([]byte(body))
+	if err != nil {
+		t.Fatalf("Could not parse frames: %v", err)
+	}
+
+	want := []message{
+		{Priority: 134, Time: "2014-01-01T00:00:00Z", Host: "postgres",
+			Token: "t.abc", ProcId: "123", MsgId: "msg",
+			StructuredData: sd, Text: "LOG: hello"},
+		{Priority: 134, Time: "2014-01-01T00:00:01Z", Host: "postgres",
+			Token: "t.abc", ProcId: "124", StructuredData: sd},
+	}
+
+	if !reflect.DeepEqual(msgs, want) {
+		t.Fatalf("Got %+v, want %+v", msgs, want)
+	}
+
+	for _, sd := range []string{`[x a="b]`, `[x]y`, `-[x]`, `x`} {
+		b := frame("<134>1 a b c d - " + sd + " e")
+		if _, err := parseFrames([]byte(b)); err == nil {
+			t.Errorf("Expected %q not to parse", b)
+		}
+	}
+}
@@ -1,19 +1,36 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
+	"time"
 )
 
-type LogplexPrint struct{}
+// How long to wait, once expectations are met, for further messages
+// that would spoil them before declaring success.
+const settlePeriod = time.Second
 
-func (*LogplexPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+const defaultToken = "t.9d19ac58-0597-4ea0-94b0-45778803597c"
+
+type LogplexPrint struct {
+	// Checks what is received, should expectations be given.
+	check *checker
+
+	// Records what is received, should a directory be given.
+	rec *recorder
+}
+
+func (lp *LogplexPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dump, err := httputil.DumpRequest(r, true)
 	if err != nil {
 		log.Printf("Could not dump request: %#v", err)
@@ -21,24 +38,112 @@ func (*LogplexPrint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("%s", dump)
 
+	if lp.check != nil || lp.rec != nil {
+		lp.decode(r)
+	}
+
 	// Respond saying everything is OK.
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// Decode the messages of r, to check or record them.
+func (lp *LogplexPrint) decode(r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("cannot read request: %v", err)
+		lp.check.fail("cannot read request: %v", err)
+		return
+	}
+
+	msgs, err := parseFrames(body)
+	if err != nil {
+		log.Printf("cannot decode request: %v", err)
+		lp.check.fail("cannot decode request: %v", err)
+	}
+
+	if lp.rec != nil {
+		if err := lp.rec.record(msgs); err != nil {
+			log.Printf("cannot record messages: %v", err)
+		}
+	}
+
+	if err == nil {
+		_, password, _ := r.BasicAuth()
+		lp.check.receive(password, msgs)
+	}
+}
+
 func main() {
-	s := httptest.NewTLSServer(&LogplexPrint{})
+	expectPath := flag.String("expect", "",
+		"exit once the messages described by this file are "+
+			"received, or with status 1 should they not be")
+	recordDir := flag.String("record", "",
+		"append the messages received for each token to a file "+
+			"in this directory")
+	addr := flag.String("addr", "",
+		"listen on this address, such as 0.0.0.0:8443, rather "+
+			"than a random port on the loopback interface")
+	plain := flag.Bool("plain", false,
+		"serve plain HTTP rather than HTTPS")
+	certFile := flag.String("cert", "",
+		"serve HTTPS with the certificate in this PEM file, "+
+			"rather than a throwaway one")
+	keyFile := flag.String("key", "",
+		"the private key of the certificate given by -cert")
+	flag.Parse()
+
+	if (*certFile == "") != (*keyFile == "") {
+		log.Fatal("-cert and -key must be given together")
+	} else if *plain && *certFile != "" {
+		log.Fatal("-plain and -cert are mutually exclusive")
+	}
+
+	lp := &LogplexPrint{}
+	if *recordDir != "" {
+		rec, err := newRecorder(*recordDir)
+		if err != nil {
+			log.Fatalf("cannot record to %q: %v", *recordDir, err)
+		}
+
+		lp.rec = rec
+	}
+
+	token := defaultToken
+	var exp *expectations
+	if *expectPath != "" {
+		var err error
+		exp, err = loadExpectations(*expectPath)
+		if err != nil {
+			log.Fatalf("cannot load expectations: %v", err)
+		}
+
+		lp.check = newChecker(exp)
+		if exp.Token != "" {
+			token = exp.Token
+		}
+	}
+
+	s, err := newServer(lp, *addr, *plain, *certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("cannot serve: %v", err)
+	}
+
 	u, err := url.Parse(s.URL)
 	if err != nil {
 		log.Printf("httptest generated a bad URL: %v", s.URL)
 	}
 
-	u.User = url.UserPassword("token",
-		"t.9d19ac58-0597-4ea0-94b0-45778803597c")
+	u.User = url.UserPassword("token", token)
 	fmt.Println(u)
 
 	// Signal handling:
-	sigch := make(chan os.Signal)
+	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, os.Interrupt, os.Kill)
+
+	if lp.check != nil {
+		os.Exit(await(lp.check, exp.timeout, sigch))
+	}
+
 	for sig := range sigch {
 		log.Printf("got signal %v", sig)
 		if sig == os.Kill {
@@ -48,3 +153,90 @@ func main() {
 		}
 	}
 }
+
+// Start serving h on addr, or a random port on the loopback
+// interface should addr be empty.  HTTPS is served unless plain is
+// set, using the certificate in certFile and keyFile if given, or
+// otherwise a throwaway one.
+func newServer(h http.Handler, addr string, plain bool,
+	certFile, keyFile string) (*httptest.Server, error) {
+	s := httptest.NewUnstartedServer(h)
+	if addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Listener.Close()
+		s.Listener = l
+	}
+
+	switch {
+	case plain:
+		s.Start()
+	case certFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			s.Listener.Close()
+			return nil, err
+		}
+
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		s.StartTLS()
+	default:
+		s.StartTLS()
+	}
+
+	return s, nil
+}
+
+// Wait for the expectations of c to be met, or for them to be
+// spoiled, timeout to elapse, or a signal to arrive, returning the
+// exit status: 0 if they were met, and 1 otherwise.
+func await(c *checker, timeout time.Duration,
+	sigch <-chan os.Signal) int {
+	deadline := time.After(timeout)
+
+	var settled <-chan time.Time
+	if len(c.unmet()) == 0 {
+		settled = time.After(settlePeriod)
+	}
+
+	for {
+		select {
+		case sig := <-sigch:
+			log.Printf("got signal %v", sig)
+			return report(c)
+		case <-deadline:
+			log.Printf("timed out after %v", timeout)
+			return report(c)
+		case <-settled:
+			return report(c)
+		case <-c.changed:
+			if c.failed() {
+				return report(c)
+			}
+
+			settled = nil
+			if len(c.unmet()) == 0 {
+				settled = time.After(settlePeriod)
+			}
+		}
+	}
+}
+
+// Log whether the expectations of c were met, returning the exit
+// status to match.
+func report(c *checker) int {
+	unmet := c.unmet()
+	if len(unmet) == 0 {
+		log.Print("expectations met")
+		return 0
+	}
+
+	for _, u := range unmet {
+		log.Printf("expectation not met: %s", u)
+	}
+
+	return 1
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNewServerPlain(t *testing.T) {
+	s, err := newServer(&LogplexPrint{}, "127.0.0.1:0", true, "", "")
+	if err != nil {
+		t.Fatalf("Could not serve: %v", err)
+	}
+	defer s.Close()
+
+	if !strings.HasPrefix(s.URL, "http://127.0.0.1:") {
+		t.Fatalf("Expected a plain HTTP URL on loopback, got %q", s.URL)
+	}
+
+	resp, err := http.Post(s.URL+"/logs", "application/logplex-1",
+		strings.NewReader(frame("<134>1 t h t.a 1 - - hello")))
+	if err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Got status %v, want 204", resp.Status)
+	}
+}
+
+func TestNewServerBadCert(t *testing.T) {
+	if _, err := newServer(&LogplexPrint{}, "", false,
+		"/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Fatal("Expected a missing certificate to be an error")
+	}
+}
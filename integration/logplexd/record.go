@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appends the text of each message received to a file per token in
+// a directory, so that what reached each drain can be inspected.
+// Each text is followed by a newline.  As texts may themselves span
+// lines, index.json in the same directory records, one JSON object
+// per line, where each message's text lies along with its syslog
+// header.
+type recorder struct {
+	dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File
+	index *os.File
+}
+
+// An entry of index.json.
+type recordEntry struct {
+	message
+	File     string    `json:"file"`
+	Offset   int64     `json:"offset"`
+	Length   int       `json:"length"`
+	Received time.Time `json:"received"`
+}
+
+func newRecorder(dir string) (*recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(filepath.Join(dir, "index.json"),
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{
+		dir:   dir,
+		files: make(map[string]*os.File),
+		index: index,
+	}, nil
+}
+
+// The name of the file holding the messages of token, which is
+// restricted to characters safe in a file name.
+func recordFileName(token string) string {
+	safe := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z',
+			r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+
+		return '_'
+	}, token)
+
+	if safe == "" || safe[0] == '.' {
+		safe = "_" + safe
+	}
+
+	return safe + ".log"
+}
+
+func (r *recorder) record(msgs []message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	enc := json.NewEncoder(r.index)
+	for _, m := range msgs {
+		name := recordFileName(m.Token)
+		f, ok := r.files[name]
+		if !ok {
+			var err error
+			f, err = os.OpenFile(filepath.Join(r.dir, name),
+				os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+
+			r.files[name] = f
+		}
+
+		off, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.WriteString(m.Text + "\n"); err != nil {
+			return err
+		}
+
+		err = enc.Encode(recordEntry{message: m, File: name,
+			Offset: off, Length: len(m.Text), Received: now})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
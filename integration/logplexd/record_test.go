@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordFileName(t *testing.T) {
+	for token, want := range map[string]string{
+		"t.abc-123": "t.abc-123.log",
+		"../evil":   "_.._evil.log",
+		"":          "_.log",
+	} {
+		if got := recordFileName(token); got != want {
+			t.Errorf("recordFileName(%q) = %q, want %q",
+				token, got, want)
+		}
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logplexd_")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := newRecorder(dir)
+	if err != nil {
+		t.Fatalf("Could not create recorder: %v", err)
+	}
+
+	msgs := []message{
+		{Token: "t.a", Text: "first"},
+		{Token: "t.b", Text: "other\ntoken"},
+		{Token: "t.a", Text: "second"},
+	}
+	if err := r.record(msgs); err != nil {
+		t.Fatalf("Could not record: %v", err)
+	}
+
+	a, _ := ioutil.ReadFile(filepath.Join(dir, "t.a.log"))
+	if string(a) != "first\nsecond\n" {
+		t.Fatalf("Unexpected contents of t.a.log: %q", a)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "index.json"))
+	if err != nil {
+		t.Fatalf("Could not open index: %v", err)
+	}
+	defer f.Close()
+
+	var entries []recordEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e recordEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("Bad index entry %q: %v", s.Text(), err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if len(entries) != len(msgs) {
+		t.Fatalf("Expected %d index entries, got %d",
+			len(msgs), len(entries))
+	}
+
+	last := entries[2]
+	if last.File != "t.a.log" || last.Offset != 6 ||
+		last.Length != 6 || last.Text != "second" {
+		t.Fatalf("Unexpected index entry: %+v", last)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/logplex/pg_logplexcollector/pkg/collector"
+)
+
+func main() {
+	// Input checking
+	showVersion := flag.Bool("version", false,
+		"print version information and exit")
+	configPath := flag.String("config", "",
+		"read settings from this file; the environment overrides it")
+	dryRunOnly := flag.Bool("dry-run", false,
+		"validate the serve database, print its routing table, "+
+			"and exit")
+	replayPath := flag.String("replay", "",
+		"replay the connections in this capture file, packet "+
+			"capture, or raw stream, print how they would be "+
+			"routed and what would be sent to their drains, "+
+			"and exit")
+	replayName := flag.String("replay-name", "",
+		"the serve record name to replay connections with")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: pg_logplexcollector "+
+			"[--version] [--config FILE] [--dry-run] "+
+			"[--replay FILE [--replay-name NAME]]\n"+
+			"       pg_logplexcollector [--config FILE] status\n")
+	}
+	flag.Parse()
+
+	status := flag.NArg() == 1 && flag.Arg(0) == "status"
+	if flag.NArg() != 0 && !status {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *showVersion {
+		fmt.Println(collector.Version())
+		os.Exit(0)
+	}
+
+	var opts []collector.Option
+	if *configPath != "" {
+		opts = append(opts, collector.WithConfigFile(*configPath))
+	}
+
+	// Summarize a running collector, without starting another.
+	if status {
+		c, err := collector.New(opts...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		if err := c.Status(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	// Set up log prefix for all future system diagnostic
+	// messages.
+	log.SetPrefix("pg_logplexcollector ")
+	log.Printf("starting %s", collector.Version())
+
+	c, err := collector.New(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *replayPath != "" {
+		f, err := os.Open(*replayPath)
+		if err != nil {
+			log.Fatalf("cannot replay: %v", err)
+		}
+
+		if err := c.Replay(f, *replayName, os.Stdout); err != nil {
+			log.Fatalf("cannot replay %q: %v", *replayPath, err)
+		}
+
+		os.Exit(0)
+	}
+
+	if *dryRunOnly {
+		if err := c.DryRun(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid serve database: %v\n",
+				err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if err := c.Run(context.Background()); err != nil {
+		if e, ok := err.(*collector.ExitError); ok {
+			os.Exit(e.Code)
+		}
+
+		log.Fatal(err)
+	}
+}
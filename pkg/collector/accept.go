@@ -0,0 +1,127 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bounds on the delay before retrying after an accept error, and
+// before retrying to recreate a failed listener.
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+	rebindBackoffMax = 30 * time.Second
+)
+
+// Counts of temporary accept errors, and of listeners recreated after
+// failing, keyed by identity.
+var (
+	acceptErrors        = expvar.NewMap("accept_errors")
+	listenerRecreations = expvar.NewMap("listener_recreations")
+)
+
+// Report whether err is expected to pass, such as running out of file
+// descriptors or a connection aborted before it could be accepted.
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// Double the backoff d, within acceptBackoffMin and max.
+func nextBackoff(d, max time.Duration) time.Duration {
+	d *= 2
+	if d < acceptBackoffMin {
+		d = acceptBackoffMin
+	}
+
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// Wait for d, reporting true should ctx be cancelled first.
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Bind the socket for sr anew, retrying with backoff until it
+// succeeds or ctx is cancelled, in which case nil is returned.
+func rebindListener(ctx context.Context, sr *serveRecord) net.Listener {
+	var backoff time.Duration
+	for {
+		l, err := bindListener(ctx, sr)
+		if err == nil {
+			return l
+		}
+
+		backoff = nextBackoff(backoff, rebindBackoffMax)
+		log.Printf("cannot recreate listener, retrying in %v: %v",
+			backoff, err)
+		if sleepOrDone(ctx, backoff) {
+			return nil
+		}
+	}
+}
+
+// Closes the listener of a generation as soon as it is cancelled,
+// so that a retired generation stops accepting at once, rather than
+// lingering in Accept until its next connection.
+type listenerCloser struct {
+	mu     sync.Mutex
+	l      net.Listener
+	closed bool
+}
+
+func closeOnDone(ctx context.Context, l net.Listener) *listenerCloser {
+	lc := &listenerCloser{l: l}
+	go func() {
+		<-ctx.Done()
+
+		lc.mu.Lock()
+		defer lc.mu.Unlock()
+		lc.closed = true
+		closeRetired(lc.l)
+	}()
+
+	return lc
+}
+
+// Replace the listener to close, should it be recreated, reporting
+// false, having closed l, if the context is already done.
+func (lc *listenerCloser) replace(l net.Listener) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.closed {
+		closeRetired(l)
+		return false
+	}
+
+	lc.l = l
+	return true
+}
+
+// Close a retired listener, leaving its socket in place: the next
+// generation may already have bound a new socket at the same path,
+// which must not be unlinked.
+func closeRetired(l net.Listener) {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	l.Close()
+}
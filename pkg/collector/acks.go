@@ -0,0 +1,493 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Optionally, the sequence numbers of the log records of each session
+// handed to the drain, and of those the drain acknowledged with a
+// successful response, are tracked, and journaled to a file.  On
+// start-up, the records the previous process received but never had
+// acknowledged, whether lost with a failed request or with the
+// process itself, are reported per identity: logged, counted, and
+// sent to the drain of records asking for sequence warnings.
+//
+// The drain client numbers the messages handed to it, reporting the
+// span of those each request carries, and of those in each bundle it
+// drops, so that neither concurrent requests nor dropped bundles
+// confuse which records were acknowledged.
+//
+// Only sessions with records yet to be acknowledged are journaled,
+// and only the most recently active of them should an identity have
+// very many, so that the journal stays small however long the
+// collector runs.  The journal is written every ackJournalInterval,
+// so that after a crash records acknowledged since are reported as
+// well, erring on the side of reporting.  A process replaced by an
+// upgrade stops journaling as it hands over, so that records it had
+// yet to deliver are reported by the process replacing it.
+
+// How often the journal is written.
+var ackJournalInterval = 5 * time.Second
+
+// The most sessions journaled per identity.
+const maxJournalSessions = 256
+
+// Count of log records reported on start-up as received but never
+// acknowledged by the drain, keyed by identity.
+var unackedRecords = expvar.NewMap("unacknowledged_records")
+
+// The journal of acknowledgments, or nil should none be kept.
+var acks *ackJournal
+
+// Sequence numbers, as sorted, disjoint and non-adjacent inclusive
+// ranges.
+type seqRanges [][2]int64
+
+// Add seq, returning the ranges.
+func (rs seqRanges) add(seq int64) seqRanges {
+	// The first range ending no earlier than just before seq.
+	i := sort.Search(len(rs), func(i int) bool {
+		return rs[i][1] >= seq-1
+	})
+
+	if i == len(rs) || rs[i][0] > seq+1 {
+		rs = append(rs, [2]int64{})
+		copy(rs[i+1:], rs[i:])
+		rs[i] = [2]int64{seq, seq}
+		return rs
+	}
+
+	if seq < rs[i][0] {
+		rs[i][0] = seq
+	} else if seq > rs[i][1] {
+		rs[i][1] = seq
+		if i+1 < len(rs) && rs[i+1][0] == seq+1 {
+			rs[i][1] = rs[i+1][1]
+			rs = append(rs[:i+1], rs[i+2:]...)
+		}
+	}
+
+	return rs
+}
+
+// The sequence numbers of rs not in o.
+func (rs seqRanges) minus(o seqRanges) seqRanges {
+	var out seqRanges
+	for _, r := range rs {
+		lo := r[0]
+		for _, x := range o {
+			if x[1] < lo || x[0] > r[1] {
+				continue
+			}
+
+			if x[0] > lo {
+				out = append(out, [2]int64{lo, x[0] - 1})
+			}
+			lo = x[1] + 1
+		}
+
+		if lo <= r[1] {
+			out = append(out, [2]int64{lo, r[1]})
+		}
+	}
+
+	return out
+}
+
+// The number of sequence numbers in rs.
+func (rs seqRanges) count() int64 {
+	var n int64
+	for _, r := range rs {
+		n += r[1] - r[0] + 1
+	}
+
+	return n
+}
+
+func (rs seqRanges) String() string {
+	parts := make([]string, len(rs))
+	for i, r := range rs {
+		parts[i] = strconv.FormatInt(r[0], 10)
+		if r[1] != r[0] {
+			parts[i] += "-" + strconv.FormatInt(r[1], 10)
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// The records of a session handed to the drain, and acknowledged by
+// it.
+type sessionAcks struct {
+	Received seqRanges `json:"received"`
+	Acked    seqRanges `json:"acked"`
+
+	// When the session was last active, as a count of journal
+	// updates, to choose which to forget.
+	touched uint64
+}
+
+// Records of acknowledgments, by identity and then session, journaled
+// to path.
+type ackJournal struct {
+	path string
+
+	mu       sync.Mutex
+	ids      map[string]map[string]*sessionAcks
+	updates  uint64
+	stopped  bool
+	reports  map[string][]string
+	saveLock sync.Mutex
+}
+
+// The journal file.
+type ackJournalFile struct {
+	Identities map[string]map[string]*sessionAcks `json:"identities"`
+}
+
+// Open the journal at path, reporting the records it shows were never
+// acknowledged.  A journal that cannot be read is started afresh.
+func openAckJournal(path string) *ackJournal {
+	j := &ackJournal{
+		path:    path,
+		ids:     make(map[string]map[string]*sessionAcks),
+		reports: make(map[string][]string),
+	}
+
+	var f ackJournalFile
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot read acknowledgment journal %q, "+
+			"starting afresh: %v", path, err)
+		return j
+	}
+
+	j.report(f.Identities)
+	return j
+}
+
+// Report the records of ids, sessions by identity, never
+// acknowledged.
+func (j *ackJournal) report(ids map[string]map[string]*sessionAcks) {
+	idents := make([]string, 0, len(ids))
+	for ident := range ids {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	for _, ident := range idents {
+		sessions := make([]string, 0, len(ids[ident]))
+		for session := range ids[ident] {
+			sessions = append(sessions, session)
+		}
+		sort.Strings(sessions)
+
+		for _, session := range sessions {
+			sa := ids[ident][session]
+			if sa == nil {
+				continue
+			}
+
+			gaps := sa.Received.minus(sa.Acked)
+			if len(gaps) == 0 {
+				continue
+			}
+
+			msg := fmt.Sprintf("%d log messages of session %s "+
+				"were received before restart but never "+
+				"acknowledged by the drain: sequence numbers %v",
+				gaps.count(), session, gaps)
+			log.Printf("identity %q: %s", ident, msg)
+			unackedRecords.Add(ident, gaps.count())
+			j.reports[ident] = append(j.reports[ident], msg)
+		}
+	}
+}
+
+// Take the reports of records of ident never acknowledged, to send to
+// its drain.
+func (j *ackJournal) takeReports(ident string) []string {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	reports := j.reports[ident]
+	delete(j.reports, ident)
+	return reports
+}
+
+// The record of session of ident, created should it not exist.  The
+// caller must hold mu.
+func (j *ackJournal) sessionLocked(ident,
+	session string) *sessionAcks {
+	j.updates += 1
+	sessions := j.ids[ident]
+	if sessions == nil {
+		sessions = make(map[string]*sessionAcks)
+		j.ids[ident] = sessions
+	}
+
+	sa := sessions[session]
+	if sa == nil {
+		if len(sessions) >= maxJournalSessions {
+			forgetOldest(sessions)
+		}
+
+		sa = &sessionAcks{}
+		sessions[session] = sa
+	}
+
+	sa.touched = j.updates
+	return sa
+}
+
+// Forget the least recently active of sessions.
+func forgetOldest(sessions map[string]*sessionAcks) {
+	var oldest string
+	var touched uint64
+	found := false
+	for session, sa := range sessions {
+		if !found || sa.touched < touched {
+			oldest, touched, found = session, sa.touched, true
+		}
+	}
+
+	delete(sessions, oldest)
+}
+
+// Record that a record of ident was handed to the drain.
+func (j *ackJournal) received(ident string, rec ackEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	sa := j.sessionLocked(ident, rec.session)
+	sa.Received = sa.Received.add(rec.seq)
+}
+
+// Record that the drain acknowledged recs, records of ident.
+func (j *ackJournal) acked(ident string, recs []ackEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, rec := range recs {
+		if !rec.record {
+			continue
+		}
+
+		// Sessions forgotten in the meantime stay so.
+		if sa := j.ids[ident][rec.session]; sa != nil {
+			sa.Acked = sa.Acked.add(rec.seq)
+		}
+	}
+}
+
+// Write the journal, should it not have stopped, forgetting sessions
+// with every record acknowledged.
+func (j *ackJournal) save() error {
+	j.saveLock.Lock()
+	defer j.saveLock.Unlock()
+
+	j.mu.Lock()
+	if j.stopped {
+		j.mu.Unlock()
+		return nil
+	}
+
+	for ident, sessions := range j.ids {
+		for session, sa := range sessions {
+			if len(sa.Received.minus(sa.Acked)) == 0 {
+				delete(sessions, session)
+			}
+		}
+
+		if len(sessions) == 0 {
+			delete(j.ids, ident)
+		}
+	}
+
+	data, err := json.Marshal(ackJournalFile{Identities: j.ids})
+	j.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path),
+		"."+filepath.Base(j.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// Write the journal, should there be one, logging any failure.
+func (j *ackJournal) flush() {
+	if j == nil {
+		return
+	}
+
+	if err := j.save(); err != nil {
+		log.Printf("cannot write acknowledgment journal: %v", err)
+	}
+}
+
+// Stop writing the journal, should there be one, leaving it to the
+// process replacing this one.
+func (j *ackJournal) stop() {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stopped = true
+}
+
+// Write the journal every ackJournalInterval until ctx is done.
+func (j *ackJournal) run(ctx context.Context) {
+	t := time.NewTicker(ackJournalInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		j.flush()
+	}
+}
+
+// A message handed to the drain client: a log record, with its
+// session and sequence number, or a message of the collector's own.
+type ackEntry struct {
+	record  bool
+	session string
+	seq     int64
+}
+
+// An http.RoundTripper tracking which of the messages of a connection
+// the drain acknowledged, recording those that are log records in the
+// journal.
+type ackTracker struct {
+	base  http.RoundTripper
+	j     *ackJournal
+	ident string
+
+	mu sync.Mutex
+	// Messages handed to the drain client but not yet posted or
+	// dropped, keyed by the number the client frames them with.
+	pending map[uint64]ackEntry
+
+	// The number of the next message handed to the drain client.
+	next uint64
+}
+
+// Track the messages of a connection to the drain of ident, should j
+// be non-nil, returning nil otherwise.
+func newAckTracker(base http.RoundTripper, j *ackJournal,
+	ident string) *ackTracker {
+	if j == nil {
+		return nil
+	}
+
+	return &ackTracker{base: base, j: j, ident: ident,
+		pending: make(map[uint64]ackEntry)}
+}
+
+// Record that lr, or a message of the collector's own should it be
+// nil, was handed to the drain client.
+func (at *ackTracker) buffered(lr *logRecord) {
+	if at == nil {
+		return
+	}
+
+	e := ackEntry{}
+	if lr != nil {
+		e = ackEntry{record: true, session: string(lr.SessionId),
+			seq: lr.SeqNum}
+		at.j.received(at.ident, e)
+	}
+
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.pending[at.next] = e
+	at.next++
+}
+
+// Remove the messages of span from those pending, returning them.
+func (at *ackTracker) take(span logplexc.BundleSpan) []ackEntry {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+
+	var taken []ackEntry
+	for i := span.First; i < span.First+span.Count; i++ {
+		if e, ok := at.pending[i]; ok {
+			taken = append(taken, e)
+			delete(at.pending, i)
+		}
+	}
+
+	return taken
+}
+
+// Forget the messages of a bundle the drain client dropped, which
+// the drain will never acknowledge.
+func (at *ackTracker) dropped(span logplexc.BundleSpan) {
+	if at == nil {
+		return
+	}
+
+	at.take(span)
+}
+
+func (at *ackTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests may be in flight at the same time, and bundles
+	// may be dropped, so the messages sent are those the client
+	// says the request carries.
+	span, ok := logplexc.BundleFromContext(req.Context())
+	if !ok {
+		return at.base.RoundTrip(req)
+	}
+	sent := at.take(span)
+
+	resp, err := at.base.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		at.j.acked(at.ident, sent)
+	}
+
+	return resp, err
+}
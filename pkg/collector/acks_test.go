@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestSeqRanges(t *testing.T) {
+	var rs seqRanges
+	for _, seq := range []int64{5, 3, 4, 9, 1, 7, 8, 12} {
+		rs = rs.add(seq)
+	}
+
+	want := seqRanges{{1, 1}, {3, 5}, {7, 9}, {12, 12}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Fatalf("Expected %v, got %v", want, rs)
+	}
+
+	// Filling a hole joins its neighbours.
+	rs = rs.add(6).add(2)
+	if want := (seqRanges{{1, 9}, {12, 12}}); !reflect.DeepEqual(rs,
+		want) {
+		t.Fatalf("Expected %v, got %v", want, rs)
+	}
+
+	gaps := rs.minus(seqRanges{{2, 3}, {6, 12}})
+	if got := gaps.String(); got != "1, 4-5" {
+		t.Fatalf("Unexpected gaps %q", got)
+	} else if gaps.count() != 3 {
+		t.Fatalf("Expected 3 missing, got %d", gaps.count())
+	}
+}
+
+// Responds to requests with each status in turn.
+type statusTripper []int
+
+func (st *statusTripper) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	code := (*st)[0]
+	*st = (*st)[1:]
+	return &http.Response{StatusCode: code, Body: http.NoBody}, nil
+}
+
+func TestAckJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acks")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "acks.json")
+	j := openAckJournal(path)
+	at := newAckTracker(&statusTripper{500, 204}, j, "ack-apple")
+
+	record := func(session string, seq int64) *logRecord {
+		lr := sampleLogRecord
+		lr.SessionId = []byte(session)
+		lr.SeqNum = seq
+		return &lr
+	}
+
+	post := func(first, count uint64) {
+		req, _ := http.NewRequestWithContext(
+			logplexc.ContextWithBundle(context.Background(),
+				logplexc.BundleSpan{First: first, Count: count}),
+			"POST", "http://drain", nil)
+		at.RoundTrip(req)
+	}
+
+	// The first request succeeds, carrying a message of the
+	// collector's own as well as the first of each session; the
+	// bundle after it is dropped, and the one after that fails.
+	// The failed request is made first, as requests in flight
+	// at the same time may be.
+	at.buffered(record("s1", 1))
+	at.buffered(nil)
+	at.buffered(record("s2", 1))
+	at.buffered(record("s1", 2))
+	at.buffered(record("s1", 3))
+	at.buffered(record("s1", 4))
+	at.dropped(logplexc.BundleSpan{First: 3, Count: 1})
+	post(4, 2)
+	post(0, 3)
+
+	if err := j.save(); err != nil {
+		t.Fatalf("Could not save: %v", err)
+	}
+
+	// Only the session with records never acknowledged is kept.
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "s2") {
+		t.Fatalf("Expected acknowledged sessions to be forgotten: %s",
+			data)
+	}
+
+	before := expvarInt(unackedRecords, "ack-apple")
+	reopened := openAckJournal(path)
+	if got := expvarInt(unackedRecords, "ack-apple"); got != before+3 {
+		t.Fatalf("Expected 3 records reported, got %d", got-before)
+	}
+
+	reports := reopened.takeReports("ack-apple")
+	if len(reports) != 1 || !strings.Contains(reports[0],
+		"session s1") || !strings.Contains(reports[0], "numbers 2-4") {
+		t.Fatalf("Unexpected reports %q", reports)
+	}
+
+	if reports := reopened.takeReports("ack-apple"); reports != nil {
+		t.Fatalf("Expected reports to be taken once, got %q", reports)
+	}
+
+	// A stopped journal is left to the process replacing it.
+	reopened.stop()
+	reopened.flush()
+	if after, _ := ioutil.ReadFile(path); string(after) != string(data) {
+		t.Fatalf("Expected a stopped journal to be left alone")
+	}
+}
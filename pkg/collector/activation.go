@@ -0,0 +1,239 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The first file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// Returned by the Accept of an activated socket's listener once its
+// generation has been cancelled.
+var errListenerRetired = errors.New("listener retired by reload")
+
+// A socket bound on our behalf by systemd and passed to the process
+// by socket activation; see sd_listen_fds(3).
+//
+// Such sockets outlive any one generation of listeners, and indeed
+// the process, so that clients can connect while the collector
+// restarts.  Accordingly they are never closed or unlinked.  Instead
+// a single goroutine accepts connections on each, handing them to
+// whichever generation's listener is current.
+type activatedSocket struct {
+	name  string
+	l     net.Listener
+	conns chan net.Conn
+	errs  chan error
+}
+
+// Activated sockets, keyed by both socket path and name.
+var activated = make(map[string]*activatedSocket)
+
+// Take the sockets passed by systemd, or by the process this one
+// replaces in an upgrade (see upgrade.go), should there be any.  The
+// variables passing them are unset, so that they are not inherited
+// by child processes.
+func activateFromEnv() error {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		os.Unsetenv(upgradeFdsVar)
+		os.Unsetenv(upgradeNamesVar)
+	}()
+
+	countVar, namesVar := "LISTEN_FDS", "LISTEN_FDNAMES"
+	if os.Getenv(upgradeFdsVar) != "" {
+		countVar, namesVar = upgradeFdsVar, upgradeNamesVar
+		upgraded = true
+	} else if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil ||
+		pid != os.Getpid() {
+		// Not for us.
+		return nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv(countVar))
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid %s %q", countVar,
+			os.Getenv(countVar))
+	}
+
+	var names []string
+	if v := os.Getenv(namesVar); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFdsStart+i),
+			"LISTEN_FD_"+strconv.Itoa(listenFdsStart+i))
+	}
+
+	files, names, err = inheritFiles(files, names)
+	if err != nil {
+		return err
+	}
+
+	socks, err := activateFiles(files, names)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range socks {
+		log.Printf("using activated socket %q (name %q)",
+			a.l.Addr(), a.name)
+		activated[a.l.Addr().String()] = a
+		if a.name != "" {
+			activated[a.name] = a
+		}
+
+		if ul, ok := a.l.(*net.UnixListener); ok {
+			registerHandoff(a.l.Addr().String(), ul)
+		}
+	}
+
+	return nil
+}
+
+// Keep aside the listening sockets serving the collector as a whole
+// among files, named by the corresponding elements of names, for it
+// to take as it starts serving, returning the others with their
+// names.
+func inheritFiles(files []*os.File, names []string) ([]*os.File,
+	[]string, error) {
+	var rest []*os.File
+	var restNames []string
+	for i, f := range files {
+		if i >= len(names) || !isCollectorHandoff(names[i]) {
+			rest = append(rest, f)
+			if i < len(names) {
+				restNames = append(restNames, names[i])
+			}
+
+			continue
+		}
+
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("passed file descriptor "+
+				"for %q is not a listening socket: %v",
+				names[i], err)
+		}
+
+		log.Printf("using passed socket %q (name %q)", l.Addr(),
+			names[i])
+		inherited.Lock()
+		inherited.m[names[i]] = l
+		inherited.Unlock()
+	}
+
+	return rest, restNames, nil
+}
+
+// Start accepting on listening sockets passed as files, named by the
+// corresponding elements of names, if any.
+func activateFiles(files []*os.File, names []string) (
+	[]*activatedSocket, error) {
+	socks := make([]*activatedSocket, 0, len(files))
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("activated file descriptor %d "+
+				"is not a listening socket: %v", f.Fd(), err)
+		}
+
+		a := &activatedSocket{
+			l:     l,
+			conns: make(chan net.Conn),
+			errs:  make(chan error),
+		}
+
+		if i < len(names) {
+			a.name = names[i]
+		}
+
+		go a.accept()
+		socks = append(socks, a)
+	}
+
+	return socks, nil
+}
+
+func (a *activatedSocket) accept() {
+	for {
+		conn, err := a.l.Accept()
+		if err != nil {
+			a.errs <- err
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		a.conns <- conn
+	}
+}
+
+// Find the activated socket for sr, matching its socket path, or
+// failing that its name.
+func activatedFor(sr *serveRecord) *activatedSocket {
+	if a, ok := activated[sr.P]; ok {
+		return a
+	}
+
+	if sr.Name != "" {
+		if a, ok := activated[sr.Name]; ok && a.name == sr.Name {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// Report whether the socket at path is owned by systemd, and so must
+// not be unlinked.
+func isActivated(path string) bool {
+	a, ok := activated[path]
+	return ok && a.l.Addr().String() == path
+}
+
+// A listener for a single generation on an activated socket, which
+// stops accepting once ctx is cancelled.
+type activatedListener struct {
+	a   *activatedSocket
+	ctx context.Context
+}
+
+func (a *activatedSocket) listener(ctx context.Context) net.Listener {
+	return &activatedListener{a: a, ctx: ctx}
+}
+
+func (al *activatedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-al.a.conns:
+		return conn, nil
+	case err := <-al.a.errs:
+		return nil, err
+	case <-al.ctx.Done():
+		return nil, errListenerRetired
+	}
+}
+
+// The socket belongs to systemd, and so is left open.
+func (al *activatedListener) Close() error {
+	return nil
+}
+
+func (al *activatedListener) Addr() net.Addr {
+	return al.a.l.Addr()
+}
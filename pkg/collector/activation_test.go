@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestActivatedSocket(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	// Stand in for systemd, binding a socket and passing it on as
+	// a file.
+	path := filepath.Join(name, "log.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	f, err := l.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatalf("Could not get listener's file: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	socks, err := activateFiles([]*os.File{f}, []string{"apple"})
+	if err != nil {
+		t.Fatalf("Could not activate: %v", err)
+	}
+	a := socks[0]
+
+	defer func(saved map[string]*activatedSocket) {
+		activated = saved
+	}(activated)
+	activated = map[string]*activatedSocket{path: a, "apple": a}
+
+	if !isActivated(path) || isActivated("apple") {
+		t.Fatal("Expected only the socket path to be activated")
+	}
+
+	for _, sr := range []*serveRecord{
+		{sKey: sKey{P: path}},
+		{sKey: sKey{P: "/elsewhere.sock"}, Name: "apple"},
+	} {
+		if activatedFor(sr) != a {
+			t.Fatalf("Expected %+v to match activated socket", sr)
+		}
+	}
+
+	if activatedFor(&serveRecord{sKey: sKey{P: "/other.sock"}}) != nil {
+		t.Fatal("Expected unrelated record not to match")
+	}
+
+	// The current generation receives connections...
+	ctx, cancel := context.WithCancel(context.Background())
+	gen := a.listener(ctx)
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := gen.Accept()
+	if err != nil {
+		t.Fatalf("Could not accept: %v", err)
+	}
+	conn.Close()
+
+	// ...until it is retired, leaving the socket open for the
+	// next generation.
+	cancel()
+	gen.Close()
+	if _, err := gen.Accept(); err != errListenerRetired {
+		t.Fatalf("Expected retired listener, got %v", err)
+	}
+
+	next := a.listener(context.Background())
+	c2, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Could not connect to next generation: %v", err)
+	}
+	defer c2.Close()
+
+	if conn, err := next.Accept(); err != nil {
+		t.Fatalf("Next generation could not accept: %v", err)
+	} else {
+		conn.Close()
+	}
+}
@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Describe every live client connection as a JSON list.
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(connSnapshots()); err != nil {
+		log.Printf("could not write admin response: %v", err)
+	}
+}
+
+// Describe the recently forwarded messages of each serve record,
+// optionally restricted to those with the "identity" query parameter.
+func handleRecent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	err := enc.Encode(recentMessages(r.URL.Query().Get("identity")))
+	if err != nil {
+		log.Printf("could not write admin response: %v", err)
+	}
+}
+
+// The handlers of the admin interface, kept off http.DefaultServeMux
+// so that a program embedding the collector does not serve them on
+// its own servers.  As it reveals the text of tenants' logs to anyone
+// who can reach the interface, /recent is served only should
+// RECENT_MESSAGES ask for messages to be retained.
+func newAdminMux(sdb *serveDbSet) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/connections", handleConnections)
+	if recentMessagesPerRecord > 0 {
+		mux.HandleFunc("/recent", handleRecent)
+	}
+	mux.Handle("/status", statusHandler(sdb))
+	return mux
+}
+
+// Listen for admin requests on addr, which is either a TCP address or
+// a unix socket path prefixed with "unix:".
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		p := strings.TrimPrefix(addr, "unix:")
+
+		// Like log sockets, the admin socket is owned by
+		// this process: clean up after any prior instance.
+		os.Remove(p)
+		return net.Listen("unix", p)
+	}
+
+	return net.Listen("tcp", addr)
+}
+
+// Listen for admin requests on addr, taking the socket passed by the
+// process this one replaces should there be one, and registering it
+// to be passed on in turn.
+func listenAdminHandoff(addr string) (net.Listener, error) {
+	if l, ok := takeInherited(adminHandoff); ok {
+		return l, nil
+	}
+
+	l, err := listenAdmin(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hl, ok := l.(handoffListener); ok {
+		registerHandoff(adminHandoff, hl)
+	}
+
+	return l, nil
+}
+
+// The read-only admin HTTP interface, including expvar's /debug/vars
+// and the /status of the records of sdb, served until closed.
+type adminServer struct {
+	srv *http.Server
+
+	mu     sync.Mutex
+	closed bool
+
+	// Receives the error of the server, should it fail before it
+	// is closed.
+	errs chan error
+}
+
+func newAdminServer(sdb *serveDbSet) *adminServer {
+	return &adminServer{
+		srv:  &http.Server{Handler: newAdminMux(sdb)},
+		errs: make(chan error, 1),
+	}
+}
+
+// Serve admin requests accepted from l, unless already closed.
+func (a *adminServer) serve(l net.Listener) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		l.Close()
+		return
+	}
+
+	go func() {
+		err := a.srv.Serve(l)
+		if err != http.ErrServerClosed {
+			a.errs <- err
+		}
+	}()
+}
+
+// Listen on addr, retrying until it is bound or ctx is done, as when
+// the process this one replaces holds it still, then serve.
+func (a *adminServer) retry(ctx context.Context, addr string) {
+	var backoff time.Duration
+	for {
+		l, err := listenAdminHandoff(addr)
+		if err == nil {
+			log.Printf("listening for admin requests on %q", addr)
+			a.serve(l)
+			return
+		}
+
+		backoff = nextBackoff(backoff, rebindBackoffMax)
+		log.Printf("cannot listen for admin requests on %q, "+
+			"retrying in %v: %v", addr, backoff, err)
+		if sleepOrDone(ctx, backoff) {
+			return
+		}
+	}
+}
+
+// Stop serving, closing the listener and any open connections.
+func (a *adminServer) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.closed = true
+	a.srv.Close()
+}
@@ -0,0 +1,80 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectionsEndpoint(t *testing.T) {
+	cs := registerConn("/p1/log.sock", nil)
+	cs.Ident = "apple"
+	cs.forwarded(42)
+	defer cs.unregister()
+
+	rec := httptest.NewRecorder()
+	handleConnections(rec, httptest.NewRequest("GET", "/connections", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected OK, got %d", rec.Code)
+	}
+
+	var got []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Expected a JSON list, got %q: %v", rec.Body, err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("Expected one connection, got %v", got)
+	}
+
+	if got[0]["identity"] != "apple" || got[0]["socket"] != "/p1/log.sock" ||
+		got[0]["bytes"] != 42.0 {
+		t.Fatalf("Unexpected connection description: %v", got[0])
+	}
+
+	rec = httptest.NewRecorder()
+	handleConnections(rec, httptest.NewRequest("POST", "/connections", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected POST to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAdminMuxIsPrivate(t *testing.T) {
+	defer func(n int) { recentMessagesPerRecord = n }(recentMessagesPerRecord)
+	recentMessagesPerRecord = 1
+
+	mux := newAdminMux(newServeDbSet())
+	for _, path := range []string{"/connections", "/recent",
+		"/debug/vars"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected OK from %s, got %d", path, rec.Code)
+		}
+
+		// expvar registers its own handler on the default mux.
+		if path == "/debug/vars" {
+			continue
+		}
+
+		if _, pattern := http.DefaultServeMux.Handler(
+			httptest.NewRequest("GET", path, nil)); pattern == path {
+			t.Fatalf("Expected %s not to be registered on "+
+				"http.DefaultServeMux", path)
+		}
+	}
+}
+
+func TestAdminMuxRecentOptIn(t *testing.T) {
+	defer func(n int) { recentMessagesPerRecord = n }(recentMessagesPerRecord)
+	recentMessagesPerRecord = 0
+
+	// Log text is not served unless retained by request.
+	rec := httptest.NewRecorder()
+	newAdminMux(newServeDbSet()).ServeHTTP(rec,
+		httptest.NewRequest("GET", "/recent", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected /recent to be absent, got %d", rec.Code)
+	}
+}
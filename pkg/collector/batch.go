@@ -0,0 +1,151 @@
+package collector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Limits on a batch of messages accumulated before it is handed to
+// the drain client.  A batch is flushed when either size limit is
+// reached, or when its oldest message has waited batchMaxDelay.
+const (
+	batchMaxMessages = 64
+	batchMaxBytes    = 32 * KB
+	batchMaxDelay    = 20 * time.Millisecond
+)
+
+// Accumulates formatted messages for a single connection and hands
+// them to the drain client in batches, amortizing the client's
+// locking and flush checks over many messages.
+type batcher struct {
+	lpc      *logplexc.Client
+	maxDelay time.Duration
+
+	mu   sync.Mutex
+	msgs []logplexc.Message
+
+	// Backing storage for the text of msgs, reused batch to
+	// batch.
+	arena []byte
+
+	timer *time.Timer
+
+	// Tracks acknowledgment of the messages handed to lpc, should
+	// acknowledgments be journaled.
+	acks *ackTracker
+
+	// Times the delivery of the messages handed to lpc.
+	timing *deliveryTimer
+}
+
+func newBatcher(lpc *logplexc.Client, maxDelay time.Duration) *batcher {
+	return &batcher{
+		lpc:      lpc,
+		maxDelay: maxDelay,
+		msgs:     make([]logplexc.Message, 0, batchMaxMessages),
+		arena:    make([]byte, 0, batchMaxBytes),
+	}
+}
+
+// Add a message to the batch.  The text of the message is copied, so
+// the caller may reuse it upon return.
+func (b *batcher) add(priority int, when time.Time, host string,
+	procId string, text []byte) error {
+	return b.addMessage(logplexc.Message{
+		Priority: priority,
+		When:     when,
+		Host:     host,
+		ProcId:   procId,
+		Log:      text,
+	})
+}
+
+// Add m to the batch, as with add, copying its structured data as
+// well as its text.
+func (b *batcher) addMessage(m logplexc.Message) error {
+	return b.addRecord(m, nil, time.Time{}, nil)
+}
+
+// Add m, the message of lr, received from the client at received and
+// traced by sp, to the batch, as with addMessage, so that the drain's
+// acknowledgment of lr and the latency of its delivery are tracked.
+func (b *batcher) addRecord(m logplexc.Message, lr *logRecord,
+	received time.Time, sp *span) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Should the arena need to grow, earlier messages continue
+	// to refer to its previous backing array, which is fine.
+	if len(m.StructuredData) > 0 {
+		start := len(b.arena)
+		b.arena = append(b.arena, m.StructuredData...)
+		m.StructuredData = b.arena[start:len(b.arena):len(b.arena)]
+	}
+
+	start := len(b.arena)
+	b.arena = append(b.arena, m.Log...)
+	m.Log = b.arena[start:len(b.arena):len(b.arena)]
+
+	b.msgs = append(b.msgs, m)
+
+	// Messages are handed to lpc in the order they are added.
+	b.acks.buffered(lr)
+	b.timing.buffered(received, sp)
+
+	if len(b.msgs) >= batchMaxMessages || len(b.arena) >= batchMaxBytes {
+		return b.flushLocked()
+	}
+
+	// Bound the latency added by batching.
+	if len(b.msgs) == 1 {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.maxDelay, b.onDeadline)
+		} else {
+			b.timer.Reset(b.maxDelay)
+		}
+	}
+
+	return nil
+}
+
+func (b *batcher) onDeadline() {
+	// Errors are detected by the connection's next add, or
+	// when it flushes at exit.
+	b.flush()
+}
+
+// Hand any accumulated messages to the drain client.
+func (b *batcher) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flushLocked()
+}
+
+func (b *batcher) flushLocked() error {
+	if len(b.msgs) == 0 {
+		return nil
+	}
+
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	err := b.lpc.BufferMessages(b.msgs)
+
+	// Clear references to the arena before reusing it.
+	for i := range b.msgs {
+		b.msgs[i] = logplexc.Message{}
+	}
+
+	b.msgs = b.msgs[:0]
+	if cap(b.arena) > maxPooledBufSize {
+		b.arena = make([]byte, 0, batchMaxBytes)
+	} else {
+		b.arena = b.arena[:0]
+	}
+
+	return err
+}
@@ -0,0 +1,139 @@
+package collector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// A drain recording the bodies of the requests made to it.
+type recordingDrain struct {
+	*httptest.Server
+	bodies chan string
+}
+
+func newRecordingDrain() *recordingDrain {
+	d := &recordingDrain{bodies: make(chan string, 100)}
+	d.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			d.bodies <- string(body)
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	return d
+}
+
+// Create a client that posts to d immediately on every buffering.
+func (d *recordingDrain) client(t *testing.T) *logplexc.Client {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		t.Fatalf("Could not parse test server URL: %v", err)
+	}
+	u.User = url.UserPassword("token", "t.test")
+
+	client, err := logplexc.NewClient(&logplexc.Config{
+		Logplex:     *u,
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		TimeTrigger: logplexc.TimeTriggerImmediate,
+	})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	// The client supplies its work tokens asynchronously, and
+	// drops requests made before they are available.
+	time.Sleep(10 * time.Millisecond)
+
+	return client
+}
+
+func (d *recordingDrain) next(t *testing.T) string {
+	select {
+	case body := <-d.bodies:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for drain request")
+	}
+
+	panic("unreachable")
+}
+
+func TestBatcherDeadline(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	bt := newBatcher(d.client(t), 10*time.Millisecond)
+
+	// Reusing the text buffer must not corrupt batched messages.
+	text := []byte("first")
+	bt.add(134, time.Now(), "postgres", "postgres.1", text)
+	copy(text, "XXXXX")
+	bt.add(134, time.Now(), "postgres", "postgres.1", []byte("second"))
+
+	body := d.next(t)
+	if !strings.Contains(body, "first") ||
+		!strings.Contains(body, "second") ||
+		strings.Contains(body, "XXXXX") {
+		t.Fatalf("Expected both messages in one request, got %q", body)
+	}
+}
+
+func TestBatcherSizeLimit(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	// A deadline long enough that only the size limit can
+	// explain a flush.
+	bt := newBatcher(d.client(t), time.Hour)
+
+	for i := 0; i < batchMaxMessages; i += 1 {
+		bt.add(134, time.Now(), "postgres", "postgres.1",
+			[]byte("message"))
+	}
+
+	body := d.next(t)
+	if n := strings.Count(body, "message"); n != batchMaxMessages {
+		t.Fatalf("Expected %d messages in request, got %d",
+			batchMaxMessages, n)
+	}
+
+	// An explicit flush sends whatever is left.
+	bt.add(134, time.Now(), "postgres", "postgres.1",
+		bytes.Repeat([]byte("z"), 10))
+	bt.flush()
+	if body := d.next(t); !strings.Contains(body, "zzzzzzzzzz") {
+		t.Fatalf("Expected flushed message, got %q", body)
+	}
+}
+
+func TestBatcherStructuredData(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	bt := newBatcher(d.client(t), time.Hour)
+
+	// The batcher must copy both, as they are reused.
+	sd := []byte(`[pg@32473 sqlstate="42P01"]`)
+	text := []byte("message")
+	bt.addMessage(logplexc.Message{Priority: 134, When: time.Now(),
+		Host: "postgres", ProcId: "postgres.1", MsgId: "query",
+		StructuredData: sd, Log: text})
+	copy(sd, "xxxxxxxxxx")
+	copy(text, "xxxxxxx")
+	bt.flush()
+
+	body := d.next(t)
+	want := ` postgres.1 query [pg@32473 sqlstate="42P01"] message`
+	if !strings.HasSuffix(body, want) {
+		t.Fatalf("Expected message ending %q, got %q", want, body)
+	}
+}
@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deafbybeheading/femebe/buf"
+)
+
+// Capabilities follow the version string in the version message, as
+// further strings of the form name=value, advertising optional
+// protocol features the client uses.  Those not known are ignored, so
+// that a client may advertise them to any collector.
+
+// The optional protocol features a client advertises, and the version
+// it advertises them with.
+type capabilities struct {
+	// The version string, such as "PG-9.4.0/logfebe-1".
+	version string
+
+	// How often the client sends a message at least; zero if it
+	// does not promise to.
+	keepalive time.Duration
+
+	// Whether each log record begins with its checksum.
+	checksum bool
+}
+
+// Read the capabilities following the version string in r, the
+// payload of a version message.
+func parseCapabilities(r io.Reader) (capabilities, error) {
+	var caps capabilities
+	for {
+		s, err := buf.ReadCString(r)
+		if err == io.EOF {
+			return caps, nil
+		} else if err != nil {
+			return caps, protocolErrorf("couldn't read capability: %v",
+				err)
+		}
+
+		name, value, _ := strings.Cut(s, "=")
+		switch name {
+		case "keepalive":
+			secs, err := strconv.Atoi(value)
+			d := time.Duration(secs) * time.Second
+			if err != nil || d < minKeepalive || d > maxKeepalive {
+				return caps, protocolErrorf("invalid keepalive "+
+					"interval %q", value)
+			}
+
+			caps.keepalive = d
+
+		case "checksum":
+			if value != "crc32c" {
+				return caps, protocolErrorf("unsupported "+
+					"checksum %q", value)
+			}
+
+			caps.checksum = true
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A capture file records the raw bytes received from logfebe clients,
+// for offline analysis and for building regression corpora.  It is
+// enabled per serve record by the "capture" key.
+//
+// The file begins with captureMagic, followed by any number of
+// records, each with a fixed-size header:
+//
+//	kind:       1 byte; 'C' for connect, 'D' for data, 'E' for end
+//	connection: 8 bytes, big-endian; distinguishes connections
+//	            sharing a capture file
+//	time:       8 bytes, big-endian Unix nanoseconds
+//	length:     4 bytes, big-endian length of the data to follow
+//
+// Concatenating the data of every 'D' record of a connection yields
+// the byte stream as it was received on the socket.
+const captureMagic = "pg_logplexcollector capture 1\n"
+
+const (
+	captureConnect = 'C'
+	captureData    = 'D'
+	captureEnd     = 'E'
+)
+
+const captureHeaderSize = 1 + 8 + 8 + 4
+
+type captureRecord struct {
+	Kind byte
+	Conn uint64
+	Time time.Time
+	Data []byte
+}
+
+// Source of capture connection identifiers, unique within a process.
+var captureConnSeq uint64
+
+// Appends capture records for a single connection.
+type captureWriter struct {
+	mu   sync.Mutex
+	f    *os.File
+	conn uint64
+}
+
+func openCapture(path string) (*captureWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.Size() == 0 {
+		if _, err := f.Write([]byte(captureMagic)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	// Mix the time into the identifier so that connections from
+	// successive collector processes don't collide.
+	conn := uint64(time.Now().UnixNano())<<16 |
+		atomic.AddUint64(&captureConnSeq, 1)&0xffff
+
+	cw := &captureWriter{f: f, conn: conn}
+	if err := cw.record(captureConnect, nil); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+// Append a record, in a single write so that records of connections
+// sharing a file are not interleaved.
+func (cw *captureWriter) record(kind byte, data []byte) error {
+	rec := make([]byte, captureHeaderSize+len(data))
+	rec[0] = kind
+	binary.BigEndian.PutUint64(rec[1:9], cw.conn)
+	binary.BigEndian.PutUint64(rec[9:17], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(rec[17:21], uint32(len(data)))
+	copy(rec[captureHeaderSize:], data)
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	_, err := cw.f.Write(rec)
+	return err
+}
+
+func (cw *captureWriter) Close() error {
+	err := cw.record(captureEnd, nil)
+	if e := cw.f.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Tees everything read from a connection into a capture file.
+// Capture is best-effort: a failure to write the capture disables it
+// for the rest of the connection rather than disturbing delivery.
+type captureConn struct {
+	io.ReadWriteCloser
+	cw     *captureWriter
+	failed bool
+}
+
+func newCaptureConn(rwc io.ReadWriteCloser, cw *captureWriter) *captureConn {
+	return &captureConn{ReadWriteCloser: rwc, cw: cw}
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	if n > 0 && !c.failed {
+		if e := c.cw.record(captureData, p[:n]); e != nil {
+			c.failed = true
+			logCaptureFailure(c.cw, e)
+		}
+	}
+
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	if e := c.cw.Close(); e != nil && !c.failed {
+		logCaptureFailure(c.cw, e)
+	}
+
+	return c.ReadWriteCloser.Close()
+}
+
+func logCaptureFailure(cw *captureWriter, err error) {
+	log.Printf("capture to %q disabled for connection: %v",
+		cw.f.Name(), err)
+}
+
+var errBadCaptureMagic = errors.New("not a pg_logplexcollector capture file")
+
+// Reads the records of a capture file.
+type captureReader struct {
+	r *bufio.Reader
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errBadCaptureMagic
+	}
+
+	if string(magic) != captureMagic {
+		return nil, errBadCaptureMagic
+	}
+
+	return &captureReader{r: br}, nil
+}
+
+// Read the next record, returning io.EOF at the end of the file.
+func (cr *captureReader) Next() (*captureRecord, error) {
+	var hdr [captureHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, hdr[:1]); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(cr.r, hdr[1:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rec := &captureRecord{
+		Kind: hdr[0],
+		Conn: binary.BigEndian.Uint64(hdr[1:9]),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(hdr[9:17]))),
+		Data: make([]byte, binary.BigEndian.Uint32(hdr[17:21])),
+	}
+
+	switch rec.Kind {
+	case captureConnect, captureData, captureEnd:
+	default:
+		return nil, fmt.Errorf("unknown capture record kind %q",
+			rec.Kind)
+	}
+
+	if _, err := io.ReadFull(cr.r, rec.Data); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return rec, nil
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// An in-memory io.ReadWriteCloser standing in for a client connection.
+type bufConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *bufConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestCaptureRoundTrip(t *testing.T) {
+	dir := newTmpDb(t)
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "capture")
+
+	// Two connections appending to the same file.
+	streams := []string{"first stream of bytes", "second"}
+	for _, s := range streams {
+		cw, err := openCapture(p)
+		if err != nil {
+			t.Fatalf("Could not open capture: %v", err)
+		}
+
+		conn := &bufConn{}
+		conn.WriteString(s)
+		cc := newCaptureConn(conn, cw)
+
+		// Read in small chunks to produce several records.
+		if _, err := io.CopyBuffer(ioutil.Discard,
+			struct{ io.Reader }{cc}, make([]byte, 4)); err != nil {
+			t.Fatalf("Could not read through capture: %v", err)
+		}
+
+		cc.Close()
+		if !conn.closed {
+			t.Fatal("Expected underlying connection to be closed")
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatalf("Could not open capture for reading: %v", err)
+	}
+	defer f.Close()
+
+	cr, err := newCaptureReader(f)
+	if err != nil {
+		t.Fatalf("Could not read capture: %v", err)
+	}
+
+	got := make(map[uint64]*bytes.Buffer)
+	var order []uint64
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Could not read capture record: %v", err)
+		}
+
+		switch rec.Kind {
+		case captureConnect:
+			got[rec.Conn] = &bytes.Buffer{}
+			order = append(order, rec.Conn)
+		case captureData:
+			got[rec.Conn].Write(rec.Data)
+		}
+	}
+
+	if len(order) != len(streams) {
+		t.Fatalf("Expected %d connections, got %d",
+			len(streams), len(order))
+	}
+
+	for i, conn := range order {
+		if got[conn].String() != streams[i] {
+			t.Errorf("Connection %d: got %q, want %q",
+				i, got[conn], streams[i])
+		}
+	}
+}
+
+func TestCaptureBadMagic(t *testing.T) {
+	_, err := newCaptureReader(bytes.NewBufferString("nonsense"))
+	if err != errBadCaptureMagic {
+		t.Fatalf("Expected bad magic error, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package collector
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"hash/crc32"
+)
+
+// A client advertising checksum=crc32c begins the payload of each log
+// record with the CRC-32C, big-endian, of the rest of it.  Postgres
+// computes this checksum for its own WAL, so it is at hand for clients
+// built with it.  A record whose checksum does not match is counted
+// and skipped, rather than forwarded with fields that may have been
+// corrupted, or disconnecting a client whose further records are
+// likely intact.
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Count of log records skipped for not matching their checksums,
+// keyed by identity.
+var corruptRecords = expvar.NewMap("corrupt_records")
+
+// Reported for a log record not matching its checksum.
+var errCorruptRecord = errors.New("log record does not match its checksum")
+
+// The size of the checksum beginning a log record.
+const checksumSize = 4
+
+// Check that payload, that of a log record, matches the checksum it
+// begins with, returning the record that follows.
+func verifyChecksum(payload []byte) ([]byte, error) {
+	if len(payload) < checksumSize {
+		return nil, protocolErrorf("log record too short for its " +
+			"checksum")
+	}
+
+	record := payload[checksumSize:]
+	if crc32.Checksum(record, castagnoli) !=
+		binary.BigEndian.Uint32(payload) {
+		return nil, errCorruptRecord
+	}
+
+	return record, nil
+}
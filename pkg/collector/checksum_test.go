@@ -0,0 +1,119 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Prefix record with its checksum.
+func checksummed(record []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil,
+		crc32.Checksum(record, castagnoli))
+	return append(b, record...)
+}
+
+func TestRecordReaderChecksum(t *testing.T) {
+	data := checksummed(encodeLogRecord(&sampleLogRecord))
+
+	// Corrupting a byte of a string, or a terminator, whose
+	// record would fail to parse.
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0x20
+	broken := append([]byte{}, data...)
+	broken[bytes.IndexByte(broken[checksumSize:], 0)+checksumSize] = 'x'
+
+	rr := newRecordReader()
+	rr.checksum = true
+	var lr logRecord
+	var m core.Message
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"intact", data, nil},
+		{"corrupt", corrupt, errCorruptRecord},
+		{"broken", broken, errCorruptRecord},
+		{"intact again", data, nil},
+	} {
+		m.InitFromBytes('L', tt.data)
+		if _, err := rr.read(&lr, &m); err != tt.want {
+			t.Errorf("%s, buffered: expected %v, got %v", tt.name,
+				tt.want, err)
+		}
+
+		m.InitPromise('L', uint32(len(tt.data)+4), tt.data[:3],
+			bytes.NewReader(tt.data[3:]))
+		if _, err := rr.read(&lr, &m); err != tt.want {
+			t.Errorf("%s, streamed: expected %v, got %v", tt.name,
+				tt.want, err)
+		} else if err == nil && !reflect.DeepEqual(lr,
+			sampleLogRecord) {
+			t.Errorf("%s: got %s", tt.name, lr.oneLine())
+		}
+	}
+
+	m.InitFromBytes('L', data[:2])
+	if _, err := rr.read(&lr, &m); err == nil ||
+		err == errCorruptRecord {
+		t.Fatalf("Expected a record too short to be refused, got %v",
+			err)
+	}
+}
+
+func TestSkipCorruptRecords(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	sr := &serveRecord{sKey: sKey{I: "crc-apple", P: "/a/log.sock"},
+		u: *u}
+	cfg := logplexc.Config{
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		Period:      10 * time.Millisecond,
+	}
+
+	second := sampleLogRecord
+	second.ErrMessage = []byte("second message")
+	corrupt := checksummed(encodeLogRecord(&sampleLogRecord))
+	corrupt[len(corrupt)-2] ^= 1
+
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write(frameMsg('V',
+			[]byte("PG-9.4.0/logfebe-1\x00checksum=crc32c\x00")))
+		client.Write(frameMsg('I', []byte("crc-apple\x00")))
+		client.Write(frameMsg('L', corrupt))
+		client.Write(frameMsg('L',
+			checksummed(encodeLogRecord(&second))))
+	}()
+
+	before := expvarInt(corruptRecords, "crc-apple")
+	logWorker(context.Background(), server, cfg, sr)
+
+	if body := d.next(t); strings.Contains(body,
+		string(sampleLogRecord.ErrMessage)) ||
+		!strings.Contains(body, "second message") {
+		t.Fatalf("Expected only the intact record, got %q", body)
+	}
+
+	if got := expvarInt(corruptRecords, "crc-apple"); got != before+1 {
+		t.Fatalf("Expected one corrupt record, got %d", got-before)
+	}
+}
@@ -0,0 +1,879 @@
+// Package collector receives the logs of Postgres servers, sent over
+// Unix sockets by the pg_logfebe extension, and forwards them to
+// Logplex drains, as directed by serve records.  It is the whole of
+// pg_logplexcollector, whose binary is a thin wrapper around it, and
+// may be embedded by control planes that would rather run the
+// pipeline themselves than supervise the binary.
+//
+// Settings, metrics and connections are kept per process, so a
+// process runs at most one Collector at a time: New and Run refuse
+// while another runs.
+package collector
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A Collector serves the sockets of the serve records of its serve
+// databases, and of any set programmatically.
+type Collector struct {
+	// The serve database directories, or nil to take them from
+	// the settings.
+	dirs []string
+
+	// The configuration file the settings were read from, if
+	// any, which a sandbox must leave readable.
+	configPath string
+
+	// How often to check for a new serve database, or zero to
+	// take it from the settings.
+	pollInterval time.Duration
+
+	// Signals to stop, or upgrade, on; nil to be notified of
+	// them by the os/signal package.
+	signals <-chan os.Signal
+
+	sdb *serveDbSet
+
+	memoryCeiling   uint64
+	restartInterval time.Duration
+	restartJitter   time.Duration
+	sandbox         bool
+	tcpAddr         string
+	tcpCert         *tls.Certificate
+	grpcAddr        string
+	ackJournal      string
+	controlSocket   string
+	adminAddr       string
+	tracing         *tracerConfig
+}
+
+// An Option configures a Collector on creation.
+type Option func(c *Collector) error
+
+// Serve the records of the serve databases in dirs, rather than
+// those named by SERVE_DB_DIR or SERVE_DB_DIRS.  Should several be
+// given, they are merged as for SERVE_DB_DIRS.
+func WithServeDbDirs(dirs ...string) Option {
+	return func(c *Collector) error {
+		c.dirs = append([]string(nil), dirs...)
+		return nil
+	}
+}
+
+// Read settings from the configuration file at path, as with the
+// binary's --config.  The environment takes precedence over them.
+func WithConfigFile(path string) Option {
+	return func(c *Collector) error {
+		settings, err := loadConfig(path)
+		if err != nil {
+			return fmt.Errorf("cannot load configuration file "+
+				"%q: %v", path, err)
+		}
+
+		fileSettings = settings
+		c.configPath = path
+		return nil
+	}
+}
+
+// Use settings, keyed by environment variable name, in place of any
+// from a configuration file.  The environment takes precedence over
+// them.
+func WithSettings(settings map[string]string) Option {
+	return func(c *Collector) error {
+		fileSettings = make(map[string]string, len(settings))
+		for k, v := range settings {
+			fileSettings[k] = v
+		}
+
+		return nil
+	}
+}
+
+// Check for a new serve database every d, rather than every
+// SERVE_DB_POLL_INTERVAL.
+func WithPollInterval(d time.Duration) Option {
+	return func(c *Collector) error {
+		if d <= 0 {
+			return fmt.Errorf("poll interval must be positive, "+
+				"got %v", d)
+		}
+
+		c.pollInterval = d
+		return nil
+	}
+}
+
+// Shut down, or upgrade on syscall.SIGUSR2, on the signals received
+// from ch, rather than on those the process receives.
+func WithSignals(ch <-chan os.Signal) Option {
+	return func(c *Collector) error {
+		c.signals = ch
+		return nil
+	}
+}
+
+// Returned by Run should the collector stop with a status other than
+// success, which the binary exits with.
+type ExitError struct {
+	Code   int
+	Reason string
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("%s (status %d)", e.Reason, e.Code)
+}
+
+// Create a Collector, checking its settings.  Nothing is served until
+// Run is called.
+func New(opts ...Option) (*Collector, error) {
+	// Configuring one would change the settings of that running.
+	if err := checkNoneRunning(); err != nil {
+		return nil, err
+	}
+
+	c := &Collector{}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.dirs == nil {
+		if setting("SERVE_DB_DIR") != "" &&
+			setting("SERVE_DB_DIRS") != "" {
+			return nil, fmt.Errorf("SERVE_DB_DIR and " +
+				"SERVE_DB_DIRS are mutually exclusive")
+		}
+
+		c.dirs = serveDbDirs()
+	}
+
+	// Use sockets passed by systemd, should there be any.
+	if err := activateFromEnv(); err != nil {
+		return nil, fmt.Errorf("cannot use activated sockets: %v", err)
+	}
+
+	c.sdb = newServeDbSet(c.dirs...)
+
+	if err := c.configure(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Apply the settings.
+func (c *Collector) configure() error {
+	// How often to check for a new serve database, and how long
+	// a submission must go unchanged before it is loaded.
+	if c.pollInterval == 0 {
+		c.pollInterval = 10 * time.Second
+		if v := setting("SERVE_DB_POLL_INTERVAL"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("SERVE_DB_POLL_INTERVAL "+
+					"must be a positive duration, such "+
+					"as \"10s\": %v", v)
+			}
+
+			c.pollInterval = d
+		}
+	}
+
+	if v := setting("SERVE_DB_DEBOUNCE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("SERVE_DB_DEBOUNCE must be a "+
+				"non-negative duration, such as \"5s\": %v", v)
+		}
+
+		c.sdb.setDebounce(d)
+	}
+
+	// Optionally provision drains for records submitted without.
+	prov, err := provisionerFromSettings()
+	if err != nil {
+		return fmt.Errorf("cannot provision tokens: %v", err)
+	} else if prov != nil {
+		c.sdb.setProvisioner(prov)
+	}
+
+	// Optionally override the clock skew reporting threshold.
+	if v := setting("CLOCK_SKEW_THRESHOLD"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("CLOCK_SKEW_THRESHOLD must be a "+
+				"duration, such as \"1m\" or \"0\" to "+
+				"disable: %v", err)
+		}
+
+		clockSkewThreshold = d
+	}
+
+	// Optionally override the stalled worker timeout.
+	if v := setting("WORKER_STALL_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("WORKER_STALL_TIMEOUT must be a "+
+				"duration, such as \"5m\" or \"0\" to "+
+				"disable: %v", err)
+		}
+
+		workerStallTimeout = d
+	}
+
+	// Optionally override how long a drain request may take.
+	if v := setting("DRAIN_REQUEST_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("DRAIN_REQUEST_TIMEOUT must be a "+
+				"non-negative duration, such as \"1m\" or "+
+				"\"0\" to disable: %v", v)
+		}
+
+		drainRequestTimeout = d
+	}
+
+	// Optionally shed load as the heap approaches a ceiling.
+	if v := setting("MEMORY_CEILING"); v != "" {
+		ceiling, err := parseByteSize(v)
+		if err != nil {
+			return fmt.Errorf("MEMORY_CEILING: %v", err)
+		}
+
+		c.memoryCeiling = ceiling
+	}
+
+	// Optionally retain recent messages for the admin interface.
+	if v := setting("RECENT_MESSAGES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("RECENT_MESSAGES must be a "+
+				"non-negative integer, got %q", v)
+		}
+
+		recentMessagesPerRecord = n
+	}
+
+	// Optionally override how long a replaced process serves its
+	// connections after an upgrade.
+	if v := setting("UPGRADE_LINGER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("UPGRADE_LINGER must be a "+
+				"non-negative duration, such as \"10m\": %v", v)
+		}
+
+		upgradeLinger = d
+	}
+
+	// Optionally override the mode of created socket directories.
+	if v := setting("SOCKET_DIR_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("SOCKET_DIR_MODE must be an octal "+
+				"permission mode, such as \"0755\": %v", v)
+		}
+
+		socketDirMode = os.FileMode(mode)
+	}
+
+	// Optionally close connections that fall silent.
+	if v := setting("IDLE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("IDLE_TIMEOUT must be a "+
+				"non-negative duration, such as \"24h\" or "+
+				"\"0\" to disable: %v", v)
+		}
+
+		idleTimeout = d
+	}
+
+	// Optionally override how often the hosts of drains are
+	// resolved again.
+	if v := setting("DRAIN_DNS_REFRESH"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("DRAIN_DNS_REFRESH must be a "+
+				"non-negative duration, such as \"30s\" or "+
+				"\"0\" to disable: %v", v)
+		}
+
+		drainDNSRefresh = d
+	}
+
+	// Optionally override how long to wait for connections to
+	// flush at exit.
+	if v := setting("SHUTDOWN_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("SHUTDOWN_TIMEOUT must be a "+
+				"non-negative duration, such as \"10s\": %v", v)
+		}
+
+		shutdownTimeout = d
+	}
+
+	// Optionally emit operational events, such as connections
+	// quarantined, into a drain of their own.
+	if v := setting("OPS_DRAIN_URL"); v != "" {
+		drain, err := newInternalDrain(v)
+		if err != nil {
+			return fmt.Errorf("OPS_DRAIN_URL: %v", err)
+		}
+
+		opsDrain = drain
+	}
+
+	// Optionally expose metrics and other administrative
+	// information over HTTP.  See admin.go.
+	c.adminAddr = setting("ADMIN_ADDR")
+
+	// Optionally trace the message pipeline.  See tracing.go.
+	tracing, err := tracerConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	c.tracing = tracing
+
+	// Optionally accept operational commands, and adjust the
+	// verbosity of logging.  See control.go.
+	c.controlSocket = setting("CONTROL_SOCKET")
+	if v := setting("LOG_LEVEL"); v != "" {
+		l, err := parseLogLevel(v)
+		if err != nil {
+			return fmt.Errorf("LOG_LEVEL: %v", err)
+		}
+
+		setLogLevel(l)
+	}
+
+	// Optionally emit the collector's own statistics into a drain
+	// of their own.  See telemetry.go.
+	if v := setting("TELEMETRY_URL"); v != "" {
+		drain, err := newInternalDrain(v)
+		if err != nil {
+			return fmt.Errorf("TELEMETRY_URL: %v", err)
+		}
+
+		telemetryDrain = drain
+	}
+
+	if v := setting("TELEMETRY_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("TELEMETRY_INTERVAL must be a "+
+				"positive duration, such as \"1m\": %v", v)
+		}
+
+		telemetryInterval = d
+	}
+
+	// Brutal hack to get around pathological Go use of virtual
+	// memory: die once in a while.  A supervisor (e.g. Upstart)
+	// should restart the process.  With buffers now pooled this
+	// is thought to be unnecessary, so it may be disabled by
+	// setting RESTART_INTERVAL to zero.
+	c.restartInterval = time.Hour
+	if v := setting("RESTART_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("RESTART_INTERVAL must be a "+
+				"duration, such as \"1h\" or \"0\" to "+
+				"disable: %v", err)
+		}
+
+		c.restartInterval = d
+	}
+
+	// Spread restarts of collectors started together over up to
+	// a tenth of the interval, unless told otherwise.
+	c.restartJitter = c.restartInterval / 10
+	if v := setting("RESTART_JITTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return fmt.Errorf("RESTART_JITTER must be a "+
+				"non-negative duration, such as \"5m\": %v", v)
+		}
+
+		c.restartJitter = d
+	}
+
+	// Optionally confine the process, once the first version of
+	// the serve database is being served.  See sandbox.go.
+	if v := setting("SANDBOX"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("SANDBOX must be a boolean, such "+
+				"as \"true\": %v", v)
+		}
+
+		c.sandbox = b
+	}
+
+	// Optionally accept connections for every serve record on a
+	// single TCP port.  See shared.go.
+	if v := setting("TCP_ADDR"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return fmt.Errorf("TCP_ADDR must be a host and port, "+
+				"such as \":5433\": %v", err)
+		}
+
+		c.tcpAddr = v
+	}
+
+	// Optionally require TLS on the shared port, presenting this
+	// certificate unless a record's is chosen by server name.
+	certFile, keyFile := setting("TCP_TLS_CERT"), setting("TCP_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("TCP_TLS_CERT and TCP_TLS_KEY must be " +
+			"set together")
+	} else if certFile != "" {
+		if c.tcpAddr == "" {
+			return errors.New("TCP_TLS_CERT requires TCP_ADDR")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load TCP_TLS_CERT: %v", err)
+		}
+
+		c.tcpCert = &cert
+	}
+
+	// Optionally journal drain acknowledgments.  See acks.go.
+	c.ackJournal = setting("ACK_JOURNAL")
+
+	// Optionally accept records pushed over gRPC.  See grpc.go.
+	if v := setting("GRPC_ADDR"); v != "" {
+		if _, _, err := net.SplitHostPort(v); err != nil {
+			return fmt.Errorf("GRPC_ADDR must be a host and port, "+
+				"such as \":5434\": %v", err)
+		}
+
+		c.grpcAddr = v
+	}
+
+	return nil
+}
+
+// A serve record given programmatically, with the keys of a record of
+// the "serves" list of a serve database: "i", "p", "url" and any of
+// the optional keys described in README.rst.
+type ServeRecord map[string]interface{}
+
+// Serve records, alongside those of the serve databases, replacing
+// any set before.  They are checked as a submission to a serve
+// database is, and should any be invalid, none are set.  Otherwise
+// they are served from the next poll.  Should a record name the
+// socket of one of a serve database, that of the serve database wins.
+func (c *Collector) SetServeRecords(records []ServeRecord) error {
+	if records == nil {
+		records = []ServeRecord{}
+	}
+
+	contents, err := json.Marshal(map[string]interface{}{
+		"serves": records,
+	})
+	if err != nil {
+		return err
+	}
+
+	routes, err := (&serveDb{}).parse(contents)
+	if err != nil {
+		return err
+	}
+
+	c.sdb.setInjected(routes)
+	return nil
+}
+
+// Check the serve databases, as with the binary's --dry-run, writing
+// the routing table they would result in to w.
+func (c *Collector) DryRun(w io.Writer) error {
+	return dryRun(w, c.sdb)
+}
+
+// Replay the connections of a capture, as with the binary's
+// --replay, routing them by the serve databases, should there be
+// any, and writing what would be sent to their drains to w.
+func (c *Collector) Replay(r io.Reader, name string, w io.Writer) error {
+	var routes map[sKey]*serveRecord
+	if len(c.dirs) > 0 {
+		var err error
+		routes, err = pendingSetRoutes(c.sdb)
+		if err != nil {
+			return fmt.Errorf("cannot read serve database: %v", err)
+		}
+	}
+
+	return replay(r, name, routes, w)
+}
+
+// Summarize the state of the collector whose control socket is at
+// CONTROL_SOCKET, or otherwise whose admin interface is served on
+// ADMIN_ADDR, as with the binary's status subcommand, writing it to
+// w.
+func (c *Collector) Status(w io.Writer) error {
+	var rep *statusReport
+	var err error
+	if c.controlSocket != "" {
+		rep, err = controlStatus(c.controlSocket)
+		if err != nil {
+			return fmt.Errorf("cannot query collector at %q: %v",
+				c.controlSocket, err)
+		}
+	} else if c.adminAddr != "" {
+		rep, err = queryStatus(c.adminAddr)
+		if err != nil {
+			return fmt.Errorf("cannot query collector at %q: %v",
+				c.adminAddr, err)
+		}
+	} else {
+		return fmt.Errorf("CONTROL_SOCKET and ADMIN_ADDR are " +
+			"unset: one must have the value the collector was " +
+			"started with")
+	}
+
+	writeStatus(w, rep)
+	return nil
+}
+
+// The Collector running in this process, if any.
+var running struct {
+	sync.Mutex
+	c *Collector
+}
+
+var errAnotherRunning = errors.New("another Collector is running in " +
+	"this process: settings, metrics and connections are kept per " +
+	"process, so only one may run at a time")
+
+func checkNoneRunning() error {
+	running.Lock()
+	defer running.Unlock()
+
+	if running.c != nil {
+		return errAnotherRunning
+	}
+
+	return nil
+}
+
+// Mark c as the Collector running in this process, failing should
+// another be.
+func claimProcess(c *Collector) error {
+	running.Lock()
+	defer running.Unlock()
+
+	if running.c != nil {
+		return errAnotherRunning
+	}
+
+	running.c = c
+	return nil
+}
+
+func releaseProcess(c *Collector) {
+	running.Lock()
+	defer running.Unlock()
+
+	if running.c == c {
+		running.c = nil
+	}
+}
+
+// Serve until told to stop by a signal, or until ctx is cancelled,
+// then flush every connection.  Returns nil should everything have
+// been flushed, or an *ExitError should the collector have stopped to
+// be restarted, or been unable to flush in time; otherwise, an error
+// should serving be impossible.
+func (c *Collector) Run(ctx context.Context) error {
+	if len(c.dirs) == 0 && !c.sdb.hasInjected() {
+		return fmt.Errorf("SERVE_DB_DIR is unset: it must have the " +
+			"value of an existing serve database.  " +
+			"This can be an be an empty directory.")
+	}
+
+	if err := claimProcess(c); err != nil {
+		return err
+	}
+	defer releaseProcess(c)
+
+	// Signal handling: flush buffered messages and exit.  See the
+	// main loop below.
+	sigch := c.signals
+	if sigch == nil {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM,
+			syscall.SIGUSR2)
+		defer signal.Stop(ch)
+		sigch = ch
+	}
+
+	// Optionally journal which records drains acknowledge,
+	// reporting those the previous process never had.
+	if c.ackJournal != "" {
+		acks = openAckJournal(c.ackJournal)
+		journalCtx, stopJournal := context.WithCancel(ctx)
+		defer stopJournal()
+		go acks.run(journalCtx)
+		defer acks.flush()
+	}
+
+	// Goroutines serving the collector as a whole stop as Run
+	// returns, so that it may be run again.
+	bgCtx, stopBg := context.WithCancel(ctx)
+	defer stopBg()
+
+	dumpStateOnSignal(bgCtx, c.sdb)
+	toggleDebugOnSignal(bgCtx)
+	go runWatchdog(bgCtx, workerStallTimeout)
+
+	if telemetryDrain != nil {
+		go runTelemetry(bgCtx, c.sdb.Snapshot)
+	}
+
+	// Follow drains failing over by DNS.  See dns.go.
+	if drainDNSRefresh > 0 {
+		go drainHosts.run(bgCtx, drainDNSRefresh)
+	}
+
+	if c.memoryCeiling > 0 {
+		go runMemoryMonitor(bgCtx, c.memoryCeiling)
+	}
+
+	// Optionally trace the message pipeline, exporting the spans
+	// still queued as Run returns.
+	tr = c.tracing.start(bgCtx)
+	defer tr.stop()
+
+	// Optionally expose metrics and other administrative
+	// information over HTTP.  Failure to listen is an error, as
+	// an operator asked for the interface explicitly, unless this
+	// process is replacing another, which may hold the address
+	// still: binding it is then retried, rather than leave
+	// neither process serving.
+	var adminErrs <-chan error
+	if c.adminAddr != "" {
+		admin := newAdminServer(c.sdb)
+		defer admin.close()
+		defer unregisterHandoff(adminHandoff)
+		adminErrs = admin.errs
+
+		l, err := listenAdminHandoff(c.adminAddr)
+		switch {
+		case err == nil:
+			admin.serve(l)
+		case upgraded:
+			go admin.retry(bgCtx, c.adminAddr)
+		default:
+			return fmt.Errorf("cannot listen for admin requests "+
+				"on %q: %v", c.adminAddr, err)
+		}
+	}
+
+	// Optionally accept operational commands on a unix socket.
+	// Those for this loop are answered from below; the others,
+	// by the control server itself.
+	ctl := &controlServer{
+		sdb:     c.sdb,
+		reloads: make(chan chan bool),
+		stops:   make(chan struct{}),
+	}
+	if c.controlSocket != "" {
+		l, err := listenControl(c.controlSocket)
+		if err != nil {
+			return fmt.Errorf("cannot listen for control "+
+				"commands on %q: %v", c.controlSocket, err)
+		}
+
+		ctlCtx, stopCtl := context.WithCancel(ctx)
+		defer stopCtl()
+		go ctl.serve(ctlCtx, l)
+	}
+
+	// A reload requested of the control socket, answered once the
+	// serve databases have been polled, and any new routing table
+	// served.
+	var reloaded chan bool
+
+	// Connections to the shared TCP port and gRPC streams,
+	// should they be enabled, are accepted until serving stops,
+	// and handed to each generation in turn.
+	var shared *sharedListener
+	var grpcSrv *grpcServer
+	sharedCtx, stopShared := context.WithCancel(ctx)
+	defer stopShared()
+	if c.tcpAddr != "" {
+		shared = newSharedListener(c.tcpAddr, c.tcpCert)
+		go shared.run(sharedCtx)
+	}
+
+	if c.grpcAddr != "" {
+		grpcSrv = newGRPCServer(c.grpcAddr)
+		go grpcSrv.run(sharedCtx)
+	}
+
+	gen := newGeneration(ctx)
+
+	// The serve records of the current generation.
+	var serving []serveRecord
+
+	started := time.Now()
+	deathClock := deathClockFrom(started, c.restartInterval,
+		c.restartJitter)
+	sandboxPending := c.sandbox
+
+	for {
+		nw, err := c.sdb.Poll()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("a serve database directory "+
+					"does not exist: %v", err)
+			}
+
+			return fmt.Errorf("serve database suffers an "+
+				"unrecoverable error: %v", err)
+		}
+
+		debugf("polled serve databases: changed=%v", nw)
+
+		// New database state discovered: refresh the
+		// listeners and signal all existing server goroutines
+		// to exit.
+		if nw {
+			// Set up new servers for the new database state,
+			// one to a socket.  Sockets of our own are
+			// replaced atomically by bindListener, and the
+			// old generation retired only once they are, so
+			// that their clients find the socket served
+			// throughout.
+			old := gen
+			gen = newGeneration(ctx)
+
+			snap := arbitrate(serving, c.sdb.Snapshot())
+			serving = nil
+			for i := range snap {
+				sr := &snap[i]
+				if !isActivated(sr.P) {
+					if err := claimSocket(sr.P); err != nil {
+						log.Printf("not serving identity "+
+							"%q: %v", sr.I, err)
+						continue
+					}
+				}
+
+				l, err := bindListener(gen.ctx, sr)
+				if err != nil {
+					log.Printf("not serving identity %q: %v",
+						sr.I, err)
+					continue
+				}
+
+				serving = append(serving, *sr)
+				gen.listen(sr, l)
+			}
+
+			if shared != nil {
+				gen.listenShared(shared, serving)
+			}
+
+			if grpcSrv != nil {
+				gen.listenGRPC(grpcSrv, serving)
+			}
+
+			// Tell the generation of goroutines from the
+			// last version of the database to die, and
+			// check that they do.
+			old.retire()
+			pruneRecent(serving)
+		}
+
+		if reloaded != nil {
+			reloaded <- nw
+			reloaded = nil
+		}
+
+		if sandboxPending {
+			spec := newSandboxSpec(c.dirs, c.configPath, serving,
+				setting("SANDBOX_SOCKET_DIRS"))
+			if err := enterSandbox(spec); err != nil {
+				return fmt.Errorf("cannot sandbox: %v", err)
+			}
+
+			log.Printf("sandboxed: sockets may be bound in %v",
+				spec.sockets)
+			sandboxPending = false
+		}
+
+		select {
+		case sig := <-sigch:
+			log.Printf("got signal %v", sig)
+			if sig == syscall.SIGUSR2 {
+				// The new process reports what is
+				// yet to be acknowledged as it starts.
+				acks.flush()
+				if upgrade(gen, c.sdb, stopShared) {
+					acks.stop()
+					return exitStatus(drain(0), "upgraded")
+				}
+			} else {
+				stopShared()
+				return exitStatus(shutdown(gen, c.sdb, 0),
+					"shut down")
+			}
+		case <-ctl.stops:
+			log.Printf("stopping on request of the control socket")
+			stopShared()
+			return exitStatus(shutdown(gen, c.sdb, 0), "shut down")
+		case <-ctx.Done():
+			log.Printf("stopping: %v", context.Cause(ctx))
+			return exitStatus(shutdown(gen, c.sdb, 0), "shut down")
+		case err := <-adminErrs:
+			log.Printf("admin server exits unexpectedly: %v", err)
+			stopShared()
+			shutdown(gen, c.sdb, 0)
+			return fmt.Errorf("admin server exits unexpectedly: "+
+				"%v", err)
+		case reloaded = <-ctl.reloads:
+			continue
+		case <-time.After(c.pollInterval):
+		}
+
+		if !deathClock.IsZero() && time.Now().After(deathClock) {
+			log.Printf("Exiting on account of deadline, "+
+				"to prevent memory bloat: %v", deathClock)
+			writeRestartEvent(os.Stderr, started, deathClock)
+			stopShared()
+			return exitStatus(shutdown(gen, c.sdb, 101),
+				"restarting to prevent memory bloat")
+		}
+	}
+}
+
+// The error Run returns on stopping with status code.
+func exitStatus(code int, reason string) error {
+	if code == 0 {
+		return nil
+	}
+
+	return &ExitError{Code: code, Reason: reason}
+}
@@ -0,0 +1,230 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Settings are read from the environment, or from a configuration
+// file named by the --config flag, with the environment taking
+// precedence.  The file is in a subset of TOML: one setting per line,
+// named by the lowercase name of its environment variable, e.g.
+//
+//	# Where the serve database lives.
+//	serve_db_dir = "/var/lib/pg_logplexcollector"
+//	memory_ceiling = "512MB"
+//	recent_messages = 20
+//
+// Values may be strings, integers, or booleans; tables and arrays are
+// not supported.
+var knownSettings = []string{
+	"ACK_JOURNAL",
+	"ADMIN_ADDR",
+	"AWS_ACCESS_KEY_ID",
+	"AWS_ENDPOINT_URL_SECRETS_MANAGER",
+	"AWS_REGION",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"CLOCK_SKEW_THRESHOLD",
+	"CONTROL_SOCKET",
+	"DRAIN_DNS_REFRESH",
+	"GCP_ACCESS_TOKEN",
+	"GRPC_ADDR",
+	"IDLE_TIMEOUT",
+	"LOGPLEX_API_URL",
+	"LOGPLEX_URL",
+	"LOG_LEVEL",
+	"MEMORY_CEILING",
+	"OPS_DRAIN_URL",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OTEL_SERVICE_NAME",
+	"OTEL_TRACES_SAMPLER_ARG",
+	"RECENT_MESSAGES",
+	"RESTART_INTERVAL",
+	"RESTART_JITTER",
+	"SANDBOX",
+	"SANDBOX_SOCKET_DIRS",
+	"SECRET_REFRESH_INTERVAL",
+	"SERVE_DB_DEBOUNCE",
+	"SERVE_DB_DIR",
+	"SERVE_DB_DIRS",
+	"SERVE_DB_POLL_INTERVAL",
+	"SHUTDOWN_TIMEOUT",
+	"SOCKET_DIR_MODE",
+	"TCP_ADDR",
+	"TCP_TLS_CERT",
+	"TCP_TLS_KEY",
+	"TELEMETRY_INTERVAL",
+	"TELEMETRY_URL",
+	"UPGRADE_LINGER",
+	"VAULT_ADDR",
+	"VAULT_TOKEN",
+	"WORKER_STALL_TIMEOUT",
+}
+
+// Settings loaded from the configuration file, keyed by environment
+// variable name.
+var fileSettings = make(map[string]string)
+
+// Look up a setting, preferring the environment to the configuration
+// file.  As with environment variables, empty means unset.
+func setting(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return fileSettings[name]
+}
+
+func loadConfig(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseConfig(f)
+}
+
+func parseConfig(r io.Reader) (map[string]string, error) {
+	known := make(map[string]bool, len(knownSettings))
+	for _, name := range knownSettings {
+		known[name] = true
+	}
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno += 1 {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d: %s", lineno,
+				fmt.Sprintf(format, args...))
+		}
+
+		if line[0] == '[' {
+			return nil, fail("tables are not supported")
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fail("expected key = value")
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		name := strings.ToUpper(key)
+		if !known[name] || key != strings.ToLower(key) {
+			return nil, fail("unknown setting %q; known settings "+
+				"are %s", key, settingKeys())
+		}
+
+		if _, dup := settings[name]; dup {
+			return nil, fail("duplicate setting %q", key)
+		}
+
+		v, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fail("%s: %v", key, err)
+		}
+
+		settings[name] = v
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// Parse a value and any trailing comment, returning the value as it
+// would be given in the environment.
+func parseConfigValue(s string) (string, error) {
+	var v, rest string
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// A basic string, whose escapes are near enough to
+		// Go's.
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end += 1 {
+			if s[end] == '\\' {
+				end += 1
+			}
+		}
+
+		if end >= len(s) {
+			return "", fmt.Errorf("unterminated string")
+		}
+
+		unq, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+
+		v, rest = unq, s[end+1:]
+
+	case strings.HasPrefix(s, "'"):
+		// A literal string, without escapes.
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+
+		v, rest = s[1:end+1], s[end+2:]
+
+	default:
+		v = s
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			v = strings.TrimSpace(s[:i])
+		}
+
+		switch {
+		case v == "true" || v == "false":
+		case isConfigInteger(v):
+			v = strings.Replace(v, "_", "", -1)
+		default:
+			return "", fmt.Errorf("expected a string, integer, "+
+				"or boolean, got %q", v)
+		}
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %q after value", rest)
+	}
+
+	return v, nil
+}
+
+func isConfigInteger(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	if s == "" {
+		return false
+	}
+
+	for _, c := range s {
+		if (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func settingKeys() string {
+	keys := make([]string, len(knownSettings))
+	for i, name := range knownSettings {
+		keys[i] = strings.ToLower(name)
+	}
+
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	got, err := parseConfig(strings.NewReader(`
+# A comment, then settings of each type.
+serve_db_dir = "/var/lib/servedb" # trailing comment
+admin_addr = 'unix:C:\no\escapes'
+recent_messages = 1_000
+otel_service_name = "quote \" and tab\t"
+memory_ceiling="512MB"
+`))
+	if err != nil {
+		t.Fatalf("Could not parse configuration: %v", err)
+	}
+
+	want := map[string]string{
+		"SERVE_DB_DIR":      "/var/lib/servedb",
+		"ADMIN_ADDR":        `unix:C:\no\escapes`,
+		"RECENT_MESSAGES":   "1000",
+		"OTEL_SERVICE_NAME": "quote \" and tab\t",
+		"MEMORY_CEILING":    "512MB",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %v, want %v", got, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, bad := range []string{
+		"serve_dbdir = \"/typo\"",
+		"SERVE_DB_DIR = \"/upper\"",
+		"[collector]",
+		"serve_db_dir",
+		"serve_db_dir = \"unterminated",
+		"serve_db_dir = bare",
+		"serve_db_dir = \"a\" \"b\"",
+		"recent_messages = 1\nrecent_messages = 2",
+	} {
+		if _, err := parseConfig(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestSettingPrecedence(t *testing.T) {
+	defer func(saved map[string]string) {
+		fileSettings = saved
+	}(fileSettings)
+	fileSettings = map[string]string{"RESTART_INTERVAL": "2h"}
+
+	os.Unsetenv("RESTART_INTERVAL")
+	if v := setting("RESTART_INTERVAL"); v != "2h" {
+		t.Fatalf("Expected setting from file, got %q", v)
+	}
+
+	os.Setenv("RESTART_INTERVAL", "0")
+	defer os.Unsetenv("RESTART_INTERVAL")
+	if v := setting("RESTART_INTERVAL"); v != "0" {
+		t.Fatalf("Expected environment to override, got %q", v)
+	}
+}
@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Bookkeeping for a single client connection, used for diagnostics.
+type connState struct {
+	Ident     string
+	Path      string
+	Connected time.Time
+
+	// Updated atomically, as these are read by diagnostic
+	// routines running in other goroutines.
+	messages     uint64
+	bytes        uint64
+	lastActivity int64
+
+	// When the worker began its current unit of work, as Unix
+	// nanoseconds, or zero while it awaits input.  See watchdog.
+	busySince int64
+	stage     atomic.Value
+
+	// Closes the client connection, for use by the watchdog.
+	closer io.Closer
+	killed int32
+
+	// Set once the drain client is set up; nil beforehand.
+	client *logplexc.Client
+
+	hb *heartbeat
+	dt *deliveryTimer
+
+	// What the client advertised in its version message.  Set
+	// and read only by the connection's worker.
+	caps capabilities
+}
+
+// A point-in-time copy of a connState, safe to read without
+// synchronization.
+type connSnapshot struct {
+	Ident        string          `json:"identity"`
+	Path         string          `json:"socket"`
+	Connected    time.Time       `json:"connected_at"`
+	Messages     uint64          `json:"messages"`
+	Bytes        uint64          `json:"bytes"`
+	LastActivity time.Time       `json:"last_activity"`
+	UnsentBytes  uint64          `json:"unsent_bytes"`
+	LastError    string          `json:"last_error,omitempty"`
+	Drain        *logplexc.Stats `json:"drain,omitempty"`
+}
+
+// The set of live connections.
+var conns = struct {
+	sync.Mutex
+	m map[*connState]struct{}
+}{m: make(map[*connState]struct{})}
+
+// Create and register the state of a new connection on the socket
+// at path, closed by closer.  The caller must call unregister when
+// the connection is finished.
+func registerConn(path string, closer io.Closer) *connState {
+	now := time.Now()
+	cs := &connState{
+		Path:         path,
+		Connected:    now,
+		lastActivity: now.UnixNano(),
+		closer:       closer,
+	}
+
+	conns.Lock()
+	defer conns.Unlock()
+	conns.m[cs] = struct{}{}
+
+	return cs
+}
+
+func (cs *connState) unregister() {
+	conns.Lock()
+	defer conns.Unlock()
+	delete(conns.m, cs)
+}
+
+// Set the drain client and its instrumentation, once a connection
+// has identified itself.
+func (cs *connState) attach(ident string, client *logplexc.Client,
+	hb *heartbeat, dt *deliveryTimer) {
+	conns.Lock()
+	defer conns.Unlock()
+
+	cs.Ident = ident
+	cs.client = client
+	cs.hb = hb
+	cs.dt = dt
+}
+
+// Record the receipt of a message of n bytes, returning the time it
+// was received.
+func (cs *connState) received(n int) time.Time {
+	now := time.Now()
+	atomic.StoreInt64(&cs.lastActivity, now.UnixNano())
+	if cs.dt != nil {
+		cs.dt.received(n)
+	}
+
+	return now
+}
+
+// Record that a message has been handed to the drain client.
+func (cs *connState) forwarded(n int) {
+	atomic.AddUint64(&cs.messages, 1)
+	atomic.AddUint64(&cs.bytes, uint64(n))
+	cs.hb.count()
+}
+
+// Record that the worker has begun a unit of work that is expected
+// to complete promptly, described by stage.
+func (cs *connState) busy(stage string) {
+	cs.stage.Store(stage)
+	atomic.StoreInt64(&cs.busySince, time.Now().UnixNano())
+}
+
+// Record that the worker is awaiting input, which may legitimately
+// take any amount of time.
+func (cs *connState) idle() {
+	atomic.StoreInt64(&cs.busySince, 0)
+}
+
+// Report how long the worker has been busy, and with what; zero if
+// it is idle.
+func (cs *connState) busyFor(now time.Time) (time.Duration, string) {
+	since := atomic.LoadInt64(&cs.busySince)
+	if since == 0 {
+		return 0, ""
+	}
+
+	stage, _ := cs.stage.Load().(string)
+	return now.Sub(time.Unix(0, since)), stage
+}
+
+func (cs *connState) snapshot() connSnapshot {
+	snap := connSnapshot{
+		Ident:     cs.Ident,
+		Path:      cs.Path,
+		Connected: cs.Connected,
+		Messages:  atomic.LoadUint64(&cs.messages),
+		Bytes:     atomic.LoadUint64(&cs.bytes),
+		LastActivity: time.Unix(0,
+			atomic.LoadInt64(&cs.lastActivity)),
+	}
+
+	if cs.dt != nil {
+		snap.UnsentBytes = cs.dt.unsent()
+		snap.LastError = cs.dt.lastError()
+	}
+
+	if cs.client != nil {
+		stats := cs.client.Statistics()
+		snap.Drain = &stats
+	}
+
+	return snap
+}
+
+// Snapshot every live connection, ordered by socket path and then
+// connection time.
+func connSnapshots() []connSnapshot {
+	conns.Lock()
+	snaps := make([]connSnapshot, 0, len(conns.m))
+	for cs := range conns.m {
+		snaps = append(snaps, cs.snapshot())
+	}
+	conns.Unlock()
+
+	sort.Slice(snaps, func(i, j int) bool {
+		if snaps[i].Path != snaps[j].Path {
+			return snaps[i].Path < snaps[j].Path
+		}
+
+		return snaps[i].Connected.Before(snaps[j].Connected)
+	})
+
+	return snaps
+}
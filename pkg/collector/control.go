@@ -0,0 +1,358 @@
+package collector
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Optionally, the collector accepts operational commands on a unix
+// socket, given by CONTROL_SOCKET, for operators and orchestration
+// alike.  Each connection gives a single line: a command and its
+// arguments, separated by spaces.  It is answered by any output of the
+// command, then a final line of "ok", or of "error: " and why, as in:
+//
+//	$ echo 'pause app mode=drop' | socat - UNIX-CONNECT:/run/collector.ctl
+//	paused identity "app" on "/pg/app/log.sock" (drop)
+//	ok
+//
+// The commands are:
+//
+//	reload           poll the serve databases now
+//	drain-and-stop   flush every connection and exit, as on SIGTERM
+//	pause IDENTITY   pause the records of IDENTITY; see pause.go
+//	resume IDENTITY  undo pause
+//	log-level LEVEL  log at LEVEL, info or debug; see loglevel.go
+//	dump-state       describe the collector's state, as on SIGUSR1
+//	status           describe it as JSON, as the admin /status does
+//
+// pause and resume may be restricted to the record of a single socket
+// with socket=PATH, and pause given mode=buffer, the default, or
+// mode=drop.  Debug logging may be restricted to a single identity
+// with identity=IDENTITY, and lasts for=DURATION, debugLogDuration by
+// default.
+//
+// The socket is accessible only to the collector's own user.
+
+// How long a control connection may take to give its command and
+// read its answer.
+const controlTimeout = 30 * time.Second
+
+// The longest command line accepted.
+const maxControlLine = 4 * KB
+
+// Serves the control socket of a collector.
+type controlServer struct {
+	sdb *serveDbSet
+
+	// Requests to Run to poll the serve databases now, each
+	// answered with whether the routing table changed, and to
+	// stop.
+	reloads chan chan bool
+	stops   chan struct{}
+}
+
+// Listen for control commands on the unix socket at p.
+func listenControl(p string) (net.Listener, error) {
+	// As with the admin socket, clean up after any prior
+	// instance.
+	os.Remove(p)
+	l, err := net.Listen("unix", p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(p, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Serve control connections accepted from l until ctx is done.
+func (ctl *controlServer) serve(ctx context.Context, l net.Listener) {
+	closeOnDone(ctx, l)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+
+			if isTemporary(err) {
+				if sleepOrDone(ctx, time.Second) {
+					return
+				}
+
+				continue
+			}
+
+			log.Printf("control socket fails, no longer "+
+				"accepting commands: %v", err)
+			return
+		}
+
+		go ctl.handle(ctx, conn)
+	}
+}
+
+// Run the command given on conn, and answer it.
+func (ctl *controlServer) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	line, err := bufio.NewReader(io.LimitReader(conn,
+		maxControlLine)).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return
+	}
+
+	var out strings.Builder
+	err = ctl.exec(ctx, strings.Fields(line), &out)
+	if s := out.String(); s != "" && !strings.HasSuffix(s, "\n") {
+		out.WriteByte('\n')
+	}
+
+	if err != nil {
+		fmt.Fprintf(&out, "error: %v\n", err)
+	} else {
+		out.WriteString("ok\n")
+	}
+
+	io.WriteString(conn, out.String())
+}
+
+// The arguments each command takes: those required, and any options,
+// given as name=value.
+var controlArgs = map[string]struct {
+	args    int
+	options []string
+}{
+	"reload":         {},
+	"drain-and-stop": {},
+	"pause":          {1, []string{"socket", "mode"}},
+	"resume":         {1, []string{"socket"}},
+	"log-level":      {1, []string{"identity", "for"}},
+	"dump-state":     {},
+	"status":         {},
+}
+
+var errControlStopping = errors.New("collector is stopping")
+
+// Run the command args, writing its output to w.
+func (ctl *controlServer) exec(ctx context.Context, args []string,
+	w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("no command given")
+	}
+
+	cmd, args := args[0], args[1:]
+	spec, ok := controlArgs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+
+	// Options follow the arguments.
+	opts := make(map[string]string)
+	for len(args) > spec.args {
+		kv := strings.SplitN(args[spec.args], "=", 2)
+		if len(kv) != 2 || !knownOption(spec.options, kv[0]) {
+			return fmt.Errorf("%s takes no option %q", cmd,
+				args[spec.args])
+		}
+
+		opts[kv[0]] = kv[1]
+		args = append(args[:spec.args], args[spec.args+1:]...)
+	}
+
+	if len(args) != spec.args {
+		return fmt.Errorf("%s takes %d arguments, got %d", cmd,
+			spec.args, len(args))
+	}
+
+	switch cmd {
+	case "reload":
+		done := make(chan bool, 1)
+		select {
+		case ctl.reloads <- done:
+		case <-ctx.Done():
+			return errControlStopping
+		}
+
+		select {
+		case changed := <-done:
+			if changed {
+				fmt.Fprintln(w, "routing table changed")
+			} else {
+				fmt.Fprintln(w, "routing table unchanged")
+			}
+		case <-ctx.Done():
+			return errControlStopping
+		}
+	case "drain-and-stop":
+		select {
+		case ctl.stops <- struct{}{}:
+		case <-ctx.Done():
+			return errControlStopping
+		}
+	case "pause":
+		mode := pauseBuffer
+		if v, ok := opts["mode"]; ok {
+			var err error
+			if mode, err = parsePauseMode(v); err != nil {
+				return err
+			}
+		}
+
+		var keys []sKey
+		for _, sr := range ctl.sdb.Snapshot() {
+			if matchesRecord(sr.sKey, args[0], opts["socket"]) {
+				keys = append(keys, sr.sKey)
+			}
+		}
+
+		if len(keys) == 0 {
+			return fmt.Errorf("no serve record has identity %q%s",
+				args[0], onSocket(opts["socket"]))
+		}
+
+		for _, k := range pauseRecords(keys, mode) {
+			log.Printf("control socket: pausing identity %q on "+
+				"%q (%v)", k.I, k.P, mode)
+			fmt.Fprintf(w, "paused identity %q on %q (%v)\n",
+				k.I, k.P, mode)
+		}
+	case "resume":
+		// Records may be resumed even should they no longer
+		// be served.
+		var keys []sKey
+		for _, k := range pausedKeys() {
+			if matchesRecord(k, args[0], opts["socket"]) {
+				keys = append(keys, k)
+			}
+		}
+
+		for _, k := range resumeRecords(keys) {
+			log.Printf("control socket: resuming identity %q on %q",
+				k.I, k.P)
+			fmt.Fprintf(w, "resumed identity %q on %q\n", k.I, k.P)
+		}
+
+		if len(keys) == 0 {
+			fmt.Fprintf(w, "identity %q%s is not paused\n", args[0],
+				onSocket(opts["socket"]))
+		}
+	case "log-level":
+		return setControlLogLevel(args[0], opts, w)
+	case "dump-state":
+		dumpState(w, ctl.sdb)
+	case "status":
+		return json.NewEncoder(w).Encode(newStatusReport(ctl.sdb))
+	}
+
+	return nil
+}
+
+func knownOption(options []string, name string) bool {
+	for _, o := range options {
+		if o == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Log at the level named level, with the options given to the
+// log-level command.
+func setControlLogLevel(level string, opts map[string]string,
+	w io.Writer) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+
+	st := &logState{level: l}
+	if l < levelDebug {
+		if len(opts) > 0 {
+			return fmt.Errorf("options apply only to level %v",
+				levelDebug)
+		}
+
+		setLogLevel(l)
+	} else {
+		d := debugLogDuration
+		if v, ok := opts["for"]; ok {
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("for must be a positive "+
+					"duration, such as \"5m\": %v", v)
+			}
+		}
+
+		st = setLogging(l, opts["identity"], d)
+	}
+
+	log.Printf("control socket: logging at level %v", st)
+	fmt.Fprintf(w, "logging at level %v\n", st)
+	return nil
+}
+
+// Report whether the record k has identity ident and, should socket
+// be given, that socket.
+func matchesRecord(k sKey, ident, socket string) bool {
+	return k.I == ident && (socket == "" || k.P == socket)
+}
+
+// Describe socket, should it be given, for an error message.
+func onSocket(socket string) string {
+	if socket == "" {
+		return ""
+	}
+
+	return fmt.Sprintf(" on %q", socket)
+}
+
+// Send command to the control socket at p, returning its output, or
+// the error it answers with.
+func sendControl(p, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", p, controlTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	if _, err := io.WriteString(conn, command+"\n"); err != nil {
+		return "", err
+	}
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+
+	// The answer is the final line; the output, all before it.
+	s := strings.TrimSuffix(string(resp), "\n")
+	i := strings.LastIndexByte(s, '\n')
+	out, last := s[:i+1], s[i+1:]
+	if last == "ok" {
+		return out, nil
+	} else if strings.HasPrefix(last, "error: ") {
+		return "", errors.New(strings.TrimPrefix(last, "error: "))
+	}
+
+	return "", fmt.Errorf("unexpected answer %q", last)
+}
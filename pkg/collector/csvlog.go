@@ -0,0 +1,145 @@
+package collector
+
+import (
+	"bytes"
+	"expvar"
+	"log"
+	"os"
+	"strconv"
+)
+
+// Serve records may give a file to which every log record received is
+// appended as a row of CSV, in the columns of Postgres's own csvlog,
+// so that log history can be loaded into a database with COPY, into
+// the postgres_log table described by the Postgres documentation:
+//
+//	COPY postgres_log FROM '/var/log/pg/app.csv' WITH csv;
+//
+// Rows are appended whole, in a single write each, so that the
+// connections of a record may share the file.  As with capture,
+// writing is best-effort: should it fail, it is given up for the rest
+// of the connection rather than disturbing delivery to the drain.
+
+// Count of connections that gave up writing their csvlog file, keyed
+// by identity.
+var csvLogErrors = expvar.NewMap("csvlog_errors")
+
+// Appends the rows of a single connection to a csvlog file.
+type csvLogWriter struct {
+	f   *os.File
+	row bytes.Buffer
+	sr  *serveRecord
+}
+
+// Open the csvlog file of sr, or return nil should it have none, or
+// the file not open.
+func openCSVLog(sr *serveRecord) *csvLogWriter {
+	if sr.CSVLog == "" {
+		return nil
+	}
+
+	f, err := os.OpenFile(sr.CSVLog,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("cannot open csvlog file %q: %v", sr.CSVLog, err)
+		csvLogErrors.Add(sr.I, 1)
+		return nil
+	}
+
+	return &csvLogWriter{f: f, sr: sr}
+}
+
+// Append lr as a row.
+func (cw *csvLogWriter) write(lr *logRecord) {
+	if cw == nil || cw.f == nil {
+		return
+	}
+
+	cw.row.Reset()
+	appendCSVRow(&cw.row, lr)
+	if _, err := cw.f.Write(cw.row.Bytes()); err != nil {
+		log.Printf("cannot write csvlog file %q, giving up for "+
+			"this connection: %v", cw.sr.CSVLog, err)
+		csvLogErrors.Add(cw.sr.I, 1)
+		cw.f.Close()
+		cw.f = nil
+	}
+}
+
+func (cw *csvLogWriter) Close() error {
+	if cw == nil || cw.f == nil {
+		return nil
+	}
+
+	return cw.f.Close()
+}
+
+// Render lr as a line of CSV in the columns of csvlog.  As there, null
+// strings are empty, which COPY reads as NULL, and strings otherwise
+// quoted, even when empty; query positions of zero are empty too.
+func appendCSVRow(b *bytes.Buffer, lr *logRecord) {
+	var num [20]byte
+	first := true
+	sep := func() {
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+	}
+
+	str := func(v []byte) {
+		sep()
+		if v == nil {
+			return
+		}
+
+		b.WriteByte('"')
+		for _, c := range v {
+			if c == '"' {
+				b.WriteByte('"')
+			}
+			b.WriteByte(c)
+		}
+		b.WriteByte('"')
+	}
+
+	i64 := func(v int64) {
+		sep()
+		b.Write(strconv.AppendInt(num[:0], v, 10))
+	}
+
+	pos := func(v int32) {
+		if v == 0 {
+			sep()
+			return
+		}
+
+		i64(int64(v))
+	}
+
+	str(lr.LogTime)
+	str(lr.UserName)
+	str(lr.DatabaseName)
+	i64(int64(lr.Pid))
+	str(lr.ClientAddr)
+	str(lr.SessionId)
+	i64(lr.SeqNum)
+	str(lr.PsDisplay)
+	str(lr.SessionStart)
+	str(lr.Vxid)
+	sep()
+	b.Write(strconv.AppendUint(num[:0], lr.Txid, 10))
+	str([]byte(elevelName(lr.ELevel)))
+	str(lr.SQLState)
+	str(lr.ErrMessage)
+	str(lr.ErrDetail)
+	str(lr.ErrHint)
+	str(lr.InternalQuery)
+	pos(lr.InternalQueryPos)
+	str(lr.ErrContext)
+	str(lr.UserQuery)
+	pos(lr.UserQueryPos)
+	str(lr.FileErrPos)
+	str(lr.ApplicationName)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppendCSVRow(t *testing.T) {
+	var b bytes.Buffer
+	appendCSVRow(&b, &sampleLogRecord)
+
+	want := `"2014-05-01 12:34:56.789 UTC","postgres","postgres",` +
+		`1234,,"53621a50.4d2",7,"SELECT","2014-05-01 12:30:00 UTC",` +
+		`"2/10",0,"ERROR","42P01",` +
+		`"relation ""nonexistent"" does not exist",,"",,,,` +
+		`"SELECT * FROM nonexistent;",15,,"psql"` + "\n"
+	if got := b.String(); got != want {
+		t.Fatalf("Expected\n%s\ngot\n%s", want, got)
+	}
+
+	// The columns are those of csvlog, and quoting survives a
+	// reader.
+	fields, err := csv.NewReader(&b).Read()
+	if err != nil {
+		t.Fatalf("Could not read row: %v", err)
+	} else if len(fields) != 23 {
+		t.Fatalf("Expected 23 columns, got %d", len(fields))
+	} else if fields[13] != string(sampleLogRecord.ErrMessage) {
+		t.Fatalf("Unexpected message %q", fields[13])
+	}
+}
+
+func TestCSVLogWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csvlog")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sr := &serveRecord{sKey: sKey{I: "csv-apple"},
+		CSVLog: filepath.Join(dir, "app.csv")}
+
+	// Connections append to the same file.
+	for i := 0; i < 2; i++ {
+		cw := openCSVLog(sr)
+		cw.write(&sampleLogRecord)
+		if err := cw.Close(); err != nil {
+			t.Fatalf("Could not close: %v", err)
+		}
+	}
+
+	data, _ := ioutil.ReadFile(sr.CSVLog)
+	rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d: %v", len(rows), err)
+	}
+
+	// Without a file, or should it not open, nothing is written.
+	none := openCSVLog(&serveRecord{})
+	none.write(&sampleLogRecord)
+	none.Close()
+
+	before := expvarInt(csvLogErrors, "csv-apple")
+	sr.CSVLog = filepath.Join(dir, "missing", "app.csv")
+	if cw := openCSVLog(sr); cw != nil {
+		t.Fatalf("Expected no writer for an unopenable file")
+	} else if got := expvarInt(csvLogErrors, "csv-apple"); got != before+1 {
+		t.Fatalf("Expected one error, got %d", got-before)
+	}
+}
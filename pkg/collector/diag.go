@@ -0,0 +1,78 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Write a human-readable description of the collector's state to w:
+// the loaded serve records, those paused, every live connection, and
+// runtime statistics.
+func dumpState(w io.Writer, sdb *serveDbSet) {
+	now := time.Now()
+	fmt.Fprintf(w, "=== pg_logplexcollector state at %v\n",
+		now.Format(time.RFC3339))
+
+	snap := sdb.Snapshot()
+	fmt.Fprintf(w, "serve records: %d\n", len(snap))
+	for i := range snap {
+		sr := &snap[i]
+		fmt.Fprintf(w, "  ident=%q path=%q name=%q host=%q\n",
+			sr.I, sr.P, sr.Name, sr.u.Host)
+	}
+
+	paused := pausedKeys()
+	fmt.Fprintf(w, "paused records: %d\n", len(paused))
+	for _, k := range paused {
+		mode, _ := pauseOf(k)
+		fmt.Fprintf(w, "  ident=%q path=%q mode=%v\n", k.I, k.P, mode)
+	}
+
+	cs := connSnapshots()
+	fmt.Fprintf(w, "connections: %d\n", len(cs))
+	for _, c := range cs {
+		fmt.Fprintf(w, "  ident=%q path=%q connected=%v "+
+			"messages=%d bytes=%d idle=%v unsent_bytes=%d\n",
+			c.Ident, c.Path, c.Connected.Format(time.RFC3339),
+			c.Messages, c.Bytes,
+			now.Sub(c.LastActivity).Truncate(time.Millisecond),
+			c.UnsentBytes)
+
+		if c.Drain != nil {
+			fmt.Fprintf(w, "    drain: %+v\n", *c.Drain)
+		}
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	fmt.Fprintf(w, "heap: alloc=%d sys=%d objects=%d num_gc=%d\n",
+		ms.HeapAlloc, ms.HeapSys, ms.HeapObjects, ms.NumGC)
+	fmt.Fprintf(w, "=== end of state\n")
+}
+
+// Dump state to stderr whenever SIGUSR1 is received, until ctx is
+// done.
+func dumpStateOnSignal(ctx context.Context, sdb *serveDbSet) {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGUSR1)
+
+	go func() {
+		defer signal.Stop(sigch)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigch:
+				dumpState(os.Stderr, sdb)
+			}
+		}
+	}()
+}
@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDumpState(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	sdbs := newServeDbSet(name)
+	ioutil.WriteFile(sdbs.dbs[0].newPath(), fixtures[0].json, 0400)
+	if _, err := sdbs.Poll(); err != nil {
+		t.Fatalf("Poll should succeed with valid input, "+
+			"instead: %v", err)
+	}
+
+	cs := registerConn("/p1/log.sock", nil)
+	cs.received(10)
+	cs.forwarded(10)
+	defer cs.unregister()
+
+	out := bytes.Buffer{}
+	dumpState(&out, sdbs)
+
+	for _, want := range []string{
+		"serve records: 2",
+		`ident="apple" path="/p1/log.sock"`,
+		"connections: 1",
+		"messages=1 bytes=10",
+		"goroutines: ",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected dump to contain %q, got:\n%s",
+				want, out.String())
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+// Why a worker stops serving a connection.  Each error a worker
+// returns is one of the kinds below, or else reports that the
+// collector itself is stopping, so that disconnects can be told apart
+// in the metrics without parsing the log.
+
+// The client sent something that cannot be understood: a malformed
+// or oversized message, an unsupported protocol version, or an
+// identity its socket does not accept.
+type protocolError struct {
+	msg string
+}
+
+func protocolErrorf(format string, args ...interface{}) error {
+	return &protocolError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+// The drain to which the client's messages are sent could not be set
+// up, or failed to accept them.
+type drainError struct {
+	err error
+}
+
+func (e *drainError) Error() string {
+	return e.err.Error()
+}
+
+func (e *drainError) Unwrap() error {
+	return e.err
+}
+
+// The client went away: it closed the connection, stayed idle for too
+// long, or could no longer be read from.
+type peerDisconnect struct {
+	msg string
+}
+
+func peerDisconnectf(format string, args ...interface{}) error {
+	return &peerDisconnect{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *peerDisconnect) Error() string {
+	return e.msg
+}
+
+// Disconnects by cause, keyed by identity.
+var (
+	protocolErrors  = expvar.NewMap("protocol_errors")
+	drainErrors     = expvar.NewMap("drain_errors")
+	peerDisconnects = expvar.NewMap("peer_disconnects")
+)
+
+// Count the disconnect of a client of sr because of err, should err
+// be one of the kinds above.
+func countDisconnect(sr *serveRecord, err error) {
+	var pe *protocolError
+	var de *drainError
+	var pd *peerDisconnect
+
+	switch {
+	case errors.As(err, &pe):
+		protocolErrors.Add(sr.I, 1)
+	case errors.As(err, &de):
+		drainErrors.Add(sr.I, 1)
+	case errors.As(err, &pd):
+		peerDisconnects.Add(sr.I, 1)
+	}
+}
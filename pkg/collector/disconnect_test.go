@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestDisconnectCauses(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	handshake := append(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")),
+		frameMsg('I', []byte("cause-apple\x00"))...)
+
+	for _, tt := range []struct {
+		name    string
+		sent    []byte
+		drain   url.URL
+		counted *expvar.Map
+	}{
+		{"bad version", frameMsg('V', []byte("PG-7.4/logfebe-1\x00")),
+			*u, protocolErrors},
+		{"malformed record", append(handshake,
+			frameMsg('L', []byte("2014\x00"))...), *u, protocolErrors},
+		{"no drain token", handshake, url.URL{}, drainErrors},
+		{"closed", handshake, *u, peerDisconnects},
+	} {
+		conn := &bufConn{}
+		conn.Write(tt.sent)
+
+		sr := &serveRecord{sKey: sKey{I: "cause-apple",
+			P: "/p1/log.sock"}, u: tt.drain}
+		before := make(map[*expvar.Map]int64)
+		for _, m := range []*expvar.Map{protocolErrors, drainErrors,
+			peerDisconnects} {
+			before[m] = expvarInt(m, sr.I)
+		}
+
+		logWorker(context.Background(), conn, logplexc.Config{
+			HttpClient:  *http.DefaultClient,
+			Concurrency: 4,
+			Period:      10 * time.Millisecond,
+		}, sr)
+
+		for m, n := range before {
+			got, want := expvarInt(m, sr.I), n
+			if m == tt.counted {
+				want += 1
+			}
+
+			if got != want {
+				t.Errorf("%s: expected %d, got %d", tt.name,
+					want, got)
+			}
+		}
+	}
+}
+
+func TestConnectionMarkers(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	sr := &serveRecord{sKey: sKey{I: "marker-apple",
+		P: "/p1/log.sock"}, u: *u, ConnectionMarkers: true}
+
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+		client.Write(frameMsg('I', []byte("marker-apple\x00")))
+		client.Write(frameMsg('L', encodeLogRecord(&sampleLogRecord)))
+	}()
+
+	logWorker(context.Background(), server, logplexc.Config{
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		Period:      10 * time.Millisecond,
+	}, sr)
+
+	// The messages may be split across requests.
+	var all string
+	for !strings.Contains(all, "disconnected") {
+		all += d.next(t)
+	}
+
+	connected := strings.Index(all, "logfebe client connected "+
+		"(identity=marker-apple, version=PG-9.4.0/logfebe-1)")
+	record := strings.Index(all, string(sampleLogRecord.ErrMessage))
+	disconnected := strings.Index(all, "logfebe client disconnected "+
+		"(reason=")
+	if connected < 0 || record < connected || disconnected < record {
+		t.Fatalf("Expected the record between the markers, got %q", all)
+	}
+}
+
+func TestTruncateOversizedRecords(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	sr := &serveRecord{sKey: sKey{I: "trunc-apple",
+		P: "/p1/log.sock"}, u: *u, TruncateOver: 1024}
+
+	huge := sampleLogRecord
+	huge.UserQuery = []byte(strings.Repeat("q", 2*MB))
+	second := sampleLogRecord
+	second.ErrMessage = []byte("second message")
+
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+		client.Write(frameMsg('I', []byte("trunc-apple\x00")))
+		client.Write(frameMsg('L', encodeLogRecord(&huge)))
+		client.Write(frameMsg('L', encodeLogRecord(&second)))
+	}()
+
+	before := expvarInt(truncatedRecords, sr.I)
+	protoBefore := expvarInt(protocolErrors, sr.I)
+	logWorker(context.Background(), server, logplexc.Config{
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		Period:      10 * time.Millisecond,
+	}, sr)
+
+	var all string
+	for !strings.Contains(all, "second message") {
+		all += d.next(t)
+	}
+
+	if !strings.Contains(all, strings.Repeat("q", 1024)+
+		" [truncated 2096128 bytes]") {
+		t.Fatalf("Expected the query truncated, got %d bytes",
+			len(all))
+	}
+
+	if got := expvarInt(truncatedRecords, sr.I); got != before+1 {
+		t.Fatalf("Expected one truncated record, got %d", got-before)
+	}
+
+	if expvarInt(protocolErrors, sr.I) != protoBefore {
+		t.Fatalf("Expected the client not to be disconnected")
+	}
+}
+
+// The count of key in m, or zero should there be none.
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+
+	return 0
+}
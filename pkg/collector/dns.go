@@ -0,0 +1,202 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Connections to drains are kept alive, and so keep to the addresses
+// their host resolved to when they were made, however long ago.  So
+// that a drain failing over by DNS is followed, the host of every
+// drain in use is resolved again every drainDNSRefresh, and should
+// its addresses have changed, the idle connections of each transport
+// to it are closed before its next request, which then connects
+// anew.  Connections in use are closed once idle, before a later
+// request.
+//
+// Go's resolver does not report TTLs, so drainDNSRefresh should be
+// no longer than the TTL of the drains' records.
+
+// How often to resolve the hosts of drains again, set by
+// DRAIN_DNS_REFRESH; zero to never.
+var drainDNSRefresh = 30 * time.Second
+
+// How many refreshes a host may go unused for before it is no longer
+// resolved.
+const drainHostIdleRefreshes = 10
+
+// Count of changes in the addresses of drain hosts, and of the
+// transports whose connections were recycled for them, keyed by host.
+var (
+	drainDNSChanges  = expvar.NewMap("drain_dns_changes")
+	drainDNSRecycles = expvar.NewMap("drain_dns_recycles")
+)
+
+// The hosts of drains in use, with the addresses they last resolved
+// to.
+var drainHosts = newHostWatch(net.DefaultResolver.LookupHost)
+
+type watchedHost struct {
+	addrs []string
+
+	// Incremented as the addresses change.
+	gen uint64
+
+	// The refresh during which the host was last used.
+	used uint64
+}
+
+type hostWatch struct {
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu        sync.Mutex
+	hosts     map[string]*watchedHost
+	refreshes uint64
+}
+
+func newHostWatch(lookup func(ctx context.Context,
+	host string) ([]string, error)) *hostWatch {
+	return &hostWatch{lookup: lookup,
+		hosts: make(map[string]*watchedHost)}
+}
+
+// Note that host is in use, returning the generation of its
+// addresses.
+func (hw *hostWatch) use(host string) uint64 {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	h := hw.hosts[host]
+	if h == nil {
+		h = &watchedHost{}
+		hw.hosts[host] = h
+	}
+
+	h.used = hw.refreshes
+	return h.gen
+}
+
+// Resolve each host in use again, noting those whose addresses
+// changed, and forgetting those unused for long.
+func (hw *hostWatch) refresh(ctx context.Context) {
+	hw.mu.Lock()
+	hw.refreshes += 1
+	var hosts []string
+	for host, h := range hw.hosts {
+		if hw.refreshes-h.used > drainHostIdleRefreshes {
+			delete(hw.hosts, host)
+			continue
+		}
+
+		hosts = append(hosts, host)
+	}
+	hw.mu.Unlock()
+
+	for _, host := range hosts {
+		addrs, err := hw.lookup(ctx, host)
+		if err != nil {
+			// Keep to the addresses already known: a
+			// failing resolver is no reason to drop
+			// working connections.
+			log.Printf("cannot resolve drain host %q: %v",
+				host, err)
+			continue
+		}
+		sort.Strings(addrs)
+
+		hw.mu.Lock()
+		h := hw.hosts[host]
+		if h != nil && !equalStrings(h.addrs, addrs) {
+			// The first resolution merely learns the
+			// addresses.
+			if h.addrs != nil {
+				h.gen += 1
+				drainDNSChanges.Add(host, 1)
+				log.Printf("drain host %q now resolves to %v, "+
+					"was %v: recycling its connections",
+					host, addrs, h.addrs)
+			}
+			h.addrs = addrs
+		}
+		hw.mu.Unlock()
+	}
+}
+
+// Resolve the hosts in use again every interval until ctx is done.
+func (hw *hostWatch) run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		hw.refresh(ctx)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// An http.RoundTripper closing the idle connections of base as the
+// addresses of the host of a request change.
+type recyclingTransport struct {
+	base *http.Transport
+	hw   *hostWatch
+
+	mu sync.Mutex
+	// The generation of the addresses of each host as of its
+	// last request.
+	gens map[string]uint64
+}
+
+func newRecyclingTransport(base *http.Transport,
+	hw *hostWatch) *recyclingTransport {
+	return &recyclingTransport{base: base, hw: hw,
+		gens: make(map[string]uint64)}
+}
+
+func (rt *recyclingTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	host := req.URL.Hostname()
+	if drainDNSRefresh <= 0 || net.ParseIP(host) != nil {
+		return rt.base.RoundTrip(req)
+	}
+
+	gen := rt.hw.use(host)
+	rt.mu.Lock()
+	last, ok := rt.gens[host]
+	rt.gens[host] = gen
+	rt.mu.Unlock()
+
+	if ok && last != gen {
+		drainDNSRecycles.Add(host, 1)
+		rt.base.CloseIdleConnections()
+	}
+
+	return rt.base.RoundTrip(req)
+}
+
+func (rt *recyclingTransport) CloseIdleConnections() {
+	rt.base.CloseIdleConnections()
+}
@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecyclingTransport(t *testing.T) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	// Connect by name, as IP addresses are never resolved again.
+	drainURL := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+	addrs := []string{"192.0.2.1", "192.0.2.2"}
+	hw := newHostWatch(func(ctx context.Context,
+		host string) ([]string, error) {
+		if host != "localhost" {
+			t.Errorf("Unexpected lookup of %q", host)
+		}
+		return append([]string(nil), addrs...), nil
+	})
+	client := http.Client{Transport: newRecyclingTransport(
+		&http.Transport{}, hw)}
+
+	post := func() {
+		resp, err := client.Post(drainURL, "text/plain", nil)
+		if err != nil {
+			t.Fatalf("Could not post: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	// The first resolution, and one finding the same addresses,
+	// however ordered, keep the connection.
+	post()
+	hw.refresh(context.Background())
+	addrs = []string{"192.0.2.2", "192.0.2.1"}
+	hw.refresh(context.Background())
+	post()
+	hw.refresh(context.Background())
+	post()
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Fatalf("Expected one connection, got %d", n)
+	}
+
+	// A change of address has the next request connect anew.
+	before := expvarInt(drainDNSChanges, "localhost")
+	addrs = []string{"192.0.2.3"}
+	hw.refresh(context.Background())
+	post()
+	post()
+	if n := atomic.LoadInt64(&conns); n != 2 {
+		t.Fatalf("Expected two connections, got %d", n)
+	}
+
+	if got := expvarInt(drainDNSChanges, "localhost"); got != before+1 {
+		t.Fatalf("Expected one change, got %d", got-before)
+	}
+}
+
+func TestHostWatchForgets(t *testing.T) {
+	lookups := 0
+	hw := newHostWatch(func(ctx context.Context,
+		host string) ([]string, error) {
+		lookups++
+		return []string{"192.0.2.1"}, nil
+	})
+
+	hw.use("drain.example.com")
+	for i := 0; i < drainHostIdleRefreshes+5; i++ {
+		hw.refresh(context.Background())
+	}
+
+	if lookups != drainHostIdleRefreshes {
+		t.Fatalf("Expected %d lookups, got %d",
+			drainHostIdleRefreshes, lookups)
+	}
+}
@@ -0,0 +1,193 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The longest socket path that can be bound, being the size of
+// sun_path in struct sockaddr_un on Linux, less its terminating NUL.
+const maxSocketPathLen = 107
+
+// Validate the serve databases without changing them or binding any
+// sockets, printing the routing table that would result to w.
+//
+// The pending serves.new of each is checked if there is one, as it
+// is what would be loaded next; otherwise serves.loaded is.
+func dryRun(w io.Writer, sdbs *serveDbSet) error {
+	tables := make([]map[sKey]*serveRecord, len(sdbs.dbs))
+	for i, sdb := range sdbs.dbs {
+		p, routes, err := pendingRoutes(sdb)
+		if err != nil {
+			return err
+		} else if p == "" {
+			fmt.Fprintf(w, "%s: empty serve database\n", sdb.path)
+		} else {
+			fmt.Fprintf(w, "%s: %d serve records\n", p, len(routes))
+		}
+
+		tables[i] = routes
+	}
+
+	routes, shadowed := mergeRoutes(tables)
+	for _, sh := range shadowed {
+		fmt.Fprintln(w, sdbs.describeShadowed(sh))
+	}
+
+	if len(routes) == 0 {
+		return nil
+	}
+
+	recs := make([]*serveRecord, 0, len(routes))
+	for _, sr := range routes {
+		recs = append(recs, sr)
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		if recs[i].P != recs[j].P {
+			return recs[i].P < recs[j].P
+		}
+
+		return recs[i].I < recs[j].I
+	})
+
+	var problems []string
+	for _, sr := range recs {
+		for _, e := range checkServeRecord(sr) {
+			problems = append(problems, fmt.Sprintf(
+				"identity %q on %q: %s", sr.I, sr.P, e))
+		}
+	}
+
+	// Each socket can only be bound by a single listener.
+	byPath := make(map[string][]string)
+	for _, sr := range recs {
+		byPath[sr.P] = append(byPath[sr.P], sr.I)
+	}
+	for _, sr := range recs {
+		if ids := byPath[sr.P]; len(ids) > 1 && ids[0] == sr.I {
+			problems = append(problems, fmt.Sprintf(
+				"socket %q is claimed by several identities: %q",
+				sr.P, ids))
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOCKET\tIDENTITY\tDRAIN\tNAME")
+	for _, sr := range recs {
+		// Never print the drain's credentials.
+		u := sr.u
+		u.User = nil
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", sr.P, sr.I, u.String(),
+			sr.Name)
+	}
+	tw.Flush()
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found:\n  %s", len(problems),
+			strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Parse the routing table that would be loaded next from the serve
+// database without loading it: that of serves.new if there is one, or
+// otherwise that of serves.loaded.  Its path is also returned, and is
+// empty should the database be empty.
+func pendingRoutes(sdb *serveDb) (string, map[sKey]*serveRecord, error) {
+	p := sdb.newPath()
+	contents, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		p = sdb.loadedPath()
+		contents, err = ioutil.ReadFile(p)
+		if os.IsNotExist(err) {
+			return "", make(map[sKey]*serveRecord), nil
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	routes, err := sdb.parse(contents)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", p, err)
+	}
+
+	return p, routes, nil
+}
+
+// Merge the routing tables that would be loaded next from each of
+// the serve databases, as with pendingRoutes.
+func pendingSetRoutes(sdbs *serveDbSet) (map[sKey]*serveRecord, error) {
+	tables := make([]map[sKey]*serveRecord, len(sdbs.dbs))
+	for i, sdb := range sdbs.dbs {
+		_, routes, err := pendingRoutes(sdb)
+		if err != nil {
+			return nil, err
+		}
+
+		tables[i] = routes
+	}
+
+	routes, _ := mergeRoutes(tables)
+	return routes, nil
+}
+
+// Report the problems with a serve record that would prevent it from
+// being served.
+func checkServeRecord(sr *serveRecord) []string {
+	var problems []string
+
+	switch sr.u.Scheme {
+	case "http", "https":
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"drain URL scheme must be http or https, not %q",
+			sr.u.Scheme))
+	}
+
+	if sr.u.Host == "" {
+		problems = append(problems, "drain URL has no host")
+	}
+
+	if _, ok := sr.u.User.Password(); !ok {
+		problems = append(problems, "drain URL has no token "+
+			"as its password")
+	}
+
+	if !filepath.IsAbs(sr.P) {
+		problems = append(problems, "socket path is not absolute")
+	}
+
+	if len(sr.P) > maxSocketPathLen {
+		problems = append(problems, fmt.Sprintf(
+			"socket path is longer than %d bytes",
+			maxSocketPathLen))
+	}
+
+	// A missing directory is created when the socket is bound.
+	dir := filepath.Dir(sr.P)
+	if fi, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			problems = append(problems, err.Error())
+		}
+	} else if !fi.IsDir() {
+		problems = append(problems, fmt.Sprintf(
+			"%s is not a directory", dir))
+	}
+
+	if fi, err := os.Lstat(sr.P); err == nil &&
+		fi.Mode()&os.ModeSocket == 0 {
+		problems = append(problems, "socket path exists "+
+			"and is not a socket")
+	}
+
+	return problems
+}
@@ -0,0 +1,486 @@
+package collector
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// Formats in which log records may be rendered as messages, selected
+// by the "format" key of a serve record.
+const (
+	// Human-readable prose; see formatLogRec.
+	formatText = "text"
+
+	// Every field of the record as logfmt key=value pairs.
+	formatLogfmt = "logfmt"
+
+	// Every field of the record as a single-line JSON object.
+	formatJSON = "json"
+
+	// As rendered by the serve record's "template".
+	formatTemplate = "template"
+)
+
+// Check the "format" of a serve record, where empty means formatText.
+func checkFormat(format string) error {
+	switch format {
+	case "", formatText, formatLogfmt, formatJSON, formatTemplate:
+		return nil
+	}
+
+	return fmt.Errorf("unknown \"format\" %q", format)
+}
+
+// Count of messages whose template could not be executed, keyed by
+// identity.  They are rendered as formatText instead.
+var templateErrors = expvar.NewMap("template_errors")
+
+// What a serve record's template is executed with: the fields of the
+// log record, such as .ErrMessage, and the record's .Name, and
+// .Environment and .Region tags.
+type templateRecord struct {
+	*logRecord
+	Name        string
+	Environment string
+	Region      string
+}
+
+// Functions available to templates, as the string fields of log
+// records are byte slices, and may be null.
+var templateFuncs = template.FuncMap{
+	// The value of a field, or "" should it be null.
+	"str": func(v []byte) string {
+		return string(v)
+	},
+
+	// Whether a field is null.
+	"null": func(v []byte) bool {
+		return v == nil
+	},
+
+	// The value of a field, or def should it be null or empty.
+	"default": func(def string, v []byte) string {
+		if len(v) == 0 {
+			return def
+		}
+
+		return string(v)
+	},
+
+	// "label: value" and a newline, should a field not be null,
+	// as in the Detail, Hint and Query lines of formatText.
+	"line": func(label string, v []byte) string {
+		if v == nil {
+			return ""
+		}
+
+		return label + ": " + string(v) + "\n"
+	},
+
+	// The name of an error level, such as .ELevel, as Postgres
+	// would log it.
+	"severity": elevelName,
+
+	// The value of a field quoted as by Go's %q, or "NULL".
+	"quote": func(v []byte) string {
+		if v == nil {
+			return "NULL"
+		}
+
+		return strconv.Quote(string(v))
+	},
+}
+
+// Parse the "template" of a serve record named name, checking that it
+// can be executed.
+func parseTemplate(text, name string) (*template.Template, error) {
+	t, err := template.New("message").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad \"template\": %v", err)
+	}
+
+	// Catch references to fields that don't exist, which are
+	// only found on execution.
+	err = t.Execute(ioutil.Discard, templateRecord{logRecord: &logRecord{},
+		Name: name})
+	if err != nil {
+		return nil, fmt.Errorf("bad \"template\": %v", err)
+	}
+
+	return t, nil
+}
+
+// Render lr with the template of sr, falling back to formatText
+// should it fail.
+func formatTemplateRec(b *bytes.Buffer, lr *logRecord, sr *serveRecord) {
+	start := b.Len()
+	err := sr.Template.Execute(b, templateRecord{logRecord: lr,
+		Name: sr.Name, Environment: sr.Environment, Region: sr.Region})
+	if err == nil {
+		return
+	}
+
+	templateErrors.Add(sr.I, 1)
+	b.Truncate(start)
+	formatTextRec(b, lr, sr)
+}
+
+// Render every field of lr as logfmt, omitting null ones, such as
+//
+//	name=primary log_time="2014-05-01 12:34:56.789 UTC" pid=1234 ...
+//
+// The keys are those of pg_logfebe's wire format, in its order, with
+// the name of the error level following it as "severity".
+func formatLogfmtRec(b *bytes.Buffer, lr *logRecord, sr *serveRecord) {
+	var num [20]byte
+	first := true
+	key := func(k string) {
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+
+		b.WriteString(k)
+		b.WriteByte('=')
+	}
+
+	str := func(k string, v []byte) {
+		if v != nil {
+			key(k)
+			writeLogfmtValue(b, v)
+		}
+	}
+
+	i64 := func(k string, v int64) {
+		key(k)
+		b.Write(strconv.AppendInt(num[:0], v, 10))
+	}
+
+	if sr.Name != "" {
+		key("name")
+		writeLogfmtValue(b, []byte(sr.Name))
+	}
+	if sr.Environment != "" {
+		key("environment")
+		b.WriteString(sr.Environment)
+	}
+	if sr.Region != "" {
+		key("region")
+		b.WriteString(sr.Region)
+	}
+
+	str("log_time", lr.LogTime)
+	str("user_name", lr.UserName)
+	str("database_name", lr.DatabaseName)
+	i64("pid", int64(lr.Pid))
+	str("client_addr", lr.ClientAddr)
+	str("session_id", lr.SessionId)
+	i64("seq_num", lr.SeqNum)
+	str("ps_display", lr.PsDisplay)
+	str("session_start", lr.SessionStart)
+	str("vxid", lr.Vxid)
+	key("txid")
+	b.Write(strconv.AppendUint(num[:0], lr.Txid, 10))
+	i64("elevel", int64(lr.ELevel))
+	key("severity")
+	b.WriteString(elevelName(lr.ELevel))
+	str("sql_state", lr.SQLState)
+	str("message", lr.ErrMessage)
+	str("detail", lr.ErrDetail)
+	str("hint", lr.ErrHint)
+	str("internal_query", lr.InternalQuery)
+	i64("internal_query_pos", int64(lr.InternalQueryPos))
+	str("context", lr.ErrContext)
+	str("query", lr.UserQuery)
+	i64("query_pos", int64(lr.UserQueryPos))
+	str("file_err_pos", lr.FileErrPos)
+	str("application_name", lr.ApplicationName)
+}
+
+// Render every field of lr as a single-line JSON object, with the
+// keys of formatLogfmtRec, such as
+//
+//	{"name":"primary","log_time":"2014-05-01 12:34:56.789 UTC",...}
+//
+// Null fields are null, rather than omitted, so that every message
+// has the same keys.  The name is only present should sr have one.
+func formatJSONRec(b *bytes.Buffer, lr *logRecord, sr *serveRecord) {
+	var num [20]byte
+	first := true
+	key := func(k string) {
+		if first {
+			b.WriteByte('{')
+		} else {
+			b.WriteByte(',')
+		}
+		first = false
+
+		b.WriteByte('"')
+		b.WriteString(k)
+		b.WriteString(`":`)
+	}
+
+	str := func(k string, v []byte) {
+		key(k)
+		if v == nil {
+			b.WriteString("null")
+		} else {
+			writeJSONString(b, v)
+		}
+	}
+
+	i64 := func(k string, v int64) {
+		key(k)
+		b.Write(strconv.AppendInt(num[:0], v, 10))
+	}
+
+	if sr.Name != "" {
+		key("name")
+		writeJSONString(b, []byte(sr.Name))
+	}
+	if sr.Environment != "" {
+		key("environment")
+		writeJSONString(b, []byte(sr.Environment))
+	}
+	if sr.Region != "" {
+		key("region")
+		writeJSONString(b, []byte(sr.Region))
+	}
+
+	str("log_time", lr.LogTime)
+	str("user_name", lr.UserName)
+	str("database_name", lr.DatabaseName)
+	i64("pid", int64(lr.Pid))
+	str("client_addr", lr.ClientAddr)
+	str("session_id", lr.SessionId)
+	i64("seq_num", lr.SeqNum)
+	str("ps_display", lr.PsDisplay)
+	str("session_start", lr.SessionStart)
+	str("vxid", lr.Vxid)
+	key("txid")
+	b.Write(strconv.AppendUint(num[:0], lr.Txid, 10))
+	i64("elevel", int64(lr.ELevel))
+	key("severity")
+	writeJSONString(b, []byte(elevelName(lr.ELevel)))
+	str("sql_state", lr.SQLState)
+	str("message", lr.ErrMessage)
+	str("detail", lr.ErrDetail)
+	str("hint", lr.ErrHint)
+	str("internal_query", lr.InternalQuery)
+	i64("internal_query_pos", int64(lr.InternalQueryPos))
+	str("context", lr.ErrContext)
+	str("query", lr.UserQuery)
+	i64("query_pos", int64(lr.UserQueryPos))
+	str("file_err_pos", lr.FileErrPos)
+	str("application_name", lr.ApplicationName)
+	b.WriteByte('}')
+}
+
+// Write v as a JSON string.  As with encoding/json, invalid UTF-8 is
+// replaced by U+FFFD, and U+2028 and U+2029 are escaped so that the
+// result is also valid JavaScript.
+func writeJSONString(b *bytes.Buffer, v []byte) {
+	const hex = "0123456789abcdef"
+
+	b.WriteByte('"')
+	for len(v) > 0 {
+		r, size := utf8.DecodeRune(v)
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r < ' ':
+			b.WriteString(`\u00`)
+			b.WriteByte(hex[r>>4])
+			b.WriteByte(hex[r&0xf])
+		case r == utf8.RuneError && size == 1:
+			b.WriteRune(utf8.RuneError)
+		case r == '\u2028' || r == '\u2029':
+			b.WriteString(`\u202`)
+			b.WriteByte(hex[r&0xf])
+		default:
+			b.Write(v[:size])
+		}
+
+		v = v[size:]
+	}
+	b.WriteByte('"')
+}
+
+// Write v as a logfmt value, quoted and escaped much as by Go's %q
+// should it be empty or contain anything but printable ASCII other
+// than '=', '"' and '\\'.
+func writeLogfmtValue(b *bytes.Buffer, v []byte) {
+	quote := len(v) == 0
+	for _, c := range v {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' ||
+			c == 0x7f || c >= utf8.RuneSelf {
+			quote = true
+			break
+		}
+	}
+
+	if !quote {
+		b.Write(v)
+		return
+	}
+
+	b.WriteByte('"')
+	for len(v) > 0 {
+		r, size := utf8.DecodeRune(v)
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(b, `\x%02x`, v[0])
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(b, `\x%02x`, r)
+		default:
+			b.Write(v[:size])
+		}
+
+		v = v[size:]
+	}
+	b.WriteByte('"')
+}
+
+// Check the "msgid" of a serve record, which RFC 5424 restricts to
+// at most 32 printable ASCII characters, not including space.  "-"
+// is the nil value, and so can't be used.
+func checkMsgId(id string) error {
+	ok := id != "" && id != "-" && len(id) <= 32
+	for i := 0; i < len(id) && ok; i++ {
+		ok = id[i] > ' ' && id[i] < 0x7f
+	}
+
+	if !ok {
+		return fmt.Errorf("bad \"msgid\" %q: expected up to 32 "+
+			"printable ASCII characters", id)
+	}
+
+	return nil
+}
+
+// Check the value of the "environment" or "region" tag of a serve
+// record, which is restricted to letters, digits, "-", "_" and "." so
+// that it can be emitted unquoted and unescaped in every format.
+func checkTag(key, value string) error {
+	ok := value != "" && len(value) <= 64
+	for i := 0; i < len(value) && ok; i++ {
+		c := value[i]
+		ok = c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+	}
+
+	if !ok {
+		return fmt.Errorf("bad %q %q: expected up to 64 letters, "+
+			"digits, \"-\", \"_\" or \".\"", key, value)
+	}
+
+	return nil
+}
+
+// Check the "structured_data" SD-ID of a serve record, which must be
+// a name followed by "@" and a private enterprise number, as names
+// without one are reserved by RFC 5424.
+func checkSDID(id string) error {
+	at := strings.IndexByte(id, '@')
+	ok := len(id) <= 32 && at > 0 && at < len(id)-1
+	for i := 0; i < len(id) && ok; i++ {
+		c := id[i]
+		if i > at {
+			ok = c >= '0' && c <= '9' || c == '.'
+		} else {
+			ok = c > ' ' && c < 0x7f && c != '=' && c != ']' &&
+				c != '"'
+		}
+	}
+
+	if !ok {
+		return fmt.Errorf("bad \"structured_data\" SD-ID %q: "+
+			"expected a name and enterprise number, as in %q",
+			id, "postgres@32473")
+	}
+
+	return nil
+}
+
+// Append the RFC 5424 structured data of the message of lr to b, as
+// a single element with the SD-ID of sr, such as
+//
+//	[postgres@32473 sqlstate="42P01" severity="ERROR" ...]
+//
+// or nothing, should sr not ask for it.  Null fields are omitted.
+func appendStructuredData(b []byte, lr *logRecord, sr *serveRecord) []byte {
+	if sr.StructuredData == "" {
+		return b
+	}
+
+	param := func(k string, v []byte) {
+		if v == nil {
+			return
+		}
+
+		b = append(b, ' ')
+		b = append(b, k...)
+		b = append(b, '=', '"')
+		b = appendSDValue(b, v)
+		b = append(b, '"')
+	}
+
+	b = append(b, '[')
+	b = append(b, sr.StructuredData...)
+	param("sqlstate", lr.SQLState)
+	param("severity", []byte(elevelName(lr.ELevel)))
+	param("database", lr.DatabaseName)
+	param("user", lr.UserName)
+	param("application_name", lr.ApplicationName)
+	param("session_id", lr.SessionId)
+	param("context", lr.ErrContext)
+	if sr.Environment != "" {
+		param("environment", []byte(sr.Environment))
+	}
+	if sr.Region != "" {
+		param("region", []byte(sr.Region))
+	}
+	return append(b, ']')
+}
+
+// Append v to b as an SD-PARAM value, escaping '"', '\\' and ']' and
+// replacing invalid UTF-8 with U+FFFD.
+func appendSDValue(b []byte, v []byte) []byte {
+	for len(v) > 0 {
+		r, size := utf8.DecodeRune(v)
+		switch {
+		case r == '"' || r == '\\' || r == ']':
+			b = append(b, '\\', byte(r))
+		case r == utf8.RuneError && size == 1:
+			b = append(b, "\uFFFD"...)
+		default:
+			b = append(b, v[:size]...)
+		}
+
+		v = v[size:]
+	}
+
+	return b
+}
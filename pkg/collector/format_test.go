@@ -0,0 +1,387 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestFormatSessionFields(t *testing.T) {
+	sr := &serveRecord{SessionFields: true}
+	lr := sampleLogRecord
+
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, sr)
+	want := "\nsession=53621a50.4d2 seq=7 vxid=2/10\n"
+	if !strings.HasSuffix(buf.String(), want) {
+		t.Fatalf("Expected message to end %q, got %q", want,
+			buf.String())
+	}
+
+	lr.Vxid = nil
+	buf.Reset()
+	formatLogRec(&buf, &lr, sr)
+	want = "\nsession=53621a50.4d2 seq=7\n"
+	if !strings.HasSuffix(buf.String(), want) {
+		t.Fatalf("Expected message to end %q, got %q", want,
+			buf.String())
+	}
+
+	sr.SessionFields = false
+	buf.Reset()
+	formatLogRec(&buf, &lr, sr)
+	if strings.Contains(buf.String(), "session=") {
+		t.Fatalf("Expected no session fields, got %q", buf.String())
+	}
+}
+
+func TestFormatErrorContext(t *testing.T) {
+	lr := sampleLogRecord
+	lr.InternalQuery = []byte("SELECT * FROM nonexistent")
+	lr.InternalQueryPos = 15
+	lr.ErrContext = []byte("PL/pgSQL function f() line 3 at PERFORM")
+
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, &serveRecord{ErrorContext: true})
+	want := "relation \"nonexistent\" does not exist\n" +
+		"Hint: \n" +
+		"Internal query: SELECT * FROM nonexistent\n" +
+		"Internal query position: 15\n" +
+		"Context: PL/pgSQL function f() line 3 at PERFORM\n" +
+		"Query: SELECT * FROM nonexistent;\n" +
+		"Query position: 15\n"
+	if buf.String() != want {
+		t.Fatalf("Expected %q, got %q", want, buf.String())
+	}
+
+	// Without the option, as before.
+	buf.Reset()
+	formatLogRec(&buf, &lr, &serveRecord{})
+	if strings.Contains(buf.String(), "Context") ||
+		strings.Contains(buf.String(), "position") {
+		t.Fatalf("Expected no error context, got %q", buf.String())
+	}
+}
+
+func TestFormatTags(t *testing.T) {
+	sr := &serveRecord{Name: "primary", Environment: "production",
+		Region: "us-east-1", StructuredData: "postgres@32473"}
+	lr := sampleLogRecord
+
+	for _, tt := range []struct {
+		format string
+		want   string
+	}{
+		{formatText, "\nenvironment=production region=us-east-1\n"},
+		{formatLogfmt, "name=primary environment=production " +
+			"region=us-east-1 log_time="},
+		{formatJSON, `{"name":"primary","environment":"production",` +
+			`"region":"us-east-1","log_time":`},
+	} {
+		sr.Format = tt.format
+		var buf bytes.Buffer
+		formatLogRec(&buf, &lr, sr)
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("%s: expected %q in %q", tt.format, tt.want,
+				buf.String())
+		}
+	}
+
+	sd := string(appendStructuredData(nil, &lr, sr))
+	if !strings.HasSuffix(sd, ` environment="production" `+
+		`region="us-east-1"]`) {
+		t.Errorf("Unexpected structured data %s", sd)
+	}
+
+	tmpl, err := parseTemplate("{{.Environment}}/{{.Region}}", sr.Name)
+	if err != nil {
+		t.Fatalf("Could not parse template: %v", err)
+	}
+	sr.Format, sr.Template = formatTemplate, tmpl
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, sr)
+	if buf.String() != "production/us-east-1" {
+		t.Errorf("Unexpected templated message %q", buf.String())
+	}
+
+	// Only the tags given are.
+	sr = &serveRecord{Region: "eu-west-1"}
+	buf.Reset()
+	formatLogRec(&buf, &lr, sr)
+	if !strings.HasSuffix(buf.String(), "\nregion=eu-west-1\n") {
+		t.Errorf("Unexpected message %q", buf.String())
+	}
+
+	for _, bad := range []string{"", "us east", "prod\"", "a=b",
+		strings.Repeat("x", 65)} {
+		if checkTag("region", bad) == nil {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestFormatLogfmt(t *testing.T) {
+	sr := &serveRecord{Name: "primary", Format: formatLogfmt}
+	lr := sampleLogRecord
+	lr.ErrDetail = []byte("line one\nline \"two\"")
+
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, sr)
+
+	want := `name=primary log_time="2014-05-01 12:34:56.789 UTC" ` +
+		`user_name=postgres database_name=postgres pid=1234 ` +
+		`session_id=53621a50.4d2 seq_num=7 ps_display=SELECT ` +
+		`session_start="2014-05-01 12:30:00 UTC" vxid=2/10 txid=0 ` +
+		`elevel=20 severity=ERROR sql_state=42P01 ` +
+		`message="relation \"nonexistent\" does not exist" ` +
+		`detail="line one\nline \"two\"" hint="" ` +
+		`internal_query_pos=0 ` +
+		`query="SELECT * FROM nonexistent;" query_pos=15 ` +
+		`application_name=psql`
+	if got := buf.String(); got != want {
+		t.Fatalf("Unexpected logfmt:\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestWriteLogfmtValue(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"plain", "plain"},
+		{"", `""`},
+		{"a=b", `"a=b"`},
+		{"tab\there", `"tab\there"`},
+		{"bell\a", `"bell\x07"`},
+		{"caf\xc3\xa9", "\"caf\xc3\xa9\""},
+		{"bad\xff", `"bad\xff"`},
+	} {
+		var buf bytes.Buffer
+		writeLogfmtValue(&buf, []byte(c.in))
+		if buf.String() != c.want {
+			t.Errorf("%q: got %s, want %s", c.in, buf.String(),
+				c.want)
+		}
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	sr := &serveRecord{Name: "primary", Format: formatJSON}
+	lr := sampleLogRecord
+	lr.ErrDetail = []byte("line one\nline \"two\"")
+
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, sr)
+	if bytes.ContainsRune(buf.Bytes(), '\n') {
+		t.Fatalf("Expected a single line, got %s", buf.Bytes())
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", buf.Bytes(), err)
+	}
+
+	for k, want := range map[string]interface{}{
+		"name":        "primary",
+		"log_time":    "2014-05-01 12:34:56.789 UTC",
+		"pid":         1234.0,
+		"client_addr": nil,
+		"seq_num":     7.0,
+		"elevel":      20.0,
+		"severity":    "ERROR",
+		"message":     `relation "nonexistent" does not exist`,
+		"detail":      "line one\nline \"two\"",
+		"hint":        "",
+		"query_pos":   15.0,
+	} {
+		if v, ok := got[k]; !ok || v != want {
+			t.Errorf("Expected %q to be %#v, got %#v", k, want, v)
+		}
+	}
+
+	if len(got) != 25 {
+		t.Errorf("Expected 25 keys, got %d: %s", len(got), buf.Bytes())
+	}
+}
+
+// writeJSONString must agree with encoding/json.
+func TestWriteJSONString(t *testing.T) {
+	for _, in := range []string{
+		"", "plain", `quote " and \ backslash`, "\x00\x1f\x7f",
+		"tab\tnew\nline\r", "caf\xc3\xa9", "bad\xff\xfe",
+		"sep\u2028ara\u2029tors", "<html> & more",
+	} {
+		var got, want bytes.Buffer
+		writeJSONString(&got, []byte(in))
+
+		enc := json.NewEncoder(&want)
+		enc.SetEscapeHTML(false)
+		enc.Encode(in)
+		if got.String()+"\n" != want.String() {
+			t.Errorf("%q: got %s, want %s", in, got.String(),
+				want.String())
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for _, ok := range []string{"", formatText, formatLogfmt,
+		formatJSON} {
+		if err := checkFormat(ok); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", ok, err)
+		}
+	}
+
+	if err := checkFormat("xml"); err == nil {
+		t.Error("Expected an unknown format to be rejected")
+	}
+}
+
+func TestFormatTemplate(t *testing.T) {
+	tmpl, err := parseTemplate(`{{.Name}}: {{str .SQLState}} `+
+		`{{quote .ErrMessage}}{{if null .ErrDetail}} no detail{{end}}`+
+		` {{default "-" .ClientAddr}} pid={{.Pid}} `+
+		`{{severity .ELevel}}`+"\n"+
+		`{{line "Hint" .ErrHint}}{{line "Context" .ErrContext}}`,
+		"primary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "template-test"}, Name: "primary",
+		Format: formatTemplate, Template: tmpl}
+	var buf bytes.Buffer
+	formatLogRec(&buf, &sampleLogRecord, sr)
+
+	want := `primary: 42P01 "relation \"nonexistent\" does not ` +
+		`exist" no detail - pid=1234 ERROR` + "\nHint: \n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Unexpected template output:\ngot:  %q\nwant: %q",
+			got, want)
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, bad := range []string{
+		"{{.ErrMessage",
+		"{{.NoSuchField}}",
+		"{{nosuchfunc .ErrMessage}}",
+	} {
+		if _, err := parseTemplate(bad, ""); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFormatTemplateFallback(t *testing.T) {
+	// Fails only given a non-empty message.
+	tmpl, err := parseTemplate(`{{if .ErrMessage}}{{index .ErrMessage 99}}`+
+		`{{end}}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := &serveRecord{sKey: sKey{I: "template-fallback-test"},
+		Format: formatTemplate, Template: tmpl}
+	var buf bytes.Buffer
+	buf.WriteString("kept ")
+	formatLogRec(&buf, &sampleLogRecord, sr)
+
+	var text bytes.Buffer
+	text.WriteString("kept ")
+	formatTextRec(&text, &sampleLogRecord, sr)
+	if buf.String() != text.String() {
+		t.Fatalf("Expected the text format, %q, got %q", text.String(),
+			buf.String())
+	}
+
+	if got := templateErrors.Get(sr.I); got == nil ||
+		got.String() != "1" {
+		t.Fatalf("Expected a template error counted, got %v", got)
+	}
+}
+
+func TestFormatSeverity(t *testing.T) {
+	sr := &serveRecord{Name: "primary", Severity: true}
+	lr := sampleLogRecord
+
+	var buf bytes.Buffer
+	formatLogRec(&buf, &lr, sr)
+	want := "[primary] ERROR:  relation \"nonexistent\" does not exist\n"
+	if !strings.HasPrefix(buf.String(), want) {
+		t.Fatalf("Expected message to begin %q, got %q", want,
+			buf.String())
+	}
+
+	for e, want := range map[int32]string{
+		elevelDebug3:    "DEBUG",
+		elevelLog:       "LOG",
+		elevelCommError: "LOG",
+		elevelWarning:   "WARNING",
+		elevelFatal:     "FATAL",
+		elevelPanic:     "PANIC",
+		99:              "LEVEL99",
+	} {
+		if got := elevelName(e); got != want {
+			t.Errorf("Level %d: got %q, want %q", e, got, want)
+		}
+	}
+}
+
+func TestAppendStructuredData(t *testing.T) {
+	lr := sampleLogRecord
+	lr.DatabaseName = []byte("app")
+	lr.UserName = []byte("alice")
+	lr.ErrContext = []byte("PL/pgSQL \"f\"]\\ line 1\xff")
+
+	if sd := appendStructuredData(nil, &lr, &serveRecord{}); sd != nil {
+		t.Fatalf("Expected no structured data, got %q", sd)
+	}
+
+	sr := &serveRecord{StructuredData: "postgres@32473"}
+	got := string(appendStructuredData(nil, &lr, sr))
+	want := `[postgres@32473 sqlstate="42P01" severity="ERROR" ` +
+		`database="app" user="alice" application_name="psql" ` +
+		`session_id="53621a50.4d2" ` +
+		`context="PL/pgSQL \"f\"\]\\ line 1` + "�" + `"]`
+	if got != want {
+		t.Fatalf("Got %q, want %q", got, want)
+	}
+
+	lr.ErrContext = nil
+	lr.ApplicationName = nil
+	got = string(appendStructuredData(nil, &lr, sr))
+	if strings.Contains(got, "context=") ||
+		strings.Contains(got, "application_name=") {
+		t.Fatalf("Expected null fields to be omitted, got %q", got)
+	}
+}
+
+func TestCheckSDID(t *testing.T) {
+	for _, id := range []string{"postgres@32473", "pg@1.2.3"} {
+		if err := checkSDID(id); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", id, err)
+		}
+	}
+
+	for _, id := range []string{"", "postgres", "@32473", "postgres@",
+		"pg sql@32473", "pg@abc", "p]g@1", "pg=x@1",
+		"a-name-that-is-much-too-long@32473"} {
+		if err := checkSDID(id); err == nil {
+			t.Errorf("Expected %q to be rejected", id)
+		}
+	}
+}
+
+func TestCheckMsgId(t *testing.T) {
+	for _, id := range []string{"pglog", "pgaudit", "a.b-c_d"} {
+		if err := checkMsgId(id); err != nil {
+			t.Errorf("Expected %q to be accepted: %v", id, err)
+		}
+	}
+
+	for _, id := range []string{"", "-", "pg log", "pg\tlog", "pglög",
+		strings.Repeat("m", 33)} {
+		if err := checkMsgId(id); err == nil {
+			t.Errorf("Expected %q to be rejected", id)
+		}
+	}
+}
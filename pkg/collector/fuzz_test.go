@@ -0,0 +1,82 @@
+package collector
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// Frame payload as a message of type typ, as a client would send it.
+func frameMsg(typ byte, payload []byte) []byte {
+	b := make([]byte, 5, 5+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], uint32(len(payload)+4))
+	return append(b, payload...)
+}
+
+// Parsing a log record must either succeed or report an error, whatever
+// the input, and reading it from a stream must agree with parsing it
+// in place.
+func FuzzParseLogRecord(f *testing.F) {
+	f.Add(encodeLogRecord(&sampleLogRecord))
+	f.Add([]byte{})
+	f.Add([]byte("2014-01-01 00:00:00 UTC\x00P"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var inPlace logRecord
+		placeErr := parseLogRecord(&inPlace, data)
+
+		var m core.Message
+		m.InitFromBytes('L', data)
+
+		var streamed logRecord
+		rr := newRecordReader()
+		_, streamErr := rr.readOwned(&streamed, &m)
+
+		if (placeErr == nil) != (streamErr == nil) {
+			t.Fatalf("Parsing in place fails with %v, but "+
+				"streaming with %v", placeErr, streamErr)
+		}
+
+		if placeErr == nil && !reflect.DeepEqual(inPlace, streamed) {
+			t.Fatalf("Parsing in place yields %+v, but "+
+				"streaming %+v", inPlace, streamed)
+		}
+	})
+}
+
+// The handshake must either succeed or report an error, whatever a client
+// sends.
+func FuzzHandshake(f *testing.F) {
+	valid := append(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")),
+		frameMsg('I', []byte("apple\x00"))...)
+	f.Add(valid)
+	f.Add(valid[:7])
+	f.Add([]byte{'V', 0, 0, 0, 0})
+	f.Add([]byte{'V', 0xff, 0xff, 0xff, 0xff, 'P', 'G'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		conn := &bufConn{}
+		conn.Write(data)
+		stream := core.NewBackendStream(conn)
+
+		msgInit := func(m *core.Message) error {
+			err := stream.Next(m)
+			if err == io.EOF {
+				return peerDisconnectf("postgres client disconnects")
+			} else if err != nil {
+				return peerDisconnectf("could not read next "+
+					"message: %v", err)
+			}
+
+			return checkMsgSize(m)
+		}
+
+		if _, err := processVerMsg(msgInit); err == nil {
+			processIdentMsg(msgInit)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package collector
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false,
+	"rewrite the golden output of replayed captures")
+
+// Replays each capture in testdata/golden, checking that what would
+// be sent to the drains is exactly as recorded in the .golden file of
+// the same name.  Run with -update to record new output after an
+// intended change of formatting or routing.
+func TestGoldenReplay(t *testing.T) {
+	captures, err := filepath.Glob(filepath.Join("testdata", "golden",
+		"*.capture"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(captures) == 0 {
+		t.Fatal("Expected captures in testdata/golden")
+	}
+
+	for _, capture := range captures {
+		golden := strings.TrimSuffix(capture, ".capture") + ".golden"
+		t.Run(filepath.Base(capture), func(t *testing.T) {
+			f, err := os.Open(capture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			var got bytes.Buffer
+			if err := replay(f, "golden", nil, &got); err != nil {
+				t.Fatalf("Could not replay: %v", err)
+			}
+
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got.Bytes(),
+					0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Could not read golden output: %v", err)
+			}
+
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatalf("Replay output differs from %s:\n"+
+					"got:  %q\nwant: %q", golden,
+					got.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestStripFrameTimes(t *testing.T) {
+	in := "40 <134>1 2014-01-01T00:00:00Z h t p - - hi" +
+		"40 <134>1 2014-01-01T00:00:01Z h t p - - yo"
+	out, n, err := stripFrameTimes([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "21 <134>1 - h t p - - hi21 <134>1 - h t p - - yo"
+	if n != 2 || string(out) != want {
+		t.Fatalf("Got %d frames, %q; want 2, %q", n, out, want)
+	}
+}
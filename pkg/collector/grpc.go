@@ -0,0 +1,564 @@
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal gRPC service, for clients such as sidecars that would
+// rather push structured records, with flow control and
+// acknowledgements, than speak logfebe.  It has a single method,
+// logfebe.v1.Ingest/Push, described in logfebe.proto: the client
+// streams requests, the first giving the identity to route them by
+// as on the shared TCP port (see shared.go), each carrying log
+// records, and the collector acknowledges each request once its
+// records have been handed to the drain client.  Flow control follows from
+// requests being read only as fast as the drain takes their records.
+//
+// This implements just enough of gRPC over cleartext HTTP/2 for that
+// method, and of the protocol buffers encoding for its messages,
+// rather than pulling in either library.  Compressed messages are
+// refused.
+
+// The path of the Push method.
+const grpcPushPath = "/logfebe.v1.Ingest/Push"
+
+// The largest message accepted, as with gRPC's default.
+const maxGRPCMsgSize = 4 * MB
+
+// gRPC status codes.
+const (
+	grpcOK              = 0
+	grpcCancelled       = 1
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+	grpcUnavailable     = 14
+)
+
+// Count of Push streams presenting an identity that no record being
+// served has, or none at all.
+var unroutedStreams = expvar.NewInt("unrouted_grpc_streams")
+
+// An error ending a stream with a particular status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// The gRPC service, listening on addr, handing each stream to
+// whichever generation admits it from admit.
+type grpcServer struct {
+	addr  string
+	admit chan chan<- grpcAdmission
+}
+
+// The generation taking a stream, which has entered it among its
+// connections, and the routes it serves.
+type grpcAdmission struct {
+	g  *generation
+	rt *sharedRoutes
+}
+
+func newGRPCServer(addr string) *grpcServer {
+	return &grpcServer{addr: addr,
+		admit: make(chan chan<- grpcAdmission)}
+}
+
+// Serve until ctx is done, on the socket passed by the process this
+// one replaces should there be one.  Should the address not be bound
+// at once, as when the process being upgraded from holds it still
+// without passing it, binding is retried.
+func (s *grpcServer) run(ctx context.Context) {
+	defer unregisterHandoff(grpcHandoff)
+
+	l, inherited := takeInherited(grpcHandoff)
+	var backoff time.Duration
+	for {
+		if !inherited {
+			var err error
+			l, err = net.Listen("tcp", s.addr)
+			if err != nil {
+				backoff = nextBackoff(backoff, rebindBackoffMax)
+				log.Printf("cannot listen to %q, retrying in "+
+					"%v: %v", s.addr, backoff, err)
+				if sleepOrDone(ctx, backoff) {
+					return
+				}
+
+				continue
+			}
+
+			registerHandoff(grpcHandoff, l.(*net.TCPListener))
+		}
+		inherited = false
+
+		log.Printf("accepting gRPC streams on %q", l.Addr())
+		if !s.serve(ctx, l) {
+			return
+		}
+
+		backoff = 0
+	}
+}
+
+// Serve streams accepted from l until ctx is done, reporting whether
+// l failed, and is to be bound anew.  Once ctx is done, streams being
+// served are left to end with their generation, as when connections
+// linger through an upgrade.
+func (s *grpcServer) serve(ctx context.Context, l net.Listener) bool {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	srv := &http.Server{Handler: s, Protocols: protocols}
+	stop := context.AfterFunc(ctx, func() {
+		srv.Shutdown(context.Background())
+	})
+	err := srv.Serve(l)
+	stop()
+	if ctx.Err() != nil {
+		return false
+	}
+
+	log.Printf("gRPC server on %q failed, recreating it: %v", s.addr,
+		err)
+	return true
+}
+
+// Admit streams received by s, routing each to one of routes, until
+// g is cancelled.
+func listenGRPC(g *generation, s *grpcServer, routes []serveRecord) {
+	rt := newSharedRoutes(nil, routes)
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case reply := <-s.admit:
+			g.enter(&g.connections)
+			reply <- grpcAdmission{g: g, rt: rt}
+		}
+	}
+}
+
+func (s *grpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"),
+		"application/grpc") {
+		http.Error(w, "expected a gRPC request",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	if r.Method != "POST" || r.URL.Path != grpcPushPath {
+		// A response with trailers only.
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcUnimplemented))
+		w.Header().Set("Grpc-Message", grpcEscape(
+			"unknown method "+r.URL.Path))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	reply := make(chan grpcAdmission, 1)
+	select {
+	case s.admit <- reply:
+	case <-r.Context().Done():
+		return
+	}
+
+	a := <-reply
+	defer a.g.exit(&a.g.connections)
+
+	// End the stream should either the client or the generation
+	// go away.  Closing the body unblocks the read of the next
+	// request.
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	stop := context.AfterFunc(a.g.ctx, func() {
+		cancel(context.Cause(a.g.ctx))
+		r.Body.Close()
+	})
+	defer stop()
+
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	code, msg := grpcStatus(servePush(ctx, r.Body, w, a.rt))
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(msg))
+	}
+}
+
+// The status to end a stream with, having been ended by err.
+func grpcStatus(err error) (int, string) {
+	var ge *grpcError
+	var pe *protocolError
+	var de *drainError
+	var pd *peerDisconnect
+
+	switch {
+	case err == nil:
+		return grpcOK, ""
+	case errors.As(err, &ge):
+		return ge.code, ge.msg
+	case errors.As(err, &pe):
+		return grpcInvalidArgument, err.Error()
+	case errors.As(err, &de):
+		return grpcUnavailable, err.Error()
+	case errors.As(err, &pd):
+		return grpcCancelled, err.Error()
+	}
+
+	// Such as the collector stopping.
+	return grpcUnavailable, err.Error()
+}
+
+// Percent-encode a status message, as gRPC requires of anything
+// outside printable ASCII, and of the percent sign.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Read a message of the stream from r, returning io.EOF should the
+// client have ended the stream.
+func readGRPCMsg(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err == io.EOF {
+		return nil, io.EOF
+	} else if err != nil {
+		return nil, peerDisconnectf("could not read request: %v", err)
+	}
+
+	if hdr[0] != 0 {
+		return nil, &grpcError{code: grpcUnimplemented,
+			msg: "compressed messages are not supported"}
+	}
+
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxGRPCMsgSize {
+		return nil, protocolErrorf("oversized request, msg size is %d",
+			n)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, peerDisconnectf("could not read request: %v", err)
+	}
+
+	return msg, nil
+}
+
+// Append msg to b as a message of the stream.
+func appendGRPCMsg(b, msg []byte) []byte {
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// A PushRequest of logfebe.proto.
+type pushRequest struct {
+	identity string
+	records  [][]byte
+	sequence uint64
+}
+
+func decodePushRequest(b []byte) (*pushRequest, error) {
+	var req pushRequest
+	err := decodeProto(b, func(num, wire int, v uint64, data []byte) error {
+		switch {
+		case num == 1 && wire == protoBytes:
+			req.identity = string(data)
+		case num == 2 && wire == protoBytes:
+			req.records = append(req.records, data)
+		case num == 3 && wire == protoVarint:
+			req.sequence = v
+		case num <= 3:
+			return protocolErrorf("PushRequest field %d has "+
+				"wire type %d", num, wire)
+		}
+
+		return nil
+	})
+
+	return &req, err
+}
+
+// Serve a Push stream, whose requests are read from body and to
+// which acknowledgements are written to w, reporting why it ended,
+// or nil should the client have ended it.
+func servePush(ctx context.Context, body io.ReadCloser, w http.ResponseWriter,
+	rt *sharedRoutes) error {
+	rc := http.NewResponseController(w)
+
+	// Flush the headers, so that the client can begin.
+	if err := rc.Flush(); err != nil {
+		return peerDisconnectf("could not respond: %v", err)
+	}
+
+	msg, err := readGRPCMsg(body)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	req, err := decodePushRequest(msg)
+	if err != nil {
+		return err
+	}
+
+	sr := routeShared(rt.records, req.identity)
+	if sr == nil {
+		unroutedStreams.Add(1)
+		log.Printf("Disconnect gRPC client: no serve record has "+
+			"identity %q", req.identity)
+		return &grpcError{code: grpcNotFound, msg: fmt.Sprintf(
+			"no serve record has identity %q", req.identity)}
+	}
+	log.Printf("gRPC client connects with identifier %q", req.identity)
+
+	cs := registerConn(sr.P, body)
+	defer cs.unregister()
+
+	err = pushRecords(ctx, body, w, rc, req, sr, cs)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("stream closed: %w", context.Cause(ctx))
+	}
+
+	if err != nil {
+		log.Printf("Disconnect gRPC client: %v", err)
+		countDisconnect(sr, err)
+	}
+
+	return err
+}
+
+// Forward the records of req, and of the requests that follow it on
+// body, to the drain of sr, acknowledging each request on w.
+func pushRecords(ctx context.Context, body io.Reader, w io.Writer,
+	rc *http.ResponseController, req *pushRequest, sr *serveRecord,
+	cs *connState) error {
+	bt, closeDrain, err := openDrain(ctx, newTemplateConfig(), sr,
+		req.identity, cs)
+	if err != nil {
+		return err
+	}
+	defer closeDrain()
+
+	p := newPipeline(bt, sr, cs)
+	defer p.close()
+
+	var ack []byte
+	for {
+		for _, data := range req.records {
+			cs.busy("awaiting pipeline")
+			it := p.get()
+			if err := p.err(); err != nil {
+				return &drainError{err}
+			}
+
+			cs.busy("processing")
+			it.received = cs.received(len(data))
+			it.sp = tr.startTrace("grpc.record", spanKindServer)
+			it.sp.setAttr("identity", sr.I)
+			it.sp.setAttr("message.size", strconv.Itoa(len(data)))
+
+			if err := decodeProtoRecord(&it.lr, data); err != nil {
+				return err
+			}
+			it.size = len(data)
+
+			p.put(it)
+		}
+
+		// Acknowledge the request only once its records have
+		// reached the drain client, lest they be lost should
+		// it fail first.
+		cs.busy("awaiting pipeline")
+		if err := p.sync(); err != nil {
+			return &drainError{err}
+		}
+
+		ack = appendGRPCMsg(ack[:0],
+			appendProtoVarint(nil, 1, req.sequence))
+		if _, err := w.Write(ack); err != nil {
+			return peerDisconnectf("could not acknowledge: %v", err)
+		}
+
+		if err := rc.Flush(); err != nil {
+			return peerDisconnectf("could not acknowledge: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		default:
+		}
+
+		cs.idle()
+		msg, err := readGRPCMsg(body)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if req, err = decodePushRequest(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Wire types of the protocol buffers encoding.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Decode b, a message in the protocol buffers encoding, calling f
+// with each field's number and wire type, and its value: v for
+// integers, data, referring to b, for bytes and strings.  Fields
+// of fixed-size types are skipped, no message here having any, and
+// groups refused.
+func decodeProto(b []byte, f func(num, wire int, v uint64,
+	data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return protocolErrorf("malformed field key")
+		}
+		b = b[n:]
+
+		num, wire := int(key>>3), int(key&7)
+		var v uint64
+		var data []byte
+		switch wire {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return protocolErrorf("malformed varint in "+
+					"field %d", num)
+			}
+			b = b[n:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return protocolErrorf("malformed length in "+
+					"field %d", num)
+			}
+			data = b[n : n+int(l) : n+int(l)]
+			b = b[n+int(l):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wire == protoFixed32 {
+				size = 4
+			}
+
+			if len(b) < size {
+				return protocolErrorf("truncated field %d", num)
+			}
+			b = b[size:]
+			continue
+		default:
+			return protocolErrorf("field %d has unsupported "+
+				"wire type %d", num, wire)
+		}
+
+		if err := f(num, wire, v, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append a varint field to b.
+func appendProtoVarint(b []byte, num int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// Decode a LogRecord of logfebe.proto into dst, overwriting every
+// field.  Its strings refer to data, and those that are absent are
+// null, save those that logfebe never sends as null, which are
+// empty.
+func decodeProtoRecord(dst *logRecord, data []byte) error {
+	*dst = logRecord{LogTime: []byte{}, SessionId: []byte{},
+		SessionStart: []byte{}}
+
+	// Fields by number: strings, and integers.
+	strs := [...]*[]byte{1: &dst.LogTime, 2: &dst.UserName,
+		3: &dst.DatabaseName, 5: &dst.ClientAddr, 6: &dst.SessionId,
+		8: &dst.PsDisplay, 9: &dst.SessionStart, 10: &dst.Vxid,
+		13: &dst.SQLState, 14: &dst.ErrMessage, 15: &dst.ErrDetail,
+		16: &dst.ErrHint, 17: &dst.InternalQuery,
+		19: &dst.ErrContext, 20: &dst.UserQuery,
+		22: &dst.FileErrPos, 23: &dst.ApplicationName}
+
+	return decodeProto(data, func(num, wire int, v uint64,
+		b []byte) error {
+		if num < len(strs) && strs[num] != nil {
+			if wire != protoBytes {
+				return protocolErrorf("LogRecord field %d "+
+					"has wire type %d", num, wire)
+			}
+
+			*strs[num] = b
+			return nil
+		}
+
+		switch num {
+		case 4, 7, 11, 12, 18, 21:
+			if wire != protoVarint {
+				return protocolErrorf("LogRecord field %d "+
+					"has wire type %d", num, wire)
+			}
+		default:
+			// Fields of later versions are ignored.
+			return nil
+		}
+
+		switch num {
+		case 4:
+			dst.Pid = int32(v)
+		case 7:
+			dst.SeqNum = int64(v)
+		case 11:
+			dst.Txid = v
+		case 12:
+			dst.ELevel = int32(v)
+		case 18:
+			dst.InternalQueryPos = int32(v)
+		case 21:
+			dst.UserQueryPos = int32(v)
+		}
+
+		return nil
+	})
+}
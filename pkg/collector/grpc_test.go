@@ -0,0 +1,189 @@
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Append a length-delimited field to b.
+func appendProtoBytes(b []byte, num int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// Encode lr as a LogRecord of logfebe.proto, leaving out null
+// strings.
+func encodeProtoRecord(lr *logRecord) []byte {
+	var b []byte
+	for _, f := range []struct {
+		num int
+		s   []byte
+	}{
+		{1, lr.LogTime}, {2, lr.UserName}, {3, lr.DatabaseName},
+		{5, lr.ClientAddr}, {6, lr.SessionId}, {8, lr.PsDisplay},
+		{9, lr.SessionStart}, {10, lr.Vxid}, {13, lr.SQLState},
+		{14, lr.ErrMessage}, {15, lr.ErrDetail}, {16, lr.ErrHint},
+		{17, lr.InternalQuery}, {19, lr.ErrContext},
+		{20, lr.UserQuery}, {22, lr.FileErrPos},
+		{23, lr.ApplicationName},
+	} {
+		if f.s != nil {
+			b = appendProtoBytes(b, f.num, f.s)
+		}
+	}
+
+	b = appendProtoVarint(b, 4, uint64(lr.Pid))
+	b = appendProtoVarint(b, 7, uint64(lr.SeqNum))
+	b = appendProtoVarint(b, 11, lr.Txid)
+	b = appendProtoVarint(b, 12, uint64(lr.ELevel))
+	b = appendProtoVarint(b, 18, uint64(lr.InternalQueryPos))
+	b = appendProtoVarint(b, 21, uint64(lr.UserQueryPos))
+	return b
+}
+
+// Encode a PushRequest of logfebe.proto.
+func encodePushRequest(ident string, seq uint64, records ...[]byte) []byte {
+	var b []byte
+	if ident != "" {
+		b = appendProtoBytes(b, 1, []byte(ident))
+	}
+
+	for _, r := range records {
+		b = appendProtoBytes(b, 2, r)
+	}
+
+	return appendProtoVarint(b, 3, seq)
+}
+
+func TestDecodeProtoRecord(t *testing.T) {
+	want := sampleLogRecord
+	want.InternalQueryPos = -1
+
+	var lr logRecord
+	if err := decodeProtoRecord(&lr, encodeProtoRecord(&want)); err != nil {
+		t.Fatalf("Could not decode: %v", err)
+	}
+
+	if !reflect.DeepEqual(lr, want) {
+		t.Fatalf("Decode mismatch:\n got %s\nwant %s", lr.oneLine(),
+			want.oneLine())
+	}
+
+	// NULL and the empty string must remain distinguishable.
+	if lr.ErrDetail != nil || lr.ErrHint == nil {
+		t.Fatalf("Expected NULL detail and empty hint, got %q and %q",
+			lr.ErrDetail, lr.ErrHint)
+	}
+
+	// Unknown fields are skipped, but not misused ones.
+	data := appendProtoVarint(encodeProtoRecord(&want), 99, 1)
+	if err := decodeProtoRecord(&lr, data); err != nil {
+		t.Fatalf("Could not decode with an unknown field: %v", err)
+	}
+
+	data = appendProtoBytes(encodeProtoRecord(&want), 4, []byte("1"))
+	if err := decodeProtoRecord(&lr, data); err == nil {
+		t.Fatal("Expected a string pid to be refused")
+	}
+
+	data = encodeProtoRecord(&want)
+	if err := decodeProtoRecord(&lr, data[:len(data)-1]); err == nil {
+		t.Fatal("Expected a truncated record to be refused")
+	}
+}
+
+func TestGRPCPush(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+
+	s := newGRPCServer("")
+	g := newGeneration(context.Background())
+	defer g.stop(errShutdown)
+	g.listenGRPC(s, []serveRecord{
+		{sKey: sKey{I: "grpc-apple", P: "/a/log.sock"}, u: *u}})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	srv := &http.Server{Handler: s, Protocols: protocols}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		Protocols: protocols}}
+
+	// Open a Push stream, returning the response and the writer
+	// of its requests.
+	push := func() (*http.Response, *io.PipeWriter) {
+		pr, pw := io.Pipe()
+		req, _ := http.NewRequest("POST", "http://"+l.Addr().String()+
+			grpcPushPath, pr)
+		req.Header.Set("Content-Type", "application/grpc")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Could not push: %v", err)
+		}
+
+		return resp, pw
+	}
+
+	// Finish reading a stream, returning its status.
+	status := func(resp *http.Response) string {
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.Trailer.Get("Grpc-Status")
+	}
+
+	resp, pw := push()
+	go pw.Write(appendGRPCMsg(nil, encodePushRequest("grpc-apple", 7,
+		encodeProtoRecord(&sampleLogRecord))))
+
+	msg, err := readGRPCMsg(resp.Body)
+	if err != nil {
+		t.Fatalf("Could not read ack: %v", err)
+	}
+
+	if seq, _ := binary.Uvarint(msg[1:]); msg[0] != 1<<3 || seq != 7 {
+		t.Fatalf("Expected an ack of 7, got %x", msg)
+	}
+
+	if body := d.next(t); !strings.Contains(body,
+		string(sampleLogRecord.ErrMessage)) {
+		t.Fatalf("Expected the log record to be forwarded, got %q",
+			body)
+	}
+
+	pw.Close()
+	if got := status(resp); got != "0" {
+		t.Fatalf("Expected status OK, got %q", got)
+	}
+
+	// An identity that is not served is refused.
+	resp, pw = push()
+	go func() {
+		pw.Write(appendGRPCMsg(nil, encodePushRequest("grpc-cherry",
+			1)))
+		pw.Close()
+	}()
+
+	if got := status(resp); got != "5" {
+		t.Fatalf("Expected status NOT_FOUND, got %q", got)
+	}
+}
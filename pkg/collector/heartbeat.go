@@ -0,0 +1,68 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Periodically emits a message into a drain attesting that the
+// collector is alive, so that downstream consumers can distinguish a
+// quiet database from a dead collector.
+//
+// A nil *heartbeat is valid and does nothing, which is convenient for
+// serve records that have not enabled heartbeats.
+type heartbeat struct {
+	// Messages forwarded since the last heartbeat was emitted.
+	// Accessed atomically.
+	forwarded uint64
+
+	interval time.Duration
+}
+
+func newHeartbeat(interval time.Duration) *heartbeat {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &heartbeat{interval: interval}
+}
+
+// Record that a message has been forwarded to the drain.
+func (hb *heartbeat) count() {
+	if hb == nil {
+		return
+	}
+
+	atomic.AddUint64(&hb.forwarded, 1)
+}
+
+// Emit heartbeats into the drain until ctx is cancelled.  Intended
+// to be run in its own goroutine.
+func (hb *heartbeat) run(ctx context.Context, bt *batcher) {
+	if hb == nil {
+		return
+	}
+
+	ticker := time.NewTicker(hb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n := atomic.SwapUint64(&hb.forwarded, 0)
+			msg := fmt.Sprintf("collector alive, %d msgs "+
+				"forwarded in last %v", n, hb.interval)
+
+			err := bt.add(134, time.Now(),
+				"postgres", "pg_logplexcollector", []byte(msg))
+			if err != nil {
+				log.Printf("could not buffer heartbeat: %v", err)
+			}
+		}
+	}
+}
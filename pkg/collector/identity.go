@@ -0,0 +1,75 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+)
+
+// What to do with a connection whose identification message names
+// neither the identity of its socket's serve record nor one of the
+// record's aliases, as set by the record's "identity_mismatch".
+const (
+	// Disconnect the client, as ever.
+	mismatchReject = "reject"
+
+	// Report the mismatch, then serve the client as though it had
+	// presented the record's identity.
+	mismatchWarn = "warn"
+
+	// Hold the connection, discarding what it sends; see
+	// quarantine.go.
+	mismatchQuarantine = "quarantine"
+)
+
+// Count of connections served despite presenting an unexpected
+// identity, keyed by the identity of the socket they connected to.
+var mismatchedConns = expvar.NewMap("mismatched_identities")
+
+func checkIdentityMismatch(policy string) error {
+	switch policy {
+	case "", mismatchReject, mismatchWarn, mismatchQuarantine:
+		return nil
+	}
+
+	return fmt.Errorf("unknown \"identity_mismatch\" %q, expected "+
+		"%q, %q or %q", policy, mismatchReject, mismatchWarn,
+		mismatchQuarantine)
+}
+
+// Report whether a client identifying itself as ident is to be served
+// by sr as is: whether ident is sr's identity, or one of its aliases,
+// as when a database has been renamed but its clients not yet
+// reconfigured.
+func (sr *serveRecord) accepts(ident string) bool {
+	if ident == sr.I {
+		return true
+	}
+
+	for _, alias := range sr.Aliases {
+		if ident == alias {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Handle a client of the socket of sr that identified itself as
+// ident, which sr does not accept, according to sr's policy.  Returns
+// nil only should the client be served regardless.
+func identityMismatch(ctx context.Context, msgInit msgInit, sr *serveRecord,
+	ident string) error {
+	switch sr.IdentityMismatch {
+	case mismatchWarn:
+		mismatchedConns.Add(sr.I, 1)
+		emitOpsEvent("unknown_identity", "socket=%q expected=%q "+
+			"identity=%q action=accept", sr.P, sr.I, ident)
+		return nil
+	case mismatchQuarantine:
+		return quarantine(ctx, msgInit, sr, ident)
+	}
+
+	return protocolErrorf("got unexpected identifier for socket: "+
+		"path %s, expected %s, got %s", sr.P, sr.I, ident)
+}
@@ -0,0 +1,96 @@
+package collector
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestServeRecordAccepts(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "apple"},
+		Aliases: []string{"apple-old", "apple-older"}}
+
+	for _, ident := range []string{"apple", "apple-old", "apple-older"} {
+		if !sr.accepts(ident) {
+			t.Errorf("Expected %q to be accepted", ident)
+		}
+	}
+
+	for _, ident := range []string{"", "banana", "apple-"} {
+		if sr.accepts(ident) {
+			t.Errorf("Expected %q not to be accepted", ident)
+		}
+	}
+}
+
+func TestIdentityMismatchWarn(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	defer func(saved *logplexc.Client) { opsDrain = saved }(opsDrain)
+	opsDrain = nil
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+
+	conn := &bufConn{}
+	conn.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+	conn.Write(frameMsg('I', []byte("banana\x00")))
+	conn.Write(frameMsg('L', encodeLogRecord(&sampleLogRecord)))
+
+	sr := &serveRecord{sKey: sKey{I: "warn-apple", P: "/p1/log.sock"},
+		u: *u, IdentityMismatch: mismatchWarn}
+	logWorker(context.Background(), conn, logplexc.Config{
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		Period:      10 * time.Millisecond,
+	}, sr)
+
+	if got := mismatchedConns.Get(sr.I).String(); got != "1" {
+		t.Errorf("Expected one mismatched connection, got %s", got)
+	}
+
+	// The record is forwarded, as though the client had presented
+	// the expected identity.
+	if body := d.next(t); !strings.Contains(body,
+		string(sampleLogRecord.ErrMessage)) {
+		t.Fatalf("Expected the log record to be forwarded, got %q",
+			body)
+	}
+}
+
+func TestParseIdentityMismatch(t *testing.T) {
+	var sdb serveDb
+	routes, err := sdb.parse([]byte(`{"serves": [
+		{"i": "apple", "p": "/p1/log.sock", "url": "https://localhost",
+		 "aliases": ["apple-old"], "identity_mismatch": "quarantine"}]}`))
+	if err != nil {
+		t.Fatalf("Could not parse: %v", err)
+	}
+
+	sr := routes[sKey{I: "apple", P: "/p1/log.sock"}]
+	if sr == nil || sr.IdentityMismatch != mismatchQuarantine ||
+		len(sr.Aliases) != 1 || sr.Aliases[0] != "apple-old" {
+		t.Fatalf("Unexpected record: %+v", sr)
+	}
+
+	for _, bad := range []string{
+		`"identity_mismatch": "ignore"`,
+		`"identity_mismatch": true`,
+		`"aliases": "apple-old"`,
+		`"aliases": [""]`,
+		`"aliases": [1]`,
+	} {
+		_, err := sdb.parse([]byte(`{"serves": [{"i": "apple", ` +
+			`"p": "/p1/log.sock", "url": "https://localhost", ` +
+			bad + `}]}`))
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"expvar"
+	"net"
+	"time"
+)
+
+// Connections on which no message begins for this long are closed,
+// so that peers that vanished without closing their connection, such
+// as after a crash of their host, do not hold a worker and a drain
+// client forever.  Zero, the default, disables the timeout, as a
+// quiet database may legitimately log nothing for a long time.
+var idleTimeout time.Duration
+
+// Count of connections closed for idleness, keyed by identity.
+var idleTimeouts = expvar.NewMap("idle_timeouts")
+
+// Implemented by connections supporting read timeouts, such as
+// net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Allow the connection idleTimeout from now to send its next
+// message, or window should that be shorter and non-zero, as for
+// clients sending keepalives.  Connections that cannot time out are
+// left alone.
+func extendIdleDeadline(conn interface{}, now time.Time,
+	window time.Duration) {
+	d := idleTimeout
+	if window > 0 && (d <= 0 || window < d) {
+		d = window
+	}
+
+	rd, ok := conn.(readDeadliner)
+	if !ok || d <= 0 {
+		return
+	}
+
+	rd.SetReadDeadline(now.Add(d))
+}
+
+// Report whether err is the expiry of a read deadline.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+func TestIdleDeadline(t *testing.T) {
+	defer func(saved time.Duration) { idleTimeout = saved }(idleTimeout)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Disabled, the deadline is never set, so a silent peer is
+	// waited for indefinitely.
+	idleTimeout = 0
+	extendIdleDeadline(server, time.Now(), 0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Write([]byte{'x'})
+	}()
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("Expected read without deadline, got %v", err)
+	}
+
+	// Enabled, a silent peer times out, and this is recognized
+	// through the message stream.
+	idleTimeout = 20 * time.Millisecond
+	extendIdleDeadline(server, time.Now(), 0)
+
+	var m core.Message
+	err := core.NewBackendStream(server).Next(&m)
+	if !isTimeout(err) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	// Connections without deadlines are left alone.
+	extendIdleDeadline(&bufConn{}, time.Now(), 0)
+}
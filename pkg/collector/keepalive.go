@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// A client may advertise in its version message that it sends a
+// message at least every so often, sending keepalive ('K') messages
+// should it have nothing to log.  Should nothing then arrive for a few
+// such intervals, the connection is closed, so that one left half-open
+// by a peer whose host vanished, or that was partitioned away, is
+// noticed within seconds rather than when the idle timeout, if any,
+// expires.
+
+// The keepalive intervals a client may advertise.
+const (
+	minKeepalive = time.Second
+	maxKeepalive = 5 * time.Minute
+)
+
+// How many keepalive intervals may pass without a message before the
+// connection is closed, allowing for keepalives delayed by a busy
+// client or network.
+const keepaliveMisses = 3
+
+// Count of connections closed for missing their keepalives, keyed by
+// identity.
+var keepaliveTimeouts = expvar.NewMap("keepalive_timeouts")
+
+// How long a client advertising caps may send nothing for before its
+// connection is closed; zero if there is no such limit.
+func (caps capabilities) window() time.Duration {
+	return keepaliveMisses * caps.keepalive
+}
+
+// Wrap msgInit to skip keepalive messages, which show only that the
+// client is alive, and are accepted whether or not it advertised
+// sending them.
+func skipKeepalives(msgInit msgInit) msgInit {
+	return func(m *core.Message) error {
+		for {
+			if err := msgInit(m); err != nil {
+				return err
+			}
+
+			if m.MsgType() != 'K' {
+				return nil
+			}
+
+			if m.Size() > maxHandshakeMsgSize {
+				return protocolErrorf("oversized keepalive "+
+					"message, msg size is %d", m.Size())
+			}
+
+			if _, err := m.Force(); err != nil {
+				return peerDisconnectf("could not read "+
+					"keepalive: %v", err)
+			}
+		}
+	}
+}
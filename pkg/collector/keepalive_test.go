@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	for _, tt := range []struct {
+		caps      string
+		keepalive time.Duration
+		ok        bool
+	}{
+		{"", 0, true},
+		{"keepalive=5\x00", 5 * time.Second, true},
+		{"compression=zstd\x00keepalive=2\x00", 2 * time.Second, true},
+		{"keepalive=0\x00", 0, false},
+		{"keepalive=3600\x00", 0, false},
+		{"keepalive=soon\x00", 0, false},
+		{"checksum=crc32c\x00", 0, true},
+		{"checksum=md5\x00", 0, false},
+	} {
+		msgInit := func(dst *core.Message) error {
+			dst.InitFromBytes('V',
+				[]byte("PG-9.4.0/logfebe-1\x00"+tt.caps))
+			return nil
+		}
+
+		caps, err := processVerMsg(msgInit)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: expected ok %v, got %v", tt.caps, tt.ok,
+				err)
+		} else if caps.keepalive != tt.keepalive {
+			t.Errorf("%q: expected keepalive %v, got %v", tt.caps,
+				tt.keepalive, caps.keepalive)
+		}
+	}
+}
+
+func TestSkipKeepalives(t *testing.T) {
+	conn := &bufConn{}
+	conn.Write(frameMsg('K', nil))
+	conn.Write(frameMsg('K', []byte("ignored")))
+	conn.Write(frameMsg('L', encodeLogRecord(&sampleLogRecord)))
+	conn.Write(frameMsg('K', nil))
+	stream := core.NewBackendStream(conn)
+
+	msgInit := skipKeepalives(func(m *core.Message) error {
+		return stream.Next(m)
+	})
+
+	var m core.Message
+	if err := msgInit(&m); err != nil || m.MsgType() != 'L' {
+		t.Fatalf("Expected the log record, got %c: %v", m.MsgType(),
+			err)
+	}
+	m.Force()
+
+	if err := msgInit(&m); err != io.EOF {
+		t.Fatalf("Expected the end of the stream, got %c: %v",
+			m.MsgType(), err)
+	}
+}
+
+func TestKeepaliveDeadline(t *testing.T) {
+	defer func(saved time.Duration) { idleTimeout = saved }(idleTimeout)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The window of a client sending keepalives is shorter than
+	// the idle timeout, and so applies.
+	idleTimeout = time.Hour
+	extendIdleDeadline(server, time.Now(), 20*time.Millisecond)
+	if _, err := server.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	// As it does without an idle timeout at all.
+	idleTimeout = 0
+	extendIdleDeadline(server, time.Now(), 20*time.Millisecond)
+	if _, err := server.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	if w := (capabilities{keepalive: 2 * time.Second}).window(); w !=
+		keepaliveMisses*2*time.Second {
+		t.Fatalf("Unexpected keepalive window %v", w)
+	}
+}
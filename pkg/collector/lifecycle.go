@@ -0,0 +1,207 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long the goroutines of a retired generation have to exit
+// before they are reported as leaked.
+var generationExitTimeout = 30 * time.Second
+
+// Causes of the cancellation of a generation, reported by its
+// listeners as they exit.
+var (
+	errRetired  = errors.New("serve database reloaded")
+	errShutdown = errors.New("collector shutting down")
+	errUpgrade  = errors.New("collector upgrading")
+)
+
+// The listeners and workers started for one version of the serve
+// database.  Cancelling its context tells them all to exit, after
+// which they can be waited for, so that goroutines that fail to exit
+// are noticed rather than accumulating unseen.
+type generation struct {
+	id     uint64
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	wg sync.WaitGroup
+
+	// Listener goroutines running, and connections being served
+	// or queued for a worker.  Accessed atomically.
+	listeners   int64
+	connections int64
+
+	retired int32
+
+	// The connection limits of the records served, keyed by
+	// record, shared by their sockets and the shared port.
+	limitersMu sync.Mutex
+	limiters   map[sKey]*connLimiter
+}
+
+// Generations that have goroutines still running, or have not yet
+// been retired, keyed by id.
+var generations = struct {
+	sync.Mutex
+	next uint64
+	m    map[uint64]*generation
+}{m: make(map[uint64]*generation)}
+
+// Create a generation, which is cancelled should parent be.
+func newGeneration(parent context.Context) *generation {
+	generations.Lock()
+	defer generations.Unlock()
+
+	generations.next += 1
+	g := &generation{id: generations.next,
+		limiters: make(map[sKey]*connLimiter)}
+	g.ctx, g.cancel = context.WithCancelCause(parent)
+
+	generations.m[g.id] = g
+	return g
+}
+
+// Record the start of a unit of work counted by n.  This must happen
+// before the work is handed to another goroutine, while the caller
+// is itself counted, so that await cannot miss it.
+func (g *generation) enter(n *int64) {
+	g.wg.Add(1)
+	atomic.AddInt64(n, 1)
+}
+
+// Record the end of a unit of work begun with enter.
+func (g *generation) exit(n *int64) {
+	atomic.AddInt64(n, -1)
+	g.wg.Done()
+}
+
+// Run f in a goroutine counted by n.
+func (g *generation) spawn(n *int64, f func()) {
+	g.enter(n)
+	go func() {
+		defer g.exit(n)
+		f()
+	}()
+}
+
+// The connection limits of sr in this generation.
+func (g *generation) limiter(sr *serveRecord) *connLimiter {
+	g.limitersMu.Lock()
+	defer g.limitersMu.Unlock()
+
+	cl, ok := g.limiters[sr.sKey]
+	if !ok {
+		cl = newConnLimiter(g, sr)
+		g.limiters[sr.sKey] = cl
+	}
+
+	return cl
+}
+
+// Serve sr from l, which was bound for this generation.
+func (g *generation) listen(sr *serveRecord, l net.Listener) {
+	g.spawn(&g.listeners, func() { listen(g, sr, l) })
+}
+
+// Serve the records of routes to the clients of s, the shared TCP
+// listener.
+func (g *generation) listenShared(s *sharedListener, routes []serveRecord) {
+	g.spawn(&g.listeners, func() { listenShared(g, s, routes) })
+}
+
+// Serve the records of routes to the streams of s, the gRPC service.
+func (g *generation) listenGRPC(s *grpcServer, routes []serveRecord) {
+	g.spawn(&g.listeners, func() { listenGRPC(g, s, routes) })
+}
+
+// Tell every goroutine of the generation to exit, for the reason
+// cause.  Safe to call more than once, the first cause given being
+// the one reported.
+func (g *generation) stop(cause error) {
+	atomic.StoreInt32(&g.retired, 1)
+	g.cancel(cause)
+}
+
+// Wait up to timeout for every goroutine of the generation to exit,
+// reporting whether they did.  Once they have, whenever that is, the
+// generation is forgotten.
+func (g *generation) await(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+
+		generations.Lock()
+		delete(generations.m, g.id)
+		generations.Unlock()
+
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop the generation and, in the background, check that its
+// goroutines exit, logging those that do not.
+func (g *generation) retire() {
+	g.stop(errRetired)
+
+	go func() {
+		if g.await(generationExitTimeout) {
+			return
+		}
+
+		log.Printf("generation %d: %d listeners and %d connections "+
+			"still running %v after being told to exit",
+			g.id, atomic.LoadInt64(&g.listeners),
+			atomic.LoadInt64(&g.connections), generationExitTimeout)
+	}()
+}
+
+// Counts of the goroutines of a generation, for diagnostics.
+type generationStats struct {
+	Listeners   int64 `json:"listeners"`
+	Connections int64 `json:"connections"`
+	Retired     bool  `json:"retired"`
+}
+
+func (g *generation) stats() generationStats {
+	return generationStats{
+		Listeners:   atomic.LoadInt64(&g.listeners),
+		Connections: atomic.LoadInt64(&g.connections),
+		Retired:     atomic.LoadInt32(&g.retired) != 0,
+	}
+}
+
+// Report the stats of every generation still being tracked, keyed
+// by id.
+func generationSnapshot() map[string]generationStats {
+	generations.Lock()
+	defer generations.Unlock()
+
+	m := make(map[string]generationStats, len(generations.m))
+	for id, g := range generations.m {
+		m[strconv.FormatUint(id, 10)] = g.stats()
+	}
+
+	return m
+}
+
+func init() {
+	expvar.Publish("generations", expvar.Func(func() interface{} {
+		return generationSnapshot()
+	}))
+}
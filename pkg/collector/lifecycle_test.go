@@ -0,0 +1,48 @@
+package collector
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGenerationAwait(t *testing.T) {
+	g := newGeneration(context.Background())
+
+	for i := 0; i < 3; i += 1 {
+		g.spawn(&g.listeners, func() { <-g.ctx.Done() })
+	}
+
+	g.enter(&g.connections)
+	st := generationSnapshot()[strconv.FormatUint(g.id, 10)]
+	if st != (generationStats{Listeners: 3, Connections: 1}) {
+		t.Fatalf("Unexpected stats for a running generation: %+v", st)
+	}
+
+	g.stop(errRetired)
+	g.stop(errShutdown)
+	if g.await(50 * time.Millisecond) {
+		t.Fatal("Expected a generation with a connection still " +
+			"being served not to finish")
+	}
+
+	if st := g.stats(); st.Listeners != 0 || st.Connections != 1 ||
+		!st.Retired {
+		t.Fatalf("Expected only the connection to remain: %+v", st)
+	}
+
+	// The first reason given is the one reported.
+	if err := context.Cause(g.ctx); err != errRetired {
+		t.Fatalf("Expected the generation to be retired, got %v", err)
+	}
+
+	g.exit(&g.connections)
+	if !g.await(time.Second) {
+		t.Fatal("Expected the generation to finish")
+	}
+
+	if _, ok := generationSnapshot()[strconv.FormatUint(g.id, 10)]; ok {
+		t.Fatal("Expected a finished generation to be forgotten")
+	}
+}
@@ -0,0 +1,190 @@
+package collector
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBindListenerCreatesDirectory(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	defer func(saved os.FileMode) { socketDirMode = saved }(socketDirMode)
+	socketDirMode = 0750
+
+	sr := &serveRecord{sKey: sKey{
+		I: "apple",
+		P: filepath.Join(name, "cluster", "run", "log.sock"),
+	}}
+
+	l, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Stat(filepath.Dir(sr.P))
+	if err != nil {
+		t.Fatalf("Expected socket directory to be created: %v", err)
+	}
+
+	if perm := fi.Mode().Perm(); perm&^0750 != 0 {
+		t.Fatalf("Expected directory mode within 0750, got %v", perm)
+	}
+
+	if fi, err := os.Stat(sr.P); err != nil ||
+		fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("Expected a socket at %q: %v", sr.P, err)
+	}
+}
+
+func TestBindListenerSocketOwnership(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	// Only the group can be changed unprivileged, and only to one
+	// of our own.
+	sr := &serveRecord{sKey: sKey{
+		I: "apple",
+		P: filepath.Join(name, "apple", "log.sock"),
+	}, SocketOwnership: &socketOwnership{UID: -1, GID: os.Getgid(),
+		DirMode: 0710}}
+
+	// The mode of an existing directory is corrected.
+	if err := os.Mkdir(filepath.Dir(sr.P), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+	defer l.Close()
+
+	if fi, err := os.Stat(filepath.Dir(sr.P)); err != nil {
+		t.Fatalf("Expected socket directory: %v", err)
+	} else if perm := fi.Mode().Perm(); perm != 0710 {
+		t.Fatalf("Expected directory mode 0710, got %v", perm)
+	}
+
+	if fi, err := os.Stat(sr.P); err != nil {
+		t.Fatalf("Expected a socket at %q: %v", sr.P, err)
+	} else if perm := fi.Mode().Perm(); perm != 0660 {
+		t.Fatalf("Expected socket mode 0660, got %v", perm)
+	}
+
+	// Links planted in place of the directory are not followed.
+	link := &serveRecord{sKey: sKey{
+		I: "banana",
+		P: filepath.Join(name, "banana", "log.sock"),
+	}, SocketOwnership: sr.SocketOwnership}
+	if err := os.Symlink(filepath.Dir(sr.P),
+		filepath.Dir(link.P)); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := bindListener(context.Background(), link); err == nil {
+		l.Close()
+		t.Fatal("Expected a linked directory to be refused")
+	}
+}
+
+func TestNextBackoff(t *testing.T) {
+	var d time.Duration
+	var got []time.Duration
+	for i := 0; i < 10; i += 1 {
+		d = nextBackoff(d, 100*time.Millisecond)
+		got = append(got, d)
+	}
+
+	want := []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond,
+		20 * time.Millisecond, 40 * time.Millisecond,
+		80 * time.Millisecond, 100 * time.Millisecond,
+		100 * time.Millisecond, 100 * time.Millisecond,
+		100 * time.Millisecond, 100 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got backoffs %v, want %v", got, want)
+	}
+}
+
+func TestRebindListener(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	// A path that cannot be bound is retried until cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	bad := &serveRecord{sKey: sKey{I: "apple",
+		P: filepath.Join(name, "missing", "\x00", "log.sock")}}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if l := rebindListener(ctx, bad); l != nil {
+		l.Close()
+		t.Fatal("Expected rebinding an invalid path to fail")
+	}
+
+	// Otherwise, the socket is recreated.
+	good := &serveRecord{sKey: sKey{I: "apple",
+		P: filepath.Join(name, "log.sock")}}
+	l := rebindListener(context.Background(), good)
+	if l == nil {
+		t.Fatal("Expected listener to be recreated")
+	}
+	l.Close()
+}
+
+func TestCloseOnDone(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	sr := &serveRecord{sKey: sKey{I: "apple",
+		P: filepath.Join(name, "log.sock")}}
+	l, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lc := closeOnDone(ctx, l)
+
+	accepted := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	cancel()
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatal("Expected Accept to fail once closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after cancellation")
+	}
+
+	// The socket is left for the next generation.
+	if _, err := os.Stat(sr.P); err != nil {
+		t.Fatalf("Retired socket was unlinked: %v", err)
+	}
+
+	// A listener recreated after cancellation is closed at once.
+	os.Remove(sr.P)
+	l2, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+	if lc.replace(l2) {
+		t.Fatal("Expected replacement after cancellation to be refused")
+	}
+	if _, err := l2.Accept(); err == nil {
+		t.Fatal("Expected replacement to be closed")
+	}
+}
@@ -0,0 +1,178 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The collector's own diagnostics are logged at one of two levels:
+// info, the default, and debug, which adds detail too voluminous for
+// normal operation: every connection accepted, every poll of the serve
+// databases, and what became of every message received.  The level is
+// set by LOG_LEVEL, and may be changed while running through the
+// control socket (see control.go) or by SIGHUP.
+//
+// As debug output is so voluminous, debug logging set while running
+// may be limited to a single identity, and always ends after a time,
+// debugLogDuration unless given otherwise.
+type logLevel int32
+
+const (
+	levelInfo logLevel = iota
+	levelDebug
+)
+
+var logLevelNames = []string{
+	levelInfo:  "info",
+	levelDebug: "debug",
+}
+
+func (l logLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return fmt.Sprintf("logLevel(%d)", int32(l))
+	}
+
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range logLevelNames {
+		if s == name {
+			return logLevel(l), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %q: must be one of %v",
+		s, logLevelNames)
+}
+
+// How long debug logging set while running lasts, unless given
+// otherwise.
+const debugLogDuration = 15 * time.Minute
+
+// How the collector logs.
+type logState struct {
+	level logLevel
+
+	// Should it be set, the only identity debug output about
+	// connections and messages is given for; other debug output
+	// is suppressed.
+	ident string
+
+	// When the level reverts to info, or the zero time should it
+	// not.
+	until time.Time
+}
+
+// The current logState, a *logState, replaced rather than modified.
+var logging atomic.Value
+
+func init() {
+	logging.Store(&logState{level: levelInfo})
+}
+
+func currentLogging() *logState {
+	return logging.Load().(*logState)
+}
+
+// Log at level l for good.
+func setLogLevel(l logLevel) {
+	logging.Store(&logState{level: l})
+}
+
+// Log at level l, with any debug output limited to ident, should it
+// be given, for d, or for good should d be zero.
+func setLogging(l logLevel, ident string, d time.Duration) *logState {
+	st := &logState{level: l, ident: ident}
+	if d > 0 {
+		st.until = time.Now().Add(d)
+	}
+
+	logging.Store(st)
+	if d > 0 {
+		time.AfterFunc(d, func() {
+			// Unless the level has been changed since.
+			if logging.CompareAndSwap(st,
+				&logState{level: levelInfo}) {
+				log.Printf("%v ends, logging at level %v",
+					st, levelInfo)
+			}
+		})
+	}
+
+	return st
+}
+
+func getLogLevel() logLevel {
+	return currentLogging().level
+}
+
+// Describe st, as in `debug for identity "app" until 12:00:00`.
+func (st *logState) String() string {
+	s := st.level.String()
+	if st.ident != "" {
+		s += fmt.Sprintf(" for identity %q", st.ident)
+	}
+
+	if !st.until.IsZero() {
+		s += " until " + st.until.Format(time.RFC3339)
+	}
+
+	return s
+}
+
+// Report whether debug output about the connections and messages of
+// ident is to be logged.
+func debugging(ident string) bool {
+	st := currentLogging()
+	return st.level >= levelDebug && (st.ident == "" || st.ident == ident)
+}
+
+// Log, as with log.Printf, should the level be debug for every
+// identity.
+func debugf(format string, v ...interface{}) {
+	if debugging("") {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// Log, as with log.Printf, should the level be debug for ident.
+func debugIdentf(ident, format string, v ...interface{}) {
+	if debugging(ident) {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// Switch between info and debug logging, for every identity and for
+// debugLogDuration, whenever SIGHUP is received, until ctx is done.
+func toggleDebugOnSignal(ctx context.Context) {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigch)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigch:
+			}
+
+			st := &logState{level: levelInfo}
+			if getLogLevel() < levelDebug {
+				st = setLogging(levelDebug, "", debugLogDuration)
+			} else {
+				setLogLevel(levelInfo)
+			}
+
+			log.Printf("got SIGHUP, logging at level %v", st)
+		}
+	}()
+}
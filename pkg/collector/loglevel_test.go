@@ -0,0 +1,80 @@
+package collector
+
+import (
+	"bytes"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScopedDebugLogging(t *testing.T) {
+	defer setLogLevel(levelInfo)
+
+	if debugging("") || debugging("log-apple") {
+		t.Fatal("Expected no debug logging by default")
+	}
+
+	st := setLogging(levelDebug, "log-apple", time.Hour)
+	if !debugging("log-apple") {
+		t.Fatal("Expected debug logging for the identity")
+	} else if debugging("log-banana") || debugging("") {
+		t.Fatal("Expected debug logging only for the identity")
+	}
+
+	if s := st.String(); !strings.HasPrefix(s,
+		`debug for identity "log-apple" until `) {
+		t.Fatalf("Unexpected description %q", s)
+	}
+
+	// Debug logging ends in time, unless changed since.
+	setLogging(levelDebug, "", 10*time.Millisecond)
+	if !debugging("log-banana") || !debugging("") {
+		t.Fatal("Expected debug logging for every identity")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for getLogLevel() != levelInfo {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for debug logging to end")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	setLogging(levelDebug, "", 10*time.Millisecond)
+	setLogLevel(levelDebug)
+	time.Sleep(30 * time.Millisecond)
+	if getLogLevel() != levelDebug {
+		t.Fatal("Expected a level set since to stand")
+	}
+}
+
+func TestRouteDebug(t *testing.T) {
+	defer setLogLevel(levelInfo)
+
+	var b bytes.Buffer
+	log.SetOutput(&b)
+	defer log.SetOutput(os.Stderr)
+
+	p := &pipeline{sr: &serveRecord{sKey: sKey{I: "log-apple",
+		P: "/p1/log.sock"}, u: url.URL{Host: "drain.example.com"}}}
+	it := &pipeItem{lr: sampleLogRecord, size: 100}
+
+	p.route(it, "forwarded")
+	if b.Len() != 0 {
+		t.Fatalf("Expected nothing logged at level info, got %q",
+			b.String())
+	}
+
+	setLogging(levelDebug, "log-apple", time.Hour)
+	p.route(it, "forwarded")
+	want := `debug: identity "log-apple" on "/p1/log.sock": message ` +
+		"of session 53621a50.4d2, sequence 7, 100 bytes, ERROR to " +
+		"drain.example.com: forwarded"
+	if got := b.String(); !strings.Contains(got, want) {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,450 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Postgres error levels, as found in logRecord.ELevel.  These are
+// the values of elog.h for the supported Postgres versions.
+const (
+	elevelDebug5    = 10
+	elevelDebug4    = 11
+	elevelDebug3    = 12
+	elevelDebug2    = 13
+	elevelDebug1    = 14
+	elevelLog       = 15
+	elevelCommError = 16
+	elevelInfo      = 17
+	elevelNotice    = 18
+	elevelWarning   = 19
+	elevelError     = 20
+	elevelFatal     = 21
+	elevelPanic     = 22
+)
+
+// The names Postgres gives error levels in its own logs.
+var elevelNames = map[int32]string{
+	elevelDebug5: "DEBUG",
+	elevelDebug4: "DEBUG",
+	elevelDebug3: "DEBUG",
+	elevelDebug2: "DEBUG",
+	elevelDebug1: "DEBUG",
+	elevelLog:    "LOG",
+
+	// Logged only to the server log, where it reads as LOG.
+	elevelCommError: "LOG",
+
+	elevelInfo:    "INFO",
+	elevelNotice:  "NOTICE",
+	elevelWarning: "WARNING",
+	elevelError:   "ERROR",
+	elevelFatal:   "FATAL",
+	elevelPanic:   "PANIC",
+}
+
+// The name of error level e, as Postgres would log it, or "LEVEL"
+// followed by its number should it be unknown.
+func elevelName(e int32) string {
+	if name, ok := elevelNames[e]; ok {
+		return name
+	}
+
+	return "LEVEL" + strconv.Itoa(int(e))
+}
+
+// A log record as sent by pg_logfebe.
+//
+// To avoid allocation when parsing, string fields are slices of the
+// message payload they were parsed from, and so are only valid for as
+// long as that payload is.  Nullable fields are nil if NULL; an empty
+// but present string is a non-nil, zero-length slice.
+type logRecord struct {
+	LogTime          []byte
+	UserName         []byte
+	DatabaseName     []byte
+	Pid              int32
+	ClientAddr       []byte
+	SessionId        []byte
+	SeqNum           int64
+	PsDisplay        []byte
+	SessionStart     []byte
+	Vxid             []byte
+	Txid             uint64
+	ELevel           int32
+	SQLState         []byte
+	ErrMessage       []byte
+	ErrDetail        []byte
+	ErrHint          []byte
+	InternalQuery    []byte
+	InternalQueryPos int32
+	ErrContext       []byte
+	UserQuery        []byte
+	UserQueryPos     int32
+	FileErrPos       []byte
+	ApplicationName  []byte
+}
+
+func (lr *logRecord) oneLine() []byte {
+	buf := bytes.Buffer{}
+
+	wd := func() {
+		buf.WriteByte(' ')
+	}
+
+	ws := func(name string, s []byte) {
+		buf.WriteString(fmt.Sprintf("%s=%q", name, s))
+	}
+
+	wns := func(name string, s []byte) {
+		body := func() string {
+			if s == nil {
+				return "NULL"
+			}
+
+			return fmt.Sprintf("[%q]", s)
+		}()
+
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.WriteString(body)
+	}
+
+	wnum := func(name string, n interface{}) {
+		buf.WriteString(fmt.Sprintf("%s=%d", name, n))
+	}
+
+	ws("LogTime", lr.LogTime)
+	wd()
+	wns("UserName", lr.UserName)
+	wd()
+	wns("DatabaseName", lr.DatabaseName)
+	wd()
+	wnum("Pid", lr.Pid)
+	wd()
+	wns("ClientAddr", lr.ClientAddr)
+	wd()
+	ws("SessionId", lr.SessionId)
+	wd()
+	wnum("SeqNum", lr.SeqNum)
+	wd()
+	wns("PsDisplay", lr.PsDisplay)
+	wd()
+	ws("SessionStart", lr.SessionStart)
+	wd()
+	wns("Vxid", lr.Vxid)
+	wd()
+	wnum("Txid", lr.Txid)
+	wd()
+	wnum("ELevel", lr.ELevel)
+	wd()
+	wns("SQLState", lr.SQLState)
+	wd()
+	wns("ErrMessage", lr.ErrMessage)
+	wd()
+	wns("ErrDetail", lr.ErrDetail)
+	wd()
+	wns("ErrHint", lr.ErrHint)
+	wd()
+	wns("InternalQuery", lr.InternalQuery)
+	wd()
+	wnum("InternalQueryPos", lr.InternalQueryPos)
+	wd()
+	wns("ErrContext", lr.ErrContext)
+	wd()
+	wns("UserQuery", lr.UserQuery)
+	wd()
+	wnum("UserQueryPos", lr.UserQueryPos)
+	wd()
+	wns("FileErrPos", lr.FileErrPos)
+	wd()
+	wns("ApplicationName", lr.ApplicationName)
+
+	return buf.Bytes()
+}
+
+// Layouts in which Postgres renders log times, depending on whether
+// log_timezone has an abbreviation or is rendered as a numeric
+// offset.  Numeric offsets are tried first, as Go is also willing to
+// interpret them as abbreviations.
+var logTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -07",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05.999999999 -07:00",
+	"2006-01-02 15:04:05.999999999 MST",
+}
+
+var errAmbiguousZone = errors.New("log time has a time zone " +
+	"abbreviation with an unknown offset")
+
+// Parse a LogTime value such as "2014-05-01 12:34:56.789 UTC".
+//
+// Zone abbreviations other than UTC and GMT are only understood if
+// they are in use by the collector's local time zone; otherwise
+// errAmbiguousZone is returned, as Go would otherwise silently
+// interpret them as UTC.
+func parseLogTime(s string) (time.Time, error) {
+	return parseLogTimeIn(s, time.Local)
+}
+
+// Like parseLogTime, but understanding the zone abbreviations in use
+// by loc, which should be the log_timezone of the Postgres server.
+func parseLogTimeIn(s string, loc *time.Location) (time.Time, error) {
+	var err error
+	for _, layout := range logTimeLayouts {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, s, loc)
+		if err != nil {
+			continue
+		}
+
+		name, offset := t.Zone()
+		if offset == 0 && name != "" && name != "UTC" && name != "GMT" {
+			// Go fabricates a zero offset for unknown
+			// abbreviations: accept only those actually
+			// used by loc.
+			if locName, _ := t.In(loc).Zone(); locName != name {
+				return time.Time{}, errAmbiguousZone
+			}
+		}
+
+		return t, nil
+	}
+
+	return time.Time{}, err
+}
+
+// Parse the log time of lr, a record served by sr, whose LogZone
+// gives the zone abbreviations to understand.
+func recordLogTime(lr *logRecord, sr *serveRecord) (time.Time, error) {
+	loc := sr.LogZone
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return parseLogTimeIn(string(lr.LogTime), loc)
+}
+
+// Decodes the fields of a log record payload, either in place from
+// a fully buffered payload, or read field by field from a stream.
+//
+// Should the payload be malformed, the first error is kept in err,
+// and the fields that follow decode as zero values.
+type recordDecoder struct {
+	data []byte
+	off  int
+	err  error
+
+	// When non-nil, fields are read from r rather than data, and
+	// strings are copied into arena.
+	r     *bufio.Reader
+	arena []byte
+
+	// When positive, strings read from r longer than this are
+	// truncated to it, followed by a note of how many bytes were
+	// dropped, which are counted in truncated.
+	maxString int
+	truncated int
+}
+
+// Record err as the reason decoding failed, unless it already has.
+func (d *recordDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// Consume n bytes, returning them.  The result is only valid until
+// the next call.
+func (d *recordDecoder) fixed(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+
+	if d.r != nil {
+		v, err := d.r.Peek(n)
+		if err != nil {
+			d.fail(protocolErrorf("%v", io.ErrUnexpectedEOF))
+			return make([]byte, n)
+		}
+
+		d.r.Discard(n)
+		return v
+	}
+
+	if len(d.data)-d.off < n {
+		d.fail(protocolErrorf("%v", io.ErrUnexpectedEOF))
+		return make([]byte, n)
+	}
+
+	v := d.data[d.off : d.off+n]
+	d.off += n
+	return v
+}
+
+// Read a NUL-terminated string, returning it without the NUL.
+func (d *recordDecoder) cString() []byte {
+	if d.err != nil {
+		return nil
+	}
+
+	if d.r != nil {
+		return d.streamCString()
+	}
+
+	rest := d.data[d.off:]
+	i := bytes.IndexByte(rest, 0)
+	if i < 0 {
+		d.fail(protocolErrorf("%v", io.ErrUnexpectedEOF))
+		return nil
+	}
+
+	d.off += i + 1
+	return rest[:i:i]
+}
+
+// Read a NUL-terminated string from the stream into the arena.  A
+// string longer than the stream's buffer is accumulated piecewise.
+//
+// Should the arena be reallocated, strings already returned continue
+// to refer to the previous array, whose contents are never
+// overwritten while the record is in use.
+func (d *recordDecoder) streamCString() []byte {
+	start := len(d.arena)
+	dropped := 0
+	for {
+		chunk, err := d.r.ReadSlice(0)
+		if err == nil {
+			chunk = chunk[:len(chunk)-1]
+		}
+
+		// Read past whatever does not fit, without keeping it.
+		if d.maxString > 0 {
+			keep := d.maxString - (len(d.arena) - start)
+			if keep < len(chunk) {
+				dropped += len(chunk) - keep
+				chunk = chunk[:keep]
+			}
+		}
+		d.arena = append(d.arena, chunk...)
+
+		switch err {
+		case nil:
+			if dropped > 0 {
+				d.truncated += dropped
+				d.arena = fmt.Appendf(d.arena,
+					" [truncated %d bytes]", dropped)
+			}
+
+			end := len(d.arena)
+			return d.arena[start:end:end]
+		case bufio.ErrBufferFull:
+			continue
+		default:
+			d.fail(protocolErrorf("%v", io.ErrUnexpectedEOF))
+			return nil
+		}
+	}
+}
+
+// Read a nullable string, returning nil should it be null.
+func (d *recordDecoder) nullableString() []byte {
+	np := d.fixed(1)[0]
+
+	switch np {
+	case 'P':
+		return d.cString()
+
+	case 'N':
+		// 'N' is still followed by a NUL byte that must be
+		// consumed.
+		d.cString()
+		return nil
+
+	default:
+		if d.err == nil {
+			d.fail(protocolErrorf("Expected nullable string "+
+				"control character, got %c", np))
+		}
+
+		return nil
+	}
+}
+
+func (d *recordDecoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.fixed(4)))
+}
+
+func (d *recordDecoder) uint64() uint64 {
+	return binary.BigEndian.Uint64(d.fixed(8))
+}
+
+// Parse data into dst, overwriting every field.  dst's string fields
+// refer to data, which must not be modified while dst is in use.
+func parseLogRecord(dst *logRecord, data []byte) error {
+	remaining, err := parseLogRecordLenient(dst, data)
+	if err != nil {
+		return err
+	} else if remaining != 0 {
+		return protocolErrorf("LogRecord message has mismatched "+
+			"length header and cString contents: remaining %d",
+			remaining)
+	}
+
+	return nil
+}
+
+// Count of log records with bytes following their final field, which
+// were ignored as the record's serve record asks for lenient parsing,
+// keyed by identity.
+var trailingFields = expvar.NewMap("trailing_fields")
+
+// Count of log records with fields truncated, as their serve record
+// asks for fields beyond a size to be, keyed by identity.
+var truncatedRecords = expvar.NewMap("truncated_records")
+
+// Like parseLogRecord, but ignoring any bytes following the final
+// field, such as fields appended by a newer version of logfebe, and
+// returning their number.
+func parseLogRecordLenient(dst *logRecord, data []byte) (int, error) {
+	d := recordDecoder{data: data}
+	d.decode(dst)
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return len(data) - d.off, nil
+}
+
+func (d *recordDecoder) decode(dst *logRecord) {
+	dst.LogTime = d.cString()
+	dst.UserName = d.nullableString()
+	dst.DatabaseName = d.nullableString()
+	dst.Pid = d.int32()
+	dst.ClientAddr = d.nullableString()
+	dst.SessionId = d.cString()
+	dst.SeqNum = int64(d.uint64())
+	dst.PsDisplay = d.nullableString()
+	dst.SessionStart = d.cString()
+	dst.Vxid = d.nullableString()
+	dst.Txid = d.uint64()
+	dst.ELevel = d.int32()
+	dst.SQLState = d.nullableString()
+	dst.ErrMessage = d.nullableString()
+	dst.ErrDetail = d.nullableString()
+	dst.ErrHint = d.nullableString()
+	dst.InternalQuery = d.nullableString()
+	dst.InternalQueryPos = d.int32()
+	dst.ErrContext = d.nullableString()
+	dst.UserQuery = d.nullableString()
+	dst.UserQueryPos = d.int32()
+	dst.FileErrPos = d.nullableString()
+	dst.ApplicationName = d.nullableString()
+}
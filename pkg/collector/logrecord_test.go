@@ -0,0 +1,187 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseLogTime(t *testing.T) {
+	want := time.Date(2014, 5, 1, 12, 34, 56, 789000000, time.UTC)
+
+	for _, s := range []string{
+		"2014-05-01 12:34:56.789 UTC",
+		"2014-05-01 12:34:56.789 GMT",
+		"2014-05-01 14:34:56.789 +02",
+		"2014-05-01 09:04:56.789 -0330",
+	} {
+		got, err := parseLogTime(s)
+		if err != nil {
+			t.Errorf("%q: could not parse: %v", s, err)
+			continue
+		}
+
+		if !got.Equal(want) {
+			t.Errorf("%q: got %v, want %v", s, got, want)
+		}
+	}
+
+	for _, s := range []string{
+		"2014-05-01 12:34:56.789 NOTAZONE",
+		"not a time at all",
+		"",
+	} {
+		if _, err := parseLogTime(s); err == nil {
+			t.Errorf("%q: expected parse error", s)
+		}
+	}
+}
+
+func TestParseLogTimeIn(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("No time zone database: %v", err)
+	}
+
+	want := time.Date(2014, 5, 1, 12, 34, 56, 789000000, time.UTC)
+	s := "2014-05-01 14:34:56.789 CEST"
+	got, err := parseLogTimeIn(s, berlin)
+	if err != nil {
+		t.Fatalf("%q: could not parse: %v", s, err)
+	}
+
+	if !got.Equal(want) {
+		t.Fatalf("%q: got %v, want %v", s, got, want)
+	}
+
+	if _, err := parseLogTimeIn(s, time.UTC); err != errAmbiguousZone {
+		t.Fatalf("%q: expected an ambiguous zone outside "+
+			"Europe/Berlin, got %v", s, err)
+	}
+}
+
+// Render lr in the pg_logfebe wire format, for use as test input.
+func encodeLogRecord(lr *logRecord) []byte {
+	b := bytes.Buffer{}
+
+	cs := func(s []byte) {
+		b.Write(s)
+		b.WriteByte(0)
+	}
+
+	ns := func(s []byte) {
+		if s == nil {
+			b.WriteString("N\x00")
+			return
+		}
+
+		b.WriteByte('P')
+		cs(s)
+	}
+
+	i32 := func(n int32) {
+		binary.Write(&b, binary.BigEndian, n)
+	}
+
+	u64 := func(n uint64) {
+		binary.Write(&b, binary.BigEndian, n)
+	}
+
+	cs(lr.LogTime)
+	ns(lr.UserName)
+	ns(lr.DatabaseName)
+	i32(lr.Pid)
+	ns(lr.ClientAddr)
+	cs(lr.SessionId)
+	u64(uint64(lr.SeqNum))
+	ns(lr.PsDisplay)
+	cs(lr.SessionStart)
+	ns(lr.Vxid)
+	u64(lr.Txid)
+	i32(lr.ELevel)
+	ns(lr.SQLState)
+	ns(lr.ErrMessage)
+	ns(lr.ErrDetail)
+	ns(lr.ErrHint)
+	ns(lr.InternalQuery)
+	i32(lr.InternalQueryPos)
+	ns(lr.ErrContext)
+	ns(lr.UserQuery)
+	i32(lr.UserQueryPos)
+	ns(lr.FileErrPos)
+	ns(lr.ApplicationName)
+
+	return b.Bytes()
+}
+
+var sampleLogRecord = logRecord{
+	LogTime:          []byte("2014-05-01 12:34:56.789 UTC"),
+	UserName:         []byte("postgres"),
+	DatabaseName:     []byte("postgres"),
+	Pid:              1234,
+	ClientAddr:       nil,
+	SessionId:        []byte("53621a50.4d2"),
+	SeqNum:           7,
+	PsDisplay:        []byte("SELECT"),
+	SessionStart:     []byte("2014-05-01 12:30:00 UTC"),
+	Vxid:             []byte("2/10"),
+	Txid:             0,
+	ELevel:           elevelError,
+	SQLState:         []byte("42P01"),
+	ErrMessage:       []byte(`relation "nonexistent" does not exist`),
+	ErrDetail:        nil,
+	ErrHint:          []byte(""),
+	InternalQuery:    nil,
+	InternalQueryPos: 0,
+	ErrContext:       nil,
+	UserQuery:        []byte("SELECT * FROM nonexistent;"),
+	UserQueryPos:     15,
+	FileErrPos:       nil,
+	ApplicationName:  []byte("psql"),
+}
+
+func TestParseLogRecord(t *testing.T) {
+	data := encodeLogRecord(&sampleLogRecord)
+
+	var lr logRecord
+	if e := parseLogRecord(&lr, data); e != nil {
+		t.Fatalf("Could not parse valid record: %v", e)
+	}
+
+	if !reflect.DeepEqual(lr, sampleLogRecord) {
+		t.Fatalf("Parse mismatch:\n got %s\nwant %s",
+			lr.oneLine(), sampleLogRecord.oneLine())
+	}
+
+	// NULL and the empty string must remain distinguishable.
+	if lr.ErrDetail != nil || lr.ErrHint == nil || len(lr.ErrHint) != 0 {
+		t.Fatalf("Expected NULL detail and empty hint, got %q and %q",
+			lr.ErrDetail, lr.ErrHint)
+	}
+
+	// Every truncation of a valid record is an error.
+	for i := 0; i < len(data); i++ {
+		if e := parseLogRecord(&lr, data[:i]); e == nil {
+			t.Fatalf("Expected truncation at %d to fail", i)
+		}
+	}
+
+	// As are trailing bytes.
+	if e := parseLogRecord(&lr, append(data, 0)); e == nil {
+		t.Fatal("Expected trailing bytes to fail")
+	}
+}
+
+func BenchmarkParseLogRecord(b *testing.B) {
+	data := encodeLogRecord(&sampleLogRecord)
+	var lr logRecord
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		if err := parseLogRecord(&lr, data); err != nil {
+			b.Fatalf("Could not parse: %v", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The collector sheds load when its heap approaches a configurable
+// ceiling, rather than growing until it is killed:
+//
+//   - new client connections are refused;
+//   - log records less severe than WARNING are dropped;
+//   - recent messages are no longer retained for the admin API;
+//   - unused memory is returned to the operating system.
+//
+// Pressure is entered at memPressureHigh of the ceiling and left at
+// memPressureLow, so that the collector does not flap between
+// states.
+const (
+	memPressureHigh = 0.9
+	memPressureLow  = 0.75
+
+	memCheckPeriod = time.Second
+)
+
+var (
+	// Non-zero while under memory pressure.  Accessed atomically.
+	memPressure int32
+
+	memPressureVar     = expvar.NewInt("memory_pressure")
+	shedMessages       = expvar.NewMap("shed_messages")
+	refusedConnections = expvar.NewMap("refused_connections")
+)
+
+func underMemoryPressure() bool {
+	return atomic.LoadInt32(&memPressure) != 0
+}
+
+// Update the memory pressure state given the current heap size,
+// reporting whether the state changed.
+func updateMemoryPressure(heap, ceiling uint64) bool {
+	was := underMemoryPressure()
+	now := was
+
+	if !was && float64(heap) >= memPressureHigh*float64(ceiling) {
+		now = true
+	} else if was && float64(heap) < memPressureLow*float64(ceiling) {
+		now = false
+	}
+
+	if now == was {
+		return false
+	}
+
+	if now {
+		atomic.StoreInt32(&memPressure, 1)
+		memPressureVar.Set(1)
+	} else {
+		atomic.StoreInt32(&memPressure, 0)
+		memPressureVar.Set(0)
+	}
+
+	return true
+}
+
+// Monitor the heap against ceiling bytes, until ctx is done.
+func runMemoryMonitor(ctx context.Context, ceiling uint64) {
+	var ms runtime.MemStats
+
+	ticker := time.NewTicker(memCheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		runtime.ReadMemStats(&ms)
+		if !updateMemoryPressure(ms.HeapAlloc, ceiling) {
+			continue
+		}
+
+		if underMemoryPressure() {
+			log.Printf("heap of %d bytes approaches ceiling of %d: "+
+				"shedding load", ms.HeapAlloc, ceiling)
+			debug.FreeOSMemory()
+		} else {
+			log.Printf("heap of %d bytes is comfortably below "+
+				"ceiling of %d: resuming normal operation",
+				ms.HeapAlloc, ceiling)
+		}
+	}
+}
+
+// Whether a log record should be dropped to relieve memory pressure.
+func shouldShed(lr *logRecord) bool {
+	return underMemoryPressure() && lr.ELevel < elevelWarning
+}
+
+// Parse a size in bytes, optionally suffixed with KB, MB, or GB.
+func parseByteSize(s string) (uint64, error) {
+	mult := uint64(1)
+	num := s
+	for _, suffix := range []struct {
+		s string
+		m uint64
+	}{{"KB", KB}, {"MB", MB}, {"GB", 1024 * MB}} {
+		if strings.HasSuffix(s, suffix.s) {
+			num = strings.TrimSuffix(s, suffix.s)
+			mult = suffix.m
+			break
+		}
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(num), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: expected a number of "+
+			"bytes, optionally suffixed with KB, MB, or GB", s)
+	}
+
+	return n * mult, nil
+}
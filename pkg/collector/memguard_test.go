@@ -0,0 +1,72 @@
+package collector
+
+import "testing"
+
+func TestUpdateMemoryPressure(t *testing.T) {
+	defer updateMemoryPressure(0, 1)
+
+	steps := []struct {
+		heap     uint64
+		pressure bool
+		changed  bool
+	}{
+		{50, false, false},
+		{89, false, false},
+		{90, true, true},
+		{99, true, false},
+		// Hysteresis: stays under pressure until well below.
+		{80, true, false},
+		{74, false, true},
+		{80, false, false},
+	}
+
+	for i, step := range steps {
+		changed := updateMemoryPressure(step.heap, 100)
+		if changed != step.changed ||
+			underMemoryPressure() != step.pressure {
+			t.Errorf("%d: heap %d: got pressure=%v changed=%v, "+
+				"want pressure=%v changed=%v", i, step.heap,
+				underMemoryPressure(), changed,
+				step.pressure, step.changed)
+		}
+	}
+}
+
+func TestShouldShed(t *testing.T) {
+	defer updateMemoryPressure(0, 1)
+
+	lr := logRecord{ELevel: elevelLog}
+	if shouldShed(&lr) {
+		t.Fatal("Should not shed without memory pressure")
+	}
+
+	updateMemoryPressure(100, 100)
+	if !shouldShed(&lr) {
+		t.Fatal("Should shed LOG records under memory pressure")
+	}
+
+	lr.ELevel = elevelError
+	if shouldShed(&lr) {
+		t.Fatal("Should never shed ERROR records")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"1024":  1024,
+		"512KB": 512 * KB,
+		"2MB":   2 * MB,
+		"1GB":   1024 * MB,
+	} {
+		got, err := parseByteSize(s)
+		if err != nil || got != want {
+			t.Errorf("%q: got %d, %v; want %d", s, got, err, want)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "-1", "1TB", "lots"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
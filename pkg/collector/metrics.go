@@ -0,0 +1,273 @@
+package collector
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Upper bounds of the latency histogram buckets.  Observations
+// beyond the last bound are counted in an overflow bucket.
+var latencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// A fixed-bucket histogram of durations, suitable for publishing via
+// expvar.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(latencyBounds)+1)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i += 1
+	}
+
+	h.counts[i] += 1
+	h.count += 1
+	h.sum += d
+}
+
+// Render the histogram as JSON, satisfying expvar.Var.
+func (h *histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]uint64, len(h.counts))
+	for i, n := range h.counts {
+		le := "+Inf"
+		if i < len(latencyBounds) {
+			le = latencyBounds[i].String()
+		}
+
+		buckets[le] = n
+	}
+
+	out, err := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		SumMs   float64           `json:"sum_ms"`
+	}{
+		Buckets: buckets,
+		Count:   h.count,
+		SumMs:   h.sum.Seconds() * 1000,
+	})
+	if err != nil {
+		// Not expected with the types above.
+		panic(err)
+	}
+
+	return string(out)
+}
+
+// Delivery latency, keyed by identity.
+var drainLatency = expvar.NewMap("drain_latency")
+
+// Serializes creation of histograms in drainLatency, which would
+// otherwise race between two connections of the same identity.
+var drainLatencyMu sync.Mutex
+
+func drainLatencyFor(ident string) *histogram {
+	drainLatencyMu.Lock()
+	defer drainLatencyMu.Unlock()
+
+	if h, ok := drainLatency.Get(ident).(*histogram); ok {
+		return h
+	}
+
+	h := newHistogram()
+	drainLatency.Set(ident, h)
+	return h
+}
+
+// An http.RoundTripper that measures the end-to-end delivery latency
+// of log messages: the time between the receipt of the oldest
+// message included in a drain request and a 2xx response to that
+// request.
+//
+// The drain client numbers the messages handed to it, reporting the
+// span of those each request carries, and of those in each bundle it
+// drops, so that neither concurrent requests nor dropped bundles skew
+// the latency of other requests.
+type deliveryTimer struct {
+	base http.RoundTripper
+	hist *histogram
+
+	mu sync.Mutex
+	// The messages handed to the drain client but not yet posted
+	// or dropped, keyed by the number the client frames them
+	// with.
+	pending map[uint64]pendingMsg
+
+	// The number of the next message handed to the drain client.
+	next uint64
+
+	// Size of the messages received since the last request.
+	unsentBytes uint64
+
+	// Description of the most recent failed request, if any.
+	lastErr string
+}
+
+func newDeliveryTimer(base http.RoundTripper, h *histogram) *deliveryTimer {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &deliveryTimer{base: base, hist: h,
+		pending: make(map[uint64]pendingMsg)}
+}
+
+// A message awaiting delivery: when it was received, and the span
+// tracing it, should its trace be sampled, to which the span of the
+// request carrying it is linked.
+type pendingMsg struct {
+	received time.Time
+	link     spanLink
+}
+
+// Record the receipt of a message of n bytes that will be sent to
+// the drain.
+func (dt *deliveryTimer) received(n int) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	dt.unsentBytes += uint64(n)
+}
+
+// Record that a message was handed to the drain client: one received
+// from the client at t, traced by sp, or should t be zero, one of the
+// collector's own, which is taken to be received now.
+func (dt *deliveryTimer) buffered(t time.Time, sp *span) {
+	if dt == nil {
+		return
+	}
+
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	dt.pending[dt.next] = pendingMsg{received: t, link: sp.link()}
+	dt.next++
+}
+
+// Remove the messages of span from those pending, returning the
+// receipt time of the oldest, or the zero value should there be none,
+// and links to the spans of those traced.
+func (dt *deliveryTimer) take(span logplexc.BundleSpan) (time.Time,
+	[]spanLink) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	var oldest time.Time
+	var links []spanLink
+	for i := span.First; i < span.First+span.Count; i++ {
+		m, ok := dt.pending[i]
+		if !ok {
+			continue
+		}
+
+		if oldest.IsZero() || m.received.Before(oldest) {
+			oldest = m.received
+		}
+
+		if m.link != (spanLink{}) {
+			links = append(links, m.link)
+		}
+		delete(dt.pending, i)
+	}
+
+	return oldest, links
+}
+
+// Forget the messages of a bundle the drain client dropped, which
+// are never delivered.
+func (dt *deliveryTimer) dropped(span logplexc.BundleSpan) {
+	dt.take(span)
+}
+
+// Report the size of the messages received but not yet submitted to
+// the drain.
+func (dt *deliveryTimer) unsent() uint64 {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	return dt.unsentBytes
+}
+
+func (dt *deliveryTimer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var since time.Time
+	var links []spanLink
+	if span, ok := logplexc.BundleFromContext(req.Context()); ok {
+		since, links = dt.take(span)
+	}
+
+	dt.mu.Lock()
+	dt.unsentBytes = 0
+	dt.mu.Unlock()
+
+	// Attribute the request's latency to the messages it carries.
+	sp := tr.startLinkedTrace("logplex.post", spanKindClient, links)
+	sp.setAttr("messages", req.Header.Get("Logplex-Msg-Count"))
+	defer sp.finish()
+
+	resp, err := dt.base.RoundTrip(req)
+	if err == nil {
+		sp.setAttr("http.status_code", strconv.Itoa(resp.StatusCode))
+	}
+
+	switch {
+	case err != nil:
+		dt.setLastErr(err.Error())
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		dt.setLastErr("drain responded " + resp.Status)
+	case !since.IsZero():
+		dt.hist.Observe(time.Since(since))
+	}
+
+	return resp, err
+}
+
+func (dt *deliveryTimer) setLastErr(e string) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	dt.lastErr = e
+}
+
+// Report the most recent drain request failure, if any.
+func (dt *deliveryTimer) lastError() string {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+
+	return dt.lastErr
+}
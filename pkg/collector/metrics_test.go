@@ -0,0 +1,131 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram()
+	h.Observe(5 * time.Millisecond)
+	h.Observe(10 * time.Millisecond)
+	h.Observe(11 * time.Millisecond)
+	h.Observe(time.Minute)
+
+	var rendered struct {
+		Buckets map[string]uint64
+		Count   uint64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &rendered); err != nil {
+		t.Fatalf("Histogram should render as JSON: %v", err)
+	}
+
+	if rendered.Count != 4 {
+		t.Fatalf("Expected 4 observations, got %d", rendered.Count)
+	}
+
+	for le, want := range map[string]uint64{
+		"10ms": 2, "25ms": 1, "+Inf": 1, "1s": 0,
+	} {
+		if got := rendered.Buckets[le]; got != want {
+			t.Errorf("Bucket %s: got %d, want %d", le, got, want)
+		}
+	}
+}
+
+func TestDeliveryTimer(t *testing.T) {
+	status := http.StatusNoContent
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+	defer s.Close()
+
+	h := newHistogram()
+	dt := newDeliveryTimer(nil, h)
+	client := http.Client{Transport: dt}
+
+	post := func(first, count uint64) {
+		req, _ := http.NewRequestWithContext(
+			logplexc.ContextWithBundle(context.Background(),
+				logplexc.BundleSpan{First: first, Count: count}),
+			"POST", s.URL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Could not post: %v", err)
+		}
+
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	// No messages carried: nothing to observe.
+	post(0, 0)
+
+	// A message received long ago is dropped, and so does not
+	// count against the request carrying the next.
+	dt.received(1)
+	dt.buffered(time.Now().Add(-time.Hour), nil)
+	dt.dropped(logplexc.BundleSpan{First: 0, Count: 1})
+
+	dt.received(1)
+	dt.buffered(time.Now(), nil)
+	post(1, 1)
+
+	if h.count != 1 {
+		t.Fatalf("Expected exactly one observation, got %d", h.count)
+	} else if h.sum > time.Minute {
+		t.Fatalf("Expected the dropped message not to be timed, "+
+			"got %v", h.sum)
+	}
+
+	// Rejected requests are not deliveries.
+	status = http.StatusBadRequest
+	dt.received(1)
+	dt.buffered(time.Now(), nil)
+	post(2, 1)
+
+	if h.count != 1 {
+		t.Fatalf("Expected exactly one observation, got %d", h.count)
+	}
+
+	// A message queued while later ones are read is timed from
+	// its own receipt, not theirs.
+	status = http.StatusNoContent
+	sum := h.sum
+	dt.received(1)
+	dt.buffered(time.Now().Add(-time.Hour), nil)
+	dt.received(1)
+	dt.buffered(time.Now(), nil)
+	post(3, 1)
+
+	if h.count != 2 {
+		t.Fatalf("Expected two observations, got %d", h.count)
+	} else if d := h.sum - sum; d < time.Hour {
+		t.Fatalf("Expected the queued message to be timed from "+
+			"its receipt, got %v", d)
+	}
+}
+
+func TestDeliveryTimerLinks(t *testing.T) {
+	dt := newDeliveryTimer(nil, newHistogram())
+	traced := (&tracer{sampleBound: ^uint64(0)}).startTrace("message",
+		spanKindServer)
+
+	dt.buffered(time.Now(), traced)
+	dt.buffered(time.Now(), nil)
+
+	// Only the traced message of a request is linked to.
+	_, links := dt.take(logplexc.BundleSpan{First: 0, Count: 2})
+	if len(links) != 1 || links[0] != traced.link() {
+		t.Fatalf("Expected a link to the traced message, got %v",
+			links)
+	}
+}
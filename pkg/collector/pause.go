@@ -0,0 +1,195 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Serve records may be paused through the control socket, as during
+// an incident at the drain of a single tenant, and later resumed,
+// without touching the serve database.  A record is paused in one of
+// two modes:
+//
+//   - buffer: its socket stops accepting connections, and its
+//     connections stop being read from, so that messages back up in
+//     its clients rather than being sent.
+//
+//   - drop: its connections are served as usual, but their messages
+//     are discarded rather than sent, and counted in
+//     paused_dropped_messages.
+//
+// Pauses are by identity and socket, and outlive reloads of the serve
+// database, so that a record stays paused should it be reloaded.
+type pauseMode int
+
+const (
+	pauseBuffer pauseMode = iota
+	pauseDrop
+)
+
+var pauseModeNames = []string{
+	pauseBuffer: "buffer",
+	pauseDrop:   "drop",
+}
+
+func (m pauseMode) String() string {
+	if m < 0 || int(m) >= len(pauseModeNames) {
+		return fmt.Sprintf("pauseMode(%d)", int(m))
+	}
+
+	return pauseModeNames[m]
+}
+
+func parsePauseMode(s string) (pauseMode, error) {
+	for m, name := range pauseModeNames {
+		if s == name {
+			return pauseMode(m), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown pause mode %q: must be one of %v",
+		s, pauseModeNames)
+}
+
+// Count of messages discarded while their record was paused in drop
+// mode, keyed by identity.
+var pausedDrops = expvar.NewMap("paused_dropped_messages")
+
+// The pause of a single record.
+type pause struct {
+	mode pauseMode
+
+	// Closed once the pause is lifted or replaced, so that those
+	// waiting on it look again.
+	changed chan struct{}
+}
+
+// The paused records.  The map, a map[sKey]*pause, is read on every
+// message, so is never modified once stored: pausing and resuming
+// store a new one instead, under the lock.
+var pauses = struct {
+	sync.Mutex
+	m atomic.Value
+}{}
+
+func init() {
+	pauses.m.Store(make(map[sKey]*pause))
+}
+
+func pausedRecords() map[sKey]*pause {
+	return pauses.m.Load().(map[sKey]*pause)
+}
+
+// Replace the pauses of the records keys with that returned by f,
+// given each one's current pause, or nil should it have none.  Should
+// f return nil, the record is resumed.  Reports the records whose
+// pause changed.
+func updatePauses(keys []sKey, f func(old *pause) *pause) []sKey {
+	pauses.Lock()
+	defer pauses.Unlock()
+
+	old := pausedRecords()
+	m := make(map[sKey]*pause, len(old))
+	for k, p := range old {
+		m[k] = p
+	}
+
+	var changed []sKey
+	for _, k := range keys {
+		p := m[k]
+		np := f(p)
+		if np == p {
+			continue
+		}
+
+		if p != nil {
+			close(p.changed)
+		}
+
+		if np == nil {
+			delete(m, k)
+		} else {
+			m[k] = np
+		}
+
+		changed = append(changed, k)
+	}
+
+	pauses.m.Store(m)
+	return changed
+}
+
+// Pause the records keys in mode, reporting those that were not
+// already so paused.
+func pauseRecords(keys []sKey, mode pauseMode) []sKey {
+	return updatePauses(keys, func(old *pause) *pause {
+		if old != nil && old.mode == mode {
+			return old
+		}
+
+		return &pause{mode: mode, changed: make(chan struct{})}
+	})
+}
+
+// Resume the records keys, reporting those that were paused.
+func resumeRecords(keys []sKey) []sKey {
+	return updatePauses(keys, func(*pause) *pause { return nil })
+}
+
+// Report how the record k is paused, if at all.
+func pauseOf(k sKey) (pauseMode, bool) {
+	p := pausedRecords()[k]
+	if p == nil {
+		return 0, false
+	}
+
+	return p.mode, true
+}
+
+// The paused records, in order.
+func pausedKeys() []sKey {
+	m := pausedRecords()
+	keys := make([]sKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].P != keys[j].P {
+			return keys[i].P < keys[j].P
+		}
+
+		return keys[i].I < keys[j].I
+	})
+
+	return keys
+}
+
+// Report whether the messages of record k are to be discarded.
+func droppingPaused(k sKey) bool {
+	p := pausedRecords()[k]
+	return p != nil && p.mode == pauseDrop
+}
+
+// Wait for record k to be resumed, should it be paused in buffer
+// mode, reporting false should ctx be done first.
+func awaitResume(ctx context.Context, k sKey) bool {
+	for {
+		p := pausedRecords()[k]
+		if p == nil || p.mode != pauseBuffer {
+			return true
+		}
+
+		debugIdentf(k.I, "identity %q on %q is paused, waiting",
+			k.I, k.P)
+		select {
+		case <-p.changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
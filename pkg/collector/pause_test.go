@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestAwaitResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	apple := sKey{I: "pause-apple", P: "/p1/log.sock"}
+	other := sKey{I: "pause-apple", P: "/p2/log.sock"}
+
+	// Records not paused proceed at once.
+	if !awaitResume(ctx, apple) {
+		t.Fatal("Expected to proceed")
+	}
+
+	if got := pauseRecords([]sKey{apple}, pauseBuffer); len(got) != 1 {
+		t.Fatalf("Expected to pause, got %v", got)
+	} else if got := pauseRecords([]sKey{apple}, pauseBuffer); len(got) != 0 {
+		t.Fatalf("Expected to be paused already, got %v", got)
+	} else if !awaitResume(ctx, other) {
+		t.Fatal("Expected other sockets to proceed")
+	}
+
+	resumed := make(chan bool)
+	go func() { resumed <- awaitResume(ctx, apple) }()
+
+	select {
+	case <-resumed:
+		t.Fatal("Expected to wait while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Should the pause change to drop, waiting ends, as messages
+	// are to be read and discarded.
+	pauseRecords([]sKey{apple}, pauseDrop)
+	if !<-resumed {
+		t.Fatal("Expected to proceed once dropping")
+	} else if !droppingPaused(apple) {
+		t.Fatal("Expected to be dropping")
+	}
+
+	if got := resumeRecords([]sKey{apple, other}); len(got) != 1 {
+		t.Fatalf("Expected to resume one record, got %v", got)
+	} else if _, paused := pauseOf(apple); paused {
+		t.Fatal("Expected to be resumed")
+	}
+
+	// Waiting ends with the context.
+	pauseRecords([]sKey{apple}, pauseBuffer)
+	defer resumeRecords([]sKey{apple})
+	cancel()
+	if awaitResume(ctx, apple) {
+		t.Fatal("Expected not to proceed once done")
+	}
+}
+
+func TestPausedDrop(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	sr := &serveRecord{sKey: sKey{I: "pause-banana",
+		P: "/p1/log.sock"}, u: *u}
+
+	pauseRecords([]sKey{sr.sKey}, pauseDrop)
+	defer resumeRecords([]sKey{sr.sKey})
+
+	dropped := sampleLogRecord
+	dropped.ErrMessage = []byte("dropped message")
+	kept := sampleLogRecord
+	kept.ErrMessage = []byte("kept message")
+
+	before := expvarInt(pausedDrops, sr.I)
+	client, server := net.Pipe()
+	go func() {
+		defer client.Close()
+		client.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+		client.Write(frameMsg('I', []byte("pause-banana\x00")))
+		client.Write(frameMsg('L', encodeLogRecord(&dropped)))
+
+		for expvarInt(pausedDrops, sr.I) == before {
+			time.Sleep(time.Millisecond)
+		}
+
+		resumeRecords([]sKey{sr.sKey})
+		client.Write(frameMsg('L', encodeLogRecord(&kept)))
+	}()
+
+	logWorker(context.Background(), server, logplexc.Config{
+		HttpClient:  *http.DefaultClient,
+		Concurrency: 4,
+		Period:      10 * time.Millisecond,
+	}, sr)
+
+	var all string
+	for !strings.Contains(all, "kept message") {
+		all += d.next(t)
+	}
+
+	if strings.Contains(all, "dropped message") {
+		t.Fatalf("Expected the message sent while paused dropped, "+
+			"got %q", all)
+	} else if got := expvarInt(pausedDrops, sr.I); got != before+1 {
+		t.Fatalf("Expected one dropped message, got %d", got-before)
+	}
+}
@@ -0,0 +1,425 @@
+package collector
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// Reading of packet captures in the classic libpcap format, as written
+// by tcpdump -w, so that logfebe connections captured in the field can
+// be replayed (see replay.go).  Only TCP over IPv4 or IPv6 is
+// understood; traffic on a unix socket can be replayed if it was
+// captured by a tool that wraps it in synthetic TCP/IP headers, or
+// else saved as a raw stream.
+//
+// The file begins with a 24-byte header whose magic number, written
+// in the capturing host's byte order, also gives the resolution of
+// the packet times.  Each packet follows with a 16-byte header giving
+// its captured length.
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapngMagic     = 0x0a0d0d0a
+)
+
+const (
+	pcapHeaderSize       = 24
+	pcapPacketHeaderSize = 16
+
+	// Far larger than any snapshot length in use, rejecting
+	// corrupt packet headers before allocating for them.
+	pcapMaxPacket = 1 << 20
+)
+
+// Link-layer header types; see https://www.tcpdump.org/linktypes.html.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkLinuxSLL = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+)
+
+var errNotPcap = errors.New("not a pcap file")
+
+// Report whether the file beginning with b is a packet capture.
+func isPcap(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+
+	for _, order := range []binary.ByteOrder{binary.BigEndian,
+		binary.LittleEndian} {
+		switch order.Uint32(b) {
+		case pcapMagicMicros, pcapMagicNanos, pcapngMagic:
+			return true
+		}
+	}
+
+	return false
+}
+
+// The bytes sent by the client of a TCP connection.
+type pcapStream struct {
+	// The client and server addresses, as "host:port".
+	Client, Server string
+
+	Data []byte
+
+	// Bytes missing from Data, having not been captured.
+	Missing int
+}
+
+// A TCP segment travelling in one direction of a connection.
+type tcpSegment struct {
+	src, dst string
+	seq      uint32
+	syn, ack bool
+	payload  []byte
+}
+
+// One direction of a TCP connection.
+type tcpHalf struct {
+	src, dst string
+
+	// Sequence numbers are taken relative to base: that following
+	// the SYN, should it have been captured, or otherwise the
+	// first seen.
+	base    uint32
+	started bool
+	synSeen bool
+
+	// Whether this half was opened by a SYN without an ACK,
+	// making its sender the client.
+	opener bool
+
+	segs []*tcpSegment
+}
+
+func (h *tcpHalf) add(s *tcpSegment) {
+	if s.syn && !h.synSeen {
+		h.base = s.seq + 1
+		h.synSeen = true
+		h.opener = !s.ack
+	} else if !h.started {
+		h.base = s.seq
+	}
+	h.started = true
+
+	if len(s.payload) > 0 {
+		h.segs = append(h.segs, s)
+	}
+}
+
+// Reassemble the bytes sent, reporting how many were missing.
+func (h *tcpHalf) assemble() ([]byte, int) {
+	type span struct {
+		off     int64
+		payload []byte
+	}
+
+	// Retransmission and reordering are within the reach of a
+	// signed 32-bit difference.
+	var spans []span
+	min := int64(0)
+	for _, s := range h.segs {
+		off := int64(int32(s.seq - h.base))
+		if s.syn {
+			off = 0
+		}
+
+		if off < 0 && h.synSeen {
+			// Belongs to an earlier connection.
+			continue
+		} else if off < min {
+			min = off
+		}
+
+		spans = append(spans, span{off, s.payload})
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].off < spans[j].off
+	})
+
+	var out []byte
+	missing := 0
+	for _, s := range spans {
+		off := s.off - min
+		have := int64(len(out))
+		if off+int64(len(s.payload)) <= have {
+			// Entirely retransmitted.
+			continue
+		}
+
+		if off > have {
+			missing += int(off - have)
+			out = append(out, make([]byte, off-have)...)
+			have = off
+		}
+
+		out = append(out, s.payload[have-off:]...)
+	}
+
+	return out, missing
+}
+
+// Both directions of a TCP connection, in the order first seen.
+type tcpConn struct {
+	halves []*tcpHalf
+}
+
+// The half sent by the client: whichever sent the SYN, or, if the
+// start of the connection was not captured, whichever sent more, as
+// logfebe servers only speak to refuse a client.
+func (c *tcpConn) client() *tcpHalf {
+	best, most := c.halves[0], -1
+	for _, h := range c.halves {
+		if h.opener {
+			return h
+		}
+
+		n := 0
+		for _, s := range h.segs {
+			n += len(s.payload)
+		}
+
+		if n > most {
+			best, most = h, n
+		}
+	}
+
+	return best
+}
+
+// Read a packet capture, returning the client-sent bytes of each TCP
+// connection in it, in the order in which the connections appear.
+// Gaps left by packets that were not captured are filled with zeroes.
+func readPcap(r io.Reader) ([]pcapStream, error) {
+	br := bufio.NewReader(r)
+
+	var hdr [pcapHeaderSize]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, errNotPcap
+	}
+
+	var order binary.ByteOrder
+	for _, o := range []binary.ByteOrder{binary.BigEndian,
+		binary.LittleEndian} {
+		switch o.Uint32(hdr[:]) {
+		case pcapMagicMicros, pcapMagicNanos:
+			order = o
+		case pcapngMagic:
+			return nil, fmt.Errorf("pcapng captures are not " +
+				"supported: write the classic pcap format, " +
+				"as with tcpdump -w or editcap -F pcap")
+		}
+	}
+	if order == nil {
+		return nil, errNotPcap
+	}
+
+	link := order.Uint32(hdr[20:24]) & 0x0fffffff
+
+	halves := make(map[string]*tcpHalf)
+	conns := make(map[string]*tcpConn)
+	var seen []*tcpConn
+
+	for n := 0; ; n++ {
+		var ph [pcapPacketHeaderSize]byte
+		if _, err := io.ReadFull(br, ph[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("packet %d: truncated header", n)
+		}
+
+		caplen := order.Uint32(ph[8:12])
+		if caplen > pcapMaxPacket {
+			return nil, fmt.Errorf("packet %d: bad length %d", n,
+				caplen)
+		}
+
+		pkt := make([]byte, caplen)
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			return nil, fmt.Errorf("packet %d: truncated", n)
+		}
+
+		s, err := decodePacket(link, pkt)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %v", n, err)
+		} else if s == nil {
+			// Not TCP.
+			continue
+		}
+
+		key := connKey(s.src, s.dst)
+		c, ok := conns[key]
+		if !ok {
+			c = &tcpConn{}
+			conns[key] = c
+			seen = append(seen, c)
+		}
+
+		h, ok := halves[s.src+" "+s.dst]
+		if !ok {
+			h = &tcpHalf{src: s.src, dst: s.dst}
+			halves[s.src+" "+s.dst] = h
+			c.halves = append(c.halves, h)
+		}
+
+		h.add(s)
+	}
+
+	streams := make([]pcapStream, 0, len(seen))
+	for _, c := range seen {
+		h := c.client()
+		data, missing := h.assemble()
+		streams = append(streams, pcapStream{
+			Client:  h.src,
+			Server:  h.dst,
+			Data:    data,
+			Missing: missing,
+		})
+	}
+
+	return streams, nil
+}
+
+// Identify a connection regardless of direction.
+func connKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	return a + " " + b
+}
+
+// Decode a captured packet, returning nil if it isn't TCP.
+func decodePacket(link uint32, pkt []byte) (*tcpSegment, error) {
+	var ethertype uint16
+	switch link {
+	case linkEthernet:
+		if len(pkt) < 14 {
+			return nil, errors.New("short Ethernet header")
+		}
+
+		ethertype = binary.BigEndian.Uint16(pkt[12:14])
+		pkt = pkt[14:]
+
+		// Skip any 802.1Q VLAN tags.
+		for ethertype == 0x8100 || ethertype == 0x88a8 {
+			if len(pkt) < 4 {
+				return nil, errors.New("short VLAN tag")
+			}
+
+			ethertype = binary.BigEndian.Uint16(pkt[2:4])
+			pkt = pkt[4:]
+		}
+	case linkLinuxSLL:
+		if len(pkt) < 16 {
+			return nil, errors.New("short Linux cooked header")
+		}
+
+		ethertype = binary.BigEndian.Uint16(pkt[14:16])
+		pkt = pkt[16:]
+	case linkNull, linkLoop:
+		// The address family, in the capturing host's byte
+		// order for linkNull but not linkLoop: rely on the IP
+		// version instead.
+		if len(pkt) < 4 {
+			return nil, errors.New("short loopback header")
+		}
+
+		pkt = pkt[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported link type %d", link)
+	}
+
+	switch ethertype {
+	case 0, 0x0800, 0x86dd:
+	default:
+		return nil, nil
+	}
+
+	if len(pkt) < 1 {
+		return nil, errors.New("empty IP packet")
+	}
+
+	var src, dst net.IP
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, errors.New("short IPv4 header")
+		}
+
+		ihl := int(pkt[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(pkt[2:4]))
+		if ihl < 20 || total < ihl || ihl > len(pkt) {
+			return nil, errors.New("bad IPv4 header")
+		} else if total > len(pkt) {
+			// Cut short by the snapshot length: what is
+			// missing is accounted for on reassembly.
+			total = len(pkt)
+		}
+
+		if pkt[9] != 6 {
+			return nil, nil
+		}
+
+		if binary.BigEndian.Uint16(pkt[6:8])&0x3fff != 0 {
+			return nil, errors.New("fragmented IPv4 packets " +
+				"are not supported")
+		}
+
+		src, dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		pkt = pkt[ihl:total]
+	case 6:
+		if len(pkt) < 40 {
+			return nil, errors.New("short IPv6 header")
+		}
+
+		payload := int(binary.BigEndian.Uint16(pkt[4:6]))
+		if 40+payload > len(pkt) {
+			payload = len(pkt) - 40
+		}
+
+		// Extension headers are not followed.
+		if pkt[6] != 6 {
+			return nil, nil
+		}
+
+		src, dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		pkt = pkt[40 : 40+payload]
+	default:
+		return nil, fmt.Errorf("unknown IP version %d", pkt[0]>>4)
+	}
+
+	if len(pkt) < 20 {
+		return nil, errors.New("short TCP header")
+	}
+
+	off := int(pkt[12]>>4) * 4
+	if off < 20 || off > len(pkt) {
+		return nil, errors.New("bad TCP header")
+	}
+
+	flags := pkt[13]
+	return &tcpSegment{
+		src: net.JoinHostPort(src.String(),
+			fmt.Sprint(binary.BigEndian.Uint16(pkt[0:2]))),
+		dst: net.JoinHostPort(dst.String(),
+			fmt.Sprint(binary.BigEndian.Uint16(pkt[2:4]))),
+		seq:     binary.BigEndian.Uint32(pkt[4:8]),
+		syn:     flags&0x02 != 0,
+		ack:     flags&0x10 != 0,
+		payload: pkt[off:],
+	}, nil
+}
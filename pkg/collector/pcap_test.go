@@ -0,0 +1,149 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpAck = 0x10
+)
+
+// Write a little-endian pcap file of Ethernet frames.
+func pcapFile(pkts ...[]byte) []byte {
+	var b bytes.Buffer
+	hdr := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagicMicros)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], linkEthernet)
+	b.Write(hdr)
+
+	for i, pkt := range pkts {
+		ph := make([]byte, pcapPacketHeaderSize)
+		binary.LittleEndian.PutUint32(ph[0:], uint32(1400000000+i))
+		binary.LittleEndian.PutUint32(ph[8:], uint32(len(pkt)))
+		binary.LittleEndian.PutUint32(ph[12:], uint32(len(pkt)))
+		b.Write(ph)
+		b.Write(pkt)
+	}
+
+	return b.Bytes()
+}
+
+// Build an Ethernet frame carrying a TCP segment over IPv4.
+func tcpPacket(src, dst string, sport, dport uint16, seq uint32,
+	flags byte, payload []byte) []byte {
+	eth := make([]byte, 14)
+	binary.BigEndian.PutUint16(eth[12:], 0x0800)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+20+len(payload)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], net.ParseIP(src).To4())
+	copy(ip[16:], net.ParseIP(dst).To4())
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+
+	pkt := append(eth, ip...)
+	pkt = append(pkt, tcp...)
+	return append(pkt, payload...)
+}
+
+func TestReadPcap(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	a, b, c := data[:10], data[10:25], data[25:]
+
+	client := func(seq uint32, flags byte, p []byte) []byte {
+		return tcpPacket("10.0.0.1", "10.0.0.2", 40000, 5432, seq,
+			flags, p)
+	}
+	server := func(seq uint32, flags byte, p []byte) []byte {
+		return tcpPacket("10.0.0.2", "10.0.0.1", 5432, 40000, seq,
+			flags, p)
+	}
+
+	// Joined mid-connection, with the server having spoken first,
+	// and a segment not captured.
+	late := func(seq uint32, p []byte) []byte {
+		return tcpPacket("10.0.0.3", "10.0.0.2", 40001, 5432, seq,
+			tcpAck, p)
+	}
+
+	f := pcapFile(
+		client(0xfffffff0, tcpSyn, nil),
+		server(5000, tcpSyn|tcpAck, nil),
+		client(0xfffffff1, tcpAck, a),
+		client(0xfffffff1+uint32(len(a)+len(b)), tcpAck, c),
+		tcpPacket("10.0.0.2", "10.0.0.3", 5432, 40001, 7000, tcpAck,
+			[]byte("E")),
+		late(900, []byte("first")),
+		client(0xfffffff1+uint32(len(a)), tcpAck, b),
+		client(0xfffffff1, tcpAck, a),
+		server(5001, tcpAck, []byte("ignored")),
+		late(910, []byte("third")),
+		client(0xfffffff1+uint32(len(data)), tcpFin|tcpAck, nil),
+	)
+
+	streams, err := readPcap(bytes.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(streams) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(streams))
+	}
+
+	got := streams[0]
+	if got.Client != "10.0.0.1:40000" || got.Server != "10.0.0.2:5432" {
+		t.Fatalf("Expected the SYN to identify the client, got "+
+			"%s to %s", got.Client, got.Server)
+	}
+
+	if !bytes.Equal(got.Data, data) || got.Missing != 0 {
+		t.Fatalf("Expected %q reassembled, got %q missing %d", data,
+			got.Data, got.Missing)
+	}
+
+	got = streams[1]
+	if got.Client != "10.0.0.3:40001" {
+		t.Fatalf("Expected the greater sender to be the client, "+
+			"got %s", got.Client)
+	}
+
+	want := []byte("first\x00\x00\x00\x00\x00third")
+	if !bytes.Equal(got.Data, want) || got.Missing != 5 {
+		t.Fatalf("Expected %q with 5 bytes missing, got %q with %d",
+			want, got.Data, got.Missing)
+	}
+}
+
+func TestReadPcapFormats(t *testing.T) {
+	if _, err := readPcap(bytes.NewReader([]byte("V\x00\x00"))); err !=
+		errNotPcap {
+		t.Fatalf("Expected a short file to be rejected, got %v", err)
+	}
+
+	ng := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(ng, pcapngMagic)
+	if !isPcap(ng) {
+		t.Fatal("Expected pcapng to be recognized")
+	}
+
+	if _, err := readPcap(bytes.NewReader(ng)); err == nil ||
+		err == errNotPcap {
+		t.Fatalf("Expected pcapng to be refused, got %v", err)
+	}
+}
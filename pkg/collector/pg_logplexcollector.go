@@ -0,0 +1,703 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deafbybeheading/femebe/buf"
+	"github.com/deafbybeheading/femebe/core"
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+const (
+	KB = 1024
+	MB = 1048576
+)
+
+// Fills a message on behalf of the caller.  Often the closure will
+// close over a core.MessageStream to provide a source of data for the
+// filled message.
+type msgInit func(dst *core.Message) error
+
+// The largest version or identification message accepted: these are
+// short strings, and anything longer is malformed or hostile.
+const maxHandshakeMsgSize = 10 * KB
+
+// Report an error should the length header of m, which counts itself,
+// be too small to be valid.  Such a length would otherwise be taken
+// as an enormous one.
+func checkMsgSize(m *core.Message) error {
+	if m.Size() < 4 {
+		return protocolErrorf("malformed message length %d", m.Size())
+	}
+
+	return nil
+}
+
+// Read the version message, reporting the capabilities the client
+// advertises, or an error if this is not a supported version.
+func processVerMsg(msgInit msgInit) (capabilities, error) {
+	var m core.Message
+
+	if err := msgInit(&m); err != nil {
+		return capabilities{}, err
+	}
+
+	if m.MsgType() != 'V' {
+		return capabilities{}, protocolErrorf("expected version "+
+			"('V') message, but received %c", m.MsgType())
+	}
+
+	if m.Size() > maxHandshakeMsgSize {
+		return capabilities{}, protocolErrorf("oversized version "+
+			"message, msg size is %d", m.Size())
+	}
+
+	payload := m.Payload()
+	s, err := buf.ReadCString(payload)
+	if err != nil {
+		return capabilities{}, protocolErrorf("couldn't read "+
+			"version string: %v", err)
+	}
+
+	if !(strings.HasPrefix(s, "PG-9.2") ||
+		strings.HasPrefix(s, "PG-9.3") ||
+		strings.HasPrefix(s, "PG-9.4")) ||
+		!strings.HasSuffix(s, "/logfebe-1") {
+		return capabilities{}, protocolErrorf("protocol version "+
+			"not supported: %s", s)
+	}
+
+	caps, err := parseCapabilities(payload)
+	caps.version = s
+	return caps, err
+}
+
+// Process the identity ('I') message, reporting the identity therein.
+func processIdentMsg(msgInit msgInit) (string, error) {
+	var m core.Message
+
+	if err := msgInit(&m); err != nil {
+		return "", err
+	}
+
+	// Read the remote system identifier string
+	if m.MsgType() != 'I' {
+		return "", protocolErrorf("expected identification ('I') "+
+			"message, but received %c", m.MsgType())
+	}
+
+	if m.Size() > maxHandshakeMsgSize {
+		return "", protocolErrorf("oversized identification "+
+			"message, msg size is %d", m.Size())
+	}
+
+	s, err := buf.ReadCString(m.Payload())
+	if err != nil {
+		return "", protocolErrorf("couldn't read identification "+
+			"string: %v", err)
+	}
+
+	return s, nil
+}
+
+// Process log messages, sending them to the client.  This reads and
+// decodes messages, handing them on to the remaining stages of the
+// connection's pipeline; see pipeline.go.  Returns nil once ctx is
+// done, and otherwise the reason the client must be disconnected.
+func processLogMsg(ctx context.Context, bt *batcher, msgInit msgInit,
+	sr *serveRecord, cs *connState) error {
+	var m core.Message
+	msgInit = skipKeepalives(msgInit)
+
+	p := newPipeline(bt, sr, cs)
+	defer p.close()
+
+	for {
+		// Poll request to exit
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+			break
+		}
+
+		// Messages can only be emitted as fast as the drain
+		// accepts them: should the pipeline be full, wait.
+		cs.busy("awaiting pipeline")
+		it := p.get()
+		if err := p.err(); err != nil {
+			return &drainError{err}
+		}
+
+		// Should the record be paused, read nothing more until
+		// it is resumed; see pause.go.
+		cs.idle()
+		if !awaitResume(ctx, sr.sKey) {
+			return nil
+		}
+
+		if err := msgInit(&m); err != nil {
+			return err
+		}
+		cs.busy("processing")
+		it.received = cs.received(int(m.Size()))
+
+		it.sp = tr.startTrace("logfebe.message", spanKindServer)
+		it.sp.setAttr("identity", sr.I)
+		it.sp.setAttr("message.size", strconv.Itoa(int(m.Size())))
+
+		// Refuse to handle any log message above an arbitrary
+		// size.  Furthermore, exit the worker, closing the
+		// connection, so that the client doesn't even bother
+		// to wait for this process to drain the oversized
+		// item and anything following it; these will be
+		// dropped.  It's on the client to gracefully handle
+		// the error and re-connect after this happens.
+		//
+		// Unless, that is, sr asks for the fields of records
+		// to be truncated, which bounds the memory a record
+		// of any size takes as it is read.
+		if m.Size() > 1*MB && sr.TruncateOver == 0 {
+			return protocolErrorf("client %q sent oversized "+
+				"log record", sr.I)
+		}
+
+		// The message is reused for the next read while this
+		// record is still in the pipeline, so the record must
+		// refer only to memory of its own.
+		parseSp := it.sp.child("parse", spanKindInternal)
+		remaining, err := it.rr.readOwned(&it.lr, &m)
+		if err == errCorruptRecord {
+			corruptRecords.Add(sr.I, 1)
+			parseSp.finish()
+			p.skip(it)
+			continue
+		} else if err != nil {
+			return err
+		} else if remaining != 0 {
+			trailingFields.Add(sr.I, 1)
+		}
+		if it.rr.truncated() > 0 {
+			truncatedRecords.Add(sr.I, 1)
+		}
+		it.size = int(m.Size()) - 4
+		parseSp.finish()
+
+		p.put(it)
+	}
+}
+
+// Render a logRecord as the text of a log message, in the format
+// chosen by sr, appending it to msgFmtBuf.
+func formatLogRec(msgFmtBuf *bytes.Buffer, lr *logRecord, sr *serveRecord) {
+	switch sr.Format {
+	case formatLogfmt:
+		formatLogfmtRec(msgFmtBuf, lr, sr)
+	case formatJSON:
+		formatJSONRec(msgFmtBuf, lr, sr)
+	case formatTemplate:
+		formatTemplateRec(msgFmtBuf, lr, sr)
+	default:
+		formatTextRec(msgFmtBuf, lr, sr)
+	}
+}
+
+// Render lr as human-readable prose: its error message, followed by
+// any detail, hint and query on lines of their own.
+func formatTextRec(msgFmtBuf *bytes.Buffer, lr *logRecord, sr *serveRecord) {
+	// Helps with formatting a series of nullable strings.
+	catOptionalField := func(prefix string, maybePresent []byte) {
+		if maybePresent != nil {
+			if prefix != "" {
+				msgFmtBuf.WriteString(prefix)
+				msgFmtBuf.WriteString(": ")
+			}
+
+			msgFmtBuf.Write(maybePresent)
+			msgFmtBuf.WriteByte('\n')
+		}
+	}
+
+	if sr.Name != "" {
+		// If available, identify what agent is doing the
+		// logging to aid human readers in determining where a
+		// log message came from.
+		msgFmtBuf.WriteByte('[')
+		msgFmtBuf.WriteString(sr.Name)
+		msgFmtBuf.WriteString("] ")
+	}
+
+	if sr.Severity {
+		// As Postgres renders it in its own logs.
+		msgFmtBuf.WriteString(elevelName(lr.ELevel))
+		msgFmtBuf.WriteString(":  ")
+	}
+
+	// As with catOptionalField, but giving the position, should
+	// there be one, of the error in the query.
+	catQuery := func(prefix string, query []byte, pos int32) {
+		catOptionalField(prefix, query)
+		if query != nil && pos > 0 {
+			var num [10]byte
+			msgFmtBuf.WriteString(prefix)
+			msgFmtBuf.WriteString(" position: ")
+			msgFmtBuf.Write(strconv.AppendInt(num[:0],
+				int64(pos), 10))
+			msgFmtBuf.WriteByte('\n')
+		}
+	}
+
+	catOptionalField("", lr.ErrMessage)
+	catOptionalField("Detail", lr.ErrDetail)
+	catOptionalField("Hint", lr.ErrHint)
+	if sr.ErrorContext {
+		// In the order Postgres logs them, as PL/pgSQL
+		// errors can hardly be debugged without them.
+		catQuery("Internal query", lr.InternalQuery,
+			lr.InternalQueryPos)
+		catOptionalField("Context", lr.ErrContext)
+		catQuery("Query", lr.UserQuery, lr.UserQueryPos)
+	} else {
+		catOptionalField("Query", lr.UserQuery)
+	}
+
+	if sr.Environment != "" || sr.Region != "" {
+		// Tag messages consistently, so that those of a fleet
+		// can be grouped however they are named.
+		sep := ""
+		if sr.Environment != "" {
+			msgFmtBuf.WriteString("environment=")
+			msgFmtBuf.WriteString(sr.Environment)
+			sep = " "
+		}
+		if sr.Region != "" {
+			msgFmtBuf.WriteString(sep)
+			msgFmtBuf.WriteString("region=")
+			msgFmtBuf.WriteString(sr.Region)
+		}
+		msgFmtBuf.WriteByte('\n')
+	}
+
+	if sr.SessionFields {
+		// Let consumers stitch together the messages of a
+		// session, and notice any that are missing.
+		var num [20]byte
+		msgFmtBuf.WriteString("session=")
+		msgFmtBuf.Write(lr.SessionId)
+		msgFmtBuf.WriteString(" seq=")
+		msgFmtBuf.Write(strconv.AppendInt(num[:0], lr.SeqNum, 10))
+		if lr.Vxid != nil {
+			msgFmtBuf.WriteString(" vxid=")
+			msgFmtBuf.Write(lr.Vxid)
+		}
+		msgFmtBuf.WriteByte('\n')
+	}
+}
+
+func logWorker(ctx context.Context, rwc io.ReadWriteCloser,
+	cfg logplexc.Config, sr *serveRecord) {
+	// The connection itself, rather than any wrapper below, for
+	// setting deadlines on.
+	conn := rwc
+
+	// Optionally capture everything received, for debugging.
+	if sr.Capture != "" {
+		cw, err := openCapture(sr.Capture)
+		if err != nil {
+			log.Printf("cannot capture to %q: %v", sr.Capture, err)
+		} else {
+			rwc = newCaptureConn(rwc, cw)
+		}
+	}
+
+	stream := core.NewBackendStream(rwc)
+
+	cs := registerConn(sr.P, rwc)
+	defer cs.unregister()
+	defer rwc.Close()
+
+	msgInit := func(m *core.Message) error {
+		window := cs.caps.window()
+		extendIdleDeadline(conn, time.Now(), window)
+		err := stream.Next(m)
+		if err == io.EOF {
+			return peerDisconnectf("postgres client disconnects")
+		} else if isTimeout(err) && window > 0 &&
+			(idleTimeout <= 0 || window < idleTimeout) {
+			keepaliveTimeouts.Add(sr.I, 1)
+			return peerDisconnectf("postgres client sent nothing "+
+				"for %v, despite keepalives every %v", window,
+				cs.caps.keepalive)
+		} else if isTimeout(err) {
+			idleTimeouts.Add(sr.I, 1)
+			return peerDisconnectf("postgres client idle for "+
+				"longer than %v", idleTimeout)
+		} else if err != nil {
+			return peerDisconnectf("could not read next "+
+				"message: %v", err)
+		}
+
+		return checkMsgSize(m)
+	}
+
+	if err := serveConn(ctx, msgInit, cfg, sr, cs); err != nil {
+		log.Printf("Disconnect client: %v", err)
+		countDisconnect(sr, err)
+	}
+}
+
+// Serve the client whose messages msgInit reads, reporting why it
+// must be disconnected, or nil should ctx be done first.
+func serveConn(ctx context.Context, msgInit msgInit, cfg logplexc.Config,
+	sr *serveRecord, cs *connState) error {
+	// Protocol start-up; packets that are only received once.
+	hsSp := tr.startTrace("logfebe.handshake", spanKindServer)
+	hsSp.setAttr("socket", sr.P)
+	caps, err := processVerMsg(msgInit)
+	if err != nil {
+		return err
+	}
+	cs.caps = caps
+	if caps.keepalive > 0 {
+		hsSp.setAttr("keepalive", caps.keepalive.String())
+	}
+
+	ident, err := processIdentMsg(msgInit)
+	if err != nil {
+		return err
+	}
+	log.Printf("client connects with identifier %q", ident)
+	hsSp.setAttr("identity", ident)
+
+	hsSp.finish()
+
+	// Resolve the identifier to a serve
+	if !sr.accepts(ident) {
+		if err := identityMismatch(ctx, msgInit, sr, ident); err != nil {
+			return err
+		}
+	}
+
+	debugIdentf(sr.I, "routing client %q on %q to drain %s", ident, sr.P,
+		sr.u.Host)
+
+	bt, closeDrain, err := openDrain(ctx, cfg, sr, ident, cs)
+	if err != nil {
+		return err
+	}
+	defer closeDrain()
+
+	// Optionally mark the connection in the drain, so that gaps
+	// due to the client being disconnected can be told apart.
+	if sr.ConnectionMarkers {
+		markConnection(bt, fmt.Sprintf("logfebe client connected "+
+			"(identity=%s, version=%s)", ident, caps.version))
+	}
+
+	err = processLogMsg(ctx, bt, msgInit, sr, cs)
+	if sr.ConnectionMarkers {
+		reason := "collector stopped serving"
+		if err != nil {
+			reason = err.Error()
+		}
+
+		markConnection(bt, fmt.Sprintf("logfebe client "+
+			"disconnected (reason=%s)", reason))
+	}
+
+	return err
+}
+
+// Emit msg, marking a change in the state of a connection, into the
+// drain.
+func markConnection(bt *batcher, msg string) {
+	if err := bt.add(134, time.Now(), "postgres", "pg_logplexcollector",
+		[]byte(msg)); err != nil {
+		log.Printf("could not buffer connection marker: %v", err)
+	}
+}
+
+// Set up the drain of sr for a client presenting ident, with its
+// heartbeat, returning the batcher to hand the client's messages to,
+// and a function that flushes and closes the drain once the client
+// is done.
+func openDrain(ctx context.Context, cfg logplexc.Config, sr *serveRecord,
+	ident string, cs *connState) (*batcher, func(), error) {
+	// Set up client with serve, timing its deliveries, and
+	// optionally signing its requests.
+	cfg.Logplex = sr.u
+	if sr.signingSecret != "" {
+		cfg.HttpClient.Transport = newSigningTransport(
+			cfg.HttpClient.Transport, sr.signingSecret)
+	}
+	dt := newDeliveryTimer(cfg.HttpClient.Transport, drainLatencyFor(sr.I))
+	cfg.HttpClient.Transport = dt
+
+	// Optionally journal which records the drain acknowledges.
+	at := newAckTracker(dt, acks, sr.I)
+	if at != nil {
+		cfg.HttpClient.Transport = at
+	}
+
+	cfg.DroppedBundle = func(span logplexc.BundleSpan) {
+		dt.dropped(span)
+		at.dropped(span)
+	}
+
+	client, err := logplexc.NewClient(&cfg)
+	if err != nil {
+		return nil, nil, &drainError{err}
+	}
+
+	// Messages are handed to the client in batches.
+	bt := newBatcher(client, batchMaxDelay)
+	bt.acks = at
+	bt.timing = dt
+
+	// Report records a previous process never had acknowledged.
+	if sr.SeqWarnings {
+		for _, msg := range acks.takeReports(sr.I) {
+			if err := bt.add(132, time.Now(), "postgres",
+				"pg_logplexcollector",
+				[]byte("warning: "+msg)); err != nil {
+				log.Printf("could not buffer acknowledgment "+
+					"report: %v", err)
+			}
+		}
+	}
+
+	// Optionally emit heartbeats into the drain for as long as
+	// the client is connected.
+	hb := newHeartbeat(sr.Heartbeat)
+	hbCtx, hbStop := context.WithCancel(ctx)
+	go hb.run(hbCtx, bt)
+	cs.attach(ident, client, hb, dt)
+
+	return bt, func() {
+		hbStop()
+
+		// Flushing the drain can stall on a hung drain
+		// request: let the watchdog know.
+		cs.busy("closing drain")
+		if err := bt.flush(); err != nil {
+			log.Printf("could not flush final batch: %v", err)
+		}
+		client.Close()
+		log.Printf("logplex client shuts down, statistics: %#v", client.Stats)
+	}, nil
+}
+
+// Bind the socket for sr, or use the one passed by systemd should
+// there be one.
+func bindListener(ctx context.Context, sr *serveRecord) (net.Listener,
+	error) {
+	if a := activatedFor(sr); a != nil {
+		return a.listener(ctx), nil
+	}
+
+	// Per-cluster runtime directories are often created at about
+	// the time the collector starts, so create the socket's
+	// directory rather than waiting on whatever does so.
+	if err := provisionSocketDir(sr); err != nil {
+		return nil, err
+	}
+
+	// Begin listening.  Should a socket of our own be at the path
+	// already, as when a reload rebinds it, the new one is bound
+	// alongside it and renamed over it, so that clients never
+	// find the path missing.
+	bindPath := sr.P
+	replace := isOwnSocket(sr.P)
+	if replace {
+		bindPath = sr.P + "~"
+		os.Remove(bindPath)
+	}
+
+	l, err := net.Listen("unix", bindPath)
+	if err != nil && replace {
+		// Perhaps the longer path is too long: fall back to
+		// unlinking the old socket.
+		replace = false
+		bindPath = sr.P
+		os.Remove(bindPath)
+		l, err = net.Listen("unix", bindPath)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen to %q: %v", sr.P, err)
+	}
+
+	// Sockets are unlinked explicitly, if at all: on close, the
+	// path may already be bound by a listener of a later
+	// generation.
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	if err := tuneListener(ul, sr); err != nil {
+		log.Printf("cannot tune socket %q, using kernel defaults: %v",
+			sr.P, err)
+	}
+
+	if err := setSocketPermissions(bindPath, sr); err != nil {
+		l.Close()
+		os.Remove(bindPath)
+		return nil, fmt.Errorf("cannot set permissions of just "+
+			"created socket %q: %v", sr.P, err)
+	}
+
+	if replace {
+		if err := os.Rename(bindPath, sr.P); err != nil {
+			l.Close()
+			os.Remove(bindPath)
+			return nil, fmt.Errorf("cannot replace socket %q: %v",
+				sr.P, err)
+		}
+	}
+
+	markOwnSocket(sr.P)
+	registerHandoff(sr.P, ul)
+
+	return l, nil
+}
+
+// Set the permissions of the socket just bound at bindPath for sr.
+// Should sr give the socket an owner or group, only they may connect.
+// Otherwise, make it world-writable so anything can connect and send
+// logs: unless pg_logplexcollector and the Postgres server share the
+// same running user, common umasks would make the socket useless.
+func setSocketPermissions(bindPath string, sr *serveRecord) error {
+	if o := sr.SocketOwnership; o.restrictsSocket() {
+		if err := os.Chown(bindPath, o.UID, o.GID); err != nil {
+			return err
+		}
+
+		return os.Chmod(bindPath, 0660)
+	}
+
+	fi, err := os.Stat(bindPath)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(bindPath, fi.Mode().Perm()|0222)
+}
+
+// The permissions of directories created to hold sockets.
+var socketDirMode os.FileMode = 0755
+
+// How long a request to a drain may take, including reading its
+// response, before it is abandoned, so that a drain that never
+// answers cannot hold up a connection, nor its closing, forever.
+// Zero for no limit.
+var drainRequestTimeout = time.Minute
+
+// Create a template config in each listening goroutine, for a tiny
+// bit more defensive programming against accidental mutations of the
+// base template that could cause cross-tenant spillage.
+func newTemplateConfig() logplexc.Config {
+	client := *http.DefaultClient
+	client.Timeout = drainRequestTimeout
+	client.Transport = newRecyclingTransport(&http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}, drainHosts)
+
+	return logplexc.Config{
+		HttpClient:         client,
+		RequestSizeTrigger: 100 * KB,
+		Concurrency:        3,
+		Period:             time.Second / 4,
+	}
+}
+
+// Serve connections accepted from l, bound for sr, until g is
+// cancelled.
+func listen(g *generation, sr *serveRecord, l net.Listener) {
+	ctx := g.ctx
+	lc := closeOnDone(ctx, l)
+
+	lim := g.limiter(sr)
+
+	// Delay before retrying after a temporary accept error.
+	var backoff time.Duration
+
+	exited := func() {
+		log.Printf("listener on %q exits: %v", sr.P,
+			context.Cause(ctx))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			exited()
+			return
+		default:
+			break
+		}
+
+		// Should the record be paused, accept nothing more
+		// until it is resumed.
+		if !awaitResume(ctx, sr.sKey) {
+			exited()
+			return
+		}
+
+		conn, err := l.Accept()
+		if err == errListenerRetired {
+			exited()
+			return
+		} else if err != nil {
+			// The listener is closed on cancellation, or for
+			// an upgrade.
+			select {
+			case <-ctx.Done():
+				exited()
+				return
+			default:
+			}
+
+			if isTemporary(err) {
+				// Such as running out of file
+				// descriptors: wait for things to
+				// improve.
+				acceptErrors.Add(sr.I, 1)
+				backoff = nextBackoff(backoff, acceptBackoffMax)
+				log.Printf("accept error on %q, retrying in %v: %v",
+					sr.P, backoff, err)
+				if sleepOrDone(ctx, backoff) {
+					return
+				}
+
+				continue
+			}
+
+			log.Printf("listener on %q failed, recreating it: %v",
+				sr.P, err)
+			listenerRecreations.Add(sr.I, 1)
+			l.Close()
+			if l = rebindListener(ctx, sr); l == nil ||
+				!lc.replace(l) {
+				return
+			}
+
+			continue
+		}
+
+		backoff = 0
+		debugIdentf(sr.I, "accepted connection on %q", sr.P)
+
+		lim.admit(conn)
+	}
+}
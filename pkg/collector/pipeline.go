@@ -0,0 +1,300 @@
+package collector
+
+import (
+	"bytes"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Number of messages a connection may have in flight between the
+// stages of its pipeline.
+const pipelineDepth = 16
+
+// Each connection processes its messages in a pipeline of stages
+// running concurrently, connected by bounded channels:
+//
+//	read:   reads and decodes messages from the socket; this runs
+//	        in the connection's worker, see processLogMsg
+//	format: renders records as text, or sheds them
+//	emit:   checks sequencing and clock skew, and adds messages to
+//	        the drain client's batch
+//
+// so that neither a slow drain nor formatting holds up reads from
+// the socket, and formatting can run in parallel with both.  Order
+// is preserved, every stage handling messages one at a time.
+//
+// Messages are carried through the pipeline by a bounded set of
+// items, each owning the memory of its record, which are recycled
+// once emitted.  Items are created only as needed, so a connection
+// that is never backlogged uses only one or two.
+type pipeline struct {
+	bt *batcher
+	sr *serveRecord
+	cs *connState
+
+	free     chan *pipeItem
+	items    int
+	toFormat chan *pipeItem
+	toEmit   chan *pipeItem
+	done     chan struct{}
+
+	// Where records are also appended as CSV, should sr ask.
+	csv *csvLogWriter
+
+	// The first error emitting a message, after which the
+	// connection is abandoned.
+	errMu   sync.Mutex
+	emitErr error
+}
+
+type pipeItem struct {
+	rr     *recordReader
+	lr     logRecord
+	size   int
+	shed   bool
+	fmtBuf *bytes.Buffer
+	sd     []byte
+	sp     *span
+
+	// When the message was received from the client, from which
+	// the latency of its delivery is measured.
+	received time.Time
+
+	// Set on an item carrying no message, which is closed once
+	// the items before it have been emitted; see sync.
+	marker chan struct{}
+}
+
+func newPipeline(bt *batcher, sr *serveRecord, cs *connState) *pipeline {
+	p := &pipeline{
+		bt:       bt,
+		sr:       sr,
+		cs:       cs,
+		free:     make(chan *pipeItem, pipelineDepth),
+		toFormat: make(chan *pipeItem, pipelineDepth),
+		toEmit:   make(chan *pipeItem, pipelineDepth),
+		done:     make(chan struct{}),
+		csv:      openCSVLog(sr),
+	}
+
+	go p.format()
+	go p.emit()
+
+	return p
+}
+
+// Take an item in which to read a message, waiting for one to be
+// recycled if all are in flight.
+func (p *pipeline) get() *pipeItem {
+	select {
+	case it := <-p.free:
+		return it
+	default:
+	}
+
+	if p.items < pipelineDepth {
+		p.items += 1
+		rr := newRecordReader()
+		rr.lenient = p.sr.LenientParse
+		rr.checksum = p.cs.caps.checksum
+		rr.truncateOver = int(p.sr.TruncateOver)
+		return &pipeItem{rr: rr, fmtBuf: newFmtBuf()}
+	}
+
+	return <-p.free
+}
+
+// Send an item holding a freshly read record down the pipeline.
+func (p *pipeline) put(it *pipeItem) {
+	p.toFormat <- it
+}
+
+// Recycle an item whose message is not to be emitted.
+func (p *pipeline) skip(it *pipeItem) {
+	it.sp.finish()
+	it.sp = nil
+	p.free <- it
+}
+
+// Wait for the messages put so far to be emitted, that is handed to
+// the drain client or dropped, returning the first error emitting
+// any of them.
+func (p *pipeline) sync() error {
+	done := make(chan struct{})
+	p.toFormat <- &pipeItem{marker: done}
+	<-done
+
+	return p.err()
+}
+
+// Stop accepting messages, and wait for those in flight to be
+// emitted.
+func (p *pipeline) close() {
+	close(p.toFormat)
+	<-p.done
+	p.csv.Close()
+}
+
+// Report the first error emitting a message, if any.
+func (p *pipeline) err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+
+	return p.emitErr
+}
+
+func (p *pipeline) format() {
+	defer close(p.toEmit)
+
+	for it := range p.toFormat {
+		if it.marker != nil {
+			p.toEmit <- it
+			continue
+		}
+
+		it.shed = shouldShed(&it.lr)
+		if !it.shed {
+			fmtSp := it.sp.child("format", spanKindInternal)
+			it.fmtBuf.Reset()
+			formatLogRec(it.fmtBuf, &it.lr, p.sr)
+			it.sd = appendStructuredData(it.sd[:0], &it.lr, p.sr)
+			fmtSp.finish()
+		}
+
+		p.toEmit <- it
+	}
+}
+
+func (p *pipeline) emit() {
+	defer close(p.done)
+
+	var seq seqTracker
+	var skew skewDetector
+
+	for it := range p.toEmit {
+		// Markers are not of the pool, so are not recycled.
+		if it.marker != nil {
+			close(it.marker)
+			continue
+		}
+
+		seq.observe(&it.lr, p.bt, p.sr)
+		skew.observe(&it.lr, p.sr, time.Now())
+
+		// Every record is archived, whether or not it is
+		// forwarded.
+		p.csv.write(&it.lr)
+
+		if it.shed {
+			shedMessages.Add(p.sr.I, 1)
+			p.route(it, "shed under memory pressure")
+		} else if droppingPaused(p.sr.sKey) {
+			pausedDrops.Add(p.sr.I, 1)
+			p.route(it, "dropped, as the record is paused")
+		} else if p.err() != nil {
+			p.route(it, "dropped, as the drain failed")
+		} else if !p.admit(it) {
+			p.route(it, "dropped, as over quota")
+		} else {
+			p.emitOne(it)
+			p.route(it, "forwarded")
+		}
+
+		it.sp.finish()
+		it.sp = nil
+		it.fmtBuf = recycleFmtBuf(it.fmtBuf)
+		p.free <- it
+	}
+}
+
+// Log, should debug logging cover the serve record, what became of
+// the message of it.
+func (p *pipeline) route(it *pipeItem, decision string) {
+	if !debugging(p.sr.I) {
+		return
+	}
+
+	log.Printf("debug: identity %q on %q: message of session %s, "+
+		"sequence %d, %d bytes, %s to %s: %s", p.sr.I, p.sr.P,
+		it.lr.SessionId, it.lr.SeqNum, it.size,
+		elevelName(it.lr.ELevel), p.sr.u.Host, decision)
+}
+
+// Charge the message of it to the quotas of the serve record,
+// reporting whether it may be emitted, and sending any notices about
+// the quotas into the drain; see quota.go.
+func (p *pipeline) admit(it *pipeItem) bool {
+	ok, notices := chargeQuota(p.sr, time.Now(), it.size)
+	for _, notice := range notices {
+		if err := p.bt.add(132, time.Now(), "postgres",
+			"pg_logplexcollector", []byte(notice)); err != nil {
+			p.errMu.Lock()
+			p.emitErr = err
+			p.errMu.Unlock()
+			return false
+		}
+	}
+
+	return ok
+}
+
+// Add a single formatted message to the batch for the drain client.
+func (p *pipeline) emitOne(it *pipeItem) {
+	now := time.Now()
+	err := p.bt.addRecord(logplexc.Message{
+		Priority:       134,
+		When:           messageTime(&it.lr, p.sr, now),
+		Host:           "postgres",
+		ProcId:         procId(&it.lr, p.sr),
+		MsgId:          p.sr.MsgId,
+		StructuredData: it.sd,
+		Log:            it.fmtBuf.Bytes(),
+	}, &it.lr, it.received, it.sp)
+	if err != nil {
+		p.errMu.Lock()
+		p.emitErr = err
+		p.errMu.Unlock()
+		return
+	}
+
+	if !underMemoryPressure() {
+		recordRecent(p.sr.sKey, now, it.fmtBuf.Bytes())
+	}
+
+	p.cs.forwarded(it.size)
+}
+
+// The time to stamp the message of lr with: its log time, so that
+// messages delayed by buffering keep their place, unless sr asks for
+// the time of receipt, now, or the log time can't be understood.
+// Either way it is in UTC, whatever the server's log_timezone.
+func messageTime(lr *logRecord, sr *serveRecord, now time.Time) time.Time {
+	if sr.ReceiptTime {
+		return now.UTC()
+	}
+
+	t, err := recordLogTime(lr, sr)
+	if err != nil {
+		return now.UTC()
+	}
+
+	return t.UTC()
+}
+
+// The syslog procid of the message of lr, "postgres." and the pid of
+// the backend that logged it, with the name of its error level
+// between them, as in "postgres.error.1234", should sr ask for it.
+func procId(lr *logRecord, sr *serveRecord) string {
+	pid := strconv.Itoa(int(lr.Pid))
+	if sr.SeverityProcId {
+		return "postgres." + strings.ToLower(elevelName(lr.ELevel)) +
+			"." + pid
+	}
+
+	return "postgres." + pid
+}
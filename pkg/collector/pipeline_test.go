@@ -0,0 +1,174 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+func TestPipelineOrder(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	bt := newBatcher(d.client(t), time.Hour)
+	sr := &serveRecord{sKey: sKey{I: "pipeline-test"}}
+	cs := registerConn("/pipeline.sock", nil)
+	defer cs.unregister()
+
+	// More messages than the pipeline holds, so that items are
+	// recycled while earlier messages are in flight.  The
+	// message is reused for every read, as in processLogMsg.
+	const n = 3 * pipelineDepth
+	var m core.Message
+	p := newPipeline(bt, sr, cs)
+	for i := 0; i < n; i += 1 {
+		lr := sampleLogRecord
+		lr.SeqNum = int64(i + 1)
+		lr.ErrMessage = []byte(fmt.Sprintf("message %03d", i))
+		m.InitFromBytes('L', encodeLogRecord(&lr))
+
+		it := p.get()
+		if _, err := it.rr.readOwned(&it.lr, &m); err != nil {
+			t.Fatalf("Could not read record: %v", err)
+		}
+		p.put(it)
+	}
+	p.close()
+
+	if err := p.err(); err != nil {
+		t.Fatalf("Unexpected emit error: %v", err)
+	}
+
+	bt.flush()
+	var got []string
+	for len(got) < n {
+		for _, line := range strings.Split(d.next(t), "\n") {
+			if i := strings.Index(line, "message "); i >= 0 {
+				got = append(got, line[i:])
+			}
+		}
+	}
+
+	for i, msg := range got {
+		if want := fmt.Sprintf("message %03d", i); msg != want {
+			t.Fatalf("Message %d out of order: got %q, want %q",
+				i, msg, want)
+		}
+	}
+
+	if cs.messages != n {
+		t.Fatalf("Expected %d messages forwarded, got %d",
+			n, cs.messages)
+	}
+}
+
+func TestMessageTime(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	logTime := time.Date(2014, 5, 1, 12, 34, 56, 789000000, time.UTC)
+
+	lr := sampleLogRecord
+	sr := &serveRecord{}
+	if got := messageTime(&lr, sr, now); !got.Equal(logTime) {
+		t.Errorf("Expected the log time %v, got %v", logTime, got)
+	}
+
+	sr.ReceiptTime = true
+	if got := messageTime(&lr, sr, now); !got.Equal(now) {
+		t.Errorf("Expected the receipt time %v, got %v", now, got)
+	}
+
+	sr.ReceiptTime = false
+	lr.LogTime = []byte("yesterday")
+	if got := messageTime(&lr, sr, now); !got.Equal(now) {
+		t.Errorf("Expected an unparseable log time to fall back "+
+			"to %v, got %v", now, got)
+	}
+}
+
+func TestProcId(t *testing.T) {
+	lr := sampleLogRecord
+	sr := &serveRecord{}
+	if got := procId(&lr, sr); got != "postgres.1234" {
+		t.Errorf("Expected postgres.1234, got %q", got)
+	}
+
+	sr.SeverityProcId = true
+	if got := procId(&lr, sr); got != "postgres.error.1234" {
+		t.Errorf("Expected postgres.error.1234, got %q", got)
+	}
+
+	lr.ELevel = elevelLog
+	if got := procId(&lr, sr); got != "postgres.log.1234" {
+		t.Errorf("Expected postgres.log.1234, got %q", got)
+	}
+}
+
+func TestPipelineSyslogFields(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	bt := newBatcher(d.client(t), time.Hour)
+	sr := &serveRecord{sKey: sKey{I: "pipeline-test"}, MsgId: "pglog",
+		StructuredData: "postgres@32473"}
+	cs := registerConn("/pipeline.sock", nil)
+	defer cs.unregister()
+
+	var m core.Message
+	lr := sampleLogRecord
+	m.InitFromBytes('L', encodeLogRecord(&lr))
+
+	p := newPipeline(bt, sr, cs)
+	it := p.get()
+	if _, err := it.rr.readOwned(&it.lr, &m); err != nil {
+		t.Fatalf("Could not read record: %v", err)
+	}
+	p.put(it)
+	p.close()
+	bt.flush()
+
+	body := d.next(t)
+	want := ` postgres.1234 pglog [postgres@32473 sqlstate="42P01" `
+	if !strings.Contains(body, want) {
+		t.Fatalf("Expected message containing %q, got %q", want, body)
+	}
+}
+
+func TestPipelineSync(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	bt := newBatcher(d.client(t), time.Hour)
+	sr := &serveRecord{sKey: sKey{I: "pipeline-test"}}
+	cs := registerConn("/pipeline.sock", nil)
+	defer cs.unregister()
+
+	lr := sampleLogRecord
+	p := newPipeline(bt, sr, cs)
+	defer p.close()
+
+	for i := 0; i < 3; i++ {
+		var m core.Message
+		m.InitFromBytes('L', encodeLogRecord(&lr))
+
+		it := p.get()
+		if _, err := it.rr.readOwned(&it.lr, &m); err != nil {
+			t.Fatalf("Could not read record: %v", err)
+		}
+		p.put(it)
+	}
+
+	// Once synced, every message put has reached the batch.
+	if err := p.sync(); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	bt.mu.Lock()
+	n := len(bt.msgs)
+	bt.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("Expected 3 messages batched, got %d", n)
+	}
+}
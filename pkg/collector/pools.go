@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// Buffers that have grown beyond this size are not reused, so that an
+// occasional huge message does not pin a large amount of memory
+// indefinitely.
+const maxPooledBufSize = 64 * KB
+
+// Initial capacity of message formatting buffers, enough for most
+// messages to be formatted without growing the buffer.
+const fmtBufInitialSize = 4 * KB
+
+// Each connection formats its messages in a buffer of its own,
+// reused from message to message.
+func newFmtBuf() *bytes.Buffer {
+	return bytes.NewBuffer(make([]byte, 0, fmtBufInitialSize))
+}
+
+// Prepare b for reuse, replacing it should it have grown too large.
+func recycleFmtBuf(b *bytes.Buffer) *bytes.Buffer {
+	if b.Cap() > maxPooledBufSize {
+		return newFmtBuf()
+	}
+
+	b.Reset()
+	return b
+}
+
+// Size of the buffer through which streamed payloads are read.
+const streamBufSize = 4 * KB
+
+// Parses log records out of the messages of a single connection.
+// Fully buffered messages are parsed in place.  Others are parsed
+// field by field as they are read from the stream, so that the
+// payload is never copied in full: only the strings of the record
+// are retained, in an arena reused from message to message.
+type recordReader struct {
+	d recordDecoder
+
+	// Whether to ignore bytes following the final field of a
+	// record, rather than exiting; see parseLogRecordLenient.
+	lenient bool
+
+	// Whether records begin with their checksum, reporting
+	// errCorruptRecord for those not matching it.
+	checksum bool
+
+	// When positive, the length beyond which the strings of
+	// records read by readOwned are truncated.
+	truncateOver int
+}
+
+// The number of bytes truncated from the strings of the record last
+// read by readOwned.
+func (rr *recordReader) truncated() int {
+	return rr.d.truncated
+}
+
+func newRecordReader() *recordReader {
+	return &recordReader{d: recordDecoder{
+		r:     bufio.NewReaderSize(nil, streamBufSize),
+		arena: make([]byte, 0, 8*KB),
+	}}
+}
+
+// Parse the payload of m into dst, overwriting every field.  dst
+// refers to memory owned by m or rr, and is only valid until the
+// next call.  Should rr be lenient, the number of bytes ignored
+// following the final field is returned.
+func (rr *recordReader) read(dst *logRecord, m *core.Message) (int, error) {
+	if m.IsBuffered() {
+		payload, err := m.Force()
+		if err != nil {
+			return 0, peerDisconnectf("could not retrieve payload "+
+				"of message: %v", err)
+		}
+
+		if rr.checksum {
+			if payload, err = verifyChecksum(payload); err != nil {
+				return 0, err
+			}
+		}
+
+		if rr.lenient {
+			return parseLogRecordLenient(dst, payload)
+		}
+
+		return 0, parseLogRecord(dst, payload)
+	}
+
+	return rr.readOwned(dst, m)
+}
+
+// Like read, but dst refers only to memory owned by rr, even should
+// m be fully buffered, so that m may be reused while dst is in use.
+func (rr *recordReader) readOwned(dst *logRecord,
+	m *core.Message) (int, error) {
+	d := &rr.d
+	if cap(d.arena) > maxPooledBufSize {
+		d.arena = make([]byte, 0, 8*KB)
+	}
+
+	d.arena = d.arena[:0]
+	d.err = nil
+	d.maxString = rr.truncateOver
+	d.truncated = 0
+
+	payload := m.Payload()
+	var want uint32
+	var sum hash.Hash32
+	if rr.checksum {
+		var b [checksumSize]byte
+		if m.Size()-4 < checksumSize {
+			return 0, protocolErrorf("log record too short for " +
+				"its checksum")
+		} else if _, err := io.ReadFull(payload, b[:]); err != nil {
+			return 0, peerDisconnectf("could not retrieve payload "+
+				"of message: %v", err)
+		}
+
+		want = binary.BigEndian.Uint32(b[:])
+		sum = crc32.New(castagnoli)
+		payload = io.TeeReader(payload, sum)
+	}
+
+	d.r.Reset(payload)
+	d.decode(dst)
+
+	// The payload is bounded by its length header, so anything
+	// left over follows the final field.  A checksummed record
+	// must be read in full before it, or any error decoding it,
+	// can be believed.
+	var remaining int
+	if sum != nil {
+		remaining, _ = d.r.Discard(int(m.Size()))
+		if sum.Sum32() != want {
+			return 0, errCorruptRecord
+		}
+	}
+
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	if sum == nil {
+		remaining, _ = d.r.Discard(int(m.Size()))
+	}
+
+	if remaining != 0 && !rr.lenient {
+		return 0, protocolErrorf("LogRecord message has mismatched "+
+			"length header and cString contents: remaining %d",
+			remaining)
+	}
+
+	return remaining, nil
+}
@@ -0,0 +1,185 @@
+package collector
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+func TestRecordReader(t *testing.T) {
+	// A detail longer than the stream buffer must be read
+	// piecewise.
+	want := sampleLogRecord
+	want.ErrDetail = bytes.Repeat([]byte("d"), 3*streamBufSize)
+	data := encodeLogRecord(&want)
+
+	rr := newRecordReader()
+	var lr logRecord
+	var m core.Message
+
+	// Fully buffered messages are parsed in place.
+	m.InitFromBytes('L', data)
+	if _, err := rr.read(&lr, &m); err != nil {
+		t.Fatalf("Buffered: %v", err)
+	}
+	if !reflect.DeepEqual(lr, want) {
+		t.Fatalf("Buffered: got %+v, want %+v", lr, want)
+	}
+
+	// Partially buffered messages are parsed from the stream,
+	// twice to exercise reuse of the arena.
+	for i := 0; i < 2; i += 1 {
+		m.InitPromise('L', uint32(len(data)+4), data[:10],
+			bytes.NewReader(data[10:]))
+		if _, err := rr.read(&lr, &m); err != nil {
+			t.Fatalf("Streamed: %v", err)
+		}
+		if !reflect.DeepEqual(lr, want) {
+			t.Fatalf("Streamed: got %+v, want %+v", lr, want)
+		}
+	}
+
+	// Truncated messages are an error.
+	m.InitPromise('L', uint32(len(data)+4), data[:10],
+		bytes.NewReader(data[10:len(data)-3]))
+	if _, err := rr.read(&lr, &m); err == nil {
+		t.Fatal("Expected error reading truncated message")
+	}
+
+	// As is trailing data.
+	padded := append(append([]byte{}, data...), 'x')
+	m.InitPromise('L', uint32(len(padded)+4), nil,
+		bytes.NewReader(padded))
+	if _, err := rr.read(&lr, &m); err == nil {
+		t.Fatal("Expected error reading record with trailing data")
+	}
+}
+
+func TestRecordReaderLenient(t *testing.T) {
+	want := sampleLogRecord
+	data := encodeLogRecord(&want)
+	padded := append(append([]byte{}, data...), "Pnew\x00"...)
+
+	rr := newRecordReader()
+	rr.lenient = true
+	var m core.Message
+
+	// Whether buffered or streamed, fields appended by a newer
+	// logfebe are ignored, and counted.
+	for _, streamed := range []bool{false, true} {
+		if streamed {
+			m.InitPromise('L', uint32(len(padded)+4), nil,
+				bytes.NewReader(padded))
+		} else {
+			m.InitFromBytes('L', padded)
+		}
+
+		var lr logRecord
+		n, err := rr.read(&lr, &m)
+		if err != nil {
+			t.Fatalf("Streamed %v: unexpected error: %v", streamed,
+				err)
+		}
+		if n != 5 {
+			t.Errorf("Streamed %v: got %d trailing bytes, want 5",
+				streamed, n)
+		}
+		if !reflect.DeepEqual(lr, want) {
+			t.Errorf("Streamed %v: got %+v, want %+v", streamed,
+				lr, want)
+		}
+	}
+}
+
+func TestRecordReaderTruncate(t *testing.T) {
+	long := sampleLogRecord
+	long.ErrDetail = bytes.Repeat([]byte("d"), 3*streamBufSize)
+	data := encodeLogRecord(&long)
+
+	rr := newRecordReader()
+	rr.truncateOver = 100
+	var lr logRecord
+	var m core.Message
+
+	// Only the field longer than the limit is truncated, however
+	// much of it is buffered.
+	want := long
+	want.ErrDetail = []byte(strings.Repeat("d", 100) +
+		" [truncated 12188 bytes]")
+	for _, buffered := range []int{10, len(data)} {
+		m.InitPromise('L', uint32(len(data)+4), data[:buffered],
+			bytes.NewReader(data[buffered:]))
+		if _, err := rr.readOwned(&lr, &m); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(lr, want) {
+			t.Fatalf("Got %s, want %s", lr.oneLine(),
+				want.oneLine())
+		}
+		if rr.truncated() != 12188 {
+			t.Fatalf("Expected 12188 bytes truncated, got %d",
+				rr.truncated())
+		}
+	}
+
+	// The count is of the record last read.
+	data = encodeLogRecord(&sampleLogRecord)
+	m.InitFromBytes('L', data)
+	if _, err := rr.readOwned(&lr, &m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	} else if rr.truncated() != 0 {
+		t.Fatalf("Expected nothing truncated, got %d", rr.truncated())
+	}
+}
+
+func TestRecycleFmtBuf(t *testing.T) {
+	b := newFmtBuf()
+	b.WriteString("leftovers")
+	if b2 := recycleFmtBuf(b); b2 != b || b2.Len() != 0 {
+		t.Fatalf("Expected the same buffer, emptied; got %q", b2)
+	}
+
+	b.Grow(maxPooledBufSize + 1)
+	b2 := recycleFmtBuf(b)
+	if b2 == b || b2.Cap() > maxPooledBufSize {
+		t.Fatal("Oversized buffer should have been replaced")
+	}
+}
+
+func BenchmarkFormatLogRecFresh(b *testing.B) {
+	sr := &serveRecord{Name: "bench"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatLogRec(&bytes.Buffer{}, &sampleLogRecord, sr)
+	}
+}
+
+func BenchmarkFormatLogRecReused(b *testing.B) {
+	sr := &serveRecord{Name: "bench"}
+	buf := newFmtBuf()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		formatLogRec(buf, &sampleLogRecord, sr)
+		buf = recycleFmtBuf(buf)
+	}
+}
+
+func BenchmarkReadLogRecordStreamed(b *testing.B) {
+	data := encodeLogRecord(&sampleLogRecord)
+	rr := newRecordReader()
+	var lr logRecord
+	var m core.Message
+	var r bytes.Reader
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		m.InitPromise('L', uint32(len(data)+4), nil, &r)
+		if _, err := rr.read(&lr, &m); err != nil {
+			b.Fatalf("Could not parse: %v", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Count of connections quarantined for presenting an unexpected
+// identity, and of the messages they sent, which were discarded,
+// keyed by the identity of the socket they connected to.
+var (
+	quarantinedConns = expvar.NewMap("quarantined_connections")
+	quarantinedMsgs  = expvar.NewMap("quarantined_messages")
+)
+
+// The drain into which operational events, such as connections
+// quarantined, are emitted, set by OPS_DRAIN_URL.  Should it be nil,
+// events are only logged.
+var opsDrain *logplexc.Client
+
+// Create a client of a drain of the collector's own, such as the ops
+// drain.
+func newInternalDrain(drainURL string) (*logplexc.Client, error) {
+	u, err := url.Parse(drainURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return logplexc.NewClient(&logplexc.Config{
+		Logplex:            *u,
+		HttpClient:         *http.DefaultClient,
+		RequestSizeTrigger: 100 * KB,
+		Concurrency:        1,
+		Period:             time.Second,
+	})
+}
+
+// Emit an operational event, a single line of the form
+// "event=name key=value ...", into the ops drain and the log.
+func emitOpsEvent(event string, format string, args ...interface{}) {
+	line := "event=" + event + " " + fmt.Sprintf(format, args...)
+	log.Print(line)
+
+	if opsDrain == nil {
+		return
+	}
+
+	if err := opsDrain.BufferMessage(134, time.Now(), "postgres",
+		"pg_logplexcollector", []byte(line)); err != nil {
+		log.Printf("could not buffer ops event: %v", err)
+	}
+}
+
+// Serve a connection to the socket of sr that identified itself as
+// ident, rather than as sr.I, without forwarding anything it sends.
+// Disconnecting such clients leaves them to retry forever, noticed
+// only by a terse line in the log; holding them instead keeps them
+// quiet, and reports them in the ops drain so that whoever
+// misconfigured them can be told.  Returns once the client
+// disconnects, or ctx is done, reporting why.
+func quarantine(ctx context.Context, msgInit msgInit, sr *serveRecord,
+	ident string) error {
+	quarantinedConns.Add(sr.I, 1)
+	emitOpsEvent("unknown_identity", "socket=%q expected=%q identity=%q "+
+		"action=quarantine", sr.P, sr.I, ident)
+
+	var m core.Message
+	var discarded int
+	defer func() {
+		log.Printf("quarantined client %q of %q discarded %d messages",
+			ident, sr.P, discarded)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("quarantined client %q closed: %w",
+				ident, context.Cause(ctx))
+		default:
+		}
+
+		// Read past the message without holding it in memory,
+		// whatever its size.
+		if err := msgInit(&m); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, m.Payload()); err != nil {
+			return peerDisconnectf("could not read quarantined "+
+				"message: %v", err)
+		}
+
+		discarded++
+		quarantinedMsgs.Add(sr.I, 1)
+	}
+}
@@ -0,0 +1,65 @@
+package collector
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestQuarantine(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	defer func(saved *logplexc.Client) { opsDrain = saved }(opsDrain)
+	opsDrain = d.client(t)
+
+	record := frameMsg('L', encodeLogRecord(&sampleLogRecord))
+	conn := &bufConn{}
+	conn.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+	conn.Write(frameMsg('I', []byte("banana\x00")))
+	conn.Write(record)
+	conn.Write(record)
+
+	sr := &serveRecord{sKey: sKey{I: "quarantine-apple",
+		P: "/p1/log.sock"}, IdentityMismatch: mismatchQuarantine}
+	logWorker(context.Background(), conn, logplexc.Config{}, sr)
+
+	if !conn.closed {
+		t.Error("Expected the connection to be closed")
+	}
+
+	if got := quarantinedConns.Get(sr.I).String(); got != "1" {
+		t.Errorf("Expected one connection quarantined, got %s", got)
+	}
+
+	if got := quarantinedMsgs.Get(sr.I).String(); got != "2" {
+		t.Errorf("Expected two messages discarded, got %s", got)
+	}
+
+	body := d.next(t)
+	want := `event=unknown_identity socket="/p1/log.sock" ` +
+		`expected="quarantine-apple" identity="banana" action=quarantine`
+	if !strings.Contains(body, want) {
+		t.Fatalf("Expected %q in the ops drain, got %q", want, body)
+	}
+}
+
+func TestQuarantineDisabled(t *testing.T) {
+	conn := &bufConn{}
+	conn.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+	conn.Write(frameMsg('I', []byte("banana\x00")))
+	conn.Write(frameMsg('L', encodeLogRecord(&sampleLogRecord)))
+
+	sr := &serveRecord{sKey: sKey{I: "reject-apple", P: "/p1/log.sock"}}
+	logWorker(context.Background(), conn, logplexc.Config{}, sr)
+
+	if !conn.closed {
+		t.Error("Expected the connection to be closed")
+	}
+
+	if v := quarantinedConns.Get(sr.I); v != nil {
+		t.Errorf("Expected no connection quarantined, got %v", v)
+	}
+}
@@ -0,0 +1,126 @@
+package collector
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Serve records may limit the bytes of log records forwarded for
+// them each hour and each day, so that billing and abuse policies
+// need not be enforced downstream.  The windows are of the clock, in
+// UTC, and shared by every connection to the record's socket.
+//
+// Once a quota is exhausted, records are dropped until its window
+// ends, however small, so that the notices do not flap as records
+// too large for what remains alternate with records that fit.  A notice is sent into the drain, and emitted as an ops
+// event, as dropping starts, and a summary of what was dropped as it
+// ends, which is noticed with the first record to arrive after.
+
+// Count of log records dropped for exceeding a quota, and of their
+// bytes, keyed by identity.
+var (
+	quotaDroppedMsgs  = expvar.NewMap("quota_dropped_messages")
+	quotaDroppedBytes = expvar.NewMap("quota_dropped_bytes")
+)
+
+// The usage of the quotas of each serve record.
+var quotas = struct {
+	sync.Mutex
+	m map[sKey]*quotaUsage
+}{m: make(map[sKey]*quotaUsage)}
+
+// The bytes a serve record forwarded in the current windows, and
+// dropped since exceeding a quota.
+type quotaUsage struct {
+	hour, day           time.Time
+	hourBytes, dayBytes uint64
+
+	// The quota exceeded, "hourly" or "daily", or empty should
+	// records be forwarded, when its window ends, and the records
+	// dropped since.
+	exceeded     string
+	since, until time.Time
+	dropped      uint64
+	droppedBytes uint64
+}
+
+// Whether sr has any quota.
+func (sr *serveRecord) hasQuota() bool {
+	return sr.HourlyQuota > 0 || sr.DailyQuota > 0
+}
+
+// Charge a record of size bytes, arriving at now, to the quotas of
+// sr, reporting whether it may be forwarded, and any notices to send
+// into the drain of sr.
+func chargeQuota(sr *serveRecord, now time.Time,
+	size int) (bool, []string) {
+	if !sr.hasQuota() {
+		return true, nil
+	}
+
+	quotas.Lock()
+	defer quotas.Unlock()
+
+	q := quotas.m[sr.sKey]
+	if q == nil {
+		q = &quotaUsage{}
+		quotas.m[sr.sKey] = q
+	}
+
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !hour.Equal(q.hour) {
+		q.hour, q.hourBytes = hour, 0
+	}
+	if day := now.Truncate(24 * time.Hour); !day.Equal(q.day) {
+		q.day, q.dayBytes = day, 0
+	}
+
+	var notices []string
+	if q.exceeded != "" && !now.Before(q.until) {
+		notices = append(notices, fmt.Sprintf("%s quota no longer "+
+			"exceeded: dropped %d log messages, %d bytes, since %s",
+			q.exceeded, q.dropped, q.droppedBytes,
+			q.since.Format(time.RFC3339)))
+		emitOpsEvent("quota_resumed", "identity=%q socket=%q "+
+			"quota=%s dropped=%d dropped_bytes=%d", sr.I, sr.P,
+			q.exceeded, q.dropped, q.droppedBytes)
+		q.exceeded, q.dropped, q.droppedBytes = "", 0, 0
+	}
+
+	n := uint64(size)
+	if q.exceeded == "" {
+		var exceeded string
+		var limit uint64
+		var until time.Time
+		if sr.DailyQuota > 0 && q.dayBytes+n > sr.DailyQuota {
+			exceeded, limit = "daily", sr.DailyQuota
+			until = q.day.Add(24 * time.Hour)
+		} else if sr.HourlyQuota > 0 &&
+			q.hourBytes+n > sr.HourlyQuota {
+			exceeded, limit = "hourly", sr.HourlyQuota
+			until = q.hour.Add(time.Hour)
+		}
+
+		if exceeded == "" {
+			q.hourBytes += n
+			q.dayBytes += n
+			return true, notices
+		}
+
+		notices = append(notices, fmt.Sprintf("%s quota of %d "+
+			"bytes exceeded: dropping log messages until %s",
+			exceeded, limit, until.Format(time.RFC3339)))
+		emitOpsEvent("quota_exceeded", "identity=%q socket=%q "+
+			"quota=%s limit=%d until=%s", sr.I, sr.P, exceeded,
+			limit, until.Format(time.RFC3339))
+		q.exceeded, q.since, q.until = exceeded, now, until
+	}
+
+	q.dropped += 1
+	q.droppedBytes += n
+	quotaDroppedMsgs.Add(sr.I, 1)
+	quotaDroppedBytes.Add(sr.I, int64(n))
+	return false, notices
+}
@@ -0,0 +1,111 @@
+package collector
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChargeQuota(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "quota-apple", P: "/q/log.sock"},
+		HourlyQuota: 100, DailyQuota: 250}
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	charge := func(at time.Duration, size int, want bool) []string {
+		ok, notices := chargeQuota(sr, start.Add(at), size)
+		if ok != want {
+			t.Fatalf("At %v: expected %v, got %v", at, want, ok)
+		}
+
+		return notices
+	}
+
+	before := expvarInt(quotaDroppedMsgs, sr.I)
+	charge(0, 60, true)
+	charge(time.Minute, 40, true)
+
+	// The hour's quota is used up: dropping starts, with a notice
+	// given only once.
+	notices := charge(2*time.Minute, 1, false)
+	if len(notices) != 1 || !strings.Contains(notices[0],
+		"hourly quota of 100 bytes exceeded") ||
+		!strings.Contains(notices[0], "until 2014-05-01T11:00:00Z") {
+		t.Fatalf("Unexpected notices %q", notices)
+	}
+	if notices := charge(3*time.Minute, 10, false); notices != nil {
+		t.Fatalf("Expected no further notices, got %q", notices)
+	}
+
+	// The next hour forwards again, summarizing what was dropped.
+	notices = charge(time.Hour, 100, true)
+	if len(notices) != 1 || !strings.Contains(notices[0],
+		"dropped 2 log messages, 11 bytes") {
+		t.Fatalf("Unexpected notices %q", notices)
+	}
+
+	// The day's quota then runs out, before the hour's, until the
+	// next day.
+	charge(2*time.Hour, 50, true)
+	notices = charge(2*time.Hour+time.Minute, 1, false)
+	if len(notices) != 1 || !strings.Contains(notices[0],
+		"daily quota of 250 bytes exceeded") {
+		t.Fatalf("Unexpected notices %q", notices)
+	}
+	charge(3*time.Hour, 1, false)
+	charge(14*time.Hour, 1, true)
+
+	if got := expvarInt(quotaDroppedMsgs, sr.I); got != before+4 {
+		t.Fatalf("Expected 4 dropped, got %d", got-before)
+	}
+
+	// Records without quotas are never dropped.
+	if ok, _ := chargeQuota(&serveRecord{}, start, 1<<30); !ok {
+		t.Fatalf("Expected a record without quotas to be forwarded")
+	}
+}
+
+func TestChargeQuotaAlternating(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "quota-banana", P: "/q/log.sock"},
+		HourlyQuota: 100}
+	start := time.Date(2014, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	var notices []string
+	charge := func(at time.Duration, size int) bool {
+		ok, n := chargeQuota(sr, start.Add(at), size)
+		notices = append(notices, n...)
+		return ok
+	}
+
+	charge(0, 90)
+
+	// Once a large record exceeds the quota, small records that
+	// would still fit are dropped too, until the hour ends, with
+	// a single notice as dropping starts.
+	for i := 1; i <= 6; i++ {
+		size := 50
+		if i%2 == 0 {
+			size = 5
+		}
+
+		if charge(time.Duration(i)*time.Minute, size) {
+			t.Fatalf("Expected record %d of %d bytes to be "+
+				"dropped", i, size)
+		}
+	}
+
+	if len(notices) != 1 || !strings.Contains(notices[0],
+		"hourly quota of 100 bytes exceeded") {
+		t.Fatalf("Unexpected notices %q", notices)
+	}
+
+	// The summary is sent as the hour rolls over.
+	notices = nil
+	if !charge(time.Hour, 5) {
+		t.Fatal("Expected the next hour to forward")
+	}
+
+	if len(notices) != 1 || !strings.Contains(notices[0],
+		"dropped 6 log messages, 165 bytes") {
+		t.Fatalf("Unexpected notices %q", notices)
+	}
+}
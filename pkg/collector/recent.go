@@ -0,0 +1,122 @@
+package collector
+
+import (
+	"sync"
+	"time"
+)
+
+// Number of recent formatted messages retained per serve record for
+// inspection via the admin interface.  Zero disables retention.
+var recentMessagesPerRecord = 0
+
+// Retained messages are truncated to this size, to bound memory use.
+const recentMessageMaxSize = 2 * KB
+
+type recentMessage struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// A fixed-size ring of the most recent messages.
+type messageRing struct {
+	mu   sync.Mutex
+	msgs []recentMessage
+	next int
+	full bool
+}
+
+func newMessageRing(n int) *messageRing {
+	return &messageRing{msgs: make([]recentMessage, n)}
+}
+
+func (r *messageRing) add(t time.Time, msg []byte) {
+	if len(msg) > recentMessageMaxSize {
+		msg = msg[:recentMessageMaxSize]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.msgs[r.next] = recentMessage{Time: t, Message: string(msg)}
+	r.next += 1
+	if r.next == len(r.msgs) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Copy out the retained messages, oldest first.
+func (r *messageRing) contents() []recentMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]recentMessage(nil), r.msgs[:r.next]...)
+	}
+
+	out := make([]recentMessage, 0, len(r.msgs))
+	out = append(out, r.msgs[r.next:]...)
+	return append(out, r.msgs[:r.next]...)
+}
+
+// Rings of recent messages, per serve record.
+var recent = struct {
+	sync.Mutex
+	m map[sKey]*messageRing
+}{m: make(map[sKey]*messageRing)}
+
+// Retain msg as one of the recent messages of the serve record k.
+func recordRecent(k sKey, t time.Time, msg []byte) {
+	if recentMessagesPerRecord <= 0 {
+		return
+	}
+
+	recent.Lock()
+	r, ok := recent.m[k]
+	if !ok {
+		r = newMessageRing(recentMessagesPerRecord)
+		recent.m[k] = r
+	}
+	recent.Unlock()
+
+	r.add(t, msg)
+}
+
+// Forget the recent messages of serve records other than those of
+// serving, as after a reload, so that records come and gone do not
+// accumulate.
+func pruneRecent(serving []serveRecord) {
+	keep := make(map[sKey]bool, len(serving))
+	for i := range serving {
+		keep[serving[i].sKey] = true
+	}
+
+	recent.Lock()
+	defer recent.Unlock()
+
+	for k := range recent.m {
+		if !keep[k] {
+			delete(recent.m, k)
+		}
+	}
+}
+
+// Report the recent messages of every serve record with the given
+// identity, or of all serve records if ident is empty.
+func recentMessages(ident string) map[string][]recentMessage {
+	recent.Lock()
+	defer recent.Unlock()
+
+	out := make(map[string][]recentMessage)
+	for k, r := range recent.m {
+		if ident != "" && k.I != ident {
+			continue
+		}
+
+		// Distinguish records sharing an identity by their
+		// socket path.
+		out[k.I+" "+k.P] = r.contents()
+	}
+
+	return out
+}
@@ -0,0 +1,71 @@
+package collector
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMessageRing(t *testing.T) {
+	r := newMessageRing(3)
+	if got := r.contents(); len(got) != 0 {
+		t.Fatalf("Expected empty ring, got %v", got)
+	}
+
+	now := time.Now()
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		r.add(now, []byte(m))
+	}
+
+	got := r.contents()
+	if len(got) != 3 || got[0].Message != "c" ||
+		got[1].Message != "d" || got[2].Message != "e" {
+		t.Fatalf("Expected the last three messages in order, got %v",
+			got)
+	}
+
+	r.add(now, bytes.Repeat([]byte("x"), recentMessageMaxSize+1))
+	got = r.contents()
+	if len(got[2].Message) != recentMessageMaxSize {
+		t.Fatalf("Expected oversized message to be truncated to %d, "+
+			"got %d", recentMessageMaxSize, len(got[2].Message))
+	}
+}
+
+func TestRecordRecent(t *testing.T) {
+	defer func(n int) { recentMessagesPerRecord = n }(recentMessagesPerRecord)
+
+	k := sKey{I: "recent-test", P: "/p1/log.sock"}
+
+	recentMessagesPerRecord = 0
+	recordRecent(k, time.Now(), []byte("dropped"))
+	if got := recentMessages(k.I); len(got) != 0 {
+		t.Fatalf("Expected nothing retained when disabled, got %v", got)
+	}
+
+	recentMessagesPerRecord = 2
+	recordRecent(k, time.Now(), []byte("kept"))
+	got := recentMessages(k.I)
+	msgs := got[k.I+" "+k.P]
+	if len(got) != 1 || len(msgs) != 1 || msgs[0].Message != "kept" {
+		t.Fatalf("Expected one retained message, got %v", got)
+	}
+}
+
+func TestPruneRecent(t *testing.T) {
+	defer func(n int) { recentMessagesPerRecord = n }(recentMessagesPerRecord)
+	recentMessagesPerRecord = 2
+
+	kept := sKey{I: "prune-kept", P: "/p1/log.sock"}
+	gone := sKey{I: "prune-gone", P: "/p2/log.sock"}
+	recordRecent(kept, time.Now(), []byte("kept"))
+	recordRecent(gone, time.Now(), []byte("gone"))
+
+	pruneRecent([]serveRecord{{sKey: kept}})
+	if got := recentMessages(kept.I); len(got) != 1 {
+		t.Fatalf("Expected the served record's messages, got %v", got)
+	} else if got := recentMessages(gone.I); len(got) != 0 {
+		t.Fatalf("Expected the departed record's messages to be "+
+			"forgotten, got %v", got)
+	}
+}
@@ -0,0 +1,52 @@
+package collector
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// SQLSTATE codes reported to refused clients.
+const (
+	sqlStateTooManyConnections = "53300"
+	sqlStateOutOfMemory        = "53200"
+)
+
+// How long to spend trying to tell a refused client why.
+const rejectTimeout = time.Second
+
+// Refuse a client connection, sending it a Postgres ErrorResponse
+// message that explains why before closing it, and logging the
+// refusal.  Clients that do not read from the connection lose
+// nothing by this.
+func rejectConn(conn net.Conn, sr *serveRecord, sqlState, msg string) {
+	defer conn.Close()
+
+	refusedConnections.Add(sr.I, 1)
+	log.Printf("refusing connection on %q for identity %q: %s "+
+		"(SQLSTATE %s)", sr.P, sr.I, msg, sqlState)
+
+	var payload bytes.Buffer
+	for _, f := range []struct {
+		code  byte
+		value string
+	}{
+		{'S', "FATAL"},
+		{'C', sqlState},
+		{'M', msg},
+	} {
+		payload.WriteByte(f.code)
+		payload.WriteString(f.value)
+		payload.WriteByte(0)
+	}
+	payload.WriteByte(0)
+
+	var m core.Message
+	m.InitFromBytes('E', payload.Bytes())
+
+	conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	m.WriteTo(conn)
+}
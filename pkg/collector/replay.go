@@ -0,0 +1,461 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// A connection to be replayed.
+type replaySource struct {
+	// Describes where the connection was found.
+	desc string
+
+	data []byte
+
+	// The number of bytes of data that were not captured, and
+	// have been filled with zeroes.
+	missing int
+}
+
+// Read the connections to replay from r, which may hold a capture
+// file (see capture.go), a packet capture (see pcap.go), or otherwise
+// the raw bytes of a single connection.
+func readReplaySources(r io.Reader) ([]replaySource, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(captureMagic))
+
+	switch {
+	case string(head) == captureMagic:
+		return readCaptureSources(br)
+	case isPcap(head):
+		streams, err := readPcap(br)
+		if err != nil {
+			return nil, err
+		}
+
+		srcs := make([]replaySource, len(streams))
+		for i, st := range streams {
+			srcs[i] = replaySource{
+				desc: fmt.Sprintf("connection %d, %s to %s",
+					i+1, st.Client, st.Server),
+				data:    st.Data,
+				missing: st.Missing,
+			}
+		}
+
+		return srcs, nil
+	default:
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, err
+		}
+
+		return []replaySource{{desc: "stream", data: data}}, nil
+	}
+}
+
+// Group the data of a capture file by connection, in the order in
+// which the connections began.
+func readCaptureSources(r io.Reader) ([]replaySource, error) {
+	cr, err := newCaptureReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []uint64
+	streams := make(map[uint64]*bytes.Buffer)
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		b, ok := streams[rec.Conn]
+		if !ok {
+			b = new(bytes.Buffer)
+			streams[rec.Conn] = b
+			order = append(order, rec.Conn)
+		}
+
+		if rec.Kind == captureData {
+			b.Write(rec.Data)
+		}
+	}
+
+	srcs := make([]replaySource, len(order))
+	for i, conn := range order {
+		srcs[i] = replaySource{
+			desc: fmt.Sprintf("connection %x", conn),
+			data: streams[conn].Bytes(),
+		}
+	}
+
+	return srcs, nil
+}
+
+// Replays the connections read from r (see readReplaySources) through
+// the collector, as though each had just been received on a socket,
+// writing to w how each would be routed, and what would have been
+// sent to its drain.
+//
+// Each connection is routed among routes, should they be given, by
+// the identity it presents: as the socket it would have arrived on
+// isn't known, any record of that identity serves, its name and
+// options applying to the replay.  Connections are always replayed to
+// a drain whose token is their identity, so that routing is visible
+// in the output without revealing the credentials of real drains.
+// Without a serve record, they are replayed as served by a record
+// named name.
+//
+// Connections are replayed one at a time, in the order in which they
+// began.  As the time of each message is that of its delivery, it is
+// replaced by the syslog nil value, "-", so that the output of a
+// given capture is always the same.  Should a connection be one the
+// collector would disconnect, why and where are written to w, and
+// the remaining connections are replayed before an error is returned.
+func replay(r io.Reader, name string, routes map[sKey]*serveRecord,
+	w io.Writer) error {
+	srcs, err := readReplaySources(r)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, src := range srcs {
+		if err := replayStream(src, name, routes, w); err != nil {
+			fmt.Fprintf(w, "# %s: %v\n", src.desc, err)
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d connections failed", failed,
+			len(srcs))
+	}
+
+	return nil
+}
+
+// Replay the bytes received on a single connection.
+func replayStream(src replaySource, name string,
+	routes map[sKey]*serveRecord, w io.Writer) error {
+	if src.missing > 0 {
+		fmt.Fprintf(w, "# %s: %d bytes were not captured\n", src.desc,
+			src.missing)
+	}
+
+	ident, records, scanErr := scanStream(src.data, false)
+	if ident == "" && scanErr != nil {
+		return scanErr
+	}
+
+	fmt.Fprintf(w, "# %s: identity %q\n", src.desc, ident)
+
+	sr := &serveRecord{Name: name}
+	if routes != nil {
+		route, desc := routeReplay(routes, ident)
+		fmt.Fprintf(w, "# %s: %s\n", src.desc, desc)
+		if route == nil {
+			return nil
+		}
+
+		*sr = *route
+		if name != "" {
+			sr.Name = name
+		}
+
+		if sr.LenientParse && scanErr != nil {
+			_, records, scanErr = scanStream(src.data, true)
+		}
+	}
+
+	// Neither capture the replay nor interleave heartbeats with
+	// it.
+	sr.sKey = sKey{I: ident, P: "replay"}
+	sr.u = url.URL{Scheme: "https", Host: "replay.invalid",
+		User: url.UserPassword("token", ident)}
+	sr.Capture = ""
+	sr.Heartbeat = 0
+
+	drain := &replayDrain{w: w}
+
+	// Buffer everything until the connection closes, so that it
+	// is sent in a single request, in order.
+	cfg := logplexc.Config{
+		HttpClient:         http.Client{Transport: drain},
+		RequestSizeTrigger: 1 << 30,
+		Concurrency:        1,
+		Period:             time.Hour,
+	}
+
+	logWorker(context.Background(),
+		&replayConn{bytes.NewReader(src.data)}, cfg, sr)
+	if drain.count() > 0 {
+		fmt.Fprintln(w)
+	}
+
+	if scanErr != nil {
+		return scanErr
+	}
+
+	if n := drain.count(); n < records {
+		return fmt.Errorf("%d of %d log records were not delivered",
+			records-n, records)
+	}
+
+	return nil
+}
+
+// Find the serve record to replay a connection presenting ident
+// with, describing the routing decision.
+func routeReplay(routes map[sKey]*serveRecord,
+	ident string) (*serveRecord, string) {
+	var recs []*serveRecord
+	for k, sr := range routes {
+		if k.I == ident {
+			recs = append(recs, sr)
+		}
+	}
+
+	if len(recs) == 0 {
+		return nil, "no serve record has this identity: " +
+			"the connection would be refused"
+	}
+
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].P < recs[j].P
+	})
+
+	// Never print the drain's credentials.
+	u := recs[0].u
+	u.User = nil
+	desc := fmt.Sprintf("routed by the record for socket %q to %s",
+		recs[0].P, u.String())
+	if recs[0].Name != "" {
+		desc += fmt.Sprintf(", named %q", recs[0].Name)
+	}
+
+	if len(recs) > 1 {
+		desc += fmt.Sprintf(" (one of %d sockets with this identity)",
+			len(recs))
+	}
+
+	return recs[0], desc
+}
+
+// Check the connection whose bytes are data as the collector would,
+// reporting the identity it presents and the number of log records
+// that follow, and why and where the collector would disconnect it
+// before its end, should it do so.  Should lenient be set, bytes
+// following the final field of a log record are ignored, as with the
+// "lenient_parse" option of serve records.  Records not matching
+// their checksums are skipped, as the collector would, and not
+// counted.
+func scanStream(data []byte,
+	lenient bool) (ident string, records int, err error) {
+	off, msgOff := 0, 0
+
+	// Say where the message that could not be handled begins.
+	at := func(err error) error {
+		return fmt.Errorf("message at offset %d: %v", msgOff, err)
+	}
+
+	// Frame messages as femebe would, but keeping track of where
+	// each begins.
+	next := func(m *core.Message) (bool, error) {
+		msgOff = off
+		if off == len(data) {
+			return false, nil
+		} else if len(data)-off < 5 {
+			return false, protocolErrorf("truncated message header")
+		}
+
+		size := binary.BigEndian.Uint32(data[off+1 : off+5])
+		if size < 4 {
+			return false, protocolErrorf("malformed message "+
+				"length %d", size)
+		} else if int64(size) > int64(len(data)-off-1) {
+			return false, protocolErrorf("truncated message: "+
+				"%d of %d bytes", len(data)-off-1, size)
+		}
+
+		m.InitFromBytes(data[off], data[off+5:off+1+int(size)])
+		off += 1 + int(size)
+		return true, nil
+	}
+
+	msgInit := func(m *core.Message) error {
+		if ok, err := next(m); err != nil {
+			return err
+		} else if !ok {
+			return peerDisconnectf("postgres client disconnects")
+		}
+
+		return nil
+	}
+
+	caps, err := processVerMsg(msgInit)
+	if err != nil {
+		return "", 0, at(err)
+	}
+
+	ident, err = processIdentMsg(msgInit)
+	if err != nil {
+		return "", 0, at(err)
+	}
+
+	var m core.Message
+	var lr logRecord
+	for {
+		if ok, err := next(&m); err != nil {
+			return ident, records, at(err)
+		} else if !ok {
+			break
+		}
+
+		// Keepalives aside, whatever their type, as does
+		// processLogMsg.
+		if m.MsgType() == 'K' {
+			continue
+		}
+
+		if m.Size() > 1*MB {
+			return ident, records, at(protocolErrorf(
+				"oversized log record"))
+		}
+
+		payload, _ := m.Force()
+		if caps.checksum {
+			payload, err = verifyChecksum(payload)
+			if err == errCorruptRecord {
+				continue
+			} else if err != nil {
+				return ident, records, at(err)
+			}
+		}
+
+		if lenient {
+			_, err = parseLogRecordLenient(&lr, payload)
+		} else {
+			err = parseLogRecord(&lr, payload)
+		}
+
+		if err != nil {
+			return ident, records, at(err)
+		}
+		records += 1
+	}
+
+	return ident, records, nil
+}
+
+// A connection whose bytes were captured earlier.
+type replayConn struct {
+	*bytes.Reader
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c *replayConn) Close() error {
+	return nil
+}
+
+// Stands in for a drain, writing the bodies of the requests it
+// receives to w, with the time of each message replaced.
+type replayDrain struct {
+	mu     sync.Mutex
+	w      io.Writer
+	frames int
+}
+
+func (d *replayDrain) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	out, n, err := stripFrameTimes(body)
+	if err != nil {
+		return nil, err
+	}
+
+	d.frames += n
+	if _, err := d.w.Write(out); err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusNoContent,
+		Status:     "204 No Content",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		Request:    req,
+	}, nil
+}
+
+// Report the number of messages received.
+func (d *replayDrain) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.frames
+}
+
+// Rewrite a logplex-1 request body, replacing the time of each
+// message with "-" and adjusting its length prefix to match.  The
+// number of messages is also reported.
+func stripFrameTimes(body []byte) ([]byte, int, error) {
+	var out bytes.Buffer
+	n := 0
+	for len(body) > 0 {
+		sp := bytes.IndexByte(body, ' ')
+		if sp < 0 {
+			return nil, n, fmt.Errorf("frame %d: no length", n)
+		}
+
+		size, err := strconv.Atoi(string(body[:sp]))
+		if err != nil || size < 0 || size > len(body)-sp-1 {
+			return nil, n, fmt.Errorf("frame %d: bad length", n)
+		}
+
+		msg := body[sp+1 : sp+1+size]
+		body = body[sp+1+size:]
+
+		// <PRI>VERSION TIMESTAMP REST
+		fields := bytes.SplitN(msg, []byte{' '}, 3)
+		if len(fields) != 3 {
+			return nil, n, fmt.Errorf("frame %d: bad header", n)
+		}
+
+		stripped := len(fields[0]) + len(" - ") + len(fields[2])
+		fmt.Fprintf(&out, "%d %s - %s", stripped, fields[0], fields[2])
+		n += 1
+	}
+
+	return out.Bytes(), n, nil
+}
@@ -0,0 +1,42 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"time"
+)
+
+// Compute when the process should restart itself, given how long it
+// should run and by up to how much longer it may, at random, so that
+// a fleet of collectors started together does not restart in
+// lockstep.  The zero time is returned if restarts are disabled.
+func deathClockFrom(start time.Time, interval,
+	jitter time.Duration) time.Time {
+	if interval <= 0 {
+		return time.Time{}
+	}
+
+	if jitter > 0 {
+		interval += time.Duration(rand.Int63n(int64(jitter)))
+	}
+
+	return start.Add(interval)
+}
+
+// Write a single logfmt line describing a restart on account of the
+// death clock, including memory statistics, so that the memory
+// growth it guards against may be tracked.
+func writeRestartEvent(w io.Writer, started, deadline time.Time) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	fmt.Fprintf(w, "event=restart reason=deadline deadline=%s "+
+		"uptime=%v connections=%d goroutines=%d heap_alloc=%d "+
+		"heap_sys=%d heap_objects=%d sys=%d num_gc=%d\n",
+		deadline.Format(time.RFC3339),
+		time.Since(started).Truncate(time.Second), liveConns(),
+		runtime.NumGoroutine(), ms.HeapAlloc, ms.HeapSys,
+		ms.HeapObjects, ms.Sys, ms.NumGC)
+}
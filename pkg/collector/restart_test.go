@@ -0,0 +1,51 @@
+package collector
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeathClockFrom(t *testing.T) {
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if dc := deathClockFrom(start, 0, time.Minute); !dc.IsZero() {
+		t.Fatalf("A zero interval should disable the death clock, "+
+			"instead it is %v", dc)
+	}
+
+	if dc := deathClockFrom(start, time.Hour, 0); !dc.Equal(
+		start.Add(time.Hour)) {
+		t.Fatalf("Without jitter the death clock should be an "+
+			"interval after start, instead it is %v", dc)
+	}
+
+	for i := 0; i < 100; i += 1 {
+		dc := deathClockFrom(start, time.Hour, time.Minute)
+		if dc.Before(start.Add(time.Hour)) ||
+			!dc.Before(start.Add(time.Hour+time.Minute)) {
+			t.Fatalf("Jittered death clock should fall within "+
+				"[1h, 1h1m) of start, instead it is %v", dc)
+		}
+	}
+}
+
+func TestWriteRestartEvent(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Now()
+	writeRestartEvent(&buf, now.Add(-time.Hour), now)
+
+	out := buf.String()
+	if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+		t.Fatalf("Restart event should be a single line, got %q", out)
+	}
+
+	for _, field := range []string{"event=restart ", "reason=deadline ",
+		"uptime=1h0m0s ", "heap_alloc=", "num_gc="} {
+		if !strings.Contains(out, field) {
+			t.Errorf("Restart event should contain %q, got %q",
+				field, out)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// What the collector may touch once sandboxed.  Everything else on
+// the filesystem becomes inaccessible, and no program may be
+// executed, so that a flaw in the handling of input from the
+// world-writable sockets cannot be used to reach further.
+type sandboxSpec struct {
+	// Directories whose files may be read, written, created and
+	// removed, such as the serve database directory.
+	data []string
+
+	// Directories in which sockets may be created and removed,
+	// along with subdirectories to hold them.
+	sockets []string
+
+	// Files and directories that may only be read, such as those
+	// consulted to resolve host names.
+	readOnly []string
+}
+
+// Files consulted by the resolver, TLS, and lookups of the users and
+// groups owning sockets, which may be read when sandboxed should they
+// exist.  TLS roots are in /etc/ssl, or behind symlinks from it in
+// /etc/pki on RHEL-family systems and /etc/ca-certificates on others.
+var sandboxSystemFiles = []string{
+	"/etc/ca-certificates",
+	"/etc/group",
+	"/etc/hosts",
+	"/etc/localtime",
+	"/etc/nsswitch.conf",
+	"/etc/passwd",
+	"/etc/pki",
+	"/etc/resolv.conf",
+	"/etc/services",
+	"/etc/ssl",
+	"/usr/share/zoneinfo",
+}
+
+// Work out what to permit when sandboxed, given the serve database
+// directories, the configuration file if any, the serve records being
+// served, and the extra socket directories given by extra, a
+// colon-separated list.
+//
+// The directory of each socket is permitted as it is now; a later
+// version of the serve database with sockets elsewhere can only be
+// served should extra name their directories.
+func newSandboxSpec(sdbDirs []string, configPath string,
+	snap []serveRecord, extra string) sandboxSpec {
+	spec := sandboxSpec{data: append([]string(nil), sdbDirs...)}
+
+	seen := make(map[string]bool)
+	addSockets := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			spec.sockets = append(spec.sockets, dir)
+		}
+	}
+
+	for i := range snap {
+		if !isActivated(snap[i].P) {
+			addSockets(filepath.Dir(snap[i].P))
+		}
+
+		if snap[i].Capture != "" {
+			spec.data = append(spec.data,
+				filepath.Dir(snap[i].Capture))
+		}
+
+		if snap[i].CSVLog != "" {
+			spec.data = append(spec.data,
+				filepath.Dir(snap[i].CSVLog))
+		}
+	}
+
+	for _, dir := range strings.Split(extra, ":") {
+		addSockets(dir)
+	}
+
+	if acks != nil {
+		spec.data = append(spec.data, filepath.Dir(acks.path))
+	}
+
+	if configPath != "" {
+		spec.readOnly = append(spec.readOnly, configPath)
+	}
+
+	for _, p := range sandboxSystemFiles {
+		if _, err := os.Stat(p); err == nil {
+			spec.readOnly = append(spec.readOnly, p)
+		}
+	}
+
+	sort.Strings(spec.sockets)
+	return spec
+}
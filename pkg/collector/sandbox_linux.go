@@ -0,0 +1,214 @@
+//go:build linux && (amd64 || arm64)
+
+package collector
+
+import (
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock, per linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	// O_PATH, per asm-generic/fcntl.h.
+	oPath = 0x200000
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+
+	// Every access right of the first version of Landlock, all of
+	// which are denied but for those granted by rules.
+	landlockHandled = 1<<13 - 1
+
+	// The rights that may be granted on a file, rather than a
+	// directory.
+	landlockFileAccess = landlockAccessExecute |
+		landlockAccessWriteFile | landlockAccessReadFile
+)
+
+// Seccomp, per linux/seccomp.h and linux/filter.h.
+const (
+	prSetNoNewPrivs = 38
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+
+	seccompRetAllow = 0x7fff0000
+	seccompRetErrno = 0x00050000
+
+	bpfLdWAbs = 0x20
+	bpfJeqK   = 0x15
+	bpfJgeK   = 0x35
+	bpfRetK   = 0x06
+
+	// Offsets within struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+)
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// Confine the process as described by spec, irrevocably: Landlock
+// limits filesystem access, and a seccomp filter refuses to execute
+// programs.
+func enterSandbox(spec sandboxSpec) error {
+	// Landlock and seccomp apply to a thread only should it be
+	// unable to gain privileges.  The Go runtime can make a system
+	// call on every thread only when cgo is not in use.
+	if _, _, e := syscall.AllThreadsSyscall(syscall.SYS_PRCTL,
+		prSetNoNewPrivs, 1, 0); e != 0 {
+		if e == syscall.ENOTSUP {
+			return fmt.Errorf("cannot sandbox every thread: " +
+				"build with CGO_ENABLED=0")
+		}
+
+		return fmt.Errorf("cannot set no_new_privs: %v", e)
+	}
+
+	// Go loads the system's TLS roots on first use: load them
+	// now, wherever they may be, so that drains and secret stores
+	// can be reached whatever the sandbox leaves readable.
+	if _, err := x509.SystemCertPool(); err != nil {
+		log.Printf("cannot load TLS roots before sandboxing: %v",
+			err)
+	}
+
+	if err := restrictFilesystem(spec); err != nil {
+		return err
+	}
+
+	return denyExec()
+}
+
+// Install a seccomp filter, on every thread, under which execve and
+// execveat fail with EPERM.
+func denyExec() error {
+	eperm := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	filter := []sockFilter{
+		{bpfLdWAbs, 0, 0, seccompDataArch},
+		{bpfJeqK, 1, 0, auditArch},
+		{bpfRetK, 0, 0, eperm},
+		{bpfLdWAbs, 0, 0, seccompDataNr},
+		{bpfJgeK, 3, 0, sysLimit},
+		{bpfJeqK, 2, 0, syscall.SYS_EXECVE},
+		{bpfJeqK, 1, 0, sysExecveat},
+		{bpfRetK, 0, 0, seccompRetAllow},
+		{bpfRetK, 0, 0, eperm},
+	}
+
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	if _, _, e := syscall.Syscall(sysSeccomp, seccompSetModeFilter,
+		seccompFilterFlagTsync,
+		uintptr(unsafe.Pointer(&prog))); e != 0 {
+		return fmt.Errorf("cannot install seccomp filter: %v", e)
+	}
+
+	return nil
+}
+
+// Limit access to the filesystem to what spec permits, on every
+// thread.
+func restrictFilesystem(spec sandboxSpec) error {
+	abi, _, e := syscall.Syscall(sysLandlockCreateRuleset, 0, 0,
+		landlockCreateRulesetVersion)
+	if e != 0 || abi < 1 {
+		return fmt.Errorf("Landlock is not available: %v", e)
+	}
+
+	// struct landlock_ruleset_attr, as of the first version.
+	handled := uint64(landlockHandled)
+	fd, _, e := syscall.Syscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&handled)), unsafe.Sizeof(handled), 0)
+	if e != 0 {
+		return fmt.Errorf("cannot create Landlock ruleset: %v", e)
+	}
+	defer syscall.Close(int(fd))
+
+	rules := []struct {
+		paths  []string
+		access uint64
+	}{
+		{spec.data, landlockAccessReadFile | landlockAccessWriteFile |
+			landlockAccessReadDir | landlockAccessMakeReg |
+			landlockAccessRemoveFile},
+		{spec.sockets, landlockAccessReadDir | landlockAccessMakeDir |
+			landlockAccessMakeSock | landlockAccessRemoveFile},
+		{spec.readOnly, landlockAccessReadFile |
+			landlockAccessReadDir},
+	}
+
+	for _, r := range rules {
+		for _, p := range r.paths {
+			if err := landlockAllow(int(fd), p, r.access); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Landlock applies only to the calling thread, so every
+	// thread must restrict itself.
+	if _, _, e := syscall.AllThreadsSyscall(sysLandlockRestrictSelf,
+		fd, 0, 0); e != 0 {
+		return fmt.Errorf("cannot apply Landlock ruleset: %v", e)
+	}
+
+	return nil
+}
+
+// Add a rule to the ruleset fd granting access beneath path.
+func landlockAllow(fd int, path string, access uint64) error {
+	f, err := os.OpenFile(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("cannot open %q for sandbox: %v", path, err)
+	}
+	defer f.Close()
+
+	if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+		access &= landlockFileAccess
+	}
+
+	// struct landlock_path_beneath_attr, which is packed.
+	var attr [12]byte
+	binary.LittleEndian.PutUint64(attr[0:8], access)
+	binary.LittleEndian.PutUint32(attr[8:12], uint32(f.Fd()))
+
+	if _, _, e := syscall.Syscall6(sysLandlockAddRule, uintptr(fd),
+		landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])),
+		0, 0, 0); e != 0 {
+		return fmt.Errorf("cannot allow %q in sandbox: %v", path, e)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+package collector
+
+const (
+	// AUDIT_ARCH_X86_64, per linux/audit.h.
+	auditArch = 0xc000003e
+
+	sysSeccomp  = 317
+	sysExecveat = 322
+
+	// System calls numbered this high are of the x32 ABI, which
+	// the filter refuses outright.
+	sysLimit = 0x40000000
+)
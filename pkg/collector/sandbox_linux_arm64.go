@@ -0,0 +1,12 @@
+package collector
+
+const (
+	// AUDIT_ARCH_AARCH64, per linux/audit.h.
+	auditArch = 0xc00000b7
+
+	sysSeccomp  = 277
+	sysExecveat = 281
+
+	// No valid system call is numbered this high.
+	sysLimit = 0xffffffff
+)
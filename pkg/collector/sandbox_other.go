@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+
+package collector
+
+import "errors"
+
+func enterSandbox(spec sandboxSpec) error {
+	return errors.New("sandboxing is only supported on Linux, " +
+		"on amd64 and arm64")
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewSandboxSpec(t *testing.T) {
+	snap := []serveRecord{
+		{sKey: sKey{I: "apple", P: "/run/a/log.sock"}},
+		{sKey: sKey{I: "banana", P: "/run/a/other.sock"},
+			Capture: "/var/capture/banana"},
+		{sKey: sKey{I: "cherry", P: "/run/c/log.sock"}},
+	}
+
+	spec := newSandboxSpec([]string{"/var/sdb"}, "/etc/plc.toml", snap,
+		"/run/later:/run/a")
+
+	if want := []string{"/var/sdb", "/var/capture"}; !reflect.DeepEqual(
+		spec.data, want) {
+		t.Errorf("Got data directories %v, want %v", spec.data, want)
+	}
+
+	want := []string{"/run/a", "/run/c", "/run/later"}
+	if !reflect.DeepEqual(spec.sockets, want) {
+		t.Errorf("Got socket directories %v, want %v",
+			spec.sockets, want)
+	}
+
+	if len(spec.readOnly) == 0 || spec.readOnly[0] != "/etc/plc.toml" {
+		t.Errorf("Expected the configuration file to be readable, "+
+			"got %v", spec.readOnly)
+	}
+}
+
+// Sandboxing cannot be undone, so it is tried in a child process:
+// this test, run again with SANDBOX_TEST_DIR set.
+func TestSandbox(t *testing.T) {
+	if dir := os.Getenv("SANDBOX_TEST_DIR"); dir != "" {
+		sandboxChild(dir)
+		return
+	}
+
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	inside := filepath.Join(name, "inside")
+	outside := filepath.Join(name, "outside")
+	os.Mkdir(inside, 0700)
+	os.Mkdir(outside, 0700)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+	cmd.Env = append(os.Environ(), "SANDBOX_TEST_DIR="+name)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "cannot sandbox") {
+		t.Skipf("Sandboxing is unavailable: %s", out)
+	} else if err != nil {
+		t.Fatalf("Sandboxed child failed: %v: %s", err, out)
+	}
+
+	if _, err := os.Stat(filepath.Join(inside, "written")); err != nil {
+		t.Errorf("Expected a write inside the sandbox: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "written")); err == nil {
+		t.Error("Expected a write outside the sandbox to fail")
+	}
+}
+
+func sandboxChild(dir string) {
+	spec := sandboxSpec{data: []string{filepath.Join(dir, "inside")}}
+	if err := enterSandbox(spec); err != nil {
+		os.Stdout.WriteString("cannot sandbox: " + err.Error())
+		os.Exit(0)
+	}
+
+	for _, sub := range []string{"inside", "outside"} {
+		ioutil.WriteFile(filepath.Join(dir, sub, "written"), nil, 0600)
+	}
+
+	if err := exec.Command(os.Args[0], "-test.run=^$").Run(); err == nil {
+		os.Stdout.WriteString("executed a program while sandboxed")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
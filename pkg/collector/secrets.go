@@ -0,0 +1,224 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serve records may give a reference to a secret held elsewhere in
+// place of their drain URL, so that credentials never land in serve
+// database files, such as
+//
+//	vault:secret/drains/app#url
+//
+// naming the scheme of a secret store, the path of a secret in it,
+// and after the last "#", the key of the secret whose value is the
+// URL.  Stores whose secrets are single values take no key.
+// References are resolved whenever the serve database is loaded, and
+// again once any secret resolved expires: when its lease does, or
+// for stores without leases, after SECRET_REFRESH_INTERVAL.
+
+// Fetches a secret, given its path and key, reporting how long its
+// value may be used: zero for as long as it is loaded.
+type secretSource func(path, key string) (string, time.Duration, error)
+
+// Secret stores by the scheme of their references.
+var secretSources = map[string]secretSource{
+	"vault": vaultSecret,
+	"awssm": awsSecret,
+	"gcpsm": gcpSecret,
+}
+
+// Report whether s is a reference to a secret, rather than a value.
+func isSecretRef(s string) bool {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return false
+	}
+
+	_, ok := secretSources[s[:i]]
+	return ok
+}
+
+// A secret resolved, kept until it expires.
+type cachedSecret struct {
+	value   string
+	expires time.Time
+}
+
+// Secrets that expire, by reference, so that a secret shared by
+// several records, or by successive versions of the serve database,
+// is fetched only once until it expires.
+var secretCache = struct {
+	sync.Mutex
+	m map[string]cachedSecret
+}{m: make(map[string]cachedSecret)}
+
+// Resolve a reference to a secret, returning its value and when it
+// expires, or the zero time should it not.
+func resolveSecret(ref string) (string, time.Time, error) {
+	i := strings.IndexByte(ref, ':')
+	if i < 0 {
+		return "", time.Time{}, fmt.Errorf("bad secret reference "+
+			"%q: expected scheme:path#key", ref)
+	}
+
+	src, ok := secretSources[ref[:i]]
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("unknown secret store "+
+			"%q", ref[:i])
+	}
+
+	path, key := ref[i+1:], ""
+	if j := strings.LastIndexByte(path, '#'); j >= 0 {
+		path, key = path[:j], path[j+1:]
+	}
+
+	if path == "" {
+		return "", time.Time{}, fmt.Errorf("bad secret reference "+
+			"%q: no path", ref)
+	}
+
+	now := time.Now()
+	secretCache.Lock()
+	c, ok := secretCache.m[ref]
+	secretCache.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.value, c.expires, nil
+	}
+
+	v, ttl, err := src(path, key)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("cannot resolve %q: %v",
+			ref, err)
+	}
+
+	if ttl <= 0 {
+		return v, time.Time{}, nil
+	}
+
+	c = cachedSecret{value: v, expires: now.Add(ttl)}
+	secretCache.Lock()
+	secretCache.m[ref] = c
+	secretCache.Unlock()
+
+	return v, c.expires, nil
+}
+
+// How long the secrets of stores without leases are used before they
+// are fetched again, so that rotated credentials are taken up.
+func secretRefreshInterval() time.Duration {
+	if v := setting("SECRET_REFRESH_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+
+		log.Printf("SECRET_REFRESH_INTERVAL must be a positive "+
+			"duration, such as \"1h\": %v", v)
+	}
+
+	return time.Hour
+}
+
+// Select key from a secret whose value is a JSON object of strings,
+// or should key be empty, return the value whole.
+func secretField(value []byte, key string) (string, error) {
+	if key == "" {
+		return string(value), nil
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, so has "+
+			"no %q", key)
+	}
+
+	v, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string %q", key)
+	}
+
+	return v, nil
+}
+
+// The earlier of two expiry times, either of which may be the zero
+// time, for never.
+func earliestExpiry(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+
+	return a
+}
+
+// Bounds of the backoff with which secrets that do not resolve are
+// tried again.
+const (
+	secretRetryMin = 10 * time.Second
+	secretRetryMax = 10 * time.Minute
+)
+
+// For fetching secrets, which should never take long.
+var secretClient = http.Client{Timeout: 10 * time.Second}
+
+// Fetch a secret from HashiCorp Vault, at VAULT_ADDR, authenticating
+// with VAULT_TOKEN.  Secrets of both versions of the key/value secrets
+// engine are understood, as are those of other engines whose data is
+// a flat map of strings.
+func vaultSecret(path, key string) (string, time.Duration, error) {
+	addr := setting("VAULT_ADDR")
+	if addr == "" {
+		return "", 0, fmt.Errorf("VAULT_ADDR is unset")
+	} else if key == "" {
+		return "", 0, fmt.Errorf("no key given")
+	}
+
+	req, err := http.NewRequest("GET",
+		strings.TrimSuffix(addr, "/")+"/v1/"+
+			strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Set("X-Vault-Token", setting("VAULT_TOKEN"))
+	body, err := readSecretResponse(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var secret struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", 0, fmt.Errorf("bad response from vault: %v", err)
+	}
+
+	// Version 2 of the key/value engine nests the secret's data,
+	// alongside its metadata.
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	v, ok := data[key].(string)
+	if !ok {
+		return "", 0, fmt.Errorf("secret has no string %q", key)
+	}
+
+	// Secrets of the key/value engine have no lease, and are
+	// refreshed as those of other stores without leases are.
+	if secret.LeaseDuration <= 0 {
+		return v, secretRefreshInterval(), nil
+	}
+
+	return v, time.Duration(secret.LeaseDuration) * time.Second, nil
+}
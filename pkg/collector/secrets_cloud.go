@@ -0,0 +1,277 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secrets held by the secret managers of cloud providers, for fleets
+// of collectors whose drain credentials are rotated centrally:
+//
+//	awssm:<secret id>#<key>
+//	gcpsm:projects/<project>/secrets/<secret>/versions/<version>#<key>
+//
+// Should a key be given, the secret's value must be a JSON object,
+// and the key selects one of its strings; otherwise the value is
+// taken whole.  As neither has leases, their secrets are fetched
+// again every SECRET_REFRESH_INTERVAL.
+
+// Fetch a secret from AWS Secrets Manager, in AWS_REGION, with the
+// credentials of AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and, for
+// temporary ones, AWS_SESSION_TOKEN.  AWS_ENDPOINT_URL_SECRETS_MANAGER
+// overrides the regional endpoint, as for the AWS SDKs.
+func awsSecret(id, key string) (string, time.Duration, error) {
+	region := setting("AWS_REGION")
+	akid := setting("AWS_ACCESS_KEY_ID")
+	secret := setting("AWS_SECRET_ACCESS_KEY")
+	if region == "" || akid == "" || secret == "" {
+		return "", 0, fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and " +
+			"AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	endpoint := setting("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", 0, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+
+		"/", bytes.NewReader(body))
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := setting("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	signAWSv4(req, body, region, "secretsmanager", akid, secret,
+		time.Now())
+
+	resp, err := readSecretResponse(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var v struct {
+		SecretString *string
+		SecretBinary []byte
+	}
+
+	if err := json.Unmarshal(resp, &v); err != nil {
+		return "", 0, fmt.Errorf("bad response from AWS: %v", err)
+	}
+
+	value := v.SecretBinary
+	if v.SecretString != nil {
+		value = []byte(*v.SecretString)
+	}
+
+	s, err := secretField(value, key)
+	return s, secretRefreshInterval(), err
+}
+
+// Sign req, whose body is body, with version 4 of AWS's signature
+// scheme, as of now.  Only the headers set by then are signed, along
+// with the host.
+func signAWSv4(req *http.Request, body []byte, region, service, akid,
+	secret string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, vs := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(
+			strings.Join(vs, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	payload := sha256.Sum256(body)
+	canon := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonHash := sha256.Sum256([]byte(canon))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(canonHash[:])
+
+	k := hmacSHA256([]byte("AWS4"+secret), date)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, service)
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+
+		akid+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+// The query string of a version 4 AWS signature's canonical request:
+// sorted, and escaped as AWS requires.
+func canonicalQuery(q url.Values) string {
+	var pairs []string
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func awsEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Where to find GCP Secret Manager, and the metadata server of the
+// instance the collector runs on, which provides its credentials;
+// variables so that they can be replaced in tests.
+var (
+	gcpSecretEndpoint = "https://secretmanager.googleapis.com"
+	gcpTokenURL       = "http://metadata.google.internal/" +
+		"computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// Fetch a secret version from GCP Secret Manager, with the
+// credentials of the instance's service account, or should it be set,
+// the OAuth access token GCP_ACCESS_TOKEN.
+func gcpSecret(name, key string) (string, time.Duration, error) {
+	token := setting("GCP_ACCESS_TOKEN")
+	if token == "" {
+		var err error
+		token, err = gcpMetadataToken()
+		if err != nil {
+			return "", 0, fmt.Errorf("cannot get credentials: %v",
+				err)
+		}
+	}
+
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	req, err := http.NewRequest("GET", gcpSecretEndpoint+"/v1/"+
+		strings.TrimPrefix(name, "/")+":access", nil)
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := readSecretResponse(req)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var v struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+
+	if err := json.Unmarshal(resp, &v); err != nil {
+		return "", 0, fmt.Errorf("bad response from GCP: %v", err)
+	}
+
+	value, err := base64.StdEncoding.DecodeString(v.Payload.Data)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad payload from GCP: %v", err)
+	}
+
+	s, err := secretField(value, key)
+	return s, secretRefreshInterval(), err
+}
+
+// Get an access token for the instance's service account from the
+// GCE metadata server.
+func gcpMetadataToken() (string, error) {
+	req, err := http.NewRequest("GET", gcpTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := readSecretResponse(req)
+	if err != nil {
+		return "", err
+	}
+
+	var v struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err := json.Unmarshal(resp, &v); err != nil || v.AccessToken == "" {
+		return "", fmt.Errorf("bad token from metadata server")
+	}
+
+	return v.AccessToken, nil
+}
+
+// Send a request for a secret, returning the body of its response
+// should it succeed.
+func readSecretResponse(req *http.Request) ([]byte, error) {
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1*MB))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responds %s", req.URL.Host,
+			resp.Status)
+	}
+
+	return body, nil
+}
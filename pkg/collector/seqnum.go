@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Counts of sequence number anomalies, keyed by identity.
+var (
+	seqGaps       = expvar.NewMap("seqnum_gaps")
+	seqDuplicates = expvar.NewMap("seqnum_duplicates")
+)
+
+// Tracks the sequence numbers of log records on a connection, to
+// detect log records lost or duplicated between the logfebe extension
+// and the collector.
+//
+// A logfebe connection is made per backend, so only the most recent
+// session is tracked: a change of session restarts tracking rather
+// than being reported as an anomaly.
+type seqTracker struct {
+	session string
+	last    int64
+	started bool
+}
+
+// Check the next record's sequence number, reporting the number of
+// records missing before it, or whether it was already seen.
+func (st *seqTracker) check(session []byte, seq int64) (missing int64,
+	dup bool) {
+	if !st.started || string(session) != st.session {
+		st.session = string(session)
+		st.last = seq
+		st.started = true
+		return 0, false
+	}
+
+	switch {
+	case seq <= st.last:
+		return 0, true
+	case seq > st.last+1:
+		missing = seq - st.last - 1
+	}
+
+	st.last = seq
+	return missing, false
+}
+
+// Check the sequence number of lr, logging and counting anomalies,
+// and optionally reporting them in-band to the drain.
+func (st *seqTracker) observe(lr *logRecord, bt *batcher,
+	sr *serveRecord) {
+	prev := st.last
+	missing, dup := st.check(lr.SessionId, lr.SeqNum)
+
+	var msg string
+	switch {
+	case dup:
+		seqDuplicates.Add(sr.I, 1)
+		msg = fmt.Sprintf("duplicate log message in session %s: "+
+			"sequence number %d follows %d",
+			lr.SessionId, lr.SeqNum, prev)
+	case missing > 0:
+		seqGaps.Add(sr.I, missing)
+		msg = fmt.Sprintf("%d log messages lost in session %s: "+
+			"sequence number %d follows %d",
+			missing, lr.SessionId, lr.SeqNum, prev)
+	default:
+		return
+	}
+
+	log.Printf("identity %q: %s", sr.I, msg)
+
+	if sr.SeqWarnings {
+		err := bt.add(132, time.Now(), "postgres",
+			"pg_logplexcollector", []byte("warning: "+msg))
+		if err != nil {
+			log.Printf("could not buffer sequence warning: %v",
+				err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package collector
+
+import "testing"
+
+func TestSeqTracker(t *testing.T) {
+	var st seqTracker
+
+	steps := []struct {
+		session string
+		seq     int64
+		missing int64
+		dup     bool
+	}{
+		{"s1", 5, 0, false},
+		{"s1", 6, 0, false},
+		{"s1", 9, 2, false},
+		{"s1", 9, 0, true},
+		{"s1", 7, 0, true},
+		{"s1", 10, 0, false},
+		// A new session restarts tracking.
+		{"s2", 1, 0, false},
+		{"s2", 3, 1, false},
+	}
+
+	for i, step := range steps {
+		missing, dup := st.check([]byte(step.session), step.seq)
+		if missing != step.missing || dup != step.dup {
+			t.Errorf("%d: got missing=%d dup=%v, "+
+				"want missing=%d dup=%v", i,
+				missing, dup, step.missing, step.dup)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Several serve databases whose records are merged into a single
+// routing table, so that, for example, records managed by a platform
+// and by an operator may live in separate directories with separate
+// write permissions.  Each database is polled and loaded as though it
+// were alone.
+//
+// Should several databases have records for the same socket, those
+// of the database listed first win, and the others are ignored.
+type serveDbSet struct {
+	dbs []*serveDb
+
+	// Records set programmatically, merged after those of every
+	// database; see Collector.SetServeRecords.
+	injected struct {
+		sync.Mutex
+		routes  map[sKey]*serveRecord
+		changed bool
+	}
+
+	// The merged routing table, a map[sKey]*serveRecord, which as
+	// with serveDb is never modified once stored.
+	merged atomic.Value
+
+	// When the merged routing table was last replaced, a
+	// time.Time, or the zero time should it never have been.
+	reloaded atomic.Value
+}
+
+func newServeDbSet(paths ...string) *serveDbSet {
+	s := &serveDbSet{}
+	for _, p := range paths {
+		s.dbs = append(s.dbs, newServeDb(p))
+	}
+
+	s.merged.Store(make(map[sKey]*serveRecord))
+	s.reloaded.Store(time.Time{})
+	return s
+}
+
+// The serve database directories given by the settings: the
+// colon-separated list of SERVE_DB_DIRS, or otherwise SERVE_DB_DIR.
+// Empty elements are ignored.
+func serveDbDirs() []string {
+	v := setting("SERVE_DB_DIRS")
+	if v == "" {
+		v = setting("SERVE_DB_DIR")
+	}
+
+	var dirs []string
+	for _, d := range filepath.SplitList(v) {
+		if d != "" {
+			dirs = append(dirs, d)
+		}
+	}
+
+	return dirs
+}
+
+// Set the debounce period of every database; see serveDb.debounce.
+func (s *serveDbSet) setDebounce(d time.Duration) {
+	for _, db := range s.dbs {
+		db.debounce = d
+	}
+}
+
+// Set the provisioner of every database; see serveDb.provision.
+func (s *serveDbSet) setProvisioner(p *provisioner) {
+	for _, db := range s.dbs {
+		db.provision = p.provision
+	}
+}
+
+// Set the records to merge after those of every database, from the
+// next poll.
+func (s *serveDbSet) setInjected(routes map[sKey]*serveRecord) {
+	s.injected.Lock()
+	defer s.injected.Unlock()
+
+	s.injected.routes = routes
+	s.injected.changed = true
+}
+
+func (s *serveDbSet) hasInjected() bool {
+	s.injected.Lock()
+	defer s.injected.Unlock()
+
+	return len(s.injected.routes) > 0
+}
+
+// Look up the serve record for an identity on a socket.  The record
+// must not be modified.
+func (s *serveDbSet) Lookup(k sKey) (*serveRecord, bool) {
+	rec, ok := s.merged.Load().(map[sKey]*serveRecord)[k]
+	return rec, ok
+}
+
+func (s *serveDbSet) Snapshot() []serveRecord {
+	routes := s.merged.Load().(map[sKey]*serveRecord)
+	snap := make([]serveRecord, 0, len(routes))
+	for _, v := range routes {
+		snap = append(snap, *v)
+	}
+
+	return snap
+}
+
+// Poll every database for new routing information, merging their
+// routing tables anew should any have changed.  Every database is
+// polled even should one fail, so that each makes what progress it
+// can, but only the first error is returned.
+func (s *serveDbSet) Poll() (newInfo bool, err error) {
+	for _, db := range s.dbs {
+		nw, dbErr := db.Poll()
+		if dbErr != nil && err == nil {
+			err = dbErr
+		}
+
+		newInfo = newInfo || nw
+	}
+
+	s.injected.Lock()
+	injected := s.injected.routes
+	newInfo = newInfo || s.injected.changed
+	s.injected.changed = false
+	s.injected.Unlock()
+
+	if newInfo {
+		tables := make([]map[sKey]*serveRecord, len(s.dbs), len(s.dbs)+1)
+		for i, db := range s.dbs {
+			tables[i] = db.routes()
+		}
+		tables = append(tables, injected)
+
+		merged, shadowed := mergeRoutes(tables)
+		for _, sh := range shadowed {
+			log.Print(s.describeShadowed(sh))
+		}
+
+		s.merged.Store(merged)
+		s.reloaded.Store(time.Now())
+	}
+
+	return newInfo, err
+}
+
+// When the routing table was last replaced by Poll, or the zero time
+// should it never have been.
+func (s *serveDbSet) lastReload() time.Time {
+	return s.reloaded.Load().(time.Time)
+}
+
+// A record left out of a merged routing table, as one of an earlier
+// database claims the same socket.
+type shadowedRecord struct {
+	sr *serveRecord
+
+	// The indexes of the database the record is from, and that
+	// of the database whose record won.
+	db, by int
+}
+
+// Describe a record left out of the merged routing table.
+func (s *serveDbSet) describeShadowed(sh shadowedRecord) string {
+	return fmt.Sprintf("%s: ignoring identity %q on socket %q, "+
+		"which is served by %s", s.describeSource(sh.db),
+		sh.sr.I, sh.sr.P, s.describeSource(sh.by))
+}
+
+// Describe the source of the records of a routing table merged by
+// Poll: one of the databases, or the records set programmatically.
+func (s *serveDbSet) describeSource(i int) string {
+	if i < len(s.dbs) {
+		return "serve database " + s.dbs[i].path
+	}
+
+	return "records set programmatically"
+}
+
+// Merge the routing tables of several databases, in order of
+// precedence, reporting the records that were left out.
+func mergeRoutes(tables []map[sKey]*serveRecord) (map[sKey]*serveRecord,
+	[]shadowedRecord) {
+	merged := make(map[sKey]*serveRecord)
+	owner := make(map[string]int)
+	var shadowed []shadowedRecord
+
+	for i, table := range tables {
+		// Visit records in a stable order, so that what is
+		// reported is too.
+		keys := make([]sKey, 0, len(table))
+		for k := range table {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(a, b int) bool {
+			if keys[a].P != keys[b].P {
+				return keys[a].P < keys[b].P
+			}
+
+			return keys[a].I < keys[b].I
+		})
+
+		for _, k := range keys {
+			if by, ok := owner[k.P]; ok && by != i {
+				shadowed = append(shadowed,
+					shadowedRecord{table[k], i, by})
+				continue
+			}
+
+			owner[k.P] = i
+			merged[k] = table[k]
+		}
+	}
+
+	return merged, shadowed
+}
@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestServeDbSetMerge(t *testing.T) {
+	platform := newTmpDb(t)
+	defer os.RemoveAll(platform)
+	operator := newTmpDb(t)
+	defer os.RemoveAll(operator)
+
+	sdbs := newServeDbSet(platform, operator)
+	ioutil.WriteFile(sdbs.dbs[0].newPath(), []byte(`{"serves": [
+		{"i": "apple", "url": "https://token:t@localhost",
+		 "p": "/p1/log.sock"}]}`), 0400)
+	ioutil.WriteFile(sdbs.dbs[1].newPath(), []byte(`{"serves": [
+		{"i": "impostor", "url": "https://token:t@localhost",
+		 "p": "/p1/log.sock"},
+		{"i": "banana", "url": "https://token:t@localhost",
+		 "p": "/p2/log.sock"}]}`), 0400)
+
+	if nw, err := sdbs.Poll(); err != nil || !nw {
+		t.Fatalf("Expected new routes, got %v, %v", nw, err)
+	}
+
+	for _, k := range []sKey{
+		{I: "apple", P: "/p1/log.sock"},
+		{I: "banana", P: "/p2/log.sock"},
+	} {
+		if _, ok := sdbs.Lookup(k); !ok {
+			t.Errorf("Expected a record for %v", k)
+		}
+	}
+
+	// The first database has the socket, so the second's record
+	// for it is ignored.
+	if _, ok := sdbs.Lookup(sKey{I: "impostor", P: "/p1/log.sock"}); ok {
+		t.Error("Expected the later database's record to be ignored")
+	}
+
+	if n := len(sdbs.Snapshot()); n != 2 {
+		t.Errorf("Expected 2 records in snapshot, got %d", n)
+	}
+
+	// Reloading either database changes the merged table.
+	ioutil.WriteFile(sdbs.dbs[0].newPath(), []byte(`{"serves": []}`),
+		0400)
+	if nw, err := sdbs.Poll(); err != nil || !nw {
+		t.Fatalf("Expected new routes, got %v, %v", nw, err)
+	}
+
+	if _, ok := sdbs.Lookup(sKey{I: "impostor", P: "/p1/log.sock"}); !ok {
+		t.Error("Expected the socket to pass to the later database")
+	}
+
+	if nw, err := sdbs.Poll(); err != nil || nw {
+		t.Fatalf("Expected no new routes, got %v, %v", nw, err)
+	}
+}
+
+func TestMergeRoutes(t *testing.T) {
+	a := &serveRecord{sKey: sKey{I: "a", P: "/1"}}
+	b := &serveRecord{sKey: sKey{I: "b", P: "/1"}}
+	c := &serveRecord{sKey: sKey{I: "c", P: "/2"}}
+
+	merged, shadowed := mergeRoutes([]map[sKey]*serveRecord{
+		{a.sKey: a},
+		{b.sKey: b, c.sKey: c},
+	})
+
+	want := map[sKey]*serveRecord{a.sKey: a, c.sKey: c}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("Got %v, want %v", merged, want)
+	}
+
+	wantShadowed := []shadowedRecord{{sr: b, db: 1, by: 0}}
+	if !reflect.DeepEqual(shadowed, wantShadowed) {
+		t.Errorf("Got shadowed %+v, want %+v", shadowed, wantShadowed)
+	}
+}
+
+func TestServeDbDirs(t *testing.T) {
+	defer func(saved map[string]string) {
+		fileSettings = saved
+	}(fileSettings)
+
+	fileSettings = map[string]string{"SERVE_DB_DIRS": "/a::/b"}
+	if got := serveDbDirs(); !reflect.DeepEqual(got,
+		[]string{"/a", "/b"}) {
+		t.Errorf("Got %q, want [/a /b]", got)
+	}
+
+	fileSettings = map[string]string{"SERVE_DB_DIR": "/c"}
+	if got := serveDbDirs(); !reflect.DeepEqual(got, []string{"/c"}) {
+		t.Errorf("Got %q, want [/c]", got)
+	}
+}
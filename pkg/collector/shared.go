@@ -0,0 +1,324 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deafbybeheading/femebe/core"
+)
+
+// Rather than connecting to a socket of its own, a client may connect
+// to a single TCP port shared by every serve record, and be routed by
+// the identity it presents.  Remote Postgres servers then need only
+// reach that one port.  Identities are not authenticated: anything
+// able to connect to the port can log as any identity, so it must be
+// firewalled as tightly as the sockets would be.
+//
+// One goroutine accepts connections for the life of the collector,
+// handing them to the current generation, which routes them by the
+// records it serves.
+//
+// Should the port require TLS, a record may instead be chosen by the
+// server name the client asks for, and present a certificate of its
+// own, so that each tenant of the port can be given a name and
+// certificate of its own.  The identity presented must then be one
+// the record accepts, as on its socket.
+
+// How long a client of the shared port has to identify itself.
+var sharedHandshakeTimeout = 30 * time.Second
+
+// Count of connections to the shared port presenting an identity
+// that no record being served has, or failing to present one at all.
+var unroutedConns = expvar.NewInt("unrouted_connections")
+
+// A TCP listener on addr, passing the connections it accepts to
+// whichever generation receives them from conns.  Should cert be
+// non-nil, clients must use TLS, and are presented with cert unless
+// the server name they ask for is that of a record.
+type sharedListener struct {
+	addr  string
+	cert  *tls.Certificate
+	conns chan net.Conn
+}
+
+func newSharedListener(addr string, cert *tls.Certificate) *sharedListener {
+	return &sharedListener{addr: addr, cert: cert,
+		conns: make(chan net.Conn)}
+}
+
+// Accept connections until ctx is done, on the socket passed by the
+// process this one replaces should there be one.  Should the address
+// not be bound at once, as when the process being upgraded from holds
+// it still without passing it, binding is retried.
+func (s *sharedListener) run(ctx context.Context) {
+	defer unregisterHandoff(sharedHandoff)
+
+	if l, ok := takeInherited(sharedHandoff); ok {
+		log.Printf("accepting connections for every identity on %q",
+			l.Addr())
+		if !s.accept(ctx, l) {
+			return
+		}
+	}
+
+	var backoff time.Duration
+	for {
+		l, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			backoff = nextBackoff(backoff, rebindBackoffMax)
+			log.Printf("cannot listen to %q, retrying in %v: %v",
+				s.addr, backoff, err)
+			if sleepOrDone(ctx, backoff) {
+				return
+			}
+
+			continue
+		}
+
+		log.Printf("accepting connections for every identity on %q",
+			l.Addr())
+		registerHandoff(sharedHandoff, l.(*net.TCPListener))
+		backoff = 0
+		if !s.accept(ctx, l) {
+			return
+		}
+	}
+}
+
+// Accept connections from l, closing it once ctx is done.  Reports
+// whether l failed, and is to be bound anew.
+func (s *sharedListener) accept(ctx context.Context, l net.Listener) bool {
+	closeOnDone(ctx, l)
+	defer l.Close()
+
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return false
+			default:
+			}
+
+			if isTemporary(err) {
+				backoff = nextBackoff(backoff, acceptBackoffMax)
+				log.Printf("accept error on %q, retrying in %v: %v",
+					s.addr, backoff, err)
+				if sleepOrDone(ctx, backoff) {
+					return false
+				}
+
+				continue
+			}
+
+			log.Printf("listener on %q failed, recreating it: %v",
+				s.addr, err)
+			return true
+		}
+
+		backoff = 0
+		select {
+		case s.conns <- conn:
+		case <-ctx.Done():
+			conn.Close()
+			return false
+		}
+	}
+}
+
+// How a generation routes connections to the shared port.
+type sharedRoutes struct {
+	// The records being served, sorted by socket path.
+	records []*serveRecord
+
+	// Records by TLS server name, and the TLS configuration to
+	// serve clients with, should the port require TLS.
+	byName map[string]*serveRecord
+	tls    *tls.Config
+}
+
+// Route to routes, the records of a generation.  Should cert be
+// non-nil, clients must use TLS, and are presented with cert unless
+// the server name they ask for is that of a record.
+func newSharedRoutes(cert *tls.Certificate,
+	routes []serveRecord) *sharedRoutes {
+	// Ties between records accepting an identity, or with the
+	// same server name, go to that with the first socket path, as
+	// with replays.
+	rt := &sharedRoutes{records: make([]*serveRecord, len(routes))}
+	for i := range routes {
+		rt.records[i] = &routes[i]
+	}
+	sort.Slice(rt.records, func(i, j int) bool {
+		return rt.records[i].P < rt.records[j].P
+	})
+
+	if cert == nil {
+		return rt
+	}
+
+	rt.byName = make(map[string]*serveRecord)
+	certs := make(map[string]*tls.Certificate)
+	for _, sr := range rt.records {
+		name := sr.TLSServerName
+		if name == "" || rt.byName[name] != nil {
+			continue
+		}
+
+		if sr.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(sr.TLSCert, sr.TLSKey)
+			if err != nil {
+				log.Printf("not routing server name %q to "+
+					"identity %q: %v", name, sr.I, err)
+				continue
+			}
+
+			certs[name] = &cert
+		}
+
+		rt.byName[name] = sr
+	}
+
+	rt.tls = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(
+			hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := certs[serverName(hello.ServerName)]; cert != nil {
+				return cert, nil
+			}
+
+			return cert, nil
+		},
+	}
+
+	return rt
+}
+
+// Normalize a TLS server name, which is case-insensitive, and may be
+// given with the trailing dot of a fully qualified name.
+func serverName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Serve connections received from s, routing each to one of routes,
+// until g is cancelled.  Each is read in a goroutine of its own until
+// routed, and then served within the limits of the record routed to.
+func listenShared(g *generation, s *sharedListener, routes []serveRecord) {
+	rt := newSharedRoutes(s.cert, routes)
+	for {
+		select {
+		case <-g.ctx.Done():
+			return
+		case conn := <-s.conns:
+			g.enter(&g.connections)
+			go func() {
+				defer g.exit(&g.connections)
+				serveShared(g, conn, rt)
+			}()
+		}
+	}
+}
+
+// Find the record of routes, sorted by socket path, to serve a client
+// presenting ident with: the first with that identity, or else the
+// first listing it among its aliases.
+func routeShared(routes []*serveRecord, ident string) *serveRecord {
+	for _, sr := range routes {
+		if sr.I == ident {
+			return sr
+		}
+	}
+
+	for _, sr := range routes {
+		if sr.accepts(ident) {
+			return sr
+		}
+	}
+
+	return nil
+}
+
+// A connection read through r, which may begin with bytes already
+// read from it.
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Read the handshake of conn, a connection to the shared port, and
+// serve it as a connection to the socket of the record its server
+// name or identity is routed to, within that record's limits in g.
+func serveShared(g *generation, conn net.Conn, rt *sharedRoutes) {
+	conn.SetReadDeadline(time.Now().Add(sharedHandshakeTimeout))
+
+	var sr *serveRecord
+	if rt.tls != nil {
+		tc := tls.Server(conn, rt.tls)
+		if err := tc.Handshake(); err != nil {
+			unroutedConns.Add(1)
+			log.Printf("Disconnect client %v: TLS handshake "+
+				"failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		sr = rt.byName[serverName(tc.ConnectionState().ServerName)]
+		conn = tc
+	}
+
+	// Keep what the handshake reads, to be read again by
+	// logWorker once the connection is routed.
+	var seen bytes.Buffer
+	stream := core.NewBackendStream(&readerConn{Conn: conn,
+		r: io.TeeReader(conn, &seen)})
+	msgInit := func(m *core.Message) error {
+		if err := stream.Next(m); err != nil {
+			return peerDisconnectf("could not read handshake: %v",
+				err)
+		}
+
+		return checkMsgSize(m)
+	}
+
+	_, err := processVerMsg(msgInit)
+	var ident string
+	if err == nil {
+		ident, err = processIdentMsg(msgInit)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		unroutedConns.Add(1)
+		log.Printf("Disconnect client %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if sr == nil {
+		sr = routeShared(rt.records, ident)
+	}
+
+	if sr == nil {
+		unroutedConns.Add(1)
+		log.Printf("Disconnect client %v: no serve record has "+
+			"identity %q", conn.RemoteAddr(), ident)
+		conn.Close()
+		return
+	}
+
+	g.limiter(sr).admit(&readerConn{Conn: conn,
+		r: io.MultiReader(&seen, conn)})
+}
@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteShared(t *testing.T) {
+	routes := []*serveRecord{
+		{sKey: sKey{I: "apple", P: "/a/log.sock"}},
+		{sKey: sKey{I: "apple", P: "/b/log.sock"}},
+		{sKey: sKey{I: "banana", P: "/c/log.sock"},
+			Aliases: []string{"apple", "apple-old"}},
+	}
+
+	for _, tt := range []struct {
+		ident string
+		path  string
+	}{
+		{"apple", "/a/log.sock"},
+		{"apple-old", "/c/log.sock"},
+		{"banana", "/c/log.sock"},
+		{"cherry", ""},
+	} {
+		sr := routeShared(routes, tt.ident)
+		if tt.path == "" {
+			if sr != nil {
+				t.Errorf("%s: expected no route, got %q", tt.ident,
+					sr.P)
+			}
+		} else if sr == nil || sr.P != tt.path {
+			t.Errorf("%s: expected %q, got %+v", tt.ident, tt.path,
+				sr)
+		}
+	}
+}
+
+func TestServeShared(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	routes := []*serveRecord{
+		{sKey: sKey{I: "shared-apple", P: "/a/log.sock"}, u: *u},
+		{sKey: sKey{I: "shared-banana", P: "/b/log.sock"}, u: *u},
+	}
+	g := newGeneration(context.Background())
+	defer g.stop(errShutdown)
+
+	// Send a handshake presenting ident, and a log record, over a
+	// connection served as one to the shared port.
+	connect := func(ident string) {
+		client, server := net.Pipe()
+		go func() {
+			defer client.Close()
+			client.Write(frameMsg('V',
+				[]byte("PG-9.4.0/logfebe-1\x00")))
+			client.Write(frameMsg('I', []byte(ident+"\x00")))
+			client.Write(frameMsg('L',
+				encodeLogRecord(&sampleLogRecord)))
+		}()
+
+		serveShared(g, server, &sharedRoutes{records: routes})
+		g.wg.Wait()
+	}
+
+	// The record is forwarded, the handshake having been read
+	// again by the worker of the record routed to.
+	connect("shared-banana")
+	if body := d.next(t); !strings.Contains(body,
+		string(sampleLogRecord.ErrMessage)) {
+		t.Fatalf("Expected the log record to be forwarded, got %q",
+			body)
+	}
+
+	before := unroutedConns.Value()
+	connect("shared-cherry")
+	if got := unroutedConns.Value(); got != before+1 {
+		t.Fatalf("Expected one more unrouted connection, got %d",
+			got-before)
+	}
+}
+
+func TestServeSharedLimits(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+	sr := serveRecord{sKey: sKey{I: "limited-apple", P: "/a/log.sock"},
+		u: *u, MaxConnections: 1}
+	rt := &sharedRoutes{records: []*serveRecord{&sr}}
+
+	g := newGeneration(context.Background())
+	defer g.stop(errShutdown)
+
+	// The limits of a record are shared by its socket and the
+	// shared port.
+	own := sr
+	if g.limiter(&own) != g.limiter(&sr) {
+		t.Fatal("Expected one limiter per record")
+	}
+
+	// Connect presenting the record's identity, returning the
+	// client's end, which is drained of anything sent to it.
+	connect := func() net.Conn {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(frameMsg('V',
+				[]byte("PG-9.4.0/logfebe-1\x00")))
+			client.Write(frameMsg('I',
+				[]byte("limited-apple\x00")))
+			io.Copy(ioutil.Discard, client)
+		}()
+
+		serveShared(g, server, rt)
+		return client
+	}
+
+	before := expvarInt(refusedConnections, "limited-apple")
+	first := connect()
+	second := connect()
+	defer second.Close()
+	if got := expvarInt(refusedConnections, "limited-apple"); got !=
+		before+1 {
+		t.Fatalf("Expected the second connection to be refused, "+
+			"got %d refused", got-before)
+	}
+
+	first.Close()
+	g.wg.Wait()
+}
+
+// Write a self-signed certificate for name, and its key, to dir,
+// returning their paths.
+func writeTestCert(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	return certPath, keyPath
+}
+
+func TestServeSharedSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sni")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := newRecordingDrain()
+	defer d.Close()
+
+	u, _ := url.Parse(d.URL)
+	u.User = url.UserPassword("token", "t.test")
+
+	defaultCert, err := tls.LoadX509KeyPair(
+		writeTestCert(t, dir, "collector.example"))
+	if err != nil {
+		t.Fatalf("Could not load certificate: %v", err)
+	}
+
+	certFile, keyFile := writeTestCert(t, dir, "banana.example")
+	rt := newSharedRoutes(&defaultCert,
+		[]serveRecord{
+			{sKey: sKey{I: "sni-apple", P: "/a/log.sock"}, u: *u},
+			{sKey: sKey{I: "sni-banana", P: "/b/log.sock"}, u: *u,
+				TLSServerName: "banana.example",
+				TLSCert:       certFile, TLSKey: keyFile},
+		})
+	g := newGeneration(context.Background())
+	defer g.stop(errShutdown)
+
+	// Connect over TLS asking for name, presenting ident, and
+	// sending a log record should it be routed, and report the
+	// name of the certificate presented in return.
+	connect := func(name, ident string, routed bool) string {
+		client, server := net.Pipe()
+		presented := make(chan string, 1)
+		go func() {
+			defer client.Close()
+			defer close(presented)
+
+			tc := tls.Client(client, &tls.Config{ServerName: name,
+				InsecureSkipVerify: true})
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			presented <- tc.ConnectionState().
+				PeerCertificates[0].Subject.CommonName
+
+			tc.Write(frameMsg('V', []byte("PG-9.4.0/logfebe-1\x00")))
+			tc.Write(frameMsg('I', []byte(ident+"\x00")))
+			if routed {
+				tc.Write(frameMsg('L',
+					encodeLogRecord(&sampleLogRecord)))
+			}
+		}()
+
+		serveShared(g, server, rt)
+		g.wg.Wait()
+		return <-presented
+	}
+
+	// The server name chooses the record, and its certificate,
+	// whatever its case.
+	if got := connect("Banana.Example", "sni-banana", true); got !=
+		"banana.example" {
+		t.Fatalf("Expected the record's certificate, got %q", got)
+	}
+	d.next(t)
+
+	// Other names are presented the port's certificate, and
+	// routed by identity.
+	if got := connect("elsewhere.example", "sni-apple", true); got !=
+		"collector.example" {
+		t.Fatalf("Expected the port's certificate, got %q", got)
+	}
+	d.next(t)
+
+	// The identity must be one the record chosen accepts.
+	before := expvarInt(protocolErrors, "sni-banana")
+	connect("banana.example", "sni-apple", false)
+	if expvarInt(protocolErrors, "sni-banana") != before+1 {
+		t.Fatal("Expected an identity mismatch to be refused")
+	}
+}
+
+func TestParseTLSServerName(t *testing.T) {
+	var sdb serveDb
+	routes, err := sdb.parse([]byte(`{"serves": [
+		{"i": "apple", "p": "/p1/log.sock", "url": "https://localhost",
+		 "tls_server_name": "Apple.Example.",
+		 "tls_cert": "/c.pem", "tls_key": "/k.pem"}]}`))
+	if err != nil {
+		t.Fatalf("Could not parse: %v", err)
+	}
+
+	sr := routes[sKey{I: "apple", P: "/p1/log.sock"}]
+	if sr == nil || sr.TLSServerName != "apple.example" ||
+		sr.TLSCert != "/c.pem" || sr.TLSKey != "/k.pem" {
+		t.Fatalf("Unexpected record: %+v", sr)
+	}
+
+	for _, bad := range []string{
+		`"tls_server_name": "a.example", "tls_cert": "/c.pem"`,
+		`"tls_cert": "/c.pem", "tls_key": "/k.pem"`,
+	} {
+		if _, err := sdb.parse([]byte(`{"serves": [{"i": "apple", ` +
+			`"p": "/p1/log.sock", "url": "https://localhost", ` +
+			bad + `}]}`)); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
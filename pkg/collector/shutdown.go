@@ -0,0 +1,93 @@
+package collector
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// How long to wait at exit for connections to flush the messages
+// they have buffered to their drains.
+var shutdownTimeout = 10 * time.Second
+
+// Interval at which to check whether all connections have finished
+// during shutdown.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Close every live connection, so that each worker stops reading and
+// flushes what it has buffered to its drain.
+func closeAllConns() {
+	conns.Lock()
+	defer conns.Unlock()
+
+	for cs := range conns.m {
+		if cs.closer != nil {
+			cs.closer.Close()
+		}
+	}
+}
+
+// Report the number of live connections.
+func liveConns() int {
+	conns.Lock()
+	defer conns.Unlock()
+
+	return len(conns.m)
+}
+
+// Wait up to timeout for every connection to finish, reporting
+// whether they all did.
+func awaitConns(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for liveConns() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(shutdownPollInterval)
+	}
+
+	return true
+}
+
+// Stop serving after giving every connection the chance to deliver
+// what it has buffered, returning the status to exit with.
+//
+// New connections are refused first, by telling the listeners to
+// exit and unlinking their sockets; clients are expected to
+// reconnect once the collector is restarted.  Sockets passed by
+// systemd are left in place, so that clients may connect while the
+// collector restarts.  Should connections not
+// finish within shutdownTimeout, the collector stops regardless, with
+// status 1 unless code is otherwise non-zero.
+func shutdown(gen *generation, sdb *serveDbSet, code int) int {
+	gen.stop(errShutdown)
+
+	snap := sdb.Snapshot()
+	for i := range snap {
+		if !isActivated(snap[i].P) {
+			os.Remove(snap[i].P)
+		}
+	}
+
+	return drain(code)
+}
+
+// Close every connection, and wait up to shutdownTimeout for them to
+// flush, returning the status to exit with.
+func drain(code int) int {
+	n := liveConns()
+	log.Printf("shutting down: flushing %d connections, "+
+		"waiting up to %v", n, shutdownTimeout)
+
+	closeAllConns()
+	if !awaitConns(shutdownTimeout) {
+		log.Printf("shutting down: %d connections did not "+
+			"finish flushing in time", liveConns())
+		if code == 0 {
+			code = 1
+		}
+	}
+
+	return code
+}
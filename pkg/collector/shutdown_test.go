@@ -0,0 +1,40 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+// Unregisters a connection once closed, as its worker would.
+type unregisteringCloser struct {
+	cs *connState
+}
+
+func (c *unregisteringCloser) Close() error {
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.cs.unregister()
+	}()
+
+	return nil
+}
+
+func TestCloseAndAwaitConns(t *testing.T) {
+	c1, c2 := &unregisteringCloser{}, &unregisteringCloser{}
+	c1.cs = registerConn("/shutdown-1.sock", c1)
+	c2.cs = registerConn("/shutdown-2.sock", c2)
+
+	closeAllConns()
+	if !awaitConns(5 * time.Second) {
+		t.Fatalf("Expected connections to finish, %d remain",
+			liveConns())
+	}
+
+	// A connection that never finishes times out.
+	cs := registerConn("/shutdown-stuck.sock", nil)
+	defer cs.unregister()
+
+	if awaitConns(100 * time.Millisecond) {
+		t.Fatal("Expected a stuck connection to time out")
+	}
+}
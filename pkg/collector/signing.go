@@ -0,0 +1,84 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Serve records may give a secret shared with their drain, with
+// which each request to the drain is signed, so that a drain run by
+// its tenant can authenticate the collector without a long-lived
+// password in the drain URL.  The signature is sent as
+//
+//	Logplex-Signature: t=1398947696,v1=5257a869...
+//
+// giving the time of the request, in seconds since the epoch, and the
+// hex HMAC-SHA256, keyed by the secret, of that time, a ".", and the
+// body of the request.  As the time is signed, a receiver can refuse
+// requests signed long ago to guard against their replay.
+
+const signatureHeader = "Logplex-Signature"
+
+// Compute the signature of body, sent at t, with secret.
+func requestSignature(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, ts)
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// An http.RoundTripper signing each request before handing it to
+// base.
+type signingTransport struct {
+	base   http.RoundTripper
+	secret []byte
+}
+
+func newSigningTransport(base http.RoundTripper,
+	secret string) *signingTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &signingTransport{base: base, secret: []byte(secret)}
+}
+
+func (st *signingTransport) RoundTrip(req *http.Request) (*http.Response,
+	error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// RoundTrippers must not modify the request they are given.
+	signed := req.Clone(req.Context())
+	signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	signed.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	signed.ContentLength = int64(len(body))
+	signed.Header.Set(signatureHeader,
+		requestSignature(st.secret, time.Now(), body))
+
+	return st.base.RoundTrip(signed)
+}
+
+func (st *signingTransport) CloseIdleConnections() {
+	if ci, ok := st.base.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
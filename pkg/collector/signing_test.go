@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigningTransport(t *testing.T) {
+	type received struct {
+		sig, body string
+	}
+	got := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			got <- received{r.Header.Get(signatureHeader),
+				string(body)}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	defer srv.Close()
+
+	client := http.Client{Transport: newSigningTransport(nil, "s3cret")}
+	before := time.Now()
+	resp, err := client.Post(srv.URL, "application/logplex-1",
+		strings.NewReader("83 <134>1 2014-05-01T12:34:56Z"))
+	if err != nil {
+		t.Fatalf("Could not post: %v", err)
+	}
+	resp.Body.Close()
+
+	r := <-got
+	if r.body != "83 <134>1 2014-05-01T12:34:56Z" {
+		t.Fatalf("Body not preserved: %q", r.body)
+	}
+
+	// The receiver recomputes the signature from the time given.
+	parts := strings.SplitN(r.sig, ",", 2)
+	secs, err := strconv.ParseInt(strings.TrimPrefix(parts[0], "t="),
+		10, 64)
+	if err != nil || secs < before.Unix() || secs > time.Now().Unix() {
+		t.Fatalf("Bad signature time in %q", r.sig)
+	}
+
+	want := requestSignature([]byte("s3cret"), time.Unix(secs, 0),
+		[]byte(r.body))
+	if r.sig != want {
+		t.Fatalf("Expected %q, got %q", want, r.sig)
+	}
+
+	if other := requestSignature([]byte("other"), time.Unix(secs, 0),
+		[]byte(r.body)); other == r.sig {
+		t.Fatalf("Expected signatures to depend on the secret")
+	}
+}
+
+func TestServeDbSigningSecret(t *testing.T) {
+	vault := newTestVault()
+	defer vault.Close()
+	defer withVault(vault.URL)()
+
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+	sdb := newServeDb(name)
+
+	routes, err := sdb.parse([]byte(`{"serves": [
+		{"i": "apple", "p": "/p1/log.sock", "url": "https://localhost",
+		 "signing_secret": "plain"},
+		{"i": "banana", "p": "/p2/log.sock", "url": "https://localhost",
+		 "signing_secret": "vault:secret/data/drain#url"}]}`))
+	if err != nil {
+		t.Fatalf("Could not parse: %v", err)
+	}
+
+	apple := routes[sKey{I: "apple", P: "/p1/log.sock"}]
+	if got := apple.signingSecret; got != "plain" {
+		t.Errorf("Expected the secret given, got %q", got)
+	}
+
+	banana := routes[sKey{I: "banana", P: "/p2/log.sock"}]
+	if got := banana.signingSecret; got != "https://token:kv@localhost" {
+		t.Errorf("Expected the secret referred to, got %q", got)
+	}
+
+	if _, err := sdb.parse([]byte(`{"serves": [
+		{"i": "apple", "p": "/p1/log.sock", "url": "https://localhost",
+		 "signing_secret": ""}]}`)); err == nil {
+		t.Errorf("Expected an empty secret to be refused")
+	}
+}
@@ -0,0 +1,55 @@
+package collector
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+// Log times further than this from the collector's clock are
+// reported as skewed.  Zero disables skew detection.
+var clockSkewThreshold = time.Minute
+
+// Count of log records with skewed log times, keyed by identity.
+var clockSkewed = expvar.NewMap("clock_skewed")
+
+// Detects skew between the clock of a Postgres server, as evidenced
+// by the LogTime of its records, and the collector's clock.
+type skewDetector struct {
+	// Whether a skew has already been logged for this
+	// connection, to avoid logging every skewed record.
+	warned bool
+}
+
+// Compare the log time of lr to now, counting and logging skew in
+// excess of clockSkewThreshold.
+func (sd *skewDetector) observe(lr *logRecord, sr *serveRecord,
+	now time.Time) {
+	if clockSkewThreshold <= 0 {
+		return
+	}
+
+	t, err := recordLogTime(lr, sr)
+	if err != nil {
+		// Unparseable or ambiguous times can't be compared.
+		return
+	}
+
+	skew := now.Sub(t)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	if skew <= clockSkewThreshold {
+		return
+	}
+
+	clockSkewed.Add(sr.I, 1)
+	if !sd.warned {
+		sd.warned = true
+		log.Printf("identity %q: log time %q is skewed by %v "+
+			"from collector time; further skew on this "+
+			"connection is counted but not logged",
+			sr.I, lr.LogTime, skew.Truncate(time.Millisecond))
+	}
+}
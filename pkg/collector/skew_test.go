@@ -0,0 +1,29 @@
+package collector
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSkewDetector(t *testing.T) {
+	sr := &serveRecord{sKey: sKey{I: "skew-test", P: "/p1/log.sock"}}
+	now := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var sd skewDetector
+	lr := logRecord{LogTime: []byte("2014-05-01 12:00:30.000 UTC")}
+	sd.observe(&lr, sr, now)
+	if sd.warned || clockSkewed.Get(sr.I) != nil {
+		t.Fatal("Expected skew within threshold to go unreported")
+	}
+
+	lr.LogTime = []byte("2014-05-01 11:50:00.000 UTC")
+	sd.observe(&lr, sr, now)
+	sd.observe(&lr, sr, now)
+	if !sd.warned {
+		t.Fatal("Expected skew beyond threshold to be reported")
+	}
+
+	if got := clockSkewed.Get(sr.I).String(); got != "2" {
+		t.Fatalf("Expected two skewed records counted, got %s", got)
+	}
+}
@@ -0,0 +1,320 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long to wait for a reply when checking whether another process
+// is serving a socket.
+const socketProbeTimeout = time.Second
+
+// Socket paths bound by this process, which it may rebind freely.
+var ownSockets = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func markOwnSocket(path string) {
+	ownSockets.Lock()
+	defer ownSockets.Unlock()
+	ownSockets.m[path] = true
+}
+
+func isOwnSocket(path string) bool {
+	ownSockets.Lock()
+	defer ownSockets.Unlock()
+	return ownSockets.m[path]
+}
+
+// Placeholders in the socket paths of serve records, as in
+// "/var/run/pg/{identity}/log.sock", so that a fleet's serve
+// databases may give every record the same path.
+var socketPathPlaceholder = regexp.MustCompile(`\{[A-Za-z_]+\}`)
+
+// Expand the placeholders of the socket path p of the record with
+// identity ident.  The only placeholder is {identity}, for which the
+// identity must be usable as a file name.
+func expandSocketPath(p, ident string) (string, error) {
+	var err error
+	expanded := socketPathPlaceholder.ReplaceAllStringFunc(p,
+		func(ph string) string {
+			if ph != "{identity}" && err == nil {
+				err = fmt.Errorf("unknown placeholder %s in "+
+					"socket path %q", ph, p)
+			}
+
+			return ident
+		})
+	if err != nil {
+		return "", err
+	}
+
+	if expanded != p && (ident == "" || ident == "." || ident == ".." ||
+		strings.ContainsAny(ident, "/\x00")) {
+		return "", fmt.Errorf("identity %q cannot be substituted "+
+			"into socket path %q: it is not a file name", ident, p)
+	}
+
+	return expanded, nil
+}
+
+// The ownership and mode a serve record gives its socket's
+// directory, so that a Postgres server running as another user may
+// connect without the socket being world-writable.  Changing the
+// owner to another user requires privilege (CAP_CHOWN).
+type socketOwnership struct {
+	// The owner and group, or -1 to leave them be.
+	UID int
+	GID int
+
+	// The mode of the directory, or zero for socketDirMode.
+	DirMode os.FileMode
+}
+
+// Report whether the socket is to be restricted to its owner and
+// group, rather than made world-writable.
+func (o *socketOwnership) restrictsSocket() bool {
+	return o != nil && (o.UID != -1 || o.GID != -1)
+}
+
+// Parse the socket_owner, socket_group and socket_dir_mode of a serve
+// record, any of which may be empty, returning nil should all be.
+// Owners and groups are given by name or number.
+func parseSocketOwnership(owner, group, dirMode string) (*socketOwnership,
+	error) {
+	if owner == "" && group == "" && dirMode == "" {
+		return nil, nil
+	}
+
+	o := &socketOwnership{UID: -1, GID: -1}
+	if owner != "" {
+		id, err := lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+
+			return u.Uid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unknown \"socket_owner\" %q: %v",
+				owner, err)
+		}
+
+		o.UID = id
+	}
+
+	if group != "" {
+		id, err := lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+
+			return g.Gid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unknown \"socket_group\" %q: %v",
+				group, err)
+		}
+
+		o.GID = id
+	}
+
+	if dirMode != "" {
+		mode, err := strconv.ParseUint(dirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, fmt.Errorf("\"socket_dir_mode\" must be an "+
+				"octal mode such as 0750, got %q", dirMode)
+		}
+
+		o.DirMode = os.FileMode(mode)
+	}
+
+	return o, nil
+}
+
+// Resolve the user or group s, given by number or else by a name
+// looked up with lookup.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		if id < 0 {
+			return 0, fmt.Errorf("negative id")
+		}
+
+		return id, nil
+	}
+
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
+
+// Create the directory of the socket of sr, should it not exist.
+// Without a socketOwnership, failure is only logged, leaving binding
+// the socket to report any problem.  With one, the directory is given
+// its ownership and mode even should it exist, and failure to do so
+// is an error, so that a socket is never served from a directory
+// its client cannot reach.
+func provisionSocketDir(sr *serveRecord) error {
+	dir := filepath.Dir(sr.P)
+	o := sr.SocketOwnership
+	if o == nil {
+		if err := os.MkdirAll(dir, socketDirMode); err != nil {
+			log.Printf("cannot create directory for socket %q: %v",
+				sr.P, err)
+		}
+
+		return nil
+	}
+
+	mode := o.DirMode
+	if mode == 0 {
+		mode = socketDirMode
+	}
+
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return fmt.Errorf("cannot create directory for socket %q: %v",
+			sr.P, err)
+	}
+
+	// Never follow a link planted in place of the directory to
+	// change the ownership of whatever it points to.
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return fmt.Errorf("cannot stat directory of socket %q: %v",
+			sr.P, err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("directory of socket %q is not a "+
+			"directory: %v", sr.P, fi.Mode())
+	}
+
+	if err := os.Chown(dir, o.UID, o.GID); err != nil {
+		return fmt.Errorf("cannot change ownership of directory of "+
+			"socket %q: %v", sr.P, err)
+	}
+
+	// Chmod, unlike MkdirAll, is not subject to the umask.
+	if err := os.Chmod(dir, mode); err != nil {
+		return fmt.Errorf("cannot change mode of directory of "+
+			"socket %q: %v", sr.P, err)
+	}
+
+	return nil
+}
+
+// Clear the way to bind a socket at path, unlinking whatever is
+// there only should it be a stale socket left behind by an exited
+// process.  A socket of our own is left for bindListener to replace.
+// Should another process be serving the socket, as when two
+// collectors are mistakenly configured with the same path, it is
+// left alone and an error returned.
+func claimSocket(path string) error {
+	if isOwnSocket(path) {
+		return nil
+	}
+
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q exists and is not a socket", path)
+	}
+
+	if c, err := net.DialTimeout("unix", path,
+		socketProbeTimeout); err == nil {
+		c.Close()
+		return fmt.Errorf("socket %q is being served by another "+
+			"process", path)
+	}
+
+	// Nothing answers: the socket is stale.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Decide which of the records in next to serve, given the records in
+// prev that are being served now, logging how each socket path's
+// assignment changes.  Only one identity may be served at a path:
+// should several claim it, the one serving it already keeps it,
+// otherwise the first in order of identity takes it.  The records
+// returned are ordered by path.
+func arbitrate(prev, next []serveRecord) []serveRecord {
+	incumbents := make(map[string]string, len(prev))
+	for i := range prev {
+		incumbents[prev[i].P] = prev[i].I
+	}
+
+	sorted := make([]serveRecord, len(next))
+	copy(sorted, next)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].P != sorted[j].P {
+			return sorted[i].P < sorted[j].P
+		}
+
+		return sorted[i].I < sorted[j].I
+	})
+
+	var serve []serveRecord
+	for lo := 0; lo < len(sorted); {
+		hi := lo + 1
+		for hi < len(sorted) && sorted[hi].P == sorted[lo].P {
+			hi += 1
+		}
+
+		path := sorted[lo].P
+		incumbent, served := incumbents[path]
+		delete(incumbents, path)
+
+		win := lo
+		for i := lo; i < hi; i += 1 {
+			if served && sorted[i].I == incumbent {
+				win = i
+			}
+		}
+
+		for i := lo; i < hi; i += 1 {
+			if i != win {
+				log.Printf("socket %q is claimed by identities "+
+					"%q and %q: serving only %q", path,
+					sorted[win].I, sorted[i].I, sorted[win].I)
+			}
+		}
+
+		if served && sorted[win].I != incumbent {
+			log.Printf("socket %q moves from identity %q to %q",
+				path, incumbent, sorted[win].I)
+		}
+
+		serve = append(serve, sorted[win])
+		lo = hi
+	}
+
+	for path, ident := range incumbents {
+		log.Printf("socket %q of identity %q is no longer served",
+			path, ident)
+	}
+
+	return serve
+}
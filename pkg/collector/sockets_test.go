@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestClaimSocket(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	// Nothing there.
+	path := filepath.Join(name, "log.sock")
+	if err := claimSocket(path); err != nil {
+		t.Fatalf("Expected absent socket to be claimable: %v", err)
+	}
+
+	// Served by someone else.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	if err := claimSocket(path); err == nil {
+		t.Fatal("Expected live socket not to be claimable")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Live socket was removed: %v", err)
+	}
+
+	// Left behind by an exited process.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := claimSocket(path); err != nil {
+		t.Fatalf("Expected stale socket to be claimable: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected stale socket to be removed: %v", err)
+	}
+
+	// Not a socket at all.
+	file := filepath.Join(name, "file")
+	ioutil.WriteFile(file, []byte("precious"), 0600)
+	if err := claimSocket(file); err == nil {
+		t.Fatal("Expected regular file not to be claimable")
+	}
+
+	// Our own, from a previous generation.
+	own := filepath.Join(name, "own.sock")
+	l, err = net.Listen("unix", own)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+	markOwnSocket(own)
+	if err := claimSocket(own); err != nil {
+		t.Fatalf("Expected own socket to be claimable: %v", err)
+	}
+}
+
+func TestArbitrate(t *testing.T) {
+	rec := func(ident, path string) serveRecord {
+		return serveRecord{sKey: sKey{I: ident, P: path}}
+	}
+
+	prev := []serveRecord{rec("banana", "/b.sock"), rec("cherry", "/c.sock")}
+	next := []serveRecord{
+		rec("apple", "/b.sock"),
+		rec("banana", "/b.sock"),
+		rec("apple", "/a.sock"),
+		rec("cherry", "/a.sock"),
+		rec("date", "/c.sock"),
+	}
+
+	got := arbitrate(prev, next)
+	want := []serveRecord{
+		// Contested and new: the first identity wins.
+		rec("apple", "/a.sock"),
+		// Contested: the incumbent keeps it.
+		rec("banana", "/b.sock"),
+		// Reassigned.
+		rec("date", "/c.sock"),
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v, want %+v", got, want)
+	}
+}
+
+func TestBindListenerReplacesOwnSocket(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	sr := &serveRecord{sKey: sKey{I: "apple",
+		P: filepath.Join(name, "log.sock")}}
+
+	old, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+	defer old.Close()
+
+	// Rebinding while the old listener is open leaves the path
+	// bound throughout, and directs new connections to the new
+	// listener.
+	l, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not rebind: %v", err)
+	}
+	defer l.Close()
+
+	old.Close()
+	if _, err := os.Stat(sr.P + "~"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no temporary socket left behind: %v", err)
+	}
+
+	c, err := net.Dial("unix", sr.P)
+	if err != nil {
+		t.Fatalf("Expected the socket to remain served: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := l.Accept(); err != nil {
+		t.Fatalf("Expected the new listener to accept: %v", err)
+	}
+}
+
+func TestExpandSocketPath(t *testing.T) {
+	for _, c := range []struct {
+		p, ident, want string
+	}{
+		{"/run/pg/log.sock", "apple", "/run/pg/log.sock"},
+		{"/run/{identity}/log.sock", "apple", "/run/apple/log.sock"},
+		{"/run/{identity}/{identity}.sock", "a.b", "/run/a.b/a.b.sock"},
+
+		// Identities that are not file names are only refused
+		// should they be substituted.
+		{"/run/pg/log.sock", "a/b", "/run/pg/log.sock"},
+	} {
+		got, err := expandSocketPath(c.p, c.ident)
+		if err != nil || got != c.want {
+			t.Errorf("%q with %q: expected %q, got %q: %v", c.p,
+				c.ident, c.want, got, err)
+		}
+	}
+
+	for _, c := range []struct {
+		p, ident string
+	}{
+		{"/run/{ident}/log.sock", "apple"},
+		{"/run/{identity}/log.sock", "../etc"},
+		{"/run/{identity}/log.sock", ".."},
+		{"/run/{identity}/log.sock", ""},
+		{"/run/{identity}.sock", "a\x00b"},
+	} {
+		if got, err := expandSocketPath(c.p, c.ident); err == nil {
+			t.Errorf("%q with %q: expected an error, got %q", c.p,
+				c.ident, got)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package collector
+
+import (
+	"net"
+	"syscall"
+)
+
+// Apply the socket options of sr to l, a listener just bound for it:
+// for now, the backlog of connections awaiting accept, which the
+// kernel caps, on Linux by net.core.somaxconn.  Should it not be
+// applied, the socket remains usable with the kernel's default.
+func tuneListener(l *net.UnixListener, sr *serveRecord) error {
+	if sr.ListenBacklog == 0 {
+		return nil
+	}
+
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	// Listening again on a listening socket changes its backlog.
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), sr.ListenBacklog)
+	})
+	if err != nil {
+		return err
+	}
+
+	return listenErr
+}
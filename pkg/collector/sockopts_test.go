@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTuneListener(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	sr := &serveRecord{sKey: sKey{I: "apple",
+		P: filepath.Join(name, "log.sock")}, ListenBacklog: 2}
+
+	l, err := bindListener(context.Background(), sr)
+	if err != nil {
+		t.Fatalf("Could not bind: %v", err)
+	}
+	defer l.Close()
+
+	// Without accepting, connections beyond the backlog are
+	// refused, where the default backlog would queue them all.
+	var connected int
+	for i := 0; i < 10; i++ {
+		c, err := net.Dial("unix", sr.P)
+		if err != nil {
+			break
+		}
+		defer c.Close()
+
+		connected++
+	}
+
+	if connected >= 10 {
+		t.Fatal("Expected connections beyond the backlog to be " +
+			"refused")
+	}
+}
+
+func TestParseSocketOptions(t *testing.T) {
+	var sdb serveDb
+	routes, err := sdb.parse([]byte(`{"serves": [
+		{"i": "apple", "p": "/p1/log.sock", "url": "https://localhost",
+		 "listen_backlog": 1024}]}`))
+	if err != nil {
+		t.Fatalf("Could not parse: %v", err)
+	}
+
+	sr := routes[sKey{I: "apple", P: "/p1/log.sock"}]
+	if sr == nil || sr.ListenBacklog != 1024 {
+		t.Fatalf("Unexpected record: %+v", sr)
+	}
+
+	for _, bad := range []string{
+		`"listen_backlog": -1`,
+		`"listen_backlog": 1.5`,
+		`"listen_backlog": "1024"`,
+	} {
+		_, err := sdb.parse([]byte(`{"serves": [{"i": "apple", ` +
+			`"p": "/p1/log.sock", "url": "https://localhost", ` +
+			bad + `}]}`))
+		if err == nil {
+			t.Errorf("Expected %s to be rejected", bad)
+		}
+	}
+}
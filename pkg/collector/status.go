@@ -0,0 +1,209 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// `pg_logplexcollector status` summarizes a running collector for an
+// operator: the records it serves, their connections, the messages it
+// has dropped for them, and when its serve database was last loaded.
+// It is answered by the status command of the control socket, should
+// CONTROL_SOCKET be set, and otherwise by the /status endpoint of the
+// admin interface, so either must be set, to the same value, for both.
+
+// The state of a running collector, as served at /status.
+type statusReport struct {
+	Time        time.Time      `json:"time"`
+	LastReload  time.Time      `json:"last_reload"`
+	LogLevel    string         `json:"log_level"`
+	Connections int            `json:"connections"`
+	Records     []statusRecord `json:"serve_records"`
+}
+
+// The state of a single serve record.  Messages it has dropped are
+// counted, as since the collector started, by why they were.
+type statusRecord struct {
+	Ident       string `json:"identity"`
+	Path        string `json:"socket"`
+	Name        string `json:"name,omitempty"`
+	Host        string `json:"drain_host"`
+	Connections int    `json:"connections"`
+	Paused      bool   `json:"paused"`
+	PauseMode   string `json:"pause_mode,omitempty"`
+	Shed        int64  `json:"shed_messages"`
+	OverQuota   int64  `json:"quota_dropped_messages"`
+	Quarantined int64  `json:"quarantined_messages"`
+	PausedDrops int64  `json:"paused_dropped_messages"`
+}
+
+// Describe the state of the collector serving the records of sdb.
+func newStatusReport(sdb *serveDbSet) *statusReport {
+	conns := make(map[sKey]int)
+	cs := connSnapshots()
+	for _, c := range cs {
+		conns[sKey{I: c.Ident, P: c.Path}]++
+	}
+
+	rep := &statusReport{
+		Time:        time.Now(),
+		LastReload:  sdb.lastReload(),
+		LogLevel:    currentLogging().String(),
+		Connections: len(cs),
+		Records:     []statusRecord{},
+	}
+
+	counters := identityCounters()
+	for _, sr := range sdb.Snapshot() {
+		c := counters[sr.I]
+		mode, paused := pauseOf(sr.sKey)
+		var pauseMode string
+		if paused {
+			pauseMode = mode.String()
+		}
+
+		rep.Records = append(rep.Records, statusRecord{
+			Ident:       sr.I,
+			Path:        sr.P,
+			Name:        sr.Name,
+			Host:        sr.u.Host,
+			Connections: conns[sr.sKey],
+			Paused:      paused,
+			PauseMode:   pauseMode,
+			Shed:        c["shed_messages"],
+			OverQuota:   c["quota_dropped_messages"],
+			Quarantined: c["quarantined_messages"],
+			PausedDrops: c["paused_dropped_messages"],
+		})
+	}
+
+	sort.Slice(rep.Records, func(i, j int) bool {
+		a, b := &rep.Records[i], &rep.Records[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+
+		return a.Ident < b.Ident
+	})
+
+	return rep
+}
+
+// Serve the state of the collector serving the records of sdb as
+// JSON.
+func statusHandler(sdb *serveDbSet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			http.Error(w, "method not allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(newStatusReport(sdb)); err != nil {
+			log.Printf("could not write admin response: %v", err)
+		}
+	})
+}
+
+// Fetch the state of the collector whose admin interface is served
+// on addr, given as for ADMIN_ADDR.
+func queryStatus(addr string) (*statusReport, error) {
+	network, dialAddr := "tcp", addr
+	if strings.HasPrefix(addr, "unix:") {
+		network, dialAddr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context,
+				_, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, dialAddr)
+			},
+		},
+	}
+
+	// The host is ignored by the dialer, but must be given.
+	resp, err := client.Get("http://collector/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	var rep statusReport
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		return nil, fmt.Errorf("cannot read response: %v", err)
+	}
+
+	return &rep, nil
+}
+
+// Fetch the state of the collector whose control socket is at p.
+func controlStatus(p string) (*statusReport, error) {
+	out, err := sendControl(p, "status")
+	if err != nil {
+		return nil, err
+	}
+
+	var rep statusReport
+	if err := json.Unmarshal([]byte(out), &rep); err != nil {
+		return nil, fmt.Errorf("cannot read response: %v", err)
+	}
+
+	return &rep, nil
+}
+
+// Write a human-readable summary of rep to w.
+func writeStatus(w io.Writer, rep *statusReport) {
+	reload := "never"
+	if !rep.LastReload.IsZero() {
+		reload = fmt.Sprintf("%s (%v ago)",
+			rep.LastReload.Format(time.RFC3339),
+			rep.Time.Sub(rep.LastReload).Truncate(time.Second))
+	}
+
+	fmt.Fprintf(w, "last reload: %s\n", reload)
+	fmt.Fprintf(w, "log level: %s\n", rep.LogLevel)
+	fmt.Fprintf(w, "connections: %d\n", rep.Connections)
+	fmt.Fprintf(w, "serve records: %d\n", len(rep.Records))
+	if len(rep.Records) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "IDENTITY\tSOCKET\tNAME\tDRAIN\tCONNECTIONS\t"+
+		"PAUSED\tSHED\tOVER QUOTA\tQUARANTINED\tPAUSED DROPS")
+	for _, r := range rep.Records {
+		name := r.Name
+		if name == "" {
+			name = "-"
+		}
+
+		paused := "no"
+		if r.Paused {
+			paused = r.PauseMode
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%d\t%d\t%d\t%d\n",
+			r.Ident, r.Path, name, r.Host, r.Connections, paused,
+			r.Shed, r.OverQuota, r.Quarantined, r.PausedDrops)
+	}
+	tw.Flush()
+}
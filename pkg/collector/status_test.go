@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	sdb := newServeDbSet()
+	routes, err := (&serveDb{}).parse([]byte(`{"serves": [
+		{"i": "status-apple", "p": "/p1/log.sock", "name": "web",
+		 "url": "https://drain.example.com"}]}`))
+	if err != nil {
+		t.Fatalf("Could not parse: %v", err)
+	}
+
+	sdb.setInjected(routes)
+	if _, err := sdb.Poll(); err != nil {
+		t.Fatalf("Could not poll: %v", err)
+	}
+
+	cs := registerConn("/p1/log.sock", nil)
+	cs.Ident = "status-apple"
+	defer cs.unregister()
+	shedMessages.Add("status-apple", 0)
+	shed := expvarInt(shedMessages, "status-apple")
+
+	// The summary is fetched over a unix socket, as ADMIN_ADDR may
+	// give.
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr := "unix:" + filepath.Join(dir, "admin.sock")
+	l, err := listenAdmin(addr)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, statusHandler(sdb))
+
+	rep, err := queryStatus(addr)
+	if err != nil {
+		t.Fatalf("Could not query status: %v", err)
+	}
+
+	if rep.LastReload.IsZero() || rep.Connections < 1 {
+		t.Fatalf("Unexpected status: %+v", rep)
+	} else if len(rep.Records) != 1 {
+		t.Fatalf("Expected one record, got %+v", rep.Records)
+	}
+
+	r := rep.Records[0]
+	if r.Ident != "status-apple" || r.Name != "web" ||
+		r.Host != "drain.example.com" || r.Connections != 1 ||
+		r.Shed != shed {
+		t.Fatalf("Unexpected record status: %+v", r)
+	}
+
+	var b bytes.Buffer
+	writeStatus(&b, rep)
+	out := b.String()
+	if !strings.Contains(out, "serve records: 1\n") ||
+		!strings.Contains(out, "status-apple") ||
+		!strings.Contains(out, "drain.example.com") {
+		t.Fatalf("Unexpected summary:\n%s", out)
+	}
+
+	// Nobody listening is an error.
+	l.Close()
+	if _, err := queryStatus(addr); err == nil {
+		t.Fatalf("Expected an error with nothing to query")
+	}
+}
+
+func TestStatusNeverReloaded(t *testing.T) {
+	var b bytes.Buffer
+	writeStatus(&b, newStatusReport(newServeDbSet()))
+	want := "last reload: never\nlog level: info\nconnections: "
+	if !strings.HasPrefix(b.String(), want) {
+		t.Fatalf("Expected a prefix of %q, got %q", want, b.String())
+	}
+}
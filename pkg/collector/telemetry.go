@@ -0,0 +1,148 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+// Optionally, the collector emits its own runtime statistics, and the
+// counters of each identity it serves, into a drain of its own every
+// TELEMETRY_INTERVAL, for fleets observed only through logplex.  Each
+// interval gives a line of the form
+//
+//	event=runtime host=db-1 goroutines=112 heap_alloc=8388608 ...
+//
+// and a line for each identity served, giving every counter of it
+// published with expvar, as since the collector started:
+//
+//	event=identity host=db-1 identity=app drain_errors=0 ...
+
+// The drain into which telemetry is emitted, set by TELEMETRY_URL, and
+// the interval at which it is, by TELEMETRY_INTERVAL.
+var (
+	telemetryDrain    *logplexc.Client
+	telemetryInterval = time.Minute
+)
+
+// Emit telemetry into telemetryDrain every telemetryInterval until ctx
+// is done, giving the counters of the identities of the records
+// snapshot returns.
+func runTelemetry(ctx context.Context, snapshot func() []serveRecord) {
+	host, _ := os.Hostname()
+	t := time.NewTicker(telemetryInterval)
+	defer t.Stop()
+
+	var last runtime.MemStats
+	runtime.ReadMemStats(&last)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		lines := []string{runtimeTelemetry(host, &ms, &last)}
+		last = ms
+
+		seen := make(map[string]bool)
+		var idents []string
+		for _, sr := range snapshot() {
+			if !seen[sr.I] {
+				seen[sr.I] = true
+				idents = append(idents, sr.I)
+			}
+		}
+		sort.Strings(idents)
+
+		counters := identityCounters()
+		for _, ident := range idents {
+			lines = append(lines, identityTelemetry(host, ident,
+				counters[ident]))
+		}
+
+		for _, line := range lines {
+			if err := telemetryDrain.BufferMessage(134, time.Now(),
+				"postgres", "pg_logplexcollector",
+				[]byte(line)); err != nil {
+				log.Printf("could not buffer telemetry: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// Render the runtime statistics of ms as a line of telemetry, giving
+// the garbage collections, and their pauses, since last.
+func runtimeTelemetry(host string, ms, last *runtime.MemStats) string {
+	// The most recent pauses, of up to the last 256 collections.
+	gcs := ms.NumGC - last.NumGC
+	var pauseMax uint64
+	for i := uint32(0); i < gcs && i < uint32(len(ms.PauseNs)); i++ {
+		p := ms.PauseNs[(ms.NumGC-i+255)%256]
+		if p > pauseMax {
+			pauseMax = p
+		}
+	}
+
+	return fmt.Sprintf("event=runtime host=%s goroutines=%d "+
+		"connections=%d heap_alloc=%d heap_sys=%d heap_objects=%d "+
+		"gc=%d gc_pause_total_ms=%.3f gc_pause_max_ms=%.3f", host,
+		runtime.NumGoroutine(), len(connSnapshots()), ms.HeapAlloc,
+		ms.HeapSys, ms.HeapObjects, gcs,
+		float64(ms.PauseTotalNs-last.PauseTotalNs)/1e6,
+		float64(pauseMax)/1e6)
+}
+
+// The integer counters of expvar maps, by key and then map name.
+func identityCounters() map[string]map[string]int64 {
+	counters := make(map[string]map[string]int64)
+	expvar.Do(func(kv expvar.KeyValue) {
+		m, ok := kv.Value.(*expvar.Map)
+		if !ok {
+			return
+		}
+
+		m.Do(func(c expvar.KeyValue) {
+			n, ok := c.Value.(*expvar.Int)
+			if !ok {
+				return
+			}
+
+			if counters[c.Key] == nil {
+				counters[c.Key] = make(map[string]int64)
+			}
+			counters[c.Key][kv.Key] = n.Value()
+		})
+	})
+
+	return counters
+}
+
+// Render the counters of ident as a line of telemetry.
+func identityTelemetry(host, ident string,
+	counters map[string]int64) string {
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "event=identity host=%s identity=%q", host, ident)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%d", name, counters[name])
+	}
+
+	return b.String()
+}
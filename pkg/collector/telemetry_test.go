@@ -0,0 +1,54 @@
+package collector
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logplex/pg_logplexcollector/pkg/logplexc"
+)
+
+func TestTelemetry(t *testing.T) {
+	d := newRecordingDrain()
+	defer d.Close()
+
+	defer func(saved *logplexc.Client, interval time.Duration) {
+		telemetryDrain, telemetryInterval = saved, interval
+	}(telemetryDrain, telemetryInterval)
+	telemetryDrain = d.client(t)
+	telemetryInterval = 10 * time.Millisecond
+
+	corruptRecords.Add("tele-apple", 0)
+	want := expvarInt(corruptRecords, "tele-apple")
+	snapshot := func() []serveRecord {
+		return []serveRecord{
+			{sKey: sKey{I: "tele-apple", P: "/a/log.sock"}},
+			{sKey: sKey{I: "tele-apple", P: "/b/log.sock"}},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go runTelemetry(ctx, snapshot)
+
+	var all string
+	for !strings.Contains(all, `identity="tele-apple"`) {
+		all += d.next(t)
+	}
+
+	if !strings.Contains(all, "event=runtime host=") ||
+		!strings.Contains(all, " goroutines=") {
+		t.Fatalf("Expected runtime telemetry, got %q", all)
+	}
+
+	// Only the identity is given counters, once however many
+	// records it has.
+	if !strings.Contains(all, " corrupt_records="+
+		strconv.FormatInt(want, 10)) {
+		t.Fatalf("Expected the identity's counters, got %q", all)
+	} else if n := strings.Count(all, `identity="tele-apple"`); n != 1 {
+		t.Fatalf("Expected the identity once, got %d times", n)
+	}
+}
@@ -0,0 +1,426 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal OpenTelemetry tracer, exporting spans in the OTLP/HTTP
+// JSON encoding.  It is configured with the standard OpenTelemetry
+// environment variables, which may also be given in the
+// configuration file (see config.go):
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT: base URL of the collector, e.g.
+//	                             http://localhost:4318; tracing is
+//	                             disabled if unset
+//	OTEL_TRACES_SAMPLER_ARG:     fraction of traces to sample,
+//	                             defaulting to 0.01
+//	OTEL_SERVICE_NAME:           defaults to pg_logplexcollector
+//
+// A nil *tracer, and the nil *span it creates, are valid and do
+// nothing, so that instrumented code need not check whether tracing
+// is enabled.
+type tracer struct {
+	endpoint    string
+	serviceName string
+
+	// Traces whose ID's leading 8 bytes, as an integer, fall
+	// below this bound are sampled.
+	sampleBound uint64
+
+	client http.Client
+	queue  chan *span
+
+	// Stops the exporter, which closes done once it has exported
+	// the spans queued.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+type traceId [16]byte
+type spanId [8]byte
+
+type span struct {
+	t      *tracer
+	trace  traceId
+	id     spanId
+	parent spanId
+	name   string
+	kind   int
+	start  time.Time
+	end    time.Time
+	attrs  map[string]string
+
+	// Spans of other traces this one relates to, such as those of
+	// the messages a drain request carries.
+	links []spanLink
+}
+
+// A reference to a span, by which one trace may refer to another.
+type spanLink struct {
+	trace traceId
+	id    spanId
+}
+
+// Return a link to s, or the zero link should s be nil.
+func (s *span) link() spanLink {
+	if s == nil {
+		return spanLink{}
+	}
+
+	return spanLink{trace: s.trace, id: s.id}
+}
+
+// Span kinds, per the OpenTelemetry protocol.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const (
+	traceExportBatch  = 512
+	traceExportPeriod = 5 * time.Second
+)
+
+// The process-wide tracer, nil unless configured.
+var tr *tracer
+
+// The settings of the tracer, should tracing be enabled.
+type tracerConfig struct {
+	endpoint    string
+	serviceName string
+	ratio       float64
+}
+
+// Read the tracer's settings, returning nil should tracing be
+// disabled.
+func tracerConfigFromEnv() (*tracerConfig, error) {
+	endpoint := setting("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	ratio := 0.01
+	if arg := setting("OTEL_TRACES_SAMPLER_ARG"); arg != "" {
+		r, err := strconv.ParseFloat(arg, 64)
+		if err != nil || r < 0 || r > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must "+
+				"be a fraction between 0 and 1, got %q", arg)
+		}
+
+		ratio = r
+	}
+
+	name := setting("OTEL_SERVICE_NAME")
+	if name == "" {
+		name = "pg_logplexcollector"
+	}
+
+	return &tracerConfig{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: name,
+		ratio:       ratio,
+	}, nil
+}
+
+// Start the tracer of cfg, exporting spans until ctx is done or it is
+// stopped, or return nil should cfg be.
+func (cfg *tracerConfig) start(ctx context.Context) *tracer {
+	if cfg == nil {
+		return nil
+	}
+
+	return newTracer(ctx, cfg.endpoint, cfg.serviceName, cfg.ratio)
+}
+
+func newTracer(ctx context.Context, endpoint, serviceName string,
+	ratio float64) *tracer {
+	ctx, cancel := context.WithCancel(ctx)
+	t := &tracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *span, 4*traceExportBatch),
+		cancel:      cancel,
+		done:        make(chan struct{}),
+	}
+
+	if ratio >= 1 {
+		t.sampleBound = ^uint64(0)
+	} else {
+		t.sampleBound = uint64(ratio * float64(^uint64(0)))
+	}
+
+	go t.export(ctx)
+	return t
+}
+
+// Stop exporting spans, waiting for those queued to be exported.
+// Spans finished afterwards are dropped.
+func (t *tracer) stop() {
+	if t == nil {
+		return
+	}
+
+	t.cancel()
+	<-t.done
+}
+
+// Begin a new trace, returning its root span if the trace is
+// sampled, or nil otherwise.  Whether it is sampled is decided
+// before anything else, as most are not.  Trace and span IDs need
+// only be unique, not unpredictable, so a cheap PRNG makes them.
+func (t *tracer) startTrace(name string, kind int) *span {
+	if t == nil {
+		return nil
+	}
+
+	hi := rand.Uint64()
+	if hi >= t.sampleBound {
+		return nil
+	}
+
+	return t.newRoot(hi, name, kind)
+}
+
+// Begin a new trace linked to the spans of links, which is sampled
+// should any of them be, so that the links are not lost, or else as
+// any other.
+func (t *tracer) startLinkedTrace(name string, kind int,
+	links []spanLink) *span {
+	if t == nil {
+		return nil
+	} else if len(links) == 0 {
+		return t.startTrace(name, kind)
+	}
+
+	s := t.newRoot(rand.Uint64(), name, kind)
+	s.links = links
+	return s
+}
+
+func (t *tracer) newRoot(hi uint64, name string, kind int) *span {
+	var id traceId
+	binary.BigEndian.PutUint64(id[:8], hi)
+	binary.BigEndian.PutUint64(id[8:], rand.Uint64())
+
+	return t.newSpan(id, spanId{}, name, kind)
+}
+
+func (t *tracer) newSpan(trace traceId, parent spanId, name string,
+	kind int) *span {
+	s := &span{
+		t:      t,
+		trace:  trace,
+		parent: parent,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	binary.BigEndian.PutUint64(s.id[:], rand.Uint64())
+	return s
+}
+
+// Begin a span nested within s.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+
+	return s.t.newSpan(s.trace, s.id, name, kind)
+}
+
+func (s *span) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+
+	s.attrs[key] = value
+}
+
+// Complete the span, queuing it for export.  Spans are dropped
+// rather than blocking the caller should the exporter fall behind.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+
+	s.end = time.Now()
+	select {
+	case s.t.queue <- s:
+	default:
+	}
+}
+
+func (t *tracer) export(ctx context.Context) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceExportPeriod)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, traceExportBatch)
+	flush := func() {
+		if err := t.post(batch); err != nil {
+			log.Printf("could not export %d trace spans: %v",
+				len(batch), err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Export what is queued, without waiting for
+			// more.  Only this goroutine receives from the
+			// queue, so what it holds can be taken.
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+				if len(batch) == traceExportBatch {
+					flush()
+				}
+			}
+
+			if len(batch) > 0 {
+				flush()
+			}
+			return
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceExportBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		flush()
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Links             []otlpLink `json:"links,omitempty"`
+}
+
+type otlpLink struct {
+	TraceId string `json:"traceId"`
+	SpanId  string `json:"spanId"`
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceId: hex.EncodeToString(s.trace[:]),
+		SpanId:  hex.EncodeToString(s.id[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		StartTimeUnixNano: strconv.FormatInt(
+			s.start.UnixNano(), 10),
+		EndTimeUnixNano: strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+
+	if s.parent != (spanId{}) {
+		o.ParentSpanId = hex.EncodeToString(s.parent[:])
+	}
+
+	for k, v := range s.attrs {
+		o.Attributes = append(o.Attributes,
+			otlpAttr{Key: k, Value: otlpValue{StringValue: v}})
+	}
+
+	for _, l := range s.links {
+		o.Links = append(o.Links, otlpLink{
+			TraceId: hex.EncodeToString(l.trace[:]),
+			SpanId:  hex.EncodeToString(l.id[:]),
+		})
+	}
+
+	return o
+}
+
+// Render spans as an OTLP/JSON ExportTraceServiceRequest.
+func (t *tracer) encode(spans []*span) ([]byte, error) {
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttr `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+
+	var ss scopeSpans
+	ss.Scope.Name = "pg_logplexcollector"
+	for _, s := range spans {
+		ss.Spans = append(ss.Spans, s.otlp())
+	}
+
+	var rs resourceSpans
+	rs.Resource.Attributes = []otlpAttr{{Key: "service.name",
+		Value: otlpValue{StringValue: t.serviceName}}}
+	rs.ScopeSpans = []scopeSpans{ss}
+
+	return json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{rs}})
+}
+
+func (t *tracer) post(spans []*span) error {
+	body, err := t.encode(spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("trace collector responded %s",
+			resp.Status)
+	}
+
+	return nil
+}
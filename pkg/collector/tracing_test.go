@@ -0,0 +1,128 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNilTracer(t *testing.T) {
+	var nt *tracer
+
+	// None of these should panic.
+	sp := nt.startTrace("root", spanKindServer)
+	sp.setAttr("key", "value")
+	sp.child("child", spanKindInternal).finish()
+	sp.finish()
+}
+
+func TestTracerSampling(t *testing.T) {
+	never := &tracer{sampleBound: 0}
+	if never.startTrace("root", spanKindServer) != nil {
+		t.Fatal("Expected a zero sampling ratio to sample nothing")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	received := make(chan []byte, 1)
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- body
+		}))
+	defer s.Close()
+
+	trc := newTracer(context.Background(), s.URL, "test", 1)
+	defer trc.stop()
+	root := trc.startTrace("root", spanKindServer)
+	root.setAttr("identity", "apple")
+	child := root.child("child", spanKindInternal)
+
+	if err := trc.post([]*span{root, child}); err != nil {
+		t.Fatalf("Could not post spans: %v", err)
+	}
+
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan
+			}
+		}
+	}
+
+	select {
+	case body := <-received:
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatalf("Could not decode export request: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for span export")
+	}
+
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected two spans, got %v", spans)
+	}
+
+	if spans[1].ParentSpanId != spans[0].SpanId ||
+		spans[1].TraceId != spans[0].TraceId {
+		t.Fatalf("Expected child to be nested in root: %+v", spans)
+	}
+
+	if len(spans[0].Attributes) != 1 ||
+		spans[0].Attributes[0].Value.StringValue != "apple" {
+		t.Fatalf("Expected identity attribute: %+v", spans[0])
+	}
+}
+
+func TestTracerStopExports(t *testing.T) {
+	received := make(chan []byte, 1)
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- body
+		}))
+	defer s.Close()
+
+	// Spans still queued as the tracer stops are exported, rather
+	// than waiting for the export period.
+	trc := newTracer(context.Background(), s.URL, "test", 1)
+	trc.startTrace("root", spanKindServer).finish()
+	trc.stop()
+
+	select {
+	case <-received:
+	default:
+		t.Fatal("Expected the queued span to be exported on stop")
+	}
+}
+
+func TestTracerLinks(t *testing.T) {
+	always := &tracer{sampleBound: ^uint64(0)}
+	msg := always.startTrace("message", spanKindServer)
+
+	// A request carrying a traced message is traced, and linked to
+	// it, however few traces are sampled.
+	never := &tracer{sampleBound: 0}
+	if never.startLinkedTrace("post", spanKindClient, nil) != nil {
+		t.Fatal("Expected an unlinked trace to be sampled as any other")
+	}
+
+	post := never.startLinkedTrace("post", spanKindClient,
+		[]spanLink{msg.link()})
+	if post == nil {
+		t.Fatal("Expected a linked trace to be sampled")
+	}
+
+	o := post.otlp()
+	if len(o.Links) != 1 || o.Links[0].TraceId != msg.otlp().TraceId ||
+		o.Links[0].SpanId != msg.otlp().SpanId {
+		t.Fatalf("Expected a link to the message's span: %+v", o)
+	} else if o.TraceId == o.Links[0].TraceId {
+		t.Fatal("Expected the request to have a trace of its own")
+	}
+}
@@ -0,0 +1,226 @@
+package collector
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A running collector can be replaced by a new binary without
+// refusing any connections.  On SIGUSR2 it starts the executable at
+// its own path, passing it the sockets it is listening on much as
+// systemd's socket activation does, using the variables below.  Once
+// the new process has started, the old one stops accepting
+// connections, leaving them to the new one, but continues to serve
+// those it has until they end or upgradeLinger elapses, whereupon it
+// flushes and exits as it would on SIGTERM.
+//
+// Listening sockets serving the collector as a whole, rather than a
+// serve record, are passed along with them under the names below, so
+// that the new process need not bind addresses the old one holds.
+//
+// As the old process exits, a supervisor tracking its process ID will
+// consider the collector to have died; upgrades are for use with
+// supervisors that do not, or without one.
+const (
+	upgradeFdsVar   = "UPGRADE_FDS"
+	upgradeNamesVar = "UPGRADE_FDNAMES"
+)
+
+// Names of the listening sockets serving the collector as a whole.
+const (
+	adminHandoff  = "collector-admin"
+	sharedHandoff = "collector-tcp"
+	grpcHandoff   = "collector-grpc"
+)
+
+var collectorHandoffs = []string{adminHandoff, sharedHandoff, grpcHandoff}
+
+// Whether name is that of a socket serving the collector as a whole.
+func isCollectorHandoff(name string) bool {
+	for _, h := range collectorHandoffs {
+		if name == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// How long a replaced process continues to serve its connections.
+var upgradeLinger = 10 * time.Minute
+
+// Whether this process replaces another in an upgrade.
+var upgraded bool
+
+// A listening socket that can be passed to another process.
+type handoffListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// Listening sockets that can be handed to a new process, keyed by
+// path, or by one of the names above.
+var handoffs = struct {
+	sync.Mutex
+	m map[string]handoffListener
+}{m: make(map[string]handoffListener)}
+
+func registerHandoff(path string, l handoffListener) {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+	handoffs.m[path] = l
+}
+
+// Stop handing on the listening socket of path, or name, as it is
+// closed.
+func unregisterHandoff(path string) {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+	delete(handoffs.m, path)
+}
+
+// Listening sockets serving the collector as a whole passed by the
+// process this one replaces, keyed by name, until taken.
+var inherited = struct {
+	sync.Mutex
+	m map[string]net.Listener
+}{m: make(map[string]net.Listener)}
+
+// Take the listening socket passed under name, should there be one,
+// registering it to be handed on in turn.
+func takeInherited(name string) (net.Listener, bool) {
+	inherited.Lock()
+	defer inherited.Unlock()
+
+	l, ok := inherited.m[name]
+	if !ok {
+		return nil, false
+	}
+
+	delete(inherited.m, name)
+	if hl, ok := l.(handoffListener); ok {
+		registerHandoff(name, hl)
+	}
+
+	return l, true
+}
+
+// Duplicate the listening sockets of the given paths or names for
+// passing to a new process, returning them with the paths handed
+// off.  Paths without a registered listener, or that cannot be
+// passed, are skipped; the new process binds those itself.
+func handoffFiles(paths []string) ([]*os.File, []string, error) {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+
+	var files []*os.File
+	var names []string
+	for _, p := range paths {
+		l, ok := handoffs.m[p]
+		if !ok || strings.Contains(p, ":") {
+			continue
+		}
+
+		f, err := l.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+
+			return nil, nil, err
+		}
+
+		files = append(files, f)
+		names = append(names, p)
+	}
+
+	return files, names, nil
+}
+
+// Start a new collector process, handing it the sockets currently
+// being served.
+func startUpgrade(sdb *serveDbSet) (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	snap := sdb.Snapshot()
+	paths := make([]string, len(snap))
+	for i := range snap {
+		paths[i] = snap[i].P
+	}
+	paths = append(paths, collectorHandoffs...)
+
+	files, names, err := handoffFiles(paths)
+	if err != nil {
+		return nil, fmt.Errorf("cannot duplicate listeners: %v", err)
+	}
+
+	// The new process has its own copies once started.
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		upgradeFdsVar+"="+strconv.Itoa(len(files)),
+		upgradeNamesVar+"="+strings.Join(names, ":"))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// Stop listening on every socket, leaving them in place for the
+// process that replaces this one.
+func releaseListeners() {
+	handoffs.Lock()
+	defer handoffs.Unlock()
+
+	for _, l := range handoffs.m {
+		closeRetired(l)
+	}
+}
+
+// Hand the sockets to a new process, reporting whether it started.
+// Should it, stopAccepting is called to stop accepting connections
+// other than on gen's listeners, and the connections already accepted
+// are served for up to upgradeLinger, and the caller is to drain and
+// exit; otherwise this process carries on.
+func upgrade(gen *generation, sdb *serveDbSet, stopAccepting func()) bool {
+	proc, err := startUpgrade(sdb)
+	if err != nil {
+		log.Printf("upgrade failed, continuing: %v", err)
+		return false
+	}
+
+	log.Printf("upgrade: started process %d; serving remaining "+
+		"connections for up to %v", proc.Pid, upgradeLinger)
+
+	stopAccepting()
+	gen.stop(errUpgrade)
+	releaseListeners()
+
+	if !awaitConns(upgradeLinger) {
+		log.Printf("upgrade: closing %d remaining connections",
+			liveConns())
+	}
+
+	return true
+}
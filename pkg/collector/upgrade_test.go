@@ -0,0 +1,226 @@
+package collector
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandoffFiles(t *testing.T) {
+	name := newTmpDb(t)
+	defer os.RemoveAll(name)
+
+	defer func(saved map[string]handoffListener) {
+		handoffs.m = saved
+	}(handoffs.m)
+	handoffs.m = make(map[string]handoffListener)
+
+	path := filepath.Join(name, "log.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+	registerHandoff(path, l.(*net.UnixListener))
+
+	files, names, err := handoffFiles([]string{
+		path, filepath.Join(name, "unbound.sock"),
+	})
+	if err != nil {
+		t.Fatalf("Could not hand off: %v", err)
+	}
+
+	if !reflect.DeepEqual(names, []string{path}) || len(files) != 1 {
+		t.Fatalf("Expected only %q to be handed off, got %q",
+			path, names)
+	}
+
+	// The new process's copy accepts connections even once this
+	// one stops listening.
+	socks, err := activateFiles(files, names)
+	if err != nil {
+		t.Fatalf("Could not activate handed off socket: %v", err)
+	}
+
+	releaseListeners()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Released socket was unlinked: %v", err)
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Could not connect after release: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := socks[0].listener(context.Background()).Accept()
+	if err != nil {
+		t.Fatalf("Handed off socket could not accept: %v", err)
+	}
+	conn.Close()
+}
+
+func TestHandoffCollectorSockets(t *testing.T) {
+	defer func(saved map[string]handoffListener) {
+		handoffs.m = saved
+	}(handoffs.m)
+	handoffs.m = make(map[string]handoffListener)
+
+	l, err := listenAdminHandoff("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	files, names, err := handoffFiles([]string{adminHandoff})
+	if err != nil {
+		t.Fatalf("Could not hand off: %v", err)
+	}
+
+	// The new process keeps the admin socket aside, rather than
+	// serving it as a serve record's.
+	rest, _, err := inheritFiles(files, names)
+	if err != nil {
+		t.Fatalf("Could not inherit: %v", err)
+	} else if len(rest) != 0 {
+		t.Fatalf("Expected the admin socket to be kept aside")
+	}
+
+	releaseListeners()
+	unregisterHandoff(adminHandoff)
+
+	inheritedL, err := listenAdminHandoff(addr)
+	if err != nil {
+		t.Fatalf("Expected the passed socket to be taken: %v", err)
+	}
+	defer inheritedL.Close()
+
+	if inheritedL.Addr().String() != addr {
+		t.Fatalf("Expected the socket of %q, got %q", addr,
+			inheritedL.Addr())
+	}
+
+	// It is handed on in turn.
+	if _, ok := handoffs.m[adminHandoff]; !ok {
+		t.Fatal("Expected the passed socket to be registered")
+	}
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect after release: %v", err)
+	}
+	defer c.Close()
+
+	conn, err := inheritedL.Accept()
+	if err != nil {
+		t.Fatalf("Passed socket could not accept: %v", err)
+	}
+	conn.Close()
+}
+
+func TestSharedListenerInherits(t *testing.T) {
+	defer func(saved map[string]handoffListener) {
+		handoffs.m = saved
+	}(handoffs.m)
+	handoffs.m = make(map[string]handoffListener)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	inherited.Lock()
+	inherited.m[sharedHandoff] = l
+	inherited.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSharedListener(l.Addr().String(), nil)
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer c.Close()
+
+	select {
+	case conn := <-s.conns:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the passed socket to accept")
+	}
+
+	handoffs.Lock()
+	_, ok := handoffs.m[sharedHandoff]
+	handoffs.Unlock()
+	if !ok {
+		t.Fatal("Expected the passed socket to be handed on")
+	}
+
+	// Once stopped, it is neither served nor handed on.
+	cancel()
+	<-done
+	if _, ok := handoffs.m[sharedHandoff]; ok {
+		t.Fatal("Expected the stopped socket not to be handed on")
+	}
+}
+
+func TestGRPCServerInherits(t *testing.T) {
+	defer func(saved map[string]handoffListener) {
+		handoffs.m = saved
+	}(handoffs.m)
+	handoffs.m = make(map[string]handoffListener)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	inherited.Lock()
+	inherited.m[grpcHandoff] = l
+	inherited.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newGRPCServer(l.Addr().String())
+	done := make(chan struct{})
+	go func() {
+		s.run(ctx)
+		close(done)
+	}()
+
+	// The passed socket is served, rather than the address bound
+	// anew, and handed on in turn.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		handoffs.Lock()
+		_, ok := handoffs.m[grpcHandoff]
+		handoffs.Unlock()
+		if ok {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the passed socket " +
+				"to be handed on")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	c.Close()
+
+	cancel()
+	<-done
+	if _, ok := handoffs.m[grpcHandoff]; ok {
+		t.Fatal("Expected the stopped socket not to be handed on")
+	}
+}
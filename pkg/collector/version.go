@@ -0,0 +1,36 @@
+package collector
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+)
+
+// Build information, set at link time, e.g.:
+//
+//	pkg=github.com/logplex/pg_logplexcollector/pkg/collector
+//	go build -ldflags "-X $pkg.version=$(git describe --always) \
+//	    -X $pkg.commit=$(git rev-parse HEAD) \
+//	    -X $pkg.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "unknown"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// A description of the collector's build, for --version.
+func Version() string {
+	return fmt.Sprintf("pg_logplexcollector %s (commit %s, built %s, %s)",
+		version, commit, buildDate, runtime.Version())
+}
+
+func init() {
+	expvar.Publish("build", expvar.Func(func() interface{} {
+		return map[string]string{
+			"version":    version,
+			"commit":     commit,
+			"build_date": buildDate,
+			"go_version": runtime.Version(),
+		}
+	}))
+}
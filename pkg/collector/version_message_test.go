@@ -2,7 +2,7 @@
 //
 // Also serves as an example on how to use indirections provided by
 // pg_logplexcollector to do testing.
-package main
+package collector
 
 import (
 	"bytes"
@@ -30,17 +30,15 @@ var versionCheckTests = []struct {
 
 func TestVersionCheck(t *testing.T) {
 	for i, tt := range versionCheckTests {
-		msgInit := func(dst *core.Message, exit exitFn) {
+		msgInit := func(dst *core.Message) error {
 			b := bytes.Buffer{}
 			buf.WriteCString(&b, tt.Version)
 			dst.InitFromBytes('V', b.Bytes())
+			return nil
 		}
 
-		ok := true
-		onBadVersion := func(args ...interface{}) {
-			ok = false
-		}
-		processVerMsg(msgInit, onBadVersion)
+		_, err := processVerMsg(msgInit)
+		ok := err == nil
 		if ok != tt.Ok {
 			t.Errorf("%d: Ver Message well formed: %v; want %v",
 				i, ok, tt.Ok)
@@ -51,30 +49,13 @@ func TestVersionCheck(t *testing.T) {
 func TestVersionMsgInitErr(t *testing.T) {
 	theErr := errors.New("An error; e.g. network difficulties")
 
-	msgInit := func(dst *core.Message, exit exitFn) {
-		exit(theErr)
+	msgInit := func(dst *core.Message) error {
+		return theErr
 	}
 
-	sentinel := &msgInit
-
-	exit := func(args ...interface{}) {
-		// Since the error instance raised is injected, test that it
-		// is precisely the error propagated to the exitFn.
-		if args[0] != theErr {
-			t.Fatal("Error propagated, but not the expected one")
-		}
-
-		panic(sentinel)
+	// Since the error instance returned is injected, test that it
+	// is precisely the error propagated.
+	if _, err := processVerMsg(msgInit); err != theErr {
+		t.Fatalf("Expected the injected error, got %v", err)
 	}
-
-	defer func() {
-		if r := recover(); r != nil && r != sentinel {
-			t.Fatal("Paniced, but not with the sentinel value")
-		}
-
-		// Success
-	}()
-
-	processVerMsg(msgInit, exit)
-	t.Fatal("Message should call exit, aborting execution before this")
 }
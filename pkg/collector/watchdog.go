@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Connections whose workers have been busy with a single unit of
+// work for longer than this are forcibly closed.  Zero disables the
+// watchdog.
+var workerStallTimeout = 5 * time.Minute
+
+// Count of connections closed by the watchdog, keyed by identity.
+var watchdogKills = expvar.NewMap("watchdog_kills")
+
+// Force-close every connection whose worker has been stuck for
+// longer than timeout, returning the number closed.
+func reapStalledWorkers(now time.Time, timeout time.Duration) int {
+	type stalledConn struct {
+		cs    *connState
+		snap  connSnapshot
+		d     time.Duration
+		stage string
+	}
+
+	// Snapshot the connections as they are found, as the fields
+	// snapshot reads are set under the lock.
+	conns.Lock()
+	var stalled []stalledConn
+	for cs := range conns.m {
+		d, stage := cs.busyFor(now)
+		if d <= timeout {
+			continue
+		}
+
+		// Only close once: the worker may take a while to
+		// notice.
+		if !atomic.CompareAndSwapInt32(&cs.killed, 0, 1) {
+			continue
+		}
+
+		stalled = append(stalled,
+			stalledConn{cs: cs, snap: cs.snapshot(), d: d,
+				stage: stage})
+	}
+	conns.Unlock()
+
+	reaped := 0
+	for _, sc := range stalled {
+		snap := sc.snap
+		log.Printf("watchdog: closing connection of identity %q "+
+			"on %q, stuck %v in stage %q; connected %v, "+
+			"%d messages processed, last activity %v",
+			snap.Ident, snap.Path, sc.d.Truncate(time.Second),
+			sc.stage, snap.Connected.Format(time.RFC3339),
+			snap.Messages, snap.LastActivity.Format(time.RFC3339))
+
+		watchdogKills.Add(snap.Ident, 1)
+		if sc.cs.closer != nil {
+			sc.cs.closer.Close()
+		}
+
+		reaped += 1
+	}
+
+	return reaped
+}
+
+// Periodically reap stalled workers, until ctx is done.
+func runWatchdog(ctx context.Context, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	// Check often enough that a stalled worker is closed not too
+	// long after its deadline.
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			reapStalledWorkers(now, timeout)
+		}
+	}
+}
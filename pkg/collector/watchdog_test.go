@@ -0,0 +1,79 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type closeRecorder struct {
+	closed int
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed += 1
+	return nil
+}
+
+func TestReapStalledWorkers(t *testing.T) {
+	stuck := &closeRecorder{}
+	waiting := &closeRecorder{}
+	fresh := &closeRecorder{}
+
+	csStuck := registerConn("/stuck.sock", stuck)
+	defer csStuck.unregister()
+	csStuck.busy("closing drain")
+
+	csWaiting := registerConn("/waiting.sock", waiting)
+	defer csWaiting.unregister()
+	csWaiting.busy("processing")
+	csWaiting.idle()
+
+	csFresh := registerConn("/fresh.sock", fresh)
+	defer csFresh.unregister()
+
+	later := time.Now().Add(time.Hour)
+	csFresh.busy("processing")
+
+	if n := reapStalledWorkers(later, 30*time.Minute); n != 2 {
+		// The 'fresh' connection became busy moments ago,
+		// which is still an hour before 'later'.
+		t.Fatalf("Expected two stalled workers, reaped %d", n)
+	}
+
+	if stuck.closed != 1 || waiting.closed != 0 || fresh.closed != 1 {
+		t.Fatalf("Unexpected closes: stuck %d, waiting %d, fresh %d",
+			stuck.closed, waiting.closed, fresh.closed)
+	}
+
+	// Already-reaped connections are not closed again.
+	if n := reapStalledWorkers(later, 30*time.Minute); n != 0 {
+		t.Fatalf("Expected no further reaping, reaped %d", n)
+	}
+}
+
+func TestDrainRequestTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-hung
+		}))
+	defer s.Close()
+	defer close(hung)
+
+	saved := drainRequestTimeout
+	drainRequestTimeout = 50 * time.Millisecond
+	defer func() { drainRequestTimeout = saved }()
+
+	// A drain that never answers is abandoned, rather than
+	// holding up the connection's worker.
+	cfg := newTemplateConfig()
+	start := time.Now()
+	if _, err := cfg.HttpClient.Get(s.URL); err == nil {
+		t.Fatal("Expected the request to time out")
+	} else if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Expected the request to be abandoned promptly, "+
+			"took %v", d)
+	}
+}
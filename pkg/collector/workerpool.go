@@ -0,0 +1,161 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Bounds the number of connections served concurrently by a listener.
+// Connections beyond the number of workers wait in a bounded queue;
+// connections beyond that are refused immediately, so that a storm of
+// reconnecting clients cannot exhaust the collector.
+//
+// A pool of zero workers serves every connection in its own
+// goroutine, without limit.
+type workerPool struct {
+	work  func(net.Conn)
+	queue chan net.Conn
+	wg    sync.WaitGroup
+}
+
+func newWorkerPool(workers, queued int, work func(net.Conn)) *workerPool {
+	p := &workerPool{work: work}
+	if workers <= 0 {
+		return p
+	}
+
+	p.queue = make(chan net.Conn, queued)
+	p.wg.Add(workers)
+	for i := 0; i < workers; i += 1 {
+		go func() {
+			defer p.wg.Done()
+			for conn := range p.queue {
+				p.work(conn)
+			}
+		}()
+	}
+
+	return p
+}
+
+// Serve conn unless the pool is saturated, reporting whether it was
+// accepted.  A connection not accepted remains the caller's to
+// close.
+func (p *workerPool) serve(conn net.Conn) bool {
+	if p.queue == nil {
+		go p.work(conn)
+		return true
+	}
+
+	select {
+	case p.queue <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop accepting work.  Queued connections are still served, and
+// workers exit once the queue is drained.
+func (p *workerPool) close() {
+	if p.queue != nil {
+		close(p.queue)
+	}
+}
+
+// Wait for all workers to exit after close.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+// Bounds the connections served for a serve record by a generation,
+// whether accepted on the record's own socket or on the shared port:
+// at most MaxConnections at once, served by a pool of MaxWorkers
+// workers with MaxQueued queue slots.  The pool is closed once the
+// generation is cancelled.
+type connLimiter struct {
+	g  *generation
+	sr *serveRecord
+
+	// Connections being served or awaiting service.  Accessed
+	// atomically.
+	live int64
+
+	mu     sync.Mutex
+	pool   *workerPool
+	closed bool
+}
+
+func newConnLimiter(g *generation, sr *serveRecord) *connLimiter {
+	cl := &connLimiter{g: g, sr: sr}
+	templateConfig := newTemplateConfig()
+	cl.pool = newWorkerPool(sr.MaxWorkers, sr.MaxQueued,
+		func(conn net.Conn) {
+			defer atomic.AddInt64(&cl.live, -1)
+			defer g.exit(&g.connections)
+			logWorker(g.ctx, conn, templateConfig, sr)
+		})
+	context.AfterFunc(g.ctx, cl.close)
+
+	return cl
+}
+
+// Serve conn, or refuse it should the collector be short of memory,
+// or the record's limits be reached.  The caller must itself be
+// counted by the generation, as for enter.
+func (cl *connLimiter) admit(conn net.Conn) {
+	sr := cl.sr
+	if underMemoryPressure() {
+		rejectConn(conn, sr, sqlStateOutOfMemory,
+			"collector is short of memory")
+		return
+	}
+
+	if sr.MaxConnections > 0 &&
+		atomic.LoadInt64(&cl.live) >= int64(sr.MaxConnections) {
+		rejectConn(conn, sr, sqlStateTooManyConnections,
+			fmt.Sprintf("too many connections: at most %d "+
+				"allowed", sr.MaxConnections))
+		return
+	}
+
+	if !cl.serve(conn) {
+		rejectConn(conn, sr, sqlStateTooManyConnections,
+			fmt.Sprintf("all %d workers and %d queue slots are "+
+				"busy", sr.MaxWorkers, sr.MaxQueued))
+	}
+}
+
+// Hand conn to the pool, reporting whether it was taken.  Should the
+// generation have been cancelled, conn is closed, as its client is
+// to reconnect to the next.
+func (cl *connLimiter) serve(conn net.Conn) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.closed {
+		conn.Close()
+		return true
+	}
+
+	atomic.AddInt64(&cl.live, 1)
+	cl.g.enter(&cl.g.connections)
+	if !cl.pool.serve(conn) {
+		atomic.AddInt64(&cl.live, -1)
+		cl.g.exit(&cl.g.connections)
+		return false
+	}
+
+	return true
+}
+
+func (cl *connLimiter) close() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.closed = true
+	cl.pool.close()
+}
@@ -0,0 +1,66 @@
+package collector
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWorkerPoolBounds(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan net.Conn)
+
+	p := newWorkerPool(1, 1, func(c net.Conn) {
+		started <- c
+		<-release
+		c.Close()
+	})
+
+	newConn := func() net.Conn {
+		c, _ := net.Pipe()
+		return c
+	}
+
+	// The first connection occupies the only worker, the second
+	// waits in the queue, and the third is refused.
+	if !p.serve(newConn()) {
+		t.Fatal("Expected first connection to be served")
+	}
+	<-started
+
+	if !p.serve(newConn()) {
+		t.Fatal("Expected second connection to be queued")
+	}
+
+	if p.serve(newConn()) {
+		t.Fatal("Expected third connection to be refused")
+	}
+
+	// Finishing the first lets the queued connection through.
+	release <- struct{}{}
+	<-started
+	release <- struct{}{}
+
+	p.close()
+	p.wait()
+}
+
+func TestWorkerPoolUnbounded(t *testing.T) {
+	done := make(chan struct{})
+	p := newWorkerPool(0, 0, func(c net.Conn) {
+		done <- struct{}{}
+	})
+
+	for i := 0; i < 10; i += 1 {
+		c, _ := net.Pipe()
+		if !p.serve(c) {
+			t.Fatal("Unbounded pool should serve every connection")
+		}
+	}
+
+	for i := 0; i < 10; i += 1 {
+		<-done
+	}
+
+	p.close()
+	p.wait()
+}
@@ -71,6 +71,8 @@ type Client struct {
 	// Threshold of logplex request size to trigger POST.
 	RequestSizeTrigger int
 
+	droppedBundle func(BundleSpan)
+
 	// For implementing timely flushing of log buffers.
 	timeTrigger    TimeTriggerBehavior
 	ticker         *time.Ticker
@@ -89,6 +91,10 @@ type Config struct {
 	// Optional: Can be set for advanced behaviors like triggering
 	// Never or Immediately.
 	TimeTrigger TimeTriggerBehavior
+
+	// Optional: Called with the span of each bundle dropped for
+	// want of a free worker, as its messages are never posted.
+	DroppedBundle func(BundleSpan)
 }
 
 func NewClient(cfg *Config) (*Client, error) {
@@ -106,6 +112,7 @@ func NewClient(cfg *Config) (*Client, error) {
 		c:                  c,
 		bucket:             make(chan struct{}),
 		RequestSizeTrigger: cfg.RequestSizeTrigger,
+		droppedBundle:      cfg.DroppedBundle,
 	}
 
 	// Handle determining m.timeTrigger.  This complexity seems
@@ -192,6 +199,18 @@ func (m *Client) BufferMessage(
 	return nil
 }
 
+// Buffer several messages at once, amortizing locking and flush
+// checks across the batch.
+func (m *Client) BufferMessages(msgs []Message) error {
+	s := m.c.BufferMessages(msgs)
+	if s.Buffered >= m.RequestSizeTrigger ||
+		m.timeTrigger == TimeTriggerImmediate {
+		m.maybeWork()
+	}
+
+	return nil
+}
+
 func (m *Client) Statistics() (s Stats) {
 	m.statLock.Lock()
 	defer m.statLock.Unlock()
@@ -218,6 +237,9 @@ func (m *Client) maybeWork() {
 		go m.postBundle(&b)
 	default:
 		m.statReqDrop(&b.MiniStats)
+		if m.droppedBundle != nil {
+			m.droppedBundle(b.Span())
+		}
 
 		// In GOMAXPROCS=1 cases, tight loops can starve out
 		// any of the workers predictably and seemingly
@@ -2,6 +2,7 @@ package logplexc
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -38,6 +39,38 @@ type MiniConfig struct {
 type Bundle struct {
 	MiniStats
 	outbox bytes.Buffer
+
+	// The number of messages the client framed before this
+	// bundle's first.
+	First uint64
+}
+
+// The messages of a bundle, numbered from zero in the order the
+// client framed them, so that those making up a request can be told
+// apart from those of other requests, which may be in flight at the
+// same time, or dropped.
+type BundleSpan struct {
+	First uint64
+	Count uint64
+}
+
+func (b *Bundle) Span() BundleSpan {
+	return BundleSpan{First: b.First, Count: b.NumberFramed}
+}
+
+type bundleSpanKey struct{}
+
+// Return a copy of ctx carrying span, as the context of the request
+// posting a bundle does.
+func ContextWithBundle(ctx context.Context, span BundleSpan) context.Context {
+	return context.WithValue(ctx, bundleSpanKey{}, span)
+}
+
+// The span of the bundle posted by a request with context ctx, as for
+// an http.RoundTripper wrapping the client's transport.
+func BundleFromContext(ctx context.Context) (BundleSpan, bool) {
+	span, ok := ctx.Value(bundleSpanKey{}).(BundleSpan)
+	return span, ok
 }
 
 // Client context: generally, at a minimum, one should exist per
@@ -107,23 +140,74 @@ func (c *MiniClient) Statistics() MiniStats {
 func (c *MiniClient) BufferMessage(
 	priority int, when time.Time, host string, procId string,
 	log []byte) MiniStats {
-	ts := when.UTC().Format(time.RFC3339)
-	syslogPrefix := "<" + strconv.Itoa(priority) + ">1 " + ts + " " +
-		host + " " + c.token + " " + procId + " - - "
-	msgLen := len(syslogPrefix) + len(log)
-
 	// Avoid racing against other operations that may want to swap
 	// out client's current bundle.
 	c.bSwapLock.Lock()
 	defer c.bSwapLock.Unlock()
 
-	fmt.Fprintf(&c.b.outbox, "%d %s%s", msgLen, syslogPrefix, log)
-	c.b.NumberFramed += 1
-	c.b.Buffered = c.b.outbox.Len()
+	c.frameUnsync(priority, when, host, procId, "", nil, log)
+
+	return unsyncStats(c.b)
+}
+
+// A message to be buffered as part of a batch.
+type Message struct {
+	Priority int
+	When     time.Time
+	Host     string
+	ProcId   string
+
+	// The MSGID and STRUCTURED-DATA of RFC 5424, each rendered as
+	// the nil value, "-", should it be empty.  StructuredData
+	// must already be encoded as one or more SD-ELEMENTs.
+	MsgId          string
+	StructuredData []byte
+
+	Log []byte
+}
+
+// The syslog nil value, standing in for empty fields.
+var nilValue = []byte("-")
+
+// Buffer several messages at once, taking the client's lock only
+// once.  The messages are copied, and so may be reused by the caller
+// on return.
+func (c *MiniClient) BufferMessages(msgs []Message) MiniStats {
+	c.bSwapLock.Lock()
+	defer c.bSwapLock.Unlock()
+
+	for i := range msgs {
+		m := &msgs[i]
+		c.frameUnsync(m.Priority, m.When, m.Host, m.ProcId, m.MsgId,
+			m.StructuredData, m.Log)
+	}
 
 	return unsyncStats(c.b)
 }
 
+// Frame a message into the current bundle.  The caller must hold
+// bSwapLock.
+func (c *MiniClient) frameUnsync(
+	priority int, when time.Time, host string, procId string,
+	msgId string, sd []byte, log []byte) {
+	if msgId == "" {
+		msgId = "-"
+	}
+
+	if len(sd) == 0 {
+		sd = nilValue
+	}
+
+	ts := when.UTC().Format(time.RFC3339)
+	syslogPrefix := "<" + strconv.Itoa(priority) + ">1 " + ts + " " +
+		host + " " + c.token + " " + procId + " " + msgId + " "
+	msgLen := len(syslogPrefix) + len(sd) + 1 + len(log)
+
+	fmt.Fprintf(&c.b.outbox, "%d %s%s %s", msgLen, syslogPrefix, sd, log)
+	c.b.NumberFramed += 1
+	c.b.Buffered = c.b.outbox.Len()
+}
+
 func (c *MiniClient) SwapBundle() Bundle {
 	// Swap out the bundle for a fresh one, so that buffering can
 	// continue again immediately.  It's the caller's perogative
@@ -135,6 +219,7 @@ func (c *MiniClient) SwapBundle() Bundle {
 	var oldB Bundle
 
 	oldB = *c.b
+	newB.First = oldB.First + oldB.NumberFramed
 	c.b = &newB
 
 	return oldB
@@ -146,7 +231,9 @@ func (c *MiniClient) Post(b *Bundle) (*http.Response, error) {
 	c.reqInFlight.Add(1)
 	defer c.reqInFlight.Done()
 
-	req, err := http.NewRequest("POST", c.Logplex.String(), &b.outbox)
+	req, err := http.NewRequestWithContext(
+		ContextWithBundle(context.Background(), b.Span()),
+		"POST", c.Logplex.String(), &b.outbox)
 	if err != nil {
 		return nil, err
 	}
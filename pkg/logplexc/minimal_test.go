@@ -0,0 +1,74 @@
+package logplexc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFraming(t *testing.T) {
+	c, err := NewMiniClient(&MiniConfig{Logplex: BogusLogplexUrl})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	when := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.BufferMessage(134, when, "host", "proc", []byte("plain"))
+	s := c.BufferMessages([]Message{{
+		Priority:       131,
+		When:           when,
+		Host:           "host",
+		ProcId:         "proc",
+		MsgId:          "ERROR",
+		StructuredData: []byte(`[origin@1 x="y"]`),
+		Log:            []byte("rich"),
+	}})
+
+	if s.NumberFramed != 2 {
+		t.Fatalf("Expected two messages framed, got %d", s.NumberFramed)
+	}
+
+	// Empty MSGID and STRUCTURED-DATA are the nil value, and the
+	// length prefix counts everything after its space.
+	want := "55 <134>1 2014-05-01T12:00:00Z host a-token proc - - plain" +
+		`73 <131>1 2014-05-01T12:00:00Z host a-token proc ERROR ` +
+		`[origin@1 x="y"] rich`
+	b := c.SwapBundle()
+	if got := b.outbox.String(); got != want {
+		t.Fatalf("Expected framing %q, got %q", want, got)
+	}
+}
+
+func TestBundleSpans(t *testing.T) {
+	c, err := NewMiniClient(&MiniConfig{Logplex: BogusLogplexUrl})
+	if err != nil {
+		t.Fatalf("Could not create client: %v", err)
+	}
+
+	when := time.Date(2014, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.BufferMessages([]Message{
+		{Priority: 134, When: when, Log: []byte("a")},
+		{Priority: 134, When: when, Log: []byte("b")},
+	})
+	first := c.SwapBundle()
+	c.BufferMessage(134, when, "host", "proc", []byte("c"))
+	second := c.SwapBundle()
+
+	// Each bundle's messages are numbered following the last
+	// bundle's.
+	if got := first.Span(); got != (BundleSpan{First: 0, Count: 2}) {
+		t.Fatalf("Unexpected span of first bundle %+v", got)
+	}
+	if got := second.Span(); got != (BundleSpan{First: 2, Count: 1}) {
+		t.Fatalf("Unexpected span of second bundle %+v", got)
+	}
+
+	ctx := ContextWithBundle(context.Background(), second.Span())
+	if span, ok := BundleFromContext(ctx); !ok || span != second.Span() {
+		t.Fatalf("Expected span %+v in context, got %+v",
+			second.Span(), span)
+	}
+	if _, ok := BundleFromContext(context.Background()); ok {
+		t.Fatalf("Expected no span in a context without one")
+	}
+}